@@ -1,12 +1,15 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"log"
 	"os"
 	"path/filepath"
 
 	"github.com/geekgonecrazy/vanityDomainManager/config"
+	"github.com/geekgonecrazy/vanityDomainManager/encryption"
 	"github.com/geekgonecrazy/vanityDomainManager/kubernetes"
 	"github.com/geekgonecrazy/vanityDomainManager/queueManager"
 	"github.com/geekgonecrazy/vanityDomainManager/router"
@@ -23,6 +26,7 @@ func main() {
 	}
 
 	configPath := flag.String("config", "config.yaml", "path to the configuration file")
+	migrateLegacyNames := flag.Bool("migrate-legacy-names", false, "rename objects still using the legacy naming scheme and exit")
 
 	flag.Parse()
 
@@ -30,7 +34,11 @@ func main() {
 		panic(fmt.Errorf("failed to load config: %w", err))
 	}
 
-	if err := kubernetes.NewClient(*kubeconfig, config.Config().Cluster()); err != nil {
+	if err := encryption.Load(config.Config().Encryption()); err != nil {
+		panic(fmt.Errorf("failed to load encryption keys: %w", err))
+	}
+
+	if err := kubernetes.NewClient(*kubeconfig, config.Config().System().Environment, config.Config().Cluster()); err != nil {
 		panic(err)
 	}
 
@@ -39,10 +47,29 @@ func main() {
 		panic(fmt.Errorf("failed to setup NATS: %w", err))
 	}
 
+	// Renaming runs once, on its own, rather than from every replica racing at startup. The registry fills in what
+	// unlabelled objects of early releases don't record and the owners explicit Certificates are issued for
+	if *migrateLegacyNames {
+		defer mgr.Close()
+
+		if err := kubernetes.GetClient().MigrateLegacyNames(context.Background(), mgr.FindDomain); err != nil {
+			panic(fmt.Errorf("failed to rename objects using the legacy naming scheme: %w", err))
+		}
+
+		log.Println("Objects using the legacy naming scheme renamed")
+		return
+	}
+
 	if err := mgr.StartWorkers(); err != nil {
 		panic(err)
 	}
 
-	router.Start()
+	if config.Config().RPC().Enabled {
+		if err := mgr.StartRPC(); err != nil {
+			panic(err)
+		}
+	}
+
+	router.Start(mgr)
 
 }
@@ -2,6 +2,7 @@ package main
 
 import (
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/geekgonecrazy/vanityDomainManager/config"
@@ -77,4 +78,181 @@ func writeToFile(path, content string) error {
 	
 	_, err = file.WriteString(content)
 	return err
-}
\ No newline at end of file
+}
+
+func TestNatsAuthValidation(t *testing.T) {
+	tempConfigPath := filepath.Join(t.TempDir(), "config.yaml")
+
+	tests := []struct {
+		name        string
+		environment string
+		nats        string
+		valid       bool
+	}{
+		{"default is jwt", "production", ``, false},
+		{"default with jwt", "production", "jwt: asdf\n  seed: asdf", true},
+		{"default in development is none", "development", ``, true},
+		{"none", "production", "auth: none", true},
+		{"jwt", "production", "auth: jwt\n  jwt: asdf\n  seed: asdf", true},
+		{"jwt without seed", "production", "auth: jwt\n  jwt: asdf", false},
+		{"creds", "production", "auth: creds\n  credsFile: /etc/nats/user.creds", true},
+		{"creds without file", "production", "auth: creds", false},
+		{"userpass", "production", "auth: userpass\n  user: bob\n  password: secret", true},
+		{"token without token", "production", "auth: token", false},
+		{"unknown method", "production", "auth: kerberos", false},
+		{"client cert without key", "production", "auth: none\n  tls:\n    certFile: /etc/nats/tls.crt", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			content := `
+system:
+  environment: "` + test.environment + `"
+nats:
+  connectionString: "nats://localhost:4222"
+  ` + test.nats + `
+cluster:
+  namespace: "default"
+  serviceName: "your-service"
+  servicePort: 3000
+`
+			if err := writeToFile(tempConfigPath, content); err != nil {
+				t.Fatalf("Failed to write temp config: %v", err)
+			}
+
+			err := config.Load(tempConfigPath)
+			if test.valid && err != nil {
+				t.Errorf("Expected config to be valid, got: %v", err)
+			}
+
+			if !test.valid && err == nil {
+				t.Error("Expected config validation to fail, but it passed")
+			}
+		})
+	}
+}
+
+func TestNatsSecretFiles(t *testing.T) {
+	tempConfigPath := filepath.Join(t.TempDir(), "config.yaml")
+	tokenPath := filepath.Join(t.TempDir(), "token")
+
+	if err := writeToFile(tokenPath, "s3cr3t\n"); err != nil {
+		t.Fatalf("Failed to write token file: %v", err)
+	}
+
+	content := `
+system:
+  environment: "production"
+nats:
+  connectionString: "nats://localhost:4222"
+  auth: token
+  tokenFile: ` + tokenPath + `
+cluster:
+  namespace: "default"
+  serviceName: "your-service"
+  servicePort: 3000
+`
+	if err := writeToFile(tempConfigPath, content); err != nil {
+		t.Fatalf("Failed to write temp config: %v", err)
+	}
+
+	if err := config.Load(tempConfigPath); err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	if token := config.Config().Nats().Token; token != "s3cr3t" {
+		t.Errorf("Expected token to be read from file, got '%s'", token)
+	}
+}
+
+func TestWorkerConfigValidation(t *testing.T) {
+	tempConfigPath := filepath.Join(t.TempDir(), "config.yaml")
+
+	tests := []struct {
+		name   string
+		worker string
+		valid  bool
+	}{
+		{"defaults", ``, true},
+		{"dns poll interval below ack wait", "awaitDns:\n    pollInterval: 29s", true},
+		{"dns poll interval at ack wait", "awaitDns:\n    pollInterval: 30s", false},
+		{"certificate poll interval above ack wait", "awaitCertificate:\n    pollInterval: 1m", false},
+		{"negative dns window", "awaitDns:\n    window: -1m", false},
+		{"concurrency within max ack pending", "concurrency: 1000", true},
+		{"concurrency above max ack pending", "concurrency: 1001", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			content := `
+system:
+  environment: "development"
+queue:
+  backend: memory
+cluster:
+  namespace: "default"
+  serviceName: "your-service"
+  servicePort: 3000
+worker:
+  ` + test.worker + `
+`
+			if err := writeToFile(tempConfigPath, content); err != nil {
+				t.Fatalf("Failed to write temp config: %v", err)
+			}
+
+			err := config.Load(tempConfigPath)
+			if test.valid && err != nil {
+				t.Errorf("Expected config to be valid, got: %v", err)
+			}
+
+			if !test.valid && err == nil {
+				t.Error("Expected config validation to fail, but it passed")
+			}
+		})
+	}
+}
+
+func TestConsumerConfigValidation(t *testing.T) {
+	tempConfigPath := filepath.Join(t.TempDir(), "config.yaml")
+
+	tests := []struct {
+		name     string
+		consumer string
+		valid    bool
+	}{
+		{"defaults", ``, true},
+		{"two deliveries", "maxDeliver: 2", true},
+		{"unlimited deliveries", "maxDeliver: -1", true},
+		{"a single delivery", "maxDeliver: 1", true},
+		{"negative deliveries", "maxDeliver: -2", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			content := `
+system:
+  environment: "development"
+queue:
+  backend: memory
+  consumer:
+    ` + test.consumer + `
+cluster:
+  namespace: "default"
+  serviceName: "your-service"
+  servicePort: 3000
+`
+			if err := writeToFile(tempConfigPath, content); err != nil {
+				t.Fatalf("Failed to write temp config: %v", err)
+			}
+
+			err := config.Load(tempConfigPath)
+			if test.valid && err != nil {
+				t.Errorf("Expected config to be valid, got: %v", err)
+			}
+
+			if !test.valid && err == nil {
+				t.Error("Expected config validation to fail, but it passed")
+			}
+		})
+	}
+}
@@ -2,18 +2,43 @@ package config
 
 import (
 	"errors"
+	"fmt"
 	"log"
 	"os"
+	"slices"
+	"strings"
+	"text/template"
+	"time"
 
 	yaml "gopkg.in/yaml.v2"
 )
 
 var _config *config
 
+// MaxStatusHistory is the most status updates kept, and returned as history, per reference ID.
+const MaxStatusHistory = 1000
+
+type NatsTLSConfig struct {
+	CAFile   string `yaml:"caFile" json:"caFile"`     // Optional, CA bundle used to verify the server
+	CertFile string `yaml:"certFile" json:"certFile"` // Optional, client certificate for mutual TLS
+	KeyFile  string `yaml:"keyFile" json:"keyFile"`   // Optional, client key for mutual TLS
+}
+
 type NatsConfig struct {
-	ConnectionString string `yaml:"connectionString" json:"-"`
-	JWT              string `yaml:"jwt" json:"-"`
-	Seed             string `yaml:"seed" json:"-"`
+	ConnectionString string        `yaml:"connectionString" json:"-"`
+	Auth             string        `yaml:"auth" json:"auth"` // none, jwt, creds, nkey, userpass or token, defaults to jwt outside development
+	JWT              string        `yaml:"jwt" json:"-"`
+	JWTFile          string        `yaml:"jwtFile" json:"-"`
+	Seed             string        `yaml:"seed" json:"-"`
+	SeedFile         string        `yaml:"seedFile" json:"-"`
+	CredsFile        string        `yaml:"credsFile" json:"-"`
+	NKeySeedFile     string        `yaml:"nkeySeedFile" json:"-"`
+	User             string        `yaml:"user" json:"-"`
+	Password         string        `yaml:"password" json:"-"`
+	PasswordFile     string        `yaml:"passwordFile" json:"-"`
+	Token            string        `yaml:"token" json:"-"`
+	TokenFile        string        `yaml:"tokenFile" json:"-"`
+	TLS              NatsTLSConfig `yaml:"tls" json:"tls"`
 }
 
 type RouterConfig struct {
@@ -25,11 +50,232 @@ type SystemConfig struct {
 	Environment string `yaml:"environment" json:"environment"`
 }
 
+type GatewayConfig struct {
+	Name         string `yaml:"name" json:"name"`                 // Gateway the HTTPRoutes attach to
+	Namespace    string `yaml:"namespace" json:"namespace"`       // Defaults to the cluster namespace
+	SectionName  string `yaml:"sectionName" json:"sectionName"`   // Optional listener to attach routes to
+	TLS          string `yaml:"tls" json:"tls"`                   // "listener" (default) adds an HTTPS listener per domain, "none" leaves TLS to the Gateway owner
+	ListenerPort int32  `yaml:"listenerPort" json:"listenerPort"` // Defaults to 443
+}
+
+type TraefikConfig struct {
+	EntryPoints  []string `yaml:"entryPoints" json:"entryPoints"`   // Defaults to websecure
+	CertResolver string   `yaml:"certResolver" json:"certResolver"` // Optional Traefik resolver used when no certificate was provided
+}
+
+type OpenShiftConfig struct {
+	Termination                   string `yaml:"termination" json:"termination"`                                     // "edge" (default) or "reencrypt"
+	InsecureEdgeTerminationPolicy string `yaml:"insecureEdgeTerminationPolicy" json:"insecureEdgeTerminationPolicy"` // "Redirect" (default), "Allow" or "None"
+}
+
+type CertificateIssuerRef struct {
+	Name  string `yaml:"name" json:"name"`   // Defaults to cluster.certManagerIssuer
+	Kind  string `yaml:"kind" json:"kind"`   // "ClusterIssuer" (default) or "Issuer", any kind for external issuers
+	Group string `yaml:"group" json:"group"` // Defaults to cert-manager.io, set for external issuers
+}
+
+type CertificatePrivateKey struct {
+	Algorithm string `yaml:"algorithm" json:"algorithm"` // "RSA", "ECDSA" or "Ed25519", cert-manager's default (RSA) when empty
+	Size      int    `yaml:"size" json:"size"`           // RSA 2048, 3072 or 4096, ECDSA 256, 384 or 521
+}
+
+// CertificateProfile is how the Certificates the manager creates are issued. Unset fields are left to cert-manager.
+type CertificateProfile struct {
+	IssuerRef   CertificateIssuerRef  `yaml:"issuerRef" json:"issuerRef"`
+	PrivateKey  CertificatePrivateKey `yaml:"privateKey" json:"privateKey"`
+	Duration    time.Duration         `yaml:"duration" json:"duration"`       // At least 1h
+	RenewBefore time.Duration         `yaml:"renewBefore" json:"renewBefore"` // At least 5m and shorter than duration
+}
+
+type CertificatesConfig struct {
+	Mode string `yaml:"mode" json:"mode"` // "ingress-shim" (default) leaves Certificates to cert-manager's shims, "explicit" creates them
+
+	CertificateProfile `yaml:",inline"`
+
+	Tenants map[string]CertificateProfile `yaml:"tenants" json:"tenants"` // Overrides per job owner, set fields replace the ones above
+}
+
+// Profile returns the certificate profile for a tenant, the default profile with the tenant's overrides applied.
+func (c CertificatesConfig) Profile(tenant string) CertificateProfile {
+	profile := c.CertificateProfile
+
+	override, ok := c.Tenants[tenant]
+	if !ok {
+		return profile
+	}
+
+	if override.IssuerRef.Name != "" {
+		profile.IssuerRef = override.IssuerRef
+	}
+
+	if override.IssuerRef.Kind == "" {
+		profile.IssuerRef.Kind = c.IssuerRef.Kind
+	}
+
+	if override.IssuerRef.Group == "" {
+		profile.IssuerRef.Group = c.IssuerRef.Group
+	}
+
+	if override.PrivateKey.Algorithm != "" {
+		profile.PrivateKey = override.PrivateKey
+	} else if override.PrivateKey.Size != 0 {
+		profile.PrivateKey.Size = override.PrivateKey.Size
+	}
+
+	if override.Duration != 0 {
+		profile.Duration = override.Duration
+	}
+
+	if override.RenewBefore != 0 {
+		profile.RenewBefore = override.RenewBefore
+	}
+
+	return profile
+}
+
+func (p CertificateProfile) validate() error {
+	if p.IssuerRef.Name == "" {
+		return errors.New("issuerRef name cannot be empty, set it or cluster.certManagerIssuer")
+	}
+
+	if p.IssuerRef.Group == "cert-manager.io" && p.IssuerRef.Kind != "ClusterIssuer" && p.IssuerRef.Kind != "Issuer" {
+		return fmt.Errorf("invalid issuerRef kind %q, must be ClusterIssuer or Issuer", p.IssuerRef.Kind)
+	}
+
+	sizes := map[string][]int{"": nil, "RSA": {0, 2048, 3072, 4096}, "ECDSA": {0, 256, 384, 521}, "Ed25519": {0}}
+	allowed, ok := sizes[p.PrivateKey.Algorithm]
+	if !ok {
+		return fmt.Errorf("invalid privateKey algorithm %q, must be RSA, ECDSA or Ed25519", p.PrivateKey.Algorithm)
+	}
+
+	if p.PrivateKey.Size != 0 && !slices.Contains(allowed, p.PrivateKey.Size) {
+		return fmt.Errorf("invalid privateKey size %d for algorithm %q", p.PrivateKey.Size, p.PrivateKey.Algorithm)
+	}
+
+	if p.Duration != 0 && p.Duration < time.Hour {
+		return errors.New("duration must be at least 1h")
+	}
+
+	if p.RenewBefore != 0 && p.RenewBefore < 5*time.Minute {
+		return errors.New("renewBefore must be at least 5m")
+	}
+
+	if p.Duration != 0 && p.RenewBefore >= p.Duration {
+		return errors.New("renewBefore must be shorter than duration")
+	}
+
+	return nil
+}
+
 type ClusterConfig struct {
 	Namespace         string `yaml:"namespace" json:"namespace"`
 	CertManagerIssuer string `yaml:"certManagerIssuer" json:"certManagerIssuer"`
 	ServiceName       string `yaml:"serviceName" json:"serviceName"`
 	ServicePort       int32  `yaml:"servicePort" json:"servicePort"`
+
+	RoutingBackend string          `yaml:"routingBackend" json:"routingBackend"` // "ingress" (default), "gateway", "traefik" or "openshift"
+	Gateway        GatewayConfig   `yaml:"gateway" json:"gateway"`
+	Traefik        TraefikConfig   `yaml:"traefik" json:"traefik"`
+	OpenShift      OpenShiftConfig `yaml:"openshift" json:"openshift"`
+
+	IngressClassName           string            `yaml:"ingressClassName" json:"ingressClassName"`                     // Optional, sets spec.ingressClassName on Ingresses
+	Labels                     map[string]string `yaml:"labels" json:"labels"`                                         // Added to every routing object
+	Annotations                map[string]string `yaml:"annotations" json:"annotations"`                               // Added to every routing object, values are Go templates over the domain
+	AllowedAnnotationOverrides []string          `yaml:"allowedAnnotationOverrides" json:"allowedAnnotationOverrides"` // Annotation keys a job may set, a trailing * matches a prefix
+
+	Certificates CertificatesConfig `yaml:"certificates" json:"certificates"`
+}
+
+type AwaitDNSConfig struct {
+	Enabled        bool          `yaml:"enabled" json:"enabled"`               // Await DNS for every job, not only jobs that ask for it
+	Window         time.Duration `yaml:"window" json:"window"`                 // How long to keep polling before giving up on the delivery
+	PollInterval   time.Duration `yaml:"pollInterval" json:"pollInterval"`     // How often to re-check DNS, must be shorter than the consumer AckWait
+	StatusInterval time.Duration `yaml:"statusInterval" json:"statusInterval"` // How often to emit a "still waiting" status event
+}
+
+type AwaitCertificateConfig struct {
+	Disabled       bool          `yaml:"disabled" json:"disabled"`             // Report success as soon as the route is set instead of waiting for cert-manager
+	Window         time.Duration `yaml:"window" json:"window"`                 // How long to wait for the certificate before giving up on the delivery
+	PollInterval   time.Duration `yaml:"pollInterval" json:"pollInterval"`     // How often to check the Certificate, must be shorter than the consumer AckWait
+	StatusInterval time.Duration `yaml:"statusInterval" json:"statusInterval"` // How often to emit a "still waiting" status event
+}
+
+type ReverifyConfig struct {
+	Enabled          bool          `yaml:"enabled" json:"enabled"`
+	Interval         time.Duration `yaml:"interval" json:"interval"`                 // How often every managed domain is re-verified
+	FailureThreshold int           `yaml:"failureThreshold" json:"failureThreshold"` // Consecutive failures before a domain is marked dns_drifted
+	Policy           string        `yaml:"policy" json:"policy"`                     // What to do with drifted domains: "none", "disable" or "remove"
+}
+
+type ReconcileConfig struct {
+	Enabled bool          `yaml:"enabled" json:"enabled"`
+	Resync  time.Duration `yaml:"resync" json:"resync"`   // How often every active domain is checked even without a change, defaults to 10 minutes
+	Workers int           `yaml:"workers" json:"workers"` // Domains reconciled in parallel, defaults to 2
+}
+
+type WorkerConfig struct {
+	Concurrency      int                    `yaml:"concurrency" json:"concurrency"` // Jobs worked on at the same time, defaults to 10
+	AwaitDNS         AwaitDNSConfig         `yaml:"awaitDns" json:"awaitDns"`
+	AwaitCertificate AwaitCertificateConfig `yaml:"awaitCertificate" json:"awaitCertificate"`
+	Reverify         ReverifyConfig         `yaml:"reverify" json:"reverify"`
+	Reconcile        ReconcileConfig        `yaml:"reconcile" json:"reconcile"`
+}
+
+type StreamConfig struct {
+	Name      string        `yaml:"name" json:"name"`           // Defaults to {environment}_vanityDomainManager_{jobs|status|events}
+	Replicas  int           `yaml:"replicas" json:"replicas"`   // Defaults to 1
+	Storage   string        `yaml:"storage" json:"storage"`     // "file" (default) or "memory"
+	Retention string        `yaml:"retention" json:"retention"` // "workqueue" (default, limits for the event stream), "limits" or "interest"
+	MaxAge    time.Duration `yaml:"maxAge" json:"maxAge"`       // Defaults to 7 days
+	MaxMsgs   int64         `yaml:"maxMsgs" json:"maxMsgs"`     // Defaults to 1 billion
+	MaxBytes  int64         `yaml:"maxBytes" json:"maxBytes"`   // Defaults to 1 GiB
+
+	MaxMsgsPerSubject int64 `yaml:"maxMsgsPerSubject" json:"maxMsgsPerSubject"` // Optional, messages kept per subject, e.g. per reference ID
+}
+
+type ConsumerConfig struct {
+	Name          string        `yaml:"name" json:"name"`                   // Defaults to vanityDomainManager-domainjob-worker
+	AckWait       time.Duration `yaml:"ackWait" json:"ackWait"`             // Defaults to 30s
+	MaxAckPending int           `yaml:"maxAckPending" json:"maxAckPending"` // Defaults to 1000, -1 is unlimited
+	MaxDeliver    int           `yaml:"maxDeliver" json:"maxDeliver"`       // Defaults to 10
+}
+
+type CertificateStoreConfig struct {
+	Enabled bool   `yaml:"enabled" json:"enabled"` // Offload provided certificates to a JetStream object store
+	Bucket  string `yaml:"bucket" json:"bucket"`   // Defaults to {environment}_vanityDomainManager_certificates
+}
+
+type QueueConfig struct {
+	Backend          string                 `yaml:"backend" json:"backend"` // "jetstream" (default) or "memory" for an in-process NATS server, needs the memory build tag
+	JobStream        StreamConfig           `yaml:"jobStream" json:"jobStream"`
+	StatusStream     StreamConfig           `yaml:"statusStream" json:"statusStream"`
+	EventStream      StreamConfig           `yaml:"eventStream" json:"eventStream"`
+	Consumer         ConsumerConfig         `yaml:"consumer" json:"consumer"`
+	CertificateStore CertificateStoreConfig `yaml:"certificateStore" json:"certificateStore"`
+}
+
+type RPCConfig struct {
+	Enabled bool          `yaml:"enabled" json:"enabled"`
+	Timeout time.Duration `yaml:"timeout" json:"timeout"` // How long a request waits for the final job status
+}
+
+type EncryptionKey struct {
+	ID      string `yaml:"id" json:"id"`
+	Key     string `yaml:"key" json:"-"`     // Base64 encoded 32 byte AES key
+	KeyFile string `yaml:"keyFile" json:"-"` // Alternatively, a mounted file holding the base64 encoded key
+}
+
+type EncryptionConfig struct {
+	ActiveKeyID string          `yaml:"activeKeyId" json:"activeKeyId"` // Key used to encrypt new submissions, empty disables encryption
+	Keys        []EncryptionKey `yaml:"keys" json:"keys"`               // Every key that may still be needed to decrypt in-flight jobs
+}
+
+type EventsConfig struct {
+	Format string `yaml:"format" json:"format"` // "json" (default) or "cloudevents"
+	Mode   string `yaml:"mode" json:"mode"`     // CloudEvents content mode: "structured" (default) or "binary" with ce- headers
+	Source string `yaml:"source" json:"source"` // CloudEvents source, defaults to /vanityDomainManager/{environment}
+
+	CertificateExpiryWarning time.Duration `yaml:"certificateExpiryWarning" json:"certificateExpiryWarning"` // Emit certificate expiring events this long before expiry, 0 disables
 }
 
 type config struct {
@@ -37,6 +283,12 @@ type config struct {
 	RouterConfig  RouterConfig  `yaml:"router" json:"yaml"`
 	SystemConfig  SystemConfig  `yaml:"system" json:"system"`
 	ClusterConfig ClusterConfig `yaml:"cluster" json:"cluster"`
+	WorkerConfig  WorkerConfig  `yaml:"worker" json:"worker"`
+	RPCConfig     RPCConfig     `yaml:"rpc" json:"rpc"`
+	QueueConfig   QueueConfig   `yaml:"queue" json:"queue"`
+	EventsConfig  EventsConfig  `yaml:"events" json:"events"`
+
+	EncryptionConfig EncryptionConfig `yaml:"encryption" json:"encryption"`
 }
 
 func (c *config) Nats() NatsConfig {
@@ -55,13 +307,43 @@ func (c *config) Cluster() ClusterConfig {
 	return c.ClusterConfig
 }
 
+func (c *config) Worker() WorkerConfig {
+	return c.WorkerConfig
+}
+
+func (c *config) RPC() RPCConfig {
+	return c.RPCConfig
+}
+
+func (c *config) Queue() QueueConfig {
+	return c.QueueConfig
+}
+
+func (c *config) Encryption() EncryptionConfig {
+	return c.EncryptionConfig
+}
+
+func (c *config) Events() EventsConfig {
+	return c.EventsConfig
+}
+
 func (c *config) IsDevelopment() bool {
 	return c.SystemConfig.Environment == "development"
 }
 
 func (c *config) validate() error {
-	if c.NatsConfig.ConnectionString == "" {
-		return errors.New("invalid NATS host, it can not be empty")
+	switch c.QueueConfig.Backend {
+	case "jetstream":
+		if c.NatsConfig.ConnectionString == "" {
+			return errors.New("invalid NATS host, it can not be empty")
+		}
+
+		if err := c.NatsConfig.validate(); err != nil {
+			return err
+		}
+	case "memory":
+	default:
+		return fmt.Errorf("invalid queue backend %q, must be jetstream or memory", c.QueueConfig.Backend)
 	}
 
 	if c.SystemConfig.Environment == "" {
@@ -82,9 +364,450 @@ func (c *config) validate() error {
 
 	// Note: CertManagerIssuer is optional and can be empty
 
+	for key, value := range c.ClusterConfig.Annotations {
+		if _, err := template.New(key).Option("missingkey=error").Parse(value); err != nil {
+			return fmt.Errorf("invalid cluster annotation template %s: %w", key, err)
+		}
+	}
+
+	switch c.ClusterConfig.RoutingBackend {
+	case "ingress":
+	case "gateway":
+		if c.ClusterConfig.Gateway.Name == "" {
+			return errors.New("cluster gateway name cannot be empty with the gateway routing backend")
+		}
+
+		switch c.ClusterConfig.Gateway.TLS {
+		case "listener", "none":
+		default:
+			return fmt.Errorf("invalid cluster gateway tls %q, must be listener or none", c.ClusterConfig.Gateway.TLS)
+		}
+	case "traefik":
+	case "openshift":
+		switch c.ClusterConfig.OpenShift.Termination {
+		case "edge", "reencrypt":
+		default:
+			return fmt.Errorf("invalid cluster openshift termination %q, must be edge or reencrypt", c.ClusterConfig.OpenShift.Termination)
+		}
+
+		switch c.ClusterConfig.OpenShift.InsecureEdgeTerminationPolicy {
+		case "Redirect", "Allow", "None":
+		default:
+			return fmt.Errorf("invalid cluster openshift insecureEdgeTerminationPolicy %q, must be Redirect, Allow or None", c.ClusterConfig.OpenShift.InsecureEdgeTerminationPolicy)
+		}
+	default:
+		return fmt.Errorf("invalid cluster routingBackend %q, must be ingress, gateway, traefik or openshift", c.ClusterConfig.RoutingBackend)
+	}
+
+	switch c.ClusterConfig.Certificates.Mode {
+	case "ingress-shim":
+	case "explicit":
+		if c.ClusterConfig.RoutingBackend == "openshift" {
+			return errors.New("cluster certificates mode explicit is not supported by the openshift routing backend, routes can't reference the issued secret")
+		}
+
+		if err := c.ClusterConfig.Certificates.validate(); err != nil {
+			return fmt.Errorf("invalid cluster certificates: %w", err)
+		}
+
+		for tenant := range c.ClusterConfig.Certificates.Tenants {
+			if err := c.ClusterConfig.Certificates.Profile(tenant).validate(); err != nil {
+				return fmt.Errorf("invalid cluster certificates for tenant %s: %w", tenant, err)
+			}
+		}
+	default:
+		return fmt.Errorf("invalid cluster certificates mode %q, must be ingress-shim or explicit", c.ClusterConfig.Certificates.Mode)
+	}
+
+	// -1 is unlimited
+	if c.QueueConfig.Consumer.MaxDeliver != -1 && c.QueueConfig.Consumer.MaxDeliver < 1 {
+		return errors.New("queue consumer maxDeliver must be at least 1, or -1 for unlimited")
+	}
+
+	// A negative maxAckPending is unlimited
+	if c.QueueConfig.Consumer.MaxAckPending > 0 && c.WorkerConfig.Concurrency > c.QueueConfig.Consumer.MaxAckPending {
+		return errors.New("worker concurrency cannot be higher than the queue consumer maxAckPending")
+	}
+
+	if c.WorkerConfig.AwaitDNS.Window < 0 || c.WorkerConfig.AwaitDNS.PollInterval < 0 || c.WorkerConfig.AwaitDNS.StatusInterval < 0 {
+		return errors.New("worker awaitDns durations cannot be negative")
+	}
+
+	if c.WorkerConfig.AwaitDNS.PollInterval >= c.QueueConfig.Consumer.AckWait {
+		return errors.New("worker awaitDns pollInterval must be shorter than the queue consumer ackWait")
+	}
+
+	if c.WorkerConfig.AwaitCertificate.Window < 0 || c.WorkerConfig.AwaitCertificate.PollInterval < 0 || c.WorkerConfig.AwaitCertificate.StatusInterval < 0 {
+		return errors.New("worker awaitCertificate durations cannot be negative")
+	}
+
+	if c.WorkerConfig.AwaitCertificate.PollInterval >= c.QueueConfig.Consumer.AckWait {
+		return errors.New("worker awaitCertificate pollInterval must be shorter than the queue consumer ackWait")
+	}
+
+	for _, stream := range []StreamConfig{c.QueueConfig.JobStream, c.QueueConfig.StatusStream, c.QueueConfig.EventStream} {
+		if err := stream.validate(); err != nil {
+			return err
+		}
+	}
+
+	if c.QueueConfig.StatusStream.MaxMsgsPerSubject < 1 || c.QueueConfig.StatusStream.MaxMsgsPerSubject > MaxStatusHistory {
+		return fmt.Errorf("queue statusStream maxMsgsPerSubject must be between 1 and %d", MaxStatusHistory)
+	}
+
+	if err := c.EncryptionConfig.validate(); err != nil {
+		return err
+	}
+
+	switch c.WorkerConfig.Reverify.Policy {
+	case "none", "disable", "remove":
+	default:
+		return fmt.Errorf("invalid worker reverify policy %q, must be none, disable or remove", c.WorkerConfig.Reverify.Policy)
+	}
+
+	switch c.EventsConfig.Format {
+	case "json", "cloudevents":
+	default:
+		return fmt.Errorf("invalid events format %q, must be json or cloudevents", c.EventsConfig.Format)
+	}
+
+	switch c.EventsConfig.Mode {
+	case "structured", "binary":
+	default:
+		return fmt.Errorf("invalid events mode %q, must be structured or binary", c.EventsConfig.Mode)
+	}
+
+	if c.EventsConfig.CertificateExpiryWarning < 0 {
+		return errors.New("events certificateExpiryWarning cannot be negative")
+	}
+
+	return nil
+}
+
+func (s *StreamConfig) validate() error {
+	switch s.Storage {
+	case "file", "memory":
+	default:
+		return fmt.Errorf("invalid storage %q for stream %s, must be file or memory", s.Storage, s.Name)
+	}
+
+	switch s.Retention {
+	case "workqueue", "limits", "interest":
+	default:
+		return fmt.Errorf("invalid retention %q for stream %s, must be workqueue, limits or interest", s.Retention, s.Name)
+	}
+
+	if s.Replicas < 1 || s.Replicas > 5 {
+		return fmt.Errorf("invalid replicas %d for stream %s, must be between 1 and 5", s.Replicas, s.Name)
+	}
+
 	return nil
 }
 
+func (s *StreamConfig) setDefaults(name string) {
+	if s.Name == "" {
+		s.Name = name
+	}
+
+	if s.Replicas == 0 {
+		s.Replicas = 1
+	}
+
+	if s.Storage == "" {
+		s.Storage = "file"
+	}
+
+	if s.Retention == "" {
+		s.Retention = "workqueue"
+	}
+
+	if s.MaxAge == 0 {
+		s.MaxAge = 7 * time.Hour * 24
+	}
+
+	if s.MaxMsgs == 0 {
+		s.MaxMsgs = 1_000_000_000
+	}
+
+	if s.MaxBytes == 0 {
+		s.MaxBytes = 1 << 30 // 1 GiB
+	}
+}
+
+func (e *EncryptionConfig) validate() error {
+	ids := map[string]bool{}
+	for _, key := range e.Keys {
+		if key.ID == "" {
+			return errors.New("encryption keys must have an id")
+		}
+
+		if ids[key.ID] {
+			return fmt.Errorf("duplicate encryption key id %s", key.ID)
+		}
+		ids[key.ID] = true
+
+		if key.Key == "" {
+			return fmt.Errorf("encryption key %s requires key or keyFile", key.ID)
+		}
+	}
+
+	if e.ActiveKeyID != "" && !ids[e.ActiveKeyID] {
+		return fmt.Errorf("encryption activeKeyId %s is not in keys", e.ActiveKeyID)
+	}
+
+	return nil
+}
+
+// resolveSecrets reads keys that are configured as mounted files.
+func (e *EncryptionConfig) resolveSecrets() error {
+	for i, key := range e.Keys {
+		if key.KeyFile == "" {
+			continue
+		}
+
+		data, err := os.ReadFile(key.KeyFile)
+		if err != nil {
+			return fmt.Errorf("failed to read encryption key file for %s: %w", key.ID, err)
+		}
+
+		e.Keys[i].Key = strings.TrimSpace(string(data))
+	}
+
+	return nil
+}
+
+func (n *NatsConfig) validate() error {
+	switch n.Auth {
+	case "none":
+	case "jwt":
+		if n.JWT == "" || n.Seed == "" {
+			return errors.New("nats jwt auth requires jwt and seed")
+		}
+	case "creds":
+		if n.CredsFile == "" {
+			return errors.New("nats creds auth requires credsFile")
+		}
+	case "nkey":
+		if n.NKeySeedFile == "" {
+			return errors.New("nats nkey auth requires nkeySeedFile")
+		}
+	case "userpass":
+		if n.User == "" || n.Password == "" {
+			return errors.New("nats userpass auth requires user and password")
+		}
+	case "token":
+		if n.Token == "" {
+			return errors.New("nats token auth requires token")
+		}
+	default:
+		return fmt.Errorf("invalid nats auth %q, must be none, jwt, creds, nkey, userpass or token", n.Auth)
+	}
+
+	if (n.TLS.CertFile == "") != (n.TLS.KeyFile == "") {
+		return errors.New("nats tls certFile and keyFile must be set together")
+	}
+
+	return nil
+}
+
+// resolveSecrets reads secrets that are configured as mounted files. A file always wins over an inline value.
+func (n *NatsConfig) resolveSecrets() error {
+	secrets := []struct {
+		file  string
+		value *string
+	}{
+		{n.JWTFile, &n.JWT},
+		{n.SeedFile, &n.Seed},
+		{n.PasswordFile, &n.Password},
+		{n.TokenFile, &n.Token},
+	}
+
+	for _, secret := range secrets {
+		if secret.file == "" {
+			continue
+		}
+
+		data, err := os.ReadFile(secret.file)
+		if err != nil {
+			return fmt.Errorf("failed to read nats secret file: %w", err)
+		}
+
+		*secret.value = strings.TrimSpace(string(data))
+	}
+
+	return nil
+}
+
+func (c *config) setDefaults() {
+	// Outside development the manager has always authenticated with a JWT
+	if c.NatsConfig.Auth == "" {
+		if c.IsDevelopment() {
+			c.NatsConfig.Auth = "none"
+		} else {
+			c.NatsConfig.Auth = "jwt"
+		}
+	}
+
+	if c.QueueConfig.Backend == "" {
+		c.QueueConfig.Backend = "jetstream"
+	}
+
+	if c.ClusterConfig.RoutingBackend == "" {
+		c.ClusterConfig.RoutingBackend = "ingress"
+	}
+
+	if c.ClusterConfig.Gateway.Namespace == "" {
+		c.ClusterConfig.Gateway.Namespace = c.ClusterConfig.Namespace
+	}
+
+	if c.ClusterConfig.Gateway.TLS == "" {
+		c.ClusterConfig.Gateway.TLS = "listener"
+	}
+
+	if c.ClusterConfig.Gateway.ListenerPort == 0 {
+		c.ClusterConfig.Gateway.ListenerPort = 443
+	}
+
+	if c.ClusterConfig.Certificates.Mode == "" {
+		c.ClusterConfig.Certificates.Mode = "ingress-shim"
+	}
+
+	if c.ClusterConfig.Certificates.IssuerRef.Name == "" {
+		c.ClusterConfig.Certificates.IssuerRef.Name = c.ClusterConfig.CertManagerIssuer
+	}
+
+	if c.ClusterConfig.Certificates.IssuerRef.Kind == "" {
+		c.ClusterConfig.Certificates.IssuerRef.Kind = "ClusterIssuer"
+	}
+
+	if c.ClusterConfig.Certificates.IssuerRef.Group == "" {
+		c.ClusterConfig.Certificates.IssuerRef.Group = "cert-manager.io"
+	}
+
+	if len(c.ClusterConfig.Traefik.EntryPoints) == 0 {
+		c.ClusterConfig.Traefik.EntryPoints = []string{"websecure"}
+	}
+
+	if c.ClusterConfig.OpenShift.Termination == "" {
+		c.ClusterConfig.OpenShift.Termination = "edge"
+	}
+
+	if c.ClusterConfig.OpenShift.InsecureEdgeTerminationPolicy == "" {
+		c.ClusterConfig.OpenShift.InsecureEdgeTerminationPolicy = "Redirect"
+	}
+
+	// Status history is kept per reference ID, reading or acking a status leaves it for the other consumers
+	if c.QueueConfig.StatusStream.Retention == "" {
+		c.QueueConfig.StatusStream.Retention = "limits"
+	}
+
+	if c.QueueConfig.StatusStream.MaxMsgsPerSubject == 0 {
+		c.QueueConfig.StatusStream.MaxMsgsPerSubject = 100
+	}
+
+	// Lifecycle events are for anyone who wants them, a work queue would hand each to a single consumer
+	if c.QueueConfig.EventStream.Retention == "" {
+		c.QueueConfig.EventStream.Retention = "limits"
+	}
+
+	// The embedded server of the memory backend keeps nothing on disk
+	if c.QueueConfig.Backend == "memory" {
+		for _, stream := range []*StreamConfig{&c.QueueConfig.JobStream, &c.QueueConfig.StatusStream, &c.QueueConfig.EventStream} {
+			if stream.Storage == "" {
+				stream.Storage = "memory"
+			}
+		}
+	}
+
+	c.QueueConfig.JobStream.setDefaults(fmt.Sprintf("%s_%s", c.SystemConfig.Environment, "vanityDomainManager_jobs"))
+	c.QueueConfig.StatusStream.setDefaults(fmt.Sprintf("%s_%s", c.SystemConfig.Environment, "vanityDomainManager_status"))
+	c.QueueConfig.EventStream.setDefaults(fmt.Sprintf("%s_%s", c.SystemConfig.Environment, "vanityDomainManager_events"))
+
+	if c.QueueConfig.CertificateStore.Bucket == "" {
+		c.QueueConfig.CertificateStore.Bucket = fmt.Sprintf("%s_%s", c.SystemConfig.Environment, "vanityDomainManager_certificates")
+	}
+
+	if c.QueueConfig.Consumer.Name == "" {
+		c.QueueConfig.Consumer.Name = "vanityDomainManager-domainjob-worker"
+	}
+
+	if c.QueueConfig.Consumer.AckWait == 0 {
+		c.QueueConfig.Consumer.AckWait = 30 * time.Second
+	}
+
+	if c.QueueConfig.Consumer.MaxAckPending == 0 {
+		c.QueueConfig.Consumer.MaxAckPending = 1000
+	}
+
+	if c.QueueConfig.Consumer.MaxDeliver == 0 {
+		c.QueueConfig.Consumer.MaxDeliver = 10
+	}
+
+	if c.WorkerConfig.Concurrency <= 0 {
+		c.WorkerConfig.Concurrency = 10
+	}
+
+	if c.WorkerConfig.AwaitDNS.Window == 0 {
+		c.WorkerConfig.AwaitDNS.Window = 15 * time.Minute
+	}
+
+	if c.WorkerConfig.AwaitDNS.PollInterval == 0 {
+		c.WorkerConfig.AwaitDNS.PollInterval = 10 * time.Second
+	}
+
+	if c.WorkerConfig.AwaitDNS.StatusInterval == 0 {
+		c.WorkerConfig.AwaitDNS.StatusInterval = time.Minute
+	}
+
+	if c.WorkerConfig.AwaitCertificate.Window == 0 {
+		c.WorkerConfig.AwaitCertificate.Window = 10 * time.Minute
+	}
+
+	if c.WorkerConfig.AwaitCertificate.PollInterval == 0 {
+		c.WorkerConfig.AwaitCertificate.PollInterval = 10 * time.Second
+	}
+
+	if c.WorkerConfig.AwaitCertificate.StatusInterval == 0 {
+		c.WorkerConfig.AwaitCertificate.StatusInterval = time.Minute
+	}
+
+	if c.WorkerConfig.Reverify.Interval <= 0 {
+		c.WorkerConfig.Reverify.Interval = time.Hour
+	}
+
+	if c.WorkerConfig.Reverify.FailureThreshold <= 0 {
+		c.WorkerConfig.Reverify.FailureThreshold = 3
+	}
+
+	if c.WorkerConfig.Reverify.Policy == "" {
+		c.WorkerConfig.Reverify.Policy = "none"
+	}
+
+	if c.WorkerConfig.Reconcile.Resync <= 0 {
+		c.WorkerConfig.Reconcile.Resync = 10 * time.Minute
+	}
+
+	if c.WorkerConfig.Reconcile.Workers <= 0 {
+		c.WorkerConfig.Reconcile.Workers = 2
+	}
+
+	if c.RPCConfig.Timeout <= 0 {
+		c.RPCConfig.Timeout = 5 * time.Minute
+	}
+
+	if c.EventsConfig.Format == "" {
+		c.EventsConfig.Format = "json"
+	}
+
+	if c.EventsConfig.Mode == "" {
+		c.EventsConfig.Mode = "structured"
+	}
+
+	if c.EventsConfig.Source == "" {
+		c.EventsConfig.Source = fmt.Sprintf("/vanityDomainManager/%s", c.SystemConfig.Environment)
+	}
+}
+
 // Loads loads the Configuration file and verifies the settings
 func Load(filePath string) error {
 	c := config{}
@@ -100,6 +823,16 @@ func Load(filePath string) error {
 		return err
 	}
 
+	c.setDefaults()
+
+	if err := c.NatsConfig.resolveSecrets(); err != nil {
+		return err
+	}
+
+	if err := c.EncryptionConfig.resolveSecrets(); err != nil {
+		return err
+	}
+
 	_config = &c
 
 	return c.validate()
@@ -0,0 +1,191 @@
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"github.com/geekgonecrazy/vanityDomainManager/config"
+	"github.com/geekgonecrazy/vanityDomainManager/jobs"
+)
+
+var keyring *Keyring
+
+var ErrNoKeyring = errors.New("certificate key encryption is not configured")
+
+// Keyring holds the manager keys used to envelope encrypt certificate private keys. Keeping retired keys in the
+// keyring lets jobs that were encrypted before a rotation still be decrypted.
+type Keyring struct {
+	activeKeyID string
+	keys        map[string]cipher.AEAD
+}
+
+func GetKeyring() *Keyring {
+	return keyring
+}
+
+// Load builds the keyring from config. With no keys configured the keyring stays nil and keys travel unencrypted.
+func Load(encryptionConfig config.EncryptionConfig) error {
+	if len(encryptionConfig.Keys) == 0 {
+		keyring = nil
+		return nil
+	}
+
+	k := &Keyring{
+		activeKeyID: encryptionConfig.ActiveKeyID,
+		keys:        map[string]cipher.AEAD{},
+	}
+
+	for _, key := range encryptionConfig.Keys {
+		raw, err := base64.StdEncoding.DecodeString(key.Key)
+		if err != nil {
+			return fmt.Errorf("encryption key %s is not valid base64: %w", key.ID, err)
+		}
+
+		if len(raw) != 32 {
+			return fmt.Errorf("encryption key %s must be 32 bytes, got %d", key.ID, len(raw))
+		}
+
+		aead, err := newAEAD(raw)
+		if err != nil {
+			return fmt.Errorf("encryption key %s: %w", key.ID, err)
+		}
+
+		k.keys[key.ID] = aead
+	}
+
+	keyring = k
+	return nil
+}
+
+// CanEncrypt reports whether new submissions should be encrypted.
+func (k *Keyring) CanEncrypt() bool {
+	return k != nil && k.activeKeyID != ""
+}
+
+// Encrypt seals plaintext with a fresh data key and wraps the data key with the active manager key.
+func (k *Keyring) Encrypt(plaintext []byte) (*jobs.EncryptedKey, error) {
+	if !k.CanEncrypt() {
+		return nil, ErrNoKeyring
+	}
+
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, fmt.Errorf("generate data key: %w", err)
+	}
+
+	dataAEAD, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	ciphertext, err := seal(dataAEAD, plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	wrappedKey, err := seal(k.keys[k.activeKeyID], dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &jobs.EncryptedKey{
+		KeyID:      k.activeKeyID,
+		WrappedKey: wrappedKey,
+		Ciphertext: ciphertext,
+	}, nil
+}
+
+// Decrypt unwraps the data key with the manager key the envelope names and opens the ciphertext with it.
+func (k *Keyring) Decrypt(envelope *jobs.EncryptedKey) ([]byte, error) {
+	if k == nil {
+		return nil, ErrNoKeyring
+	}
+
+	keyAEAD, ok := k.keys[envelope.KeyID]
+	if !ok {
+		return nil, fmt.Errorf("unknown encryption key id %s", envelope.KeyID)
+	}
+
+	dataKey, err := open(keyAEAD, envelope.WrappedKey)
+	if err != nil {
+		return nil, fmt.Errorf("unwrap data key: %w", err)
+	}
+
+	dataAEAD, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := open(dataAEAD, envelope.Ciphertext)
+	if err != nil {
+		return nil, fmt.Errorf("decrypt key: %w", err)
+	}
+
+	return plaintext, nil
+}
+
+// SealCertificate replaces the plaintext private key on the certificate with its encrypted form. Clients that
+// publish straight to NATS and share a manager key can use it before publishing.
+func (k *Keyring) SealCertificate(cert *jobs.DomainCustomCert) error {
+	if cert == nil || cert.Key == "" {
+		return nil
+	}
+
+	envelope, err := k.Encrypt([]byte(cert.Key))
+	if err != nil {
+		return err
+	}
+
+	cert.EncryptedKey = envelope
+	cert.Key = ""
+	return nil
+}
+
+// OpenCertificate returns a copy of the certificate with the private key decrypted. Certificates that were never
+// encrypted are returned as they are.
+func (k *Keyring) OpenCertificate(cert *jobs.DomainCustomCert) (*jobs.DomainCustomCert, error) {
+	if cert == nil || cert.EncryptedKey == nil {
+		return cert, nil
+	}
+
+	key, err := k.Decrypt(cert.EncryptedKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &jobs.DomainCustomCert{
+		Key:  string(key),
+		Cert: cert.Cert,
+	}, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("aes cipher: %w", err)
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func seal(aead cipher.AEAD, plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("generate nonce: %w", err)
+	}
+
+	return aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func open(aead cipher.AEAD, sealed []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, nil)
+}
@@ -1,8 +1,62 @@
 package jobs
 
+import (
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const Redacted = "[REDACTED]"
+
+const (
+	StatePending             = "pending"              // A job for the domain is queued or being retried
+	StateActive              = "active"               // The domain is verified and routed
+	StateFailed              = "failed"               // The last job for the domain was dropped
+	StateRemoved             = "removed"              // The domain was removed from the environment
+	StateAwaitingDNS         = "awaiting_dns"         // DNS has not propagated yet, the worker is still polling
+	StateAwaitingCertificate = "awaiting_certificate" // cert-manager is still issuing the certificate
+	StateDNSDrifted          = "dns_drifted"          // An active domain repeatedly failed re-verification
+	StateTimedOut            = "timed_out"            // A synchronous request gave up waiting, the job itself keeps going
+	StateScheduled           = "scheduled"            // The job is held until its notBefore time
+	StateCancelled           = "cancelled"            // The job was cancelled before it completed
+	StateExpired             = "expired"              // The job was not processed before its expiresAt time
+	StateSuperseded          = "superseded"           // A newer job for the same domain replaced this one
+	StateUnsupported         = "unsupported_schema"   // The job uses a schema version this manager doesn't know
+	StateUnmanaged           = "unmanaged_conflict"   // The job would modify a Kubernetes object or field the manager doesn't own
+)
+
+// EncryptedKey is an envelope encrypted private key. The data key that encrypts the private key is itself encrypted
+// with the manager key identified by KeyID.
+type EncryptedKey struct {
+	KeyID      string `json:"keyId"`
+	WrappedKey []byte `json:"wrappedKey"` // Nonce followed by the sealed data key
+	Ciphertext []byte `json:"ciphertext"` // Nonce followed by the sealed private key
+}
+
 type DomainCustomCert struct {
-	Key  string `json:"key"`
-	Cert string `json:"cert"`
+	Key          string        `json:"key,omitempty"`          // PEM private key, cleared once encrypted
+	EncryptedKey *EncryptedKey `json:"encryptedKey,omitempty"` // Set instead of Key when the key is encrypted
+	Cert         string        `json:"cert"`
+}
+
+// String keeps the private key out of anything that formats the certificate.
+func (c DomainCustomCert) String() string {
+	return fmt.Sprintf("{Key:%s Cert:%d bytes}", Redacted, len(c.Cert))
+}
+
+// GoString keeps the private key out of %#v formatting.
+func (c DomainCustomCert) GoString() string {
+	return c.String()
+}
+
+// RedactKey replaces any occurrence of the private key in message.
+func (c *DomainCustomCert) RedactKey(message string) string {
+	if c == nil || c.Key == "" {
+		return message
+	}
+
+	return strings.ReplaceAll(message, c.Key, Redacted)
 }
 
 type VanityDomain struct {
@@ -11,19 +65,216 @@ type VanityDomain struct {
 	DesiredCNAMETarget    string            `json:"desiredCNAME"`
 	DesiredARecordTargets []string          `json:"desiredARecords"`
 	ProvidedCertificate   *DomainCustomCert `json:"providedCertificate,omitempty"` // Optional, if the user provides a certificate
+	CertificateRef        string            `json:"certificateRef,omitempty"`      // Set instead of ProvidedCertificate when it was offloaded to the object store
 	TargetServiceName     string            `json:"targetServiceName,omitempty"`   // Optional, The service name to set in the ingress
 	TargetServicePort     int32             `json:"targetServicePort,omitempty"`   // Optional, The service port to set in the ingress
+	Annotations           map[string]string `json:"annotations,omitempty"`         // Optional, per domain annotations, limited by cluster.allowedAnnotationOverrides
+	Routes                []Route           `json:"routes,omitempty"`              // Optional, path based routing, defaults to everything going to the cluster service
+	Adopt                 bool              `json:"adopt,omitempty"`               // Take over existing Kubernetes objects the manager didn't create
+}
+
+// Route sends requests for a path on the vanity domain to a service.
+type Route struct {
+	Path        string `json:"path"`
+	PathType    string `json:"pathType,omitempty"`    // "Prefix" (default), "Exact" or "ImplementationSpecific"
+	ServiceName string `json:"serviceName,omitempty"` // Defaults to the cluster service
+	ServicePort int32  `json:"servicePort,omitempty"` // Required with serviceName
 }
 
 type VanityDomainJob struct {
-	Type        string       `json:"type"`        // "add", "change", or "remove"
-	Domain      VanityDomain `json:"domain"`      // The vanity domain to process
-	ReferenceID string       `json:"referenceId"` // Unique ID for the job, can be used to track the job
+	SchemaVersion int `json:"schemaVersion"` // Version of the JSON shape, see CurrentSchemaVersion
+
+	Type        string       `json:"type"`                // "add", "change", or "remove"
+	Domain      VanityDomain `json:"domain"`              // The vanity domain to process
+	ReferenceID string       `json:"referenceId"`         // Unique ID for the job, can be used to track the job
+	AwaitDNS    bool         `json:"awaitDns,omitempty"`  // Optional, poll DNS for up to the configured window instead of retrying
+	Owner       string       `json:"owner,omitempty"`     // Optional, who the domain belongs to, recorded in the domain registry
+	NotBefore   *time.Time   `json:"notBefore,omitempty"` // Optional, hold the job until this time
+	ExpiresAt   *time.Time   `json:"expiresAt,omitempty"` // Optional, drop the job if it hasn't completed by this time
+	BatchID     string       `json:"batchId,omitempty"`   // Set when the job was submitted as part of a batch
+}
+
+// Validate checks that a job has everything the worker needs to process it.
+func (j VanityDomainJob) Validate() error {
+	if err := j.CheckSchemaVersion(); err != nil {
+		return err
+	}
+
+	if err := ValidateReferenceID(j.ReferenceID); err != nil {
+		return err
+	}
+
+	if j.Domain.VanityDomain == "" {
+		return fmt.Errorf("domain.vanityDomain is required")
+	}
+
+	if containsRuleBreak(j.Domain.VanityDomain) || strings.ContainsFunc(j.Domain.VanityDomain, unicode.IsSpace) {
+		return fmt.Errorf("domain.vanityDomain must not contain backticks, whitespace or control characters")
+	}
+
+	switch j.Type {
+	case "add", "change":
+		switch j.Domain.DesiredDNSTargetType {
+		case "CNAME":
+			if j.Domain.DesiredCNAMETarget == "" {
+				return fmt.Errorf("domain.desiredCNAME is required for CNAME targets")
+			}
+		case "A":
+			if len(j.Domain.DesiredARecordTargets) == 0 {
+				return fmt.Errorf("domain.desiredARecords is required for A targets")
+			}
+		default:
+			return fmt.Errorf("domain.desiredDnsTargetType must be CNAME or A")
+		}
+
+		if err := validateRoutes(j.Domain.Routes); err != nil {
+			return err
+		}
+	case "remove":
+	default:
+		return fmt.Errorf("type must be add, change or remove")
+	}
+
+	return nil
+}
+
+// ValidateReferenceID checks that a reference ID can be used as a single NATS subject token. Dots would split it
+// into more tokens, wildcards would match other jobs.
+func ValidateReferenceID(referenceID string) error {
+	if referenceID == "" {
+		return fmt.Errorf("referenceId is required")
+	}
+
+	if strings.ContainsFunc(referenceID, func(r rune) bool { return r == '.' || r == '*' || r == '>' || unicode.IsSpace(r) }) {
+		return fmt.Errorf("referenceId must not contain '.', '*', '>' or whitespace")
+	}
+
+	return nil
+}
+
+// containsRuleBreak reports whether value holds a backtick or a control character. Routing rules like Traefik's
+// quote hosts and paths in backticks, either would let a job change the rule.
+func containsRuleBreak(value string) bool {
+	return strings.ContainsFunc(value, func(r rune) bool { return r == '`' || unicode.IsControl(r) })
+}
+
+func validateRoutes(routes []Route) error {
+	seen := map[string]bool{}
+	for i, route := range routes {
+		if !strings.HasPrefix(route.Path, "/") {
+			return fmt.Errorf("domain.routes[%d].path must start with /", i)
+		}
+
+		if containsRuleBreak(route.Path) {
+			return fmt.Errorf("domain.routes[%d].path must not contain backticks or control characters", i)
+		}
+
+		switch route.PathType {
+		case "", "Prefix", "Exact", "ImplementationSpecific":
+		default:
+			return fmt.Errorf("domain.routes[%d].pathType must be Prefix, Exact or ImplementationSpecific", i)
+		}
+
+		if route.ServiceName != "" && (route.ServicePort <= 0 || route.ServicePort > 65535) {
+			return fmt.Errorf("domain.routes[%d].servicePort must be between 1 and 65535", i)
+		}
+
+		if route.ServiceName == "" && route.ServicePort != 0 {
+			return fmt.Errorf("domain.routes[%d].serviceName is required with servicePort", i)
+		}
+
+		// An empty pathType is the default Prefix
+		pathType := route.PathType
+		if pathType == "" {
+			pathType = "Prefix"
+		}
+
+		key := pathType + " " + route.Path
+		if seen[key] {
+			return fmt.Errorf("domain.routes[%d] duplicates path %s", i, route.Path)
+		}
+		seen[key] = true
+	}
+
+	return nil
 }
 
 type JobStatus struct {
-	Success      bool   `json:"success"`      // Whether the job was successful
-	ReferenceID  string `json:"referenceId"`  // Unique ID for the job, same as in DomainJob
-	ErrorMessage string `json:"errorMessage"` // Error message if the job failed
-	Dropped      bool   `json:"dropped"`      // Whether the job was dropped
+	Success      bool      `json:"success"`           // Whether the job was successful
+	ReferenceID  string    `json:"referenceId"`       // Unique ID for the job, same as in DomainJob
+	Domain       string    `json:"domain,omitempty"`  // Vanity domain the job is for, when known
+	ErrorMessage string    `json:"errorMessage"`      // Error message if the job failed
+	Dropped      bool      `json:"dropped"`           // Whether the job was dropped
+	State        string    `json:"state,omitempty"`   // Progress state for non-final updates, e.g. awaiting_dns
+	Message      string    `json:"message,omitempty"` // Human readable progress detail
+	Timestamp    time.Time `json:"timestamp"`         // When the status was published
+}
+
+// DomainStatus is the last observed state of a managed domain.
+type DomainStatus struct {
+	State        string    `json:"state"`                  // One of the State constants
+	ReferenceID  string    `json:"referenceId"`            // The job that last changed the state
+	ErrorMessage string    `json:"errorMessage,omitempty"` // Error from the last failed attempt, if any
+	UpdatedAt    time.Time `json:"updatedAt"`
+}
+
+// DomainEvent is an entry in the history of a managed domain.
+type DomainEvent struct {
+	ReferenceID string    `json:"referenceId"`
+	Type        string    `json:"type,omitempty"` // Job type, empty for events not caused by a job
+	State       string    `json:"state"`
+	Message     string    `json:"message,omitempty"`
+	At          time.Time `json:"at"`
+}
+
+// DomainLifecycleEvent is published when a managed domain is activated, drifts, recovers or its certificate nears
+// expiry.
+type DomainLifecycleEvent struct {
+	Domain      string     `json:"domain"`
+	ReferenceID string     `json:"referenceId,omitempty"` // The job that configured the domain
+	Message     string     `json:"message,omitempty"`
+	NotAfter    *time.Time `json:"notAfter,omitempty"` // Certificate expiry, only for certificate events
+	Timestamp   time.Time  `json:"timestamp"`
+}
+
+// LatestJob identifies the most recently queued job for a domain.
+type LatestJob struct {
+	ReferenceID string `json:"referenceId"`
+	Sequence    uint64 `json:"sequence"` // Position of the job in the job queue
+}
+
+// DomainRecord is the registry entry for a vanity domain. The provided certificate key is never stored.
+type DomainRecord struct {
+	Domain    VanityDomain  `json:"domain"` // Desired spec from the latest job
+	Owner     string        `json:"owner,omitempty"`
+	Status    DomainStatus  `json:"status"`
+	History   []DomainEvent `json:"history"`
+	LatestJob *LatestJob    `json:"latestJob,omitempty"`
+	Reverify  *Reverify     `json:"reverify,omitempty"` // DNS re-verification of the active domain
+	Revision  uint64        `json:"revision,omitempty"` // KV revision the record was read at
+}
+
+// Reverify counts the failed DNS re-verifications of a domain. It lives in the registry so the count survives
+// restarts and every replica sees the same one.
+type Reverify struct {
+	Failures  int       `json:"failures"`  // Consecutive failed checks
+	CheckedAt time.Time `json:"checkedAt"` // Last check by any replica
+}
+
+// BatchStatus aggregates the results of the jobs submitted in a batch.
+type BatchStatus struct {
+	BatchID   string            `json:"batchId"`
+	Total     int               `json:"total"`
+	Succeeded int               `json:"succeeded"`
+	Failed    int               `json:"failed"`
+	Pending   int               `json:"pending"`
+	Jobs      map[string]string `json:"jobs"` // Reference ID to pending, succeeded or failed
+	CreatedAt time.Time         `json:"createdAt"`
+	UpdatedAt time.Time         `json:"updatedAt"`
+}
+
+// IsFinal reports whether the status is the last one a job will produce, either success or dropped. Dropped
+// statuses may carry a State explaining why, e.g. cancelled.
+func (s JobStatus) IsFinal() bool {
+	return s.Success || s.Dropped
 }
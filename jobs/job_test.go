@@ -0,0 +1,102 @@
+package jobs
+
+import (
+	"encoding/json"
+	"slices"
+	"testing"
+)
+
+func TestValidateRoutes(t *testing.T) {
+	tests := []struct {
+		name   string
+		routes []Route
+		valid  bool
+	}{
+		{"default pathType", []Route{{Path: "/api"}}, true},
+		{"every pathType", []Route{{Path: "/a", PathType: "Prefix"}, {Path: "/b", PathType: "Exact"}, {Path: "/c", PathType: "ImplementationSpecific"}}, true},
+		{"same path, other pathType", []Route{{Path: "/api", PathType: "Exact"}, {Path: "/api"}}, true},
+		{"own service", []Route{{Path: "/api", ServiceName: "api", ServicePort: 8080}}, true},
+		{"relative path", []Route{{Path: "api"}}, false},
+		{"unknown pathType", []Route{{Path: "/api", PathType: "Regex"}}, false},
+		{"duplicate path", []Route{{Path: "/api"}, {Path: "/api"}}, false},
+		{"duplicate of the default pathType", []Route{{Path: "/api"}, {Path: "/api", PathType: "Prefix"}}, false},
+		{"service without port", []Route{{Path: "/api", ServiceName: "api"}}, false},
+		{"port without service", []Route{{Path: "/api", ServicePort: 8080}}, false},
+	}
+
+	for _, test := range tests {
+		if err := validateRoutes(test.routes); (err == nil) != test.valid {
+			t.Errorf("Expected %s to be valid: %v, got %v", test.name, test.valid, err)
+		}
+	}
+}
+
+func TestSchemaPathTypesMatchValidation(t *testing.T) {
+	data, err := JSONSchema(CurrentSchemaVersion)
+	if err != nil {
+		t.Fatalf("Failed to get schema: %v", err)
+	}
+
+	var schema struct {
+		Defs struct {
+			Route struct {
+				Properties struct {
+					PathType struct {
+						Enum []string `json:"enum"`
+					} `json:"pathType"`
+				} `json:"properties"`
+			} `json:"route"`
+		} `json:"$defs"`
+	}
+	if err := json.Unmarshal(data, &schema); err != nil {
+		t.Fatalf("Failed to parse schema: %v", err)
+	}
+
+	enum := schema.Defs.Route.Properties.PathType.Enum
+	if len(enum) == 0 {
+		t.Fatal("Expected the schema to list the path types")
+	}
+
+	for _, pathType := range enum {
+		if err := validateRoutes([]Route{{Path: "/api", PathType: pathType}}); err != nil {
+			t.Errorf("Expected pathType %q allowed by the schema to pass validation, got %v", pathType, err)
+		}
+	}
+
+	if !slices.Contains(enum, "") {
+		t.Errorf("Expected the schema to allow the empty pathType validation defaults, got %v", enum)
+	}
+}
+
+func TestRoutesRejectRuleBreaks(t *testing.T) {
+	valid := VanityDomainJob{
+		ReferenceID: "ref-1",
+		Type:        "add",
+		Domain: VanityDomain{
+			VanityDomain:          "example.org",
+			DesiredDNSTargetType:  "A",
+			DesiredARecordTargets: []string{"192.0.2.1"},
+			Routes:                []Route{{Path: "/api"}},
+		},
+	}
+
+	if err := valid.Validate(); err != nil {
+		t.Fatalf("Expected a plain path to pass, got %v", err)
+	}
+
+	for _, path := range []string{"/api`) || Host(`evil.example", "/api\n", "/api\x00", "/api\x7f"} {
+		job := valid
+		job.Domain.Routes = []Route{{Path: path}}
+		if err := job.Validate(); err == nil {
+			t.Errorf("Expected path %q to be rejected", path)
+		}
+	}
+
+	for _, domain := range []string{"example.org`) || Host(`evil.example", "example.org\r", "example .org"} {
+		job := valid
+		job.Domain.VanityDomain = domain
+		if err := job.Validate(); err == nil {
+			t.Errorf("Expected domain %q to be rejected", domain)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package jobs
+
+import (
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// CurrentSchemaVersion is the job schema this manager produces. Adding an optional field doesn't need a new
+// version; renaming or removing a field, or changing what it means, does. A new version needs a decoder that
+// upgrades it to the in-memory model and a JSON Schema in schema/.
+const CurrentSchemaVersion = 1
+
+var ErrUnsupportedSchemaVersion = errors.New("unsupported job schema version")
+
+//go:embed schema/*.json
+var schemas embed.FS
+
+// decoders upgrade each supported schema version to the current in-memory model.
+var decoders = map[int]func(data []byte) (VanityDomainJob, error){
+	1: decodeV1,
+}
+
+// DecodeJob decodes a job message of any supported schema version. Messages without a schemaVersion predate
+// versioning and are decoded as version 1. For unsupported versions the returned job still carries the
+// reference ID so the failure can be reported.
+func DecodeJob(data []byte) (VanityDomainJob, error) {
+	var header struct {
+		SchemaVersion int    `json:"schemaVersion"`
+		ReferenceID   string `json:"referenceId"`
+	}
+
+	if err := json.Unmarshal(data, &header); err != nil {
+		return VanityDomainJob{}, fmt.Errorf("json unmarshal job: %w", err)
+	}
+
+	version := header.SchemaVersion
+	if version == 0 {
+		version = 1
+	}
+
+	decode, ok := decoders[version]
+	if !ok {
+		return VanityDomainJob{ReferenceID: header.ReferenceID}, fmt.Errorf("%w %d, this manager supports up to %d", ErrUnsupportedSchemaVersion, header.SchemaVersion, CurrentSchemaVersion)
+	}
+
+	return decode(data)
+}
+
+// CheckSchemaVersion rejects jobs written for a schema version this manager can't decode. Zero means unversioned.
+func (j VanityDomainJob) CheckSchemaVersion() error {
+	if j.SchemaVersion == 0 {
+		return nil
+	}
+
+	if _, ok := decoders[j.SchemaVersion]; !ok {
+		return fmt.Errorf("%w %d, this manager supports up to %d", ErrUnsupportedSchemaVersion, j.SchemaVersion, CurrentSchemaVersion)
+	}
+
+	return nil
+}
+
+// JSONSchema returns the published JSON Schema for a job schema version.
+func JSONSchema(version int) ([]byte, error) {
+	if _, ok := decoders[version]; !ok {
+		return nil, fmt.Errorf("%w %d", ErrUnsupportedSchemaVersion, version)
+	}
+
+	return schemas.ReadFile(fmt.Sprintf("schema/v%d.json", version))
+}
+
+// SupportedSchemaVersions lists every version DecodeJob accepts.
+func SupportedSchemaVersions() []int {
+	versions := []int{}
+	for version := 1; version <= CurrentSchemaVersion; version++ {
+		if _, ok := decoders[version]; ok {
+			versions = append(versions, version)
+		}
+	}
+
+	return versions
+}
+
+func decodeV1(data []byte) (VanityDomainJob, error) {
+	var job VanityDomainJob
+	if err := json.Unmarshal(data, &job); err != nil {
+		return VanityDomainJob{}, fmt.Errorf("json unmarshal job: %w", err)
+	}
+
+	job.SchemaVersion = CurrentSchemaVersion
+	return job, nil
+}
@@ -0,0 +1,82 @@
+package jobs
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestDecodeLegacyJob(t *testing.T) {
+	data := []byte(`{"type":"add","referenceId":"ref-1","domain":{"vanityDomain":"example.com","desiredDnsTargetType":"CNAME","desiredCNAME":"target.example.net"}}`)
+
+	job, err := DecodeJob(data)
+	if err != nil {
+		t.Fatalf("Failed to decode legacy job: %v", err)
+	}
+
+	if job.SchemaVersion != CurrentSchemaVersion {
+		t.Errorf("Expected schema version %d, got %d", CurrentSchemaVersion, job.SchemaVersion)
+	}
+
+	if job.ReferenceID != "ref-1" || job.Domain.VanityDomain != "example.com" || job.Domain.DesiredCNAMETarget != "target.example.net" {
+		t.Errorf("Expected the legacy job to decode as version 1, got %+v", job)
+	}
+}
+
+func TestDecodeCurrentJobRoundTrip(t *testing.T) {
+	job := VanityDomainJob{
+		SchemaVersion: CurrentSchemaVersion,
+		Type:          "remove",
+		ReferenceID:   "ref-2",
+		Domain:        VanityDomain{VanityDomain: "example.org"},
+	}
+
+	data, err := json.Marshal(job)
+	if err != nil {
+		t.Fatalf("Failed to marshal job: %v", err)
+	}
+
+	decoded, err := DecodeJob(data)
+	if err != nil {
+		t.Fatalf("Failed to decode job: %v", err)
+	}
+
+	if decoded.ReferenceID != job.ReferenceID || decoded.Type != job.Type || decoded.Domain.VanityDomain != job.Domain.VanityDomain {
+		t.Errorf("Expected the job to survive a round trip, got %+v", decoded)
+	}
+}
+
+func TestDecodeUnsupportedVersion(t *testing.T) {
+	data := []byte(`{"schemaVersion":99,"referenceId":"ref-3","type":"add"}`)
+
+	job, err := DecodeJob(data)
+	if !errors.Is(err, ErrUnsupportedSchemaVersion) {
+		t.Fatalf("Expected ErrUnsupportedSchemaVersion, got %v", err)
+	}
+
+	if job.ReferenceID != "ref-3" {
+		t.Errorf("Expected reference ID to survive an unsupported version, got %q", job.ReferenceID)
+	}
+
+	if err := (VanityDomainJob{SchemaVersion: 99}).CheckSchemaVersion(); !errors.Is(err, ErrUnsupportedSchemaVersion) {
+		t.Errorf("Expected CheckSchemaVersion to reject version 99, got %v", err)
+	}
+}
+
+func TestJSONSchemaPublished(t *testing.T) {
+	for _, version := range SupportedSchemaVersions() {
+		schema, err := JSONSchema(version)
+		if err != nil {
+			t.Fatalf("Failed to get schema v%d: %v", version, err)
+		}
+
+		var parsed map[string]interface{}
+		if err := json.Unmarshal(schema, &parsed); err != nil {
+			t.Errorf("Expected schema v%d to be valid JSON, got %v", version, err)
+		}
+	}
+
+	if _, err := JSONSchema(CurrentSchemaVersion + 1); !errors.Is(err, ErrUnsupportedSchemaVersion) {
+		t.Errorf("Expected unknown schema version to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,82 @@
+package kubernetes
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/geekgonecrazy/vanityDomainManager/jobs"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/util/csaupgrade"
+)
+
+// FieldManager is the server-side apply field manager of every object the manager writes. Earlier releases wrote
+// objects with Create and Update, which the API server recorded under the same name from the user agent.
+const FieldManager = ManagedByValue
+
+// ErrFieldConflict is returned when applying an object would change fields another field manager owns, e.g. after
+// someone edited the object by hand or another controller took it over.
+var ErrFieldConflict = errors.New("object has fields managed by another field manager")
+
+type forceApplyKey struct{}
+
+// withForceApply makes every apply under ctx take over conflicting fields instead of failing. The reconciler uses
+// it to undo drift.
+func withForceApply(ctx context.Context) context.Context {
+	return context.WithValue(ctx, forceApplyKey{}, true)
+}
+
+// applyOptions applies as the manager's field manager. Conflicts are forced when the job adopts the object or ctx
+// comes from withForceApply.
+func applyOptions(ctx context.Context, job jobs.VanityDomain) metaV1.ApplyOptions {
+	force, _ := ctx.Value(forceApplyKey{}).(bool)
+	return metaV1.ApplyOptions{FieldManager: FieldManager, Force: force || job.Adopt}
+}
+
+// applyError names the object when an apply conflicted with another field manager. The API server's message lists
+// the conflicting managers and fields.
+func applyError(kind string, namespace string, name string, err error) error {
+	if apierrors.IsConflict(err) {
+		return fmt.Errorf("%w: %s %s/%s: %v, set adopt to take them over", ErrFieldConflict, kind, namespace, name, err)
+	}
+
+	return err
+}
+
+// upgradeManagedFields moves the fields the manager owns through Create and Update into its apply field manager,
+// so the next apply can change or remove them without conflicting with itself. patch sends a JSON patch to the
+// object and is only called when there is something to move.
+func upgradeManagedFields(obj runtime.Object, patch func(data []byte, opts metaV1.PatchOptions) error) error {
+	data, err := csaupgrade.UpgradeManagedFieldsPatch(obj, sets.New(FieldManager), FieldManager)
+	if err != nil || data == nil {
+		return err
+	}
+
+	return patch(data, metaV1.PatchOptions{FieldManager: FieldManager})
+}
+
+// toApplyConfiguration fills an apply configuration, created with its constructor so it carries the kind, from a
+// typed object of the same kind. Both have the same JSON shape. Status is dropped, the manager never applies it.
+func toApplyConfiguration(obj interface{}, applyConfiguration interface{}) error {
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+
+	var fields map[string]interface{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	delete(fields, "status")
+
+	data, err = json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, applyConfiguration)
+}
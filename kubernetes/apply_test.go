@@ -0,0 +1,176 @@
+package kubernetes
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/geekgonecrazy/vanityDomainManager/jobs"
+	v1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestSetTLSKeepsCertManagerAnnotations(t *testing.T) {
+	c := newDynamicTestClient(t)
+	c.client = fake.NewClientset()
+	ctx := context.Background()
+
+	domain := jobs.VanityDomain{VanityDomain: "example.org", ProvidedCertificate: &jobs.DomainCustomCert{Cert: "CERT", Key: "KEY"}}
+	name := tlsSecretName(domain)
+
+	// cert-manager issued the secret before a certificate was provided
+	issued := &v1.Secret{
+		ObjectMeta: metaV1.ObjectMeta{
+			Name:      name,
+			Namespace: "vanity",
+			Annotations: map[string]string{
+				certManagerCertificateAnnotation: name,
+				"cert-manager.io/issuer-name":    "letsencrypt",
+			},
+		},
+		Type: v1.SecretTypeTLS,
+		Data: map[string][]byte{"tls.crt": []byte("ISSUED"), "tls.key": []byte("ISSUED-KEY")},
+	}
+	if _, err := c.client.CoreV1().Secrets("vanity").Create(ctx, issued, metaV1.CreateOptions{FieldManager: "cert-manager-certificates-issuing"}); err != nil {
+		t.Fatalf("Failed to create issued secret: %v", err)
+	}
+
+	if err := c.SetTLS(ctx, "ref-1", domain); err != nil {
+		t.Fatalf("Failed to set TLS over the issued secret: %v", err)
+	}
+
+	// Applying again is a no-op rather than a conflict with our own fields
+	if err := c.SetTLS(ctx, "ref-1", domain); err != nil {
+		t.Fatalf("Failed to set TLS again: %v", err)
+	}
+
+	secret, err := c.client.CoreV1().Secrets("vanity").Get(ctx, name, metaV1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Failed to get secret: %v", err)
+	}
+
+	if string(secret.Data["tls.crt"]) != "CERT" || string(secret.Data["tls.key"]) != "KEY" {
+		t.Errorf("Expected the provided certificate, got %q", secret.Data["tls.crt"])
+	}
+
+	if secret.Annotations["cert-manager.io/issuer-name"] != "letsencrypt" || secret.Labels[ManagedByLabel] != ManagedByValue {
+		t.Errorf("Expected cert-manager's annotations to be kept next to ours, got %v %v", secret.Annotations, secret.Labels)
+	}
+}
+
+func TestSetRouteDetectsFieldConflicts(t *testing.T) {
+	c := newDynamicTestClient(t)
+	c.client = fake.NewClientset()
+	c.routing = &ingressProvider{kube: c}
+	ctx := context.Background()
+
+	domain := jobs.VanityDomain{VanityDomain: "example.org", DesiredDNSTargetType: "CNAME", DesiredCNAMETarget: "lb.example.net"}
+	if err := c.SetVanityDomain(ctx, "ref-1", domain); err != nil {
+		t.Fatalf("Failed to set vanity domain: %v", err)
+	}
+
+	ingresses := c.client.NetworkingV1().Ingresses("vanity")
+
+	// Another controller annotates the ingress and someone repoints its backend by hand
+	ingress, _ := ingresses.Get(ctx, routeName(domain), metaV1.GetOptions{})
+	ingress.Annotations["external-dns.alpha.kubernetes.io/ttl"] = "60"
+	ingress.Spec.Rules[0].HTTP.Paths[0].Backend.Service.Name = "elsewhere"
+	if _, err := ingresses.Update(ctx, ingress, metaV1.UpdateOptions{FieldManager: "kubectl-edit"}); err != nil {
+		t.Fatalf("Failed to edit ingress: %v", err)
+	}
+
+	c.ServiceName = "web-v2"
+	err := c.SetVanityDomain(ctx, "ref-2", domain)
+	if !errors.Is(err, ErrFieldConflict) {
+		t.Fatalf("Expected a field conflict, got %v", err)
+	}
+
+	domain.Adopt = true
+	if err := c.SetVanityDomain(ctx, "ref-2", domain); err != nil {
+		t.Fatalf("Failed to adopt: %v", err)
+	}
+
+	ingress, _ = ingresses.Get(ctx, routeName(domain), metaV1.GetOptions{})
+	if ingress.Spec.Rules[0].HTTP.Paths[0].Backend.Service.Name != "web-v2" {
+		t.Errorf("Expected the backend to be taken back, got %s", ingress.Spec.Rules[0].HTTP.Paths[0].Backend.Service.Name)
+	}
+
+	if ingress.Annotations["external-dns.alpha.kubernetes.io/ttl"] != "60" || ingress.Annotations[ReferenceIDAnnotation] != "ref-2" {
+		t.Errorf("Expected the other controller's annotation to be kept, got %v", ingress.Annotations)
+	}
+}
+
+func TestSetRouteTakesOverLegacyUpdates(t *testing.T) {
+	c := newDynamicTestClient(t)
+	c.client = fake.NewClientset()
+	c.routing = &ingressProvider{kube: c}
+	ctx := context.Background()
+
+	domain := jobs.VanityDomain{VanityDomain: "example.org", DesiredDNSTargetType: "CNAME", DesiredCNAMETarget: "lb.example.net"}
+	ingress, err := c.routing.(*ingressProvider).desiredIngress("ref-1", domain)
+	if err != nil {
+		t.Fatalf("Failed to build desired ingress: %v", err)
+	}
+
+	// Written by an earlier release with Create and Update, then disabled
+	ingress.Annotations[StateAnnotation] = "dns_drifted"
+	if _, err := c.client.NetworkingV1().Ingresses("vanity").Create(ctx, ingress, metaV1.CreateOptions{FieldManager: FieldManager}); err != nil {
+		t.Fatalf("Failed to create legacy ingress: %v", err)
+	}
+
+	c.ServiceName = "web-v2"
+	if err := c.SetVanityDomain(ctx, "ref-2", domain); err != nil {
+		t.Fatalf("Failed to set vanity domain over the legacy ingress: %v", err)
+	}
+
+	live, _ := c.client.NetworkingV1().Ingresses("vanity").Get(ctx, routeName(domain), metaV1.GetOptions{})
+	if _, ok := live.Annotations[StateAnnotation]; ok {
+		t.Errorf("Expected the state annotation the manager no longer sets to be removed, got %v", live.Annotations)
+	}
+
+	if live.Spec.Rules[0].HTTP.Paths[0].Backend.Service.Name != "web-v2" {
+		t.Errorf("Expected the backend to be updated, got %s", live.Spec.Rules[0].HTTP.Paths[0].Backend.Service.Name)
+	}
+
+	for _, entry := range live.ManagedFields {
+		if entry.Manager == FieldManager && entry.Operation != metaV1.ManagedFieldsOperationApply {
+			t.Errorf("Expected the legacy fields to be moved to the apply field manager, got %+v", entry)
+		}
+	}
+}
+
+func TestSetTLSLabelsDomainsByName(t *testing.T) {
+	c := newDynamicTestClient(t)
+	c.client = fake.NewClientset()
+	ctx := context.Background()
+
+	for _, vanityDomain := range []string{strings.Repeat("a", 60) + ".example.org", "bücher.example"} {
+		domain := jobs.VanityDomain{VanityDomain: vanityDomain, ProvidedCertificate: &jobs.DomainCustomCert{Cert: "CERT", Key: "KEY"}}
+		if err := c.SetTLS(ctx, "ref-1", domain); err != nil {
+			t.Fatalf("Failed to set TLS: %v", err)
+		}
+
+		secret, err := c.client.CoreV1().Secrets("vanity").Get(ctx, tlsSecretName(domain), metaV1.GetOptions{})
+		if err != nil {
+			t.Fatalf("Failed to get secret: %v", err)
+		}
+
+		label := secret.Labels[DomainLabel]
+		if errs := validation.IsValidLabelValue(label); len(errs) > 0 || label != routeName(domain) {
+			t.Errorf("Expected the domain label to be the valid object name %s, got %q %v", routeName(domain), label, errs)
+		}
+
+		if secret.Annotations[DomainAnnotation] != vanityDomain || secretDomain(secret) != vanityDomain {
+			t.Errorf("Expected the domain annotation to hold %s, got %v", vanityDomain, secret.Annotations)
+		}
+	}
+
+	// Secrets of earlier releases only have the label
+	legacy := &v1.Secret{ObjectMeta: metaV1.ObjectMeta{Labels: map[string]string{DomainLabel: "example.org"}}}
+	if domain := secretDomain(legacy); domain != "example.org" {
+		t.Errorf("Expected the domain of a legacy secret from its label, got %q", domain)
+	}
+}
@@ -0,0 +1,297 @@
+package kubernetes
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/geekgonecrazy/vanityDomainManager/jobs"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+const certManagerRevisionAnnotation = "cert-manager.io/certificate-revision"
+
+var (
+	certificateResource        = schema.GroupVersionResource{Group: "cert-manager.io", Version: "v1", Resource: "certificates"}
+	certificateRequestResource = schema.GroupVersionResource{Group: "cert-manager.io", Version: "v1", Resource: "certificaterequests"}
+	orderResource              = schema.GroupVersionResource{Group: "acme.cert-manager.io", Version: "v1", Resource: "orders"}
+)
+
+// CertificateStatus is how far cert-manager got issuing a domain's certificate.
+type CertificateStatus struct {
+	Ready   bool
+	Failed  bool   // cert-manager gave up on the current attempt
+	Message string // What cert-manager last reported
+}
+
+// ManagesCertificates reports whether the manager creates cert-manager Certificates itself instead of leaving
+// them to cert-manager's ingress-shim or gateway-shim.
+func (c *KubeClient) ManagesCertificates() bool {
+	return c.certificates.Mode == "explicit"
+}
+
+// IssuesCertificate reports whether cert-manager issues the domain's certificate into its TLS secret, so there is
+// a Certificate named after the secret to follow. It is created by the manager in explicit mode, otherwise by
+// ingress-shim or gateway-shim. Traefik resolvers and the OpenShift add-on don't create one.
+func (c *KubeClient) IssuesCertificate(job jobs.VanityDomain) bool {
+	if job.ProvidedCertificate != nil {
+		return false
+	}
+
+	if c.ManagesCertificates() {
+		return true
+	}
+
+	if c.CertManagerIssuer == "" {
+		return false
+	}
+
+	switch p := c.routing.(type) {
+	case *ingressProvider:
+		return true
+	case *gatewayProvider:
+		return p.config.TLS == "listener"
+	default:
+		return false
+	}
+}
+
+// SetCertificate creates or updates the cert-manager Certificate for a domain with the certificate profile of
+// tenant. cert-manager issues it into the domain's TLS secret, which carries the manager's ownership labels.
+func (c *KubeClient) SetCertificate(ctx context.Context, referenceID string, tenant string, job jobs.VanityDomain) error {
+	certificate, err := c.desiredCertificate(referenceID, tenant, job)
+	if err != nil {
+		return err
+	}
+
+	if err := c.applyUnstructured(ctx, certificateResource, certificate, job); err != nil {
+		return fmt.Errorf("failed to set certificate for vanity domain %s: %w", job.VanityDomain, err)
+	}
+
+	return nil
+}
+
+// desiredCertificate builds the Certificate SetCertificate applies, the reconciler compares the live one with it.
+func (c *KubeClient) desiredCertificate(referenceID string, tenant string, job jobs.VanityDomain) (*unstructured.Unstructured, error) {
+	profile := c.certificates.Profile(tenant)
+
+	labels, annotations, err := c.ownershipMetadata(referenceID, job)
+	if err != nil {
+		return nil, err
+	}
+
+	spec := map[string]interface{}{
+		"secretName": tlsSecretName(job),
+		"dnsNames":   []interface{}{job.VanityDomain},
+		"issuerRef": map[string]interface{}{
+			"name":  profile.IssuerRef.Name,
+			"kind":  profile.IssuerRef.Kind,
+			"group": profile.IssuerRef.Group,
+		},
+		"secretTemplate": map[string]interface{}{
+			"labels": toUnstructuredMap(labels),
+		},
+	}
+
+	if profile.PrivateKey.Algorithm != "" || profile.PrivateKey.Size != 0 {
+		privateKey := map[string]interface{}{}
+		if profile.PrivateKey.Algorithm != "" {
+			privateKey["algorithm"] = profile.PrivateKey.Algorithm
+		}
+		if profile.PrivateKey.Size != 0 {
+			privateKey["size"] = int64(profile.PrivateKey.Size)
+		}
+		spec["privateKey"] = privateKey
+	}
+
+	if profile.Duration != 0 {
+		spec["duration"] = profile.Duration.String()
+	}
+
+	if profile.RenewBefore != 0 {
+		spec["renewBefore"] = profile.RenewBefore.String()
+	}
+
+	certificate := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": certificateResource.GroupVersion().String(),
+		"kind":       "Certificate",
+		"metadata": map[string]interface{}{
+			"name":        tlsSecretName(job),
+			"namespace":   c.Namespace,
+			"labels":      toUnstructuredMap(labels),
+			"annotations": toUnstructuredMap(annotations),
+		},
+		"spec": spec,
+	}}
+
+	return certificate, nil
+}
+
+// UnSetCertificate deletes the cert-manager Certificate of a domain, a missing one is not an error. The issued
+// secret is left to UnSetTLS.
+func (c *KubeClient) UnSetCertificate(ctx context.Context, job jobs.VanityDomain) error {
+	if err := c.deleteUnstructured(ctx, certificateResource, tlsSecretName(job), job); err != nil {
+		return fmt.Errorf("failed to remove certificate for vanity domain %s: %w", job.VanityDomain, err)
+	}
+
+	return nil
+}
+
+// GetCertificateStatus reads the cert-manager Certificate of a domain and, while it isn't ready, its newest
+// CertificateRequest and ACME Order to say what issuance is waiting on or why it failed.
+func (c *KubeClient) GetCertificateStatus(ctx context.Context, job jobs.VanityDomain) (CertificateStatus, error) {
+	name := tlsSecretName(job)
+
+	cert, err := c.dynamic.Resource(certificateResource).Namespace(c.Namespace).Get(ctx, name, metaV1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return CertificateStatus{Message: fmt.Sprintf("waiting for cert-manager to create Certificate %s/%s", c.Namespace, name)}, nil
+	}
+	if err != nil {
+		return CertificateStatus{}, fmt.Errorf("failed to get certificate for vanity domain %s: %v", job.VanityDomain, err)
+	}
+
+	ready := findCondition(cert, "Ready")
+	if ready.Status == "True" {
+		return CertificateStatus{Ready: true, Message: ready.Message}, nil
+	}
+
+	// cert-manager marks a failed attempt on the Certificate and backs off before the next one
+	if issuing := findCondition(cert, "Issuing"); issuing.Status == "False" && issuing.Reason == "Failed" {
+		return CertificateStatus{Failed: true, Message: issuing.describe()}, nil
+	}
+
+	status := CertificateStatus{Message: ready.describe()}
+	if status.Message == "" {
+		status.Message = fmt.Sprintf("Certificate %s/%s is being issued", c.Namespace, name)
+	}
+
+	request, err := c.latestCertificateRequest(ctx, job)
+	if err != nil || request == nil {
+		return status, err
+	}
+
+	if denied := findCondition(request, "Denied"); denied.Status == "True" {
+		return CertificateStatus{Failed: true, Message: denied.describe()}, nil
+	}
+
+	if requestReady := findCondition(request, "Ready"); requestReady.Status == "False" {
+		if requestReady.Reason == "Failed" {
+			return CertificateStatus{Failed: true, Message: requestReady.describe()}, nil
+		}
+		status.Message = requestReady.describe()
+	}
+
+	order, err := c.requestOrder(ctx, job, request.GetName())
+	if err != nil || order == nil {
+		return status, err
+	}
+
+	state, _, _ := unstructured.NestedString(order.Object, "status", "state")
+	reason, _, _ := unstructured.NestedString(order.Object, "status", "reason")
+
+	switch state {
+	case "invalid", "errored":
+		return CertificateStatus{Failed: true, Message: fmt.Sprintf("ACME order %s is %s: %s", order.GetName(), state, reason)}, nil
+	case "":
+	default:
+		status.Message = fmt.Sprintf("ACME order %s is %s", order.GetName(), state)
+	}
+
+	return status, nil
+}
+
+// domainSelector selects the cert-manager objects of a domain. cert-manager copies the labels of an Ingress or
+// Gateway to the Certificate it creates, and those of a Certificate to its CertificateRequests and ACME Orders.
+func domainSelector(job jobs.VanityDomain) metaV1.ListOptions {
+	return metaV1.ListOptions{LabelSelector: fmt.Sprintf("%s=%s", DomainLabel, routeName(job))}
+}
+
+// latestCertificateRequest returns the request for the newest revision of the domain's Certificate, nil when there
+// is none.
+func (c *KubeClient) latestCertificateRequest(ctx context.Context, job jobs.VanityDomain) (*unstructured.Unstructured, error) {
+	certificate := tlsSecretName(job)
+
+	requests, err := c.dynamic.Resource(certificateRequestResource).Namespace(c.Namespace).List(ctx, domainSelector(job))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list certificaterequests: %v", err)
+	}
+
+	var latest *unstructured.Unstructured
+	latestRevision := -1
+	for i, request := range requests.Items {
+		annotations := request.GetAnnotations()
+		if annotations[certManagerCertificateAnnotation] != certificate {
+			continue
+		}
+
+		revision, _ := strconv.Atoi(annotations[certManagerRevisionAnnotation])
+		if revision > latestRevision {
+			latest = &requests.Items[i]
+			latestRevision = revision
+		}
+	}
+
+	return latest, nil
+}
+
+// requestOrder returns the ACME Order created for a CertificateRequest of the domain, nil when the issuer isn't
+// ACME.
+func (c *KubeClient) requestOrder(ctx context.Context, job jobs.VanityDomain, request string) (*unstructured.Unstructured, error) {
+	orders, err := c.dynamic.Resource(orderResource).Namespace(c.Namespace).List(ctx, domainSelector(job))
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to list orders: %v", err)
+	}
+
+	for i, order := range orders.Items {
+		for _, owner := range order.GetOwnerReferences() {
+			if owner.Kind == "CertificateRequest" && owner.Name == request {
+				return &orders.Items[i], nil
+			}
+		}
+	}
+
+	return nil, nil
+}
+
+type condition struct {
+	Status  string
+	Reason  string
+	Message string
+}
+
+func (c condition) describe() string {
+	if c.Reason == "" {
+		return c.Message
+	}
+
+	if c.Message == "" {
+		return c.Reason
+	}
+
+	return fmt.Sprintf("%s: %s", c.Reason, c.Message)
+}
+
+// findCondition returns a status condition of a cert-manager object, empty when it isn't set.
+func findCondition(obj *unstructured.Unstructured, conditionType string) condition {
+	conditions, _, _ := unstructured.NestedSlice(obj.Object, "status", "conditions")
+	for _, item := range conditions {
+		c, ok := item.(map[string]interface{})
+		if !ok || c["type"] != conditionType {
+			continue
+		}
+
+		found := condition{}
+		found.Status, _ = c["status"].(string)
+		found.Reason, _ = c["reason"].(string)
+		found.Message, _ = c["message"].(string)
+		return found
+	}
+
+	return condition{}
+}
@@ -0,0 +1,183 @@
+package kubernetes
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/geekgonecrazy/vanityDomainManager/config"
+	"github.com/geekgonecrazy/vanityDomainManager/jobs"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	clienttesting "k8s.io/client-go/testing"
+)
+
+func certManagerObject(resource schema.GroupVersionResource, kind string, name string, status map[string]interface{}) *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": resource.GroupVersion().String(),
+		"kind":       kind,
+		"metadata":   map[string]interface{}{"name": name, "namespace": "vanity"},
+		"status":     status,
+	}}
+}
+
+func conditions(conditionType string, status string, reason string, message string) map[string]interface{} {
+	return map[string]interface{}{"conditions": []interface{}{
+		map[string]interface{}{"type": conditionType, "status": status, "reason": reason, "message": message},
+	}}
+}
+
+func TestCertificateStatus(t *testing.T) {
+	c := newDynamicTestClient(t)
+	c.routing = &ingressProvider{kube: c}
+	ctx := context.Background()
+	domain := jobs.VanityDomain{VanityDomain: "example.org"}
+	name := tlsSecretName(domain)
+
+	if !c.IssuesCertificate(domain) {
+		t.Fatalf("Expected cert-manager to issue the certificate of an ingress without a provided one")
+	}
+
+	if c.IssuesCertificate(jobs.VanityDomain{VanityDomain: "example.org", ProvidedCertificate: &jobs.DomainCustomCert{}}) {
+		t.Errorf("Expected no cert-manager certificate for a provided one")
+	}
+
+	status, err := c.GetCertificateStatus(ctx, domain)
+	if err != nil || status.Ready || status.Failed || !strings.Contains(status.Message, "waiting for cert-manager") {
+		t.Fatalf("Unexpected status before the certificate exists: %+v (%v)", status, err)
+	}
+
+	certificates := c.dynamic.Resource(certificateResource).Namespace("vanity")
+	cert := certManagerObject(certificateResource, "Certificate", name, conditions("Ready", "False", "DoesNotExist", "Issuing certificate as Secret does not exist"))
+	if _, err := certificates.Create(ctx, cert, metaV1.CreateOptions{}); err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+
+	request := certManagerObject(certificateRequestResource, "CertificateRequest", name+"-1", conditions("Ready", "False", "Pending", "Waiting on certificate issuance"))
+	request.SetAnnotations(map[string]string{certManagerCertificateAnnotation: name, certManagerRevisionAnnotation: "1"})
+	request.SetLabels(map[string]string{DomainLabel: routeName(domain)})
+	if _, err := c.dynamic.Resource(certificateRequestResource).Namespace("vanity").Create(ctx, request, metaV1.CreateOptions{}); err != nil {
+		t.Fatalf("Failed to create CertificateRequest: %v", err)
+	}
+
+	order := certManagerObject(orderResource, "Order", name+"-1-123", map[string]interface{}{"state": "pending"})
+	order.SetOwnerReferences([]metaV1.OwnerReference{{Kind: "CertificateRequest", Name: name + "-1", APIVersion: "cert-manager.io/v1"}})
+	order.SetLabels(map[string]string{DomainLabel: routeName(domain)})
+	orders := c.dynamic.Resource(orderResource).Namespace("vanity")
+	if _, err := orders.Create(ctx, order, metaV1.CreateOptions{}); err != nil {
+		t.Fatalf("Failed to create order: %v", err)
+	}
+
+	status, _ = c.GetCertificateStatus(ctx, domain)
+	if status.Ready || status.Failed || status.Message != "ACME order "+name+"-1-123 is pending" {
+		t.Errorf("Unexpected status while the order is pending: %+v", status)
+	}
+
+	// Only the domain's own requests and orders are listed, not every one in the namespace
+	for _, action := range c.dynamic.(*dynamicfake.FakeDynamicClient).Actions() {
+		list, ok := action.(clienttesting.ListAction)
+		if !ok || list.GetResource() == certificateResource {
+			continue
+		}
+
+		if selector := list.GetListRestrictions().Labels.String(); selector != DomainLabel+"="+routeName(domain) {
+			t.Errorf("Expected %s to be listed for the domain only, got selector %q", list.GetResource().Resource, selector)
+		}
+	}
+
+	// The HTTP-01 challenge fails
+	order.Object["status"] = map[string]interface{}{"state": "invalid", "reason": "Failed to finalize order: 403 urn:ietf:params:acme:error:unauthorized"}
+	if _, err := orders.Update(ctx, order, metaV1.UpdateOptions{}); err != nil {
+		t.Fatalf("Failed to update order: %v", err)
+	}
+
+	status, _ = c.GetCertificateStatus(ctx, domain)
+	if !status.Failed || !strings.Contains(status.Message, "unauthorized") {
+		t.Errorf("Expected the order failure, got %+v", status)
+	}
+
+	cert.Object["status"] = conditions("Ready", "True", "Ready", "Certificate is up to date and has not expired")
+	if _, err := certificates.Update(ctx, cert, metaV1.UpdateOptions{}); err != nil {
+		t.Fatalf("Failed to update certificate: %v", err)
+	}
+
+	status, _ = c.GetCertificateStatus(ctx, domain)
+	if !status.Ready {
+		t.Errorf("Expected the certificate to be ready, got %+v", status)
+	}
+}
+
+func TestExplicitCertificates(t *testing.T) {
+	c := newDynamicTestClient(t)
+	c.client = fake.NewClientset()
+	c.routing = &ingressProvider{kube: c}
+	c.certificates = config.CertificatesConfig{
+		Mode: "explicit",
+		CertificateProfile: config.CertificateProfile{
+			IssuerRef: config.CertificateIssuerRef{Name: "letsencrypt", Kind: "ClusterIssuer", Group: "cert-manager.io"},
+			Duration:  90 * 24 * time.Hour,
+		},
+		Tenants: map[string]config.CertificateProfile{
+			"acme": {
+				IssuerRef:  config.CertificateIssuerRef{Name: "acme-ca", Kind: "Issuer"},
+				PrivateKey: config.CertificatePrivateKey{Algorithm: "ECDSA", Size: 384},
+			},
+		},
+	}
+	ctx := context.Background()
+	domain := jobs.VanityDomain{VanityDomain: "example.org"}
+
+	if err := c.SetCertificate(ctx, "ref-1", "acme", domain); err != nil {
+		t.Fatalf("Failed to set certificate: %v", err)
+	}
+
+	if err := c.SetVanityDomain(ctx, "ref-1", domain); err != nil {
+		t.Fatalf("Failed to set vanity domain: %v", err)
+	}
+
+	cert, err := c.dynamic.Resource(certificateResource).Namespace("vanity").Get(ctx, tlsSecretName(domain), metaV1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Failed to get certificate: %v", err)
+	}
+
+	issuer, _, _ := unstructured.NestedStringMap(cert.Object, "spec", "issuerRef")
+	if issuer["name"] != "acme-ca" || issuer["kind"] != "Issuer" || issuer["group"] != "cert-manager.io" {
+		t.Errorf("Expected the tenant's issuer, got %v", issuer)
+	}
+
+	algorithm, _, _ := unstructured.NestedString(cert.Object, "spec", "privateKey", "algorithm")
+	size, _, _ := unstructured.NestedInt64(cert.Object, "spec", "privateKey", "size")
+	duration, _, _ := unstructured.NestedString(cert.Object, "spec", "duration")
+	if algorithm != "ECDSA" || size != 384 || duration != "2160h0m0s" {
+		t.Errorf("Unexpected key %s/%d or duration %s", algorithm, size, duration)
+	}
+
+	if secretName, _, _ := unstructured.NestedString(cert.Object, "spec", "secretName"); secretName != tlsSecretName(domain) {
+		t.Errorf("Expected the domain's TLS secret, got %s", secretName)
+	}
+
+	if cert.GetLabels()[ManagedByLabel] != ManagedByValue {
+		t.Errorf("Expected the certificate to be owned by the manager, got %v", cert.GetLabels())
+	}
+
+	ingress, _ := c.client.NetworkingV1().Ingresses("vanity").Get(ctx, routeName(domain), metaV1.GetOptions{})
+	if _, ok := ingress.Annotations["cert-manager.io/cluster-issuer"]; ok {
+		t.Errorf("Expected no ingress-shim annotation when certificates are explicit")
+	}
+
+	if !c.IssuesCertificate(domain) {
+		t.Errorf("Expected explicit certificates to be awaited")
+	}
+
+	if err := c.UnSetCertificate(ctx, domain); err != nil {
+		t.Fatalf("Failed to unset certificate: %v", err)
+	}
+
+	if _, err := c.dynamic.Resource(certificateResource).Namespace("vanity").Get(ctx, tlsSecretName(domain), metaV1.GetOptions{}); err == nil {
+		t.Errorf("Expected the certificate to be removed")
+	}
+}
@@ -0,0 +1,277 @@
+package kubernetes
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/geekgonecrazy/vanityDomainManager/config"
+	"github.com/geekgonecrazy/vanityDomainManager/jobs"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/util/retry"
+)
+
+const gatewayGroup = "gateway.networking.k8s.io"
+
+var (
+	httpRouteResource      = schema.GroupVersionResource{Group: gatewayGroup, Version: "v1", Resource: "httproutes"}
+	gatewayResource        = schema.GroupVersionResource{Group: gatewayGroup, Version: "v1", Resource: "gateways"}
+	referenceGrantResource = schema.GroupVersionResource{Group: gatewayGroup, Version: "v1beta1", Resource: "referencegrants"}
+)
+
+// gatewayProvider exposes vanity domains with Gateway API HTTPRoutes attached to a shared Gateway.
+type gatewayProvider struct {
+	kube   *KubeClient
+	config config.GatewayConfig
+}
+
+// SetRoute creates or updates the HTTPRoute for the vanity domain and, in listener mode, the HTTPS listener on the
+// Gateway that terminates TLS with the domain's secret.
+func (p *gatewayProvider) SetRoute(ctx context.Context, referenceID string, job jobs.VanityDomain) error {
+	metadata, err := p.kube.managedObjectMeta(routeName(job), referenceID, job)
+	if err != nil {
+		return err
+	}
+
+	parentRef := map[string]interface{}{
+		"group":     gatewayGroup,
+		"kind":      "Gateway",
+		"name":      p.config.Name,
+		"namespace": p.config.Namespace,
+	}
+
+	if p.config.SectionName != "" {
+		parentRef["sectionName"] = p.config.SectionName
+	}
+
+	rules := []interface{}{}
+	for _, r := range p.kube.domainRoutes(job) {
+		rule := map[string]interface{}{
+			"backendRefs": []interface{}{
+				map[string]interface{}{
+					"name": r.ServiceName,
+					"port": int64(r.ServicePort),
+				},
+			},
+		}
+
+		// Without a path the rule matches every request
+		if r.Path != "" {
+			matchType := "PathPrefix"
+			if r.PathType == "Exact" {
+				matchType = "Exact"
+			}
+
+			rule["matches"] = []interface{}{
+				map[string]interface{}{
+					"path": map[string]interface{}{"type": matchType, "value": r.Path},
+				},
+			}
+		}
+
+		rules = append(rules, rule)
+	}
+
+	route := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": httpRouteResource.GroupVersion().String(),
+		"kind":       "HTTPRoute",
+		"metadata":   metadata,
+		"spec": map[string]interface{}{
+			"parentRefs": []interface{}{parentRef},
+			"hostnames":  []interface{}{job.VanityDomain},
+			"rules":      rules,
+		},
+	}}
+
+	if err := p.kube.applyUnstructured(ctx, httpRouteResource, route, job); err != nil {
+		return fmt.Errorf("failed to set httproute for vanity domain %s: %w", job.VanityDomain, err)
+	}
+
+	if p.config.TLS != "listener" {
+		return nil
+	}
+
+	if p.config.Namespace != p.kube.Namespace {
+		if err := p.setReferenceGrant(ctx, referenceID, job); err != nil {
+			return err
+		}
+	}
+
+	return p.setListener(ctx, job)
+}
+
+// UnSetRoute removes the HTTPRoute and everything SetRoute attached to the Gateway for the domain.
+func (p *gatewayProvider) UnSetRoute(ctx context.Context, name string, job jobs.VanityDomain) error {
+	if p.config.TLS == "listener" {
+		// The listener and grant are named after the route, legacy listener names were lowercased
+		if err := p.removeListener(ctx, job, strings.ToLower(name)); err != nil {
+			return err
+		}
+
+		if p.config.Namespace != p.kube.Namespace {
+			if err := p.kube.deleteUnstructured(ctx, referenceGrantResource, name+tlsSecretSuffix, job); err != nil {
+				return fmt.Errorf("failed to remove referencegrant for vanity domain %s: %w", job.VanityDomain, err)
+			}
+		}
+	}
+
+	if err := p.kube.deleteUnstructured(ctx, httpRouteResource, name, job); err != nil {
+		return fmt.Errorf("failed to remove httproute for vanity domain %s: %w", job.VanityDomain, err)
+	}
+
+	return nil
+}
+
+// ListManagedDomains returns every vanity domain that has an HTTPRoute written by the manager.
+func (p *gatewayProvider) ListManagedDomains(ctx context.Context) ([]ManagedDomain, error) {
+	return p.kube.listManagedUnstructured(ctx, httpRouteResource, "HTTPRoute")
+}
+
+// DisableRoute keeps the HTTPRoute but marks it with the given state and drops the domain's listener, so nothing
+// keeps requesting a certificate for it.
+func (p *gatewayProvider) DisableRoute(ctx context.Context, job jobs.VanityDomain, state string) error {
+	if err := p.kube.markUnstructured(ctx, httpRouteResource, routeName(job), state); err != nil {
+		return fmt.Errorf("failed to disable httproute for vanity domain %s: %w", job.VanityDomain, err)
+	}
+
+	if p.config.TLS == "listener" {
+		return p.removeListener(ctx, job, listenerName(job))
+	}
+
+	return nil
+}
+
+// setListener adds or replaces the HTTPS listener for the domain on the configured Gateway.
+func (p *gatewayProvider) setListener(ctx context.Context, job jobs.VanityDomain) error {
+	allowedNamespaces := map[string]interface{}{"from": "Same"}
+	if p.config.Namespace != p.kube.Namespace {
+		allowedNamespaces = map[string]interface{}{
+			"from": "Selector",
+			"selector": map[string]interface{}{
+				"matchLabels": map[string]interface{}{
+					"kubernetes.io/metadata.name": p.kube.Namespace,
+				},
+			},
+		}
+	}
+
+	listener := map[string]interface{}{
+		"name":     listenerName(job),
+		"hostname": job.VanityDomain,
+		"port":     int64(p.config.ListenerPort),
+		"protocol": "HTTPS",
+		"tls": map[string]interface{}{
+			"mode": "Terminate",
+			"certificateRefs": []interface{}{
+				map[string]interface{}{
+					"kind":      "Secret",
+					"name":      tlsSecretName(job),
+					"namespace": p.kube.Namespace,
+				},
+			},
+		},
+		"allowedRoutes": map[string]interface{}{
+			"namespaces": allowedNamespaces,
+		},
+	}
+
+	return p.updateListeners(ctx, job, func(listeners []interface{}) []interface{} {
+		return append(withoutListener(listeners, listenerName(job)), listener)
+	})
+}
+
+// removeListener removes the domain's listener called name from the Gateway, if it is there.
+func (p *gatewayProvider) removeListener(ctx context.Context, job jobs.VanityDomain, name string) error {
+	return p.updateListeners(ctx, job, func(listeners []interface{}) []interface{} {
+		return withoutListener(listeners, name)
+	})
+}
+
+// updateListeners rewrites the Gateway's listeners, retrying when another writer changed it in between.
+func (p *gatewayProvider) updateListeners(ctx context.Context, job jobs.VanityDomain, mutate func([]interface{}) []interface{}) error {
+	gateways := p.kube.dynamic.Resource(gatewayResource).Namespace(p.config.Namespace)
+
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		gateway, err := gateways.Get(ctx, p.config.Name, metaV1.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		listeners, _, err := unstructured.NestedSlice(gateway.Object, "spec", "listeners")
+		if err != nil {
+			return err
+		}
+
+		if err := unstructured.SetNestedSlice(gateway.Object, mutate(listeners), "spec", "listeners"); err != nil {
+			return err
+		}
+
+		_, err = gateways.Update(ctx, gateway, metaV1.UpdateOptions{FieldManager: FieldManager})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update listeners of gateway %s/%s for vanity domain %s: %v", p.config.Namespace, p.config.Name, job.VanityDomain, err)
+	}
+
+	return nil
+}
+
+// setReferenceGrant lets a Gateway in another namespace use the domain's TLS secret.
+func (p *gatewayProvider) setReferenceGrant(ctx context.Context, referenceID string, job jobs.VanityDomain) error {
+	labels, annotations, err := p.kube.ownershipMetadata(referenceID, job)
+	if err != nil {
+		return err
+	}
+
+	grant := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": referenceGrantResource.GroupVersion().String(),
+		"kind":       "ReferenceGrant",
+		"metadata": map[string]interface{}{
+			"name":        tlsSecretName(job),
+			"namespace":   p.kube.Namespace,
+			"labels":      toUnstructuredMap(labels),
+			"annotations": toUnstructuredMap(annotations),
+		},
+		"spec": map[string]interface{}{
+			"from": []interface{}{
+				map[string]interface{}{
+					"group":     gatewayGroup,
+					"kind":      "Gateway",
+					"namespace": p.config.Namespace,
+				},
+			},
+			"to": []interface{}{
+				map[string]interface{}{
+					"group": "",
+					"kind":  "Secret",
+					"name":  tlsSecretName(job),
+				},
+			},
+		},
+	}}
+
+	if err := p.kube.applyUnstructured(ctx, referenceGrantResource, grant, job); err != nil {
+		return fmt.Errorf("failed to set referencegrant for vanity domain %s: %w", job.VanityDomain, err)
+	}
+
+	return nil
+}
+
+func withoutListener(listeners []interface{}, name string) []interface{} {
+	kept := []interface{}{}
+	for _, listener := range listeners {
+		if l, ok := listener.(map[string]interface{}); ok && l["name"] == name {
+			continue
+		}
+		kept = append(kept, listener)
+	}
+
+	return kept
+}
+
+// listenerName is the Gateway listener for a domain, named like its other objects.
+func listenerName(job jobs.VanityDomain) string {
+	return routeName(job)
+}
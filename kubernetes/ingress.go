@@ -0,0 +1,184 @@
+package kubernetes
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/geekgonecrazy/vanityDomainManager/jobs"
+	networkingV1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	networkingApply "k8s.io/client-go/applyconfigurations/networking/v1"
+)
+
+// ingressProvider exposes vanity domains with networking.k8s.io/v1 Ingresses, certificates come from
+// cert-manager's ingress-shim unless one was provided.
+type ingressProvider struct {
+	kube *KubeClient
+}
+
+// SetRoute applies the Ingress for the provided vanity domain. Annotations other controllers set on it are kept.
+func (p *ingressProvider) SetRoute(ctx context.Context, referenceID string, job jobs.VanityDomain) error {
+	ingress, err := p.desiredIngress(referenceID, job)
+	if err != nil {
+		return err
+	}
+
+	ingresses := p.kube.client.NetworkingV1().Ingresses(p.kube.Namespace)
+
+	existingIngress, err := ingresses.Get(ctx, ingress.Name, metaV1.GetOptions{})
+	switch {
+	case apierrors.IsNotFound(err):
+	case err != nil:
+		return fmt.Errorf("failed to get ingress for vanity domain %s: %v", job.VanityDomain, err)
+	default:
+		if err := p.kube.checkOwnership("Ingress", existingIngress.Name, existingIngress.Labels, job); err != nil {
+			return err
+		}
+
+		err := upgradeManagedFields(existingIngress, func(data []byte, opts metaV1.PatchOptions) error {
+			_, err := ingresses.Patch(ctx, ingress.Name, types.JSONPatchType, data, opts)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to upgrade field managers of ingress for vanity domain %s: %v", job.VanityDomain, err)
+		}
+	}
+
+	applyConfiguration := networkingApply.Ingress(ingress.Name, ingress.Namespace)
+	if err := toApplyConfiguration(ingress, applyConfiguration); err != nil {
+		return fmt.Errorf("failed to build ingress for vanity domain %s: %v", job.VanityDomain, err)
+	}
+
+	if _, err := ingresses.Apply(ctx, applyConfiguration, applyOptions(ctx, job)); err != nil {
+		return fmt.Errorf("failed to apply ingress for vanity domain %s: %w", job.VanityDomain, applyError("Ingress", ingress.Namespace, ingress.Name, err))
+	}
+
+	return nil
+}
+
+// desiredIngress builds the Ingress SetRoute writes for the vanity domain.
+func (p *ingressProvider) desiredIngress(referenceID string, job jobs.VanityDomain) (*networkingV1.Ingress, error) {
+	labels, annotations, err := p.kube.objectMetadata(referenceID, job)
+	if err != nil {
+		return nil, err
+	}
+
+	paths := []networkingV1.HTTPIngressPath{}
+	for _, route := range p.kube.domainRoutes(job) {
+		pathType := networkingV1.PathType(route.PathType)
+		paths = append(paths, networkingV1.HTTPIngressPath{
+			Path:     route.Path,
+			PathType: &pathType,
+			Backend: networkingV1.IngressBackend{
+				Service: &networkingV1.IngressServiceBackend{
+					Name: route.ServiceName,
+					Port: networkingV1.ServiceBackendPort{
+						Number: route.ServicePort,
+					},
+				},
+			},
+		})
+	}
+
+	ingress := &networkingV1.Ingress{
+		ObjectMeta: metaV1.ObjectMeta{
+			Name:        routeName(job),
+			Namespace:   p.kube.Namespace,
+			Labels:      labels,
+			Annotations: annotations,
+		},
+		Spec: networkingV1.IngressSpec{
+			Rules: []networkingV1.IngressRule{
+				{
+					Host: job.VanityDomain,
+					IngressRuleValue: networkingV1.IngressRuleValue{
+						HTTP: &networkingV1.HTTPIngressRuleValue{
+							Paths: paths,
+						},
+					},
+				},
+			},
+			TLS: []networkingV1.IngressTLS{
+				{
+					Hosts:      []string{job.VanityDomain},
+					SecretName: tlsSecretName(job), // This should be created by cert-manager
+				},
+			},
+		},
+	}
+
+	if p.kube.IngressClassName != "" {
+		ingress.Spec.IngressClassName = &p.kube.IngressClassName
+	}
+
+	if job.ProvidedCertificate == nil && p.kube.CertManagerIssuer != "" && !p.kube.ManagesCertificates() {
+		ingress.ObjectMeta.Annotations["cert-manager.io/cluster-issuer"] = p.kube.CertManagerIssuer
+	}
+
+	return ingress, nil
+}
+
+// UnSetRoute deletes an Ingress resource in the Kubernetes cluster for the provided vanity domain.
+func (p *ingressProvider) UnSetRoute(ctx context.Context, name string, job jobs.VanityDomain) error {
+	ingress, err := p.kube.client.NetworkingV1().Ingresses(p.kube.Namespace).Get(ctx, name, metaV1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := p.kube.checkOwnership("Ingress", ingress.Name, ingress.Labels, job); err != nil {
+		return err
+	}
+
+	err = p.kube.client.NetworkingV1().Ingresses(p.kube.Namespace).Delete(ctx, ingress.Name, deleteIfUnchanged(ingress))
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+
+	return nil
+}
+
+// ListManagedDomains returns every vanity domain that has an Ingress written by the manager.
+func (p *ingressProvider) ListManagedDomains(ctx context.Context) ([]ManagedDomain, error) {
+	ingresses, err := p.kube.client.NetworkingV1().Ingresses(p.kube.Namespace).List(ctx, metaV1.ListOptions{
+		LabelSelector: fmt.Sprintf("%s=%s", ManagedByLabel, ManagedByValue),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list managed ingresses: %v", err)
+	}
+
+	domains := []ManagedDomain{}
+	for _, ingress := range ingresses.Items {
+		if managed, ok := managedDomain("Ingress", ingress.Name, ingress.Annotations); ok {
+			domains = append(domains, managed)
+		}
+	}
+
+	return domains, nil
+}
+
+// DisableRoute keeps the Ingress in place but marks it with the given state and stops cert-manager from
+// attempting issuance for it.
+func (p *ingressProvider) DisableRoute(ctx context.Context, job jobs.VanityDomain, state string) error {
+	ingress, err := p.kube.client.NetworkingV1().Ingresses(p.kube.Namespace).Get(ctx, routeName(job), metaV1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to get ingress for vanity domain %s: %v", job.VanityDomain, err)
+	}
+
+	if ingress.Annotations == nil {
+		ingress.Annotations = map[string]string{}
+	}
+
+	delete(ingress.Annotations, "cert-manager.io/cluster-issuer")
+	ingress.Annotations[StateAnnotation] = state
+
+	if _, err := p.kube.client.NetworkingV1().Ingresses(p.kube.Namespace).Update(ctx, ingress, metaV1.UpdateOptions{FieldManager: FieldManager}); err != nil {
+		return fmt.Errorf("failed to disable ingress for vanity domain %s: %v", job.VanityDomain, err)
+	}
+
+	return nil
+}
@@ -2,35 +2,72 @@ package kubernetes
 
 import (
 	"context"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"log"
-	"strings"
+	"text/template"
 
 	"github.com/geekgonecrazy/vanityDomainManager/config"
 	"github.com/geekgonecrazy/vanityDomainManager/jobs"
 	v1 "k8s.io/api/core/v1"
-	networkingV1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	coreApply "k8s.io/client-go/applyconfigurations/core/v1"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 )
 
+const (
+	ManagedByLabel        = "app.kubernetes.io/managed-by"
+	ManagedByValue        = "vanityDomainManager"
+	DomainSpecAnnotation  = "vanitydomainmanager.io/domain-spec"
+	ReferenceIDAnnotation = "vanitydomainmanager.io/reference-id"
+	StateAnnotation       = "vanitydomainmanager.io/state"
+	DomainAnnotation      = "vanitydomainmanager.io/domain"
+
+	// DomainLabel selects the objects of a domain by their name, a domain can be too long or not ASCII for a
+	// label value
+	DomainLabel = "Domain"
+)
+
 var kubeClient *KubeClient
 
+// ManagedDomain is a vanity domain recovered from a routing object written by the manager.
+type ManagedDomain struct {
+	Name        string // Name of the routing object
+	Domain      jobs.VanityDomain
+	ReferenceID string
+	State       string
+	Owner       string // Tenant whose certificate profile the domain's Certificate uses, only known to the registry
+}
+
 type KubeClient struct {
-	client            *kubernetes.Clientset
+	client            kubernetes.Interface
+	dynamic           dynamic.Interface
 	Namespace         string
 	CertManagerIssuer string
 	ServiceName       string
 	ServicePort       int32
+	IngressClassName  string
+	Environment       string // Recorded in the owner label so managers sharing a namespace leave each other's objects alone
+	routing           RoutingProvider
+	certificates      config.CertificatesConfig
+
+	labels              map[string]string
+	annotationTemplates map[string]*template.Template
+	annotationOverrides []string
 }
 
 func GetClient() *KubeClient {
 	return kubeClient
 }
 
-func NewClient(kubeconfig string, clusterConfig config.ClusterConfig) (err error) {
+func NewClient(kubeconfig string, environment string, clusterConfig config.ClusterConfig) (err error) {
 	var config *rest.Config
 
 	if kubeconfig != "" {
@@ -52,150 +89,169 @@ func NewClient(kubeconfig string, clusterConfig config.ClusterConfig) (err error
 		return fmt.Errorf("Failed to create clientset: %v", err)
 	}
 
+	dynamicClient, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return fmt.Errorf("Failed to create dynamic client: %v", err)
+	}
+
 	kubeClient = &KubeClient{
 		client:            clientset,
+		dynamic:           dynamicClient,
 		Namespace:         clusterConfig.Namespace,
 		CertManagerIssuer: clusterConfig.CertManagerIssuer,
 		ServiceName:       clusterConfig.ServiceName,
 		ServicePort:       clusterConfig.ServicePort,
+		IngressClassName:  clusterConfig.IngressClassName,
+		Environment:       environment,
+		certificates:      clusterConfig.Certificates,
+
+		labels:              clusterConfig.Labels,
+		annotationOverrides: clusterConfig.AllowedAnnotationOverrides,
 	}
 
+	kubeClient.annotationTemplates, err = parseAnnotationTemplates(clusterConfig.Annotations)
+	if err != nil {
+		return err
+	}
+
+	kubeClient.routing, err = newRoutingProvider(kubeClient, clusterConfig)
+
 	return err
 }
 
-// SetTLS creates or updates a TLS secret in the Kubernetes cluster for the provided vanity domain.
-func (c *KubeClient) SetTLS(ctx context.Context, job jobs.VanityDomain) error {
-	secret := &v1.Secret{
-		ObjectMeta: metaV1.ObjectMeta{
-			Name:      fmt.Sprintf("%s-tls-cert", safeDomainName(job.VanityDomain)),
-			Namespace: c.Namespace,
-			Labels: map[string]string{
-				"Domain":   job.VanityDomain,
-				"Provided": "true",
-			},
-		},
-		Type: v1.SecretTypeTLS,
-
-		Data: map[string][]byte{
-			"ca.crt":  []byte(""), // Nothing for now
-			"tls.key": []byte(job.ProvidedCertificate.Key),
-			"tls.crt": []byte(job.ProvidedCertificate.Cert),
-		},
-	}
-
-	existingSecret, err := c.client.CoreV1().Secrets(c.Namespace).Get(ctx, fmt.Sprintf("%s-tls-cert", safeDomainName(job.VanityDomain)), metaV1.GetOptions{})
+// SetTLS applies the TLS secret for the provided vanity domain. Annotations and labels other controllers set on
+// the secret are kept.
+func (c *KubeClient) SetTLS(ctx context.Context, referenceID string, job jobs.VanityDomain) error {
+	labels, annotations, err := c.ownershipMetadata(referenceID, job)
 	if err != nil {
-		log.Println(err)
+		return err
 	}
+	labels["Provided"] = "true"
 
-	if err != nil && strings.Contains(err.Error(), "not found") {
-		_, err := c.client.CoreV1().Secrets(c.Namespace).Create(ctx, secret, metaV1.CreateOptions{})
-		if err != nil {
+	secrets := c.client.CoreV1().Secrets(c.Namespace)
+	name := tlsSecretName(job)
+	opts := applyOptions(ctx, job)
+
+	existingSecret, err := secrets.Get(ctx, name, metaV1.GetOptions{})
+	switch {
+	case apierrors.IsNotFound(err):
+	case err != nil:
+		return fmt.Errorf("failed to get secret for vanity domain %s: %v", job.VanityDomain, err)
+	default:
+		if err := c.checkSecretOwnership(existingSecret, job); err != nil {
 			return err
 		}
-	} else {
-		existingSecret.ObjectMeta.Annotations = secret.ObjectMeta.Annotations
-		existingSecret.Labels = secret.Labels
-		existingSecret.Data = secret.Data
 
-		if _, err = c.client.CoreV1().Secrets(c.Namespace).Update(ctx, secret, metaV1.UpdateOptions{}); err != nil {
+		// A provided certificate replaces the one cert-manager issued, which cert-manager owns
+		if existingSecret.Annotations[certManagerCertificateAnnotation] == name {
+			opts.Force = true
+		}
+
+		err := upgradeManagedFields(existingSecret, func(data []byte, patchOpts metaV1.PatchOptions) error {
+			_, err := secrets.Patch(ctx, name, types.JSONPatchType, data, patchOpts)
 			return err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to upgrade field managers of secret for vanity domain %s: %v", job.VanityDomain, err)
 		}
 	}
 
+	secret := coreApply.Secret(name, c.Namespace).
+		WithLabels(labels).
+		WithAnnotations(annotations).
+		WithType(v1.SecretTypeTLS).
+		WithData(map[string][]byte{
+			"ca.crt":  []byte(""), // Nothing for now
+			"tls.key": []byte(job.ProvidedCertificate.Key),
+			"tls.crt": []byte(job.ProvidedCertificate.Cert),
+		})
+
+	if _, err := secrets.Apply(ctx, secret, opts); err != nil {
+		return fmt.Errorf("failed to apply secret for vanity domain %s: %w", job.VanityDomain, applyError("Secret", c.Namespace, name, err))
+	}
+
 	return nil
 }
 
 // UnSetTLS deletes a TLS secret in the Kubernetes cluster for the provided vanity domain.
 func (c *KubeClient) UnSetTLS(ctx context.Context, job jobs.VanityDomain) error {
-	err := c.client.CoreV1().Secrets(c.Namespace).Delete(ctx, fmt.Sprintf("%s-tls-cert", safeDomainName(job.VanityDomain)), metaV1.DeleteOptions{})
-	if err != nil && !strings.Contains(err.Error(), "not found") {
+	secret, err := c.client.CoreV1().Secrets(c.Namespace).Get(ctx, tlsSecretName(job), metaV1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := c.checkSecretOwnership(secret, job); err != nil {
+		return err
+	}
+
+	err = c.client.CoreV1().Secrets(c.Namespace).Delete(ctx, secret.Name, deleteIfUnchanged(secret))
+	if err != nil && !apierrors.IsNotFound(err) {
 		return err
 	}
 
 	return nil
 }
 
-// SetVanityDomain creates or updates an Ingress resource in the Kubernetes cluster for the provided vanity domain.
-func (c *KubeClient) SetVanityDomain(ctx context.Context, job jobs.VanityDomain) error {
-
-	var pathType networkingV1.PathType = networkingV1.PathTypeImplementationSpecific
-	ingress := &networkingV1.Ingress{
-		ObjectMeta: metaV1.ObjectMeta{
-			Name:        safeDomainName(job.VanityDomain),
-			Namespace:   c.Namespace,
-			Annotations: map[string]string{},
-		},
-		Spec: networkingV1.IngressSpec{
-			Rules: []networkingV1.IngressRule{
-				{
-					Host: job.VanityDomain,
-					IngressRuleValue: networkingV1.IngressRuleValue{
-						HTTP: &networkingV1.HTTPIngressRuleValue{
-							Paths: []networkingV1.HTTPIngressPath{
-								{
-									PathType: &pathType,
-									Backend: networkingV1.IngressBackend{
-										Service: &networkingV1.IngressServiceBackend{
-											Name: c.ServiceName,
-											Port: networkingV1.ServiceBackendPort{
-												Number: c.ServicePort,
-											},
-										},
-									},
-								},
-							},
-						},
-					},
-				},
-			},
-			TLS: []networkingV1.IngressTLS{
-				{
-					Hosts:      []string{job.VanityDomain},
-					SecretName: fmt.Sprintf("%s-tls-cert", safeDomainName(job.VanityDomain)), // This should be created by cert-manager
-				},
-			},
-		},
-	}
-
-	if job.ProvidedCertificate == nil && c.CertManagerIssuer != "" {
-		ingress.ObjectMeta.Annotations["cert-manager.io/cluster-issuer"] = c.CertManagerIssuer
-	}
-
-	existingIngress, err := c.client.NetworkingV1().Ingresses(c.Namespace).Get(ctx, ingress.Name, metaV1.GetOptions{})
+// GetCertificate returns the leaf certificate in the TLS secret of a vanity domain, whether it was provided or
+// issued by cert-manager. It returns nil when there is no certificate yet.
+func (c *KubeClient) GetCertificate(ctx context.Context, job jobs.VanityDomain) (*x509.Certificate, error) {
+	secret, err := c.client.CoreV1().Secrets(c.Namespace).Get(ctx, tlsSecretName(job), metaV1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
 	if err != nil {
-		log.Println(err)
+		return nil, err
 	}
 
-	if err != nil && strings.Contains(err.Error(), "not found") {
-		if _, err := c.client.NetworkingV1().Ingresses(c.Namespace).Create(ctx, ingress, metaV1.CreateOptions{}); err != nil {
-			return fmt.Errorf("failed to create ingress for vanity domain %s: %v", job.VanityDomain, err)
-		}
-	} else {
-		existingIngress.ObjectMeta.Annotations = ingress.ObjectMeta.Annotations
-		existingIngress.Labels = ingress.Labels
-		existingIngress.Spec = ingress.Spec
+	block, _ := pem.Decode(secret.Data["tls.crt"])
+	if block == nil {
+		return nil, nil
+	}
 
-		if _, err = c.client.NetworkingV1().Ingresses(c.Namespace).Update(ctx, existingIngress, metaV1.UpdateOptions{}); err != nil {
-			return err
-		}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse certificate for %s: %v", job.VanityDomain, err)
 	}
 
-	return nil
+	return cert, nil
 }
 
-// UnSetCustomDomain deletes an Ingress resource in the Kubernetes cluster for the provided vanity domain.
-func (c *KubeClient) UnSetVanityDomain(ctx context.Context, job jobs.VanityDomain) error {
-	err := c.client.NetworkingV1().Ingresses(c.Namespace).Delete(ctx, safeDomainName(job.VanityDomain), metaV1.DeleteOptions{})
-	if err != nil && !strings.Contains(err.Error(), "not found") {
-		return err
+// managedDomain recovers a managed domain from the annotations the manager writes on its routing objects.
+func managedDomain(kind string, name string, annotations map[string]string) (ManagedDomain, bool) {
+	spec, ok := annotations[DomainSpecAnnotation]
+	if !ok {
+		log.Printf("%s %s is missing the %s annotation, skipping", kind, name, DomainSpecAnnotation)
+		return ManagedDomain{}, false
 	}
 
-	return nil
+	var domain jobs.VanityDomain
+	if err := json.Unmarshal([]byte(spec), &domain); err != nil {
+		log.Printf("%s %s has an invalid %s annotation: %s", kind, name, DomainSpecAnnotation, err)
+		return ManagedDomain{}, false
+	}
+
+	return ManagedDomain{
+		Name:        name,
+		Domain:      domain,
+		ReferenceID: annotations[ReferenceIDAnnotation],
+		State:       annotations[StateAnnotation],
+	}, true
 }
 
-func safeDomainName(domain string) string {
-	// Replace any invalid characters with a hyphen
-	// This is a simple implementation, you might want to use a more robust validation
-	return strings.ReplaceAll(domain, ".", "-")
+// domainSpec serializes the desired DNS state of a domain so it can be re-verified later.
+// The provided certificate is never stored on the Ingress.
+func domainSpec(domain jobs.VanityDomain) (string, error) {
+	domain.ProvidedCertificate = nil
+	domain.CertificateRef = ""
+	domain.Adopt = false
+
+	data, err := json.Marshal(domain)
+	if err != nil {
+		return "", fmt.Errorf("failed to serialize domain spec for %s: %v", domain.VanityDomain, err)
+	}
+
+	return string(data), nil
 }
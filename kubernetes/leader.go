@@ -0,0 +1,72 @@
+package kubernetes
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/rand"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+// RunLeaderElected runs run on one replica at a time, the one holding the Lease named name in the namespace. The
+// context passed to run is cancelled when the Lease is lost, and the replica competes for it again until ctx is
+// done.
+func (c *KubeClient) RunLeaderElected(ctx context.Context, name string, run func(ctx context.Context)) error {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return fmt.Errorf("failed to get hostname for leader election: %v", err)
+	}
+
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta: metaV1.ObjectMeta{Name: c.leaseName(name), Namespace: c.Namespace},
+		Client:    c.client.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{
+			// Restarted pods keep their hostname, the suffix keeps an old process from passing for the new one
+			Identity: hostname + "_" + rand.String(8),
+		},
+	}
+
+	elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		LeaseDuration:   15 * time.Second,
+		RenewDeadline:   10 * time.Second,
+		RetryPeriod:     2 * time.Second,
+		ReleaseOnCancel: true,
+		Name:            name,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) {
+				log.Printf("Leading %s as %s", name, lock.Identity())
+				run(ctx)
+			},
+			OnStoppedLeading: func() {
+				log.Printf("Stopped leading %s", name)
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to set up leader election for %s: %v", name, err)
+	}
+
+	go func() {
+		for ctx.Err() == nil {
+			elector.Run(ctx)
+		}
+	}()
+
+	return nil
+}
+
+// leaseName keeps the Lease of each environment sharing the namespace apart.
+func (c *KubeClient) leaseName(name string) string {
+	if c.Environment == "" {
+		return "vanitydomainmanager-" + name
+	}
+
+	return strings.ToLower(fmt.Sprintf("vanitydomainmanager-%s-%s", c.Environment, name))
+}
@@ -0,0 +1,128 @@
+package kubernetes
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/geekgonecrazy/vanityDomainManager/jobs"
+)
+
+// managedAnnotationPrefix marks the annotations the manager keeps for itself, jobs can never override them.
+const managedAnnotationPrefix = "vanitydomainmanager.io/"
+
+// annotationData is what annotation templates can reference, e.g. {{ .Domain.VanityDomain }}.
+type annotationData struct {
+	Domain      jobs.VanityDomain
+	ReferenceID string
+	Namespace   string
+}
+
+// parseAnnotationTemplates compiles the configured annotation values.
+func parseAnnotationTemplates(annotations map[string]string) (map[string]*template.Template, error) {
+	templates := map[string]*template.Template{}
+	for key, value := range annotations {
+		tmpl, err := template.New(key).Option("missingkey=error").Parse(value)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse annotation template %s: %v", key, err)
+		}
+		templates[key] = tmpl
+	}
+
+	return templates, nil
+}
+
+// objectMetadata returns the labels and annotations for a routing object: the configured defaults, then the job's
+// allowed overrides, then the manager's own bookkeeping, which always wins.
+func (c *KubeClient) objectMetadata(referenceID string, job jobs.VanityDomain) (map[string]string, map[string]string, error) {
+	spec, err := domainSpec(job)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ownerLabels, ownerAnnotations, err := c.ownershipMetadata(referenceID, job)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	labels := map[string]string{}
+	for key, value := range c.labels {
+		labels[key] = value
+	}
+	for key, value := range ownerLabels {
+		labels[key] = value
+	}
+
+	// Templates never get to see the certificate
+	data := annotationData{Domain: job, ReferenceID: referenceID, Namespace: c.Namespace}
+	data.Domain.ProvidedCertificate = nil
+	data.Domain.Annotations = nil
+	data.Domain.Adopt = false
+
+	annotations := map[string]string{}
+	for key, tmpl := range c.annotationTemplates {
+		var value strings.Builder
+		if err := tmpl.Execute(&value, data); err != nil {
+			return nil, nil, fmt.Errorf("failed to render annotation %s for vanity domain %s: %v", key, job.VanityDomain, err)
+		}
+		annotations[key] = value.String()
+	}
+
+	for key, value := range job.Annotations {
+		if !AnnotationOverrideAllowed(key, c.annotationOverrides) {
+			return nil, nil, fmt.Errorf("annotation %s is not allowed for vanity domain %s", key, job.VanityDomain)
+		}
+		annotations[key] = value
+	}
+
+	for key, value := range ownerAnnotations {
+		annotations[key] = value
+	}
+	annotations[DomainSpecAnnotation] = spec
+
+	return labels, annotations, nil
+}
+
+// AnnotationOverrideAllowed reports whether a job may set the annotation key. Entries in allowlist match exactly
+// or, with a trailing *, by prefix.
+func AnnotationOverrideAllowed(key string, allowlist []string) bool {
+	if strings.HasPrefix(key, managedAnnotationPrefix) {
+		return false
+	}
+
+	for _, allowed := range allowlist {
+		if allowed == key || (strings.HasSuffix(allowed, "*") && strings.HasPrefix(key, strings.TrimSuffix(allowed, "*"))) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// CheckAnnotationOverrides returns an error listing every annotation in a job that isn't allowed.
+func CheckAnnotationOverrides(annotations map[string]string, allowlist []string) error {
+	denied := []string{}
+	for key := range annotations {
+		if !AnnotationOverrideAllowed(key, allowlist) {
+			denied = append(denied, key)
+		}
+	}
+
+	if len(denied) == 0 {
+		return nil
+	}
+
+	sort.Strings(denied)
+	return fmt.Errorf("annotations not allowed: %s", strings.Join(denied, ", "))
+}
+
+// toUnstructuredMap converts string maps for unstructured objects.
+func toUnstructuredMap(values map[string]string) map[string]interface{} {
+	converted := map[string]interface{}{}
+	for key, value := range values {
+		converted[key] = value
+	}
+
+	return converted
+}
@@ -0,0 +1,72 @@
+package kubernetes
+
+import (
+	"testing"
+
+	"github.com/geekgonecrazy/vanityDomainManager/jobs"
+)
+
+func TestObjectMetadata(t *testing.T) {
+	templates, err := parseAnnotationTemplates(map[string]string{
+		"nginx.ingress.kubernetes.io/proxy-body-size": "8m",
+		"example.com/upstream-vhost":                  "{{ .Domain.VanityDomain }}",
+		DomainSpecAnnotation:                          "overridden",
+	})
+	if err != nil {
+		t.Fatalf("Failed to parse templates: %v", err)
+	}
+
+	c := &KubeClient{
+		Namespace:           "vanity",
+		labels:              map[string]string{"team": "web", ManagedByLabel: "someone-else"},
+		annotationTemplates: templates,
+		annotationOverrides: []string{"nginx.ingress.kubernetes.io/*"},
+	}
+
+	job := jobs.VanityDomain{
+		VanityDomain: "shop.example.com",
+		Annotations:  map[string]string{"nginx.ingress.kubernetes.io/proxy-body-size": "64m"},
+	}
+
+	labels, annotations, err := c.objectMetadata("ref-1", job)
+	if err != nil {
+		t.Fatalf("Failed to build object metadata: %v", err)
+	}
+
+	if labels["team"] != "web" || labels[ManagedByLabel] != ManagedByValue {
+		t.Errorf("Unexpected labels %v", labels)
+	}
+
+	if annotations["example.com/upstream-vhost"] != "shop.example.com" {
+		t.Errorf("Expected rendered template, got %q", annotations["example.com/upstream-vhost"])
+	}
+
+	if annotations["nginx.ingress.kubernetes.io/proxy-body-size"] != "64m" {
+		t.Errorf("Expected the job override to win over the default, got %q", annotations["nginx.ingress.kubernetes.io/proxy-body-size"])
+	}
+
+	if annotations[ReferenceIDAnnotation] != "ref-1" || annotations[DomainSpecAnnotation] == "overridden" {
+		t.Errorf("Expected manager annotations not to be overridable, got %v", annotations)
+	}
+
+	job.Annotations = map[string]string{"example.com/auth": "off"}
+	if _, _, err := c.objectMetadata("ref-1", job); err == nil {
+		t.Errorf("Expected an annotation outside the allowlist to be rejected")
+	}
+}
+
+func TestCheckAnnotationOverrides(t *testing.T) {
+	allowlist := []string{"nginx.ingress.kubernetes.io/proxy-body-size", "example.com/*", "vanitydomainmanager.io/*"}
+
+	if err := CheckAnnotationOverrides(map[string]string{"nginx.ingress.kubernetes.io/proxy-body-size": "1m", "example.com/a": "b"}, allowlist); err != nil {
+		t.Errorf("Expected allowed annotations to pass, got %v", err)
+	}
+
+	if err := CheckAnnotationOverrides(map[string]string{"nginx.ingress.kubernetes.io/auth-url": "x"}, allowlist); err == nil {
+		t.Errorf("Expected an exact allowlist entry not to match other keys")
+	}
+
+	if err := CheckAnnotationOverrides(map[string]string{ReferenceIDAnnotation: "x"}, allowlist); err == nil {
+		t.Errorf("Expected manager annotations to be rejected even when allowlisted")
+	}
+}
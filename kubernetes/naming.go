@@ -0,0 +1,381 @@
+package kubernetes
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/geekgonecrazy/vanityDomainManager/jobs"
+	"golang.org/x/net/idna"
+	v1 "k8s.io/api/core/v1"
+	networkingV1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	tlsSecretSuffix = "-tls-cert"
+
+	// Names are kept to a DNS-1123 label so they are also valid as Gateway listener names and OpenShift route
+	// hostnames, with room left for the TLS secret suffix.
+	maxNameLength  = 63 - len(tlsSecretSuffix)
+	nameHashLength = 8
+)
+
+// routeName is the name of every object written for a domain. It is the lowercased, punycoded domain with dots
+// and any other invalid characters turned into hyphens, followed by a hash of the domain so names that read the
+// same ("a-b.com" and "a.b.com") stay distinct. Long domains are truncated before the hash.
+func routeName(job jobs.VanityDomain) string {
+	domain := normalizeDomain(job.VanityDomain)
+
+	sum := sha256.Sum256([]byte(domain))
+	hash := hex.EncodeToString(sum[:])[:nameHashLength]
+
+	readable := strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '-' {
+			return r
+		}
+		return '-'
+	}, domain)
+
+	if max := maxNameLength - nameHashLength - 1; len(readable) > max {
+		readable = readable[:max]
+	}
+
+	readable = strings.Trim(readable, "-")
+	if readable == "" {
+		return hash
+	}
+
+	return readable + "-" + hash
+}
+
+// tlsSecretName is the Secret holding the certificate of a vanity domain, provided or issued by cert-manager.
+func tlsSecretName(job jobs.VanityDomain) string {
+	return routeName(job) + tlsSecretSuffix
+}
+
+// normalizeDomain lowercases a domain and converts internationalized labels to punycode. Domains idna rejects,
+// wildcards for one, are only lowercased.
+func normalizeDomain(domain string) string {
+	domain = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(domain)), ".")
+
+	ascii, err := idna.ToASCII(domain)
+	if err != nil {
+		return domain
+	}
+
+	return ascii
+}
+
+// MigrateLegacyNames renames the objects written before names were hashed. Kubernetes can't rename, so each domain
+// gets its TLS secret copied and its routing object recreated under the new name before the old ones are deleted,
+// the domain keeps serving throughout. It is safe to run again after an interruption. lookup returns the registry
+// record of a domain, or nil when there is none. In explicit certificate mode renamed domains get a Certificate
+// with the profile of the record's owner.
+func (c *KubeClient) MigrateLegacyNames(ctx context.Context, lookup func(domain string) (*jobs.DomainRecord, error)) error {
+	// Releases before ownership labels wrote Ingresses and Secrets without any, they have to be claimed first
+	if _, ok := c.routing.(*ingressProvider); ok {
+		if err := c.claimUnlabeledIngresses(ctx, lookup); err != nil {
+			return err
+		}
+	}
+
+	domains, err := c.routing.ListManagedDomains(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, managed := range domains {
+		name := routeName(managed.Domain)
+		if managed.Name == name {
+			continue
+		}
+
+		log.Printf("Renaming objects of vanity domain %s from %s to %s", managed.Domain.VanityDomain, managed.Name, name)
+
+		if err := c.migrateLegacyDomain(ctx, managed, lookup); err != nil {
+			return fmt.Errorf("failed to rename objects of vanity domain %s: %w", managed.Domain.VanityDomain, err)
+		}
+	}
+
+	return nil
+}
+
+func (c *KubeClient) migrateLegacyDomain(ctx context.Context, managed ManagedDomain, lookup func(domain string) (*jobs.DomainRecord, error)) error {
+	domain := managed.Domain
+	legacySecret := managed.Name + tlsSecretSuffix
+
+	secret, err := c.copyLegacySecret(ctx, legacySecret, domain)
+	if err != nil {
+		return err
+	}
+
+	// The domain spec annotation never holds the certificate, recover it so the new objects keep using it
+	// instead of asking cert-manager for one
+	if secret != nil && secret.Labels["Provided"] == "true" {
+		domain.ProvidedCertificate = &jobs.DomainCustomCert{
+			Cert: string(secret.Data["tls.crt"]),
+			Key:  string(secret.Data["tls.key"]),
+		}
+	}
+
+	// Legacy domains were issued by the shims, which don't act on routes written in explicit mode. Disabled
+	// domains get no Certificate, like DisableVanityDomain leaves them
+	if c.ManagesCertificates() && domain.ProvidedCertificate == nil && managed.State == "" {
+		record, err := lookup(domain.VanityDomain)
+		if err != nil {
+			return fmt.Errorf("failed to look up owner: %w", err)
+		}
+
+		tenant := ""
+		if record != nil {
+			tenant = record.Owner
+		}
+
+		if err := c.SetCertificate(ctx, managed.ReferenceID, tenant, domain); err != nil {
+			return err
+		}
+	}
+
+	if err := c.routing.SetRoute(ctx, managed.ReferenceID, domain); err != nil {
+		return err
+	}
+
+	if managed.State != "" {
+		if err := c.routing.DisableRoute(ctx, domain, managed.State); err != nil {
+			return err
+		}
+	}
+
+	if err := c.routing.UnSetRoute(ctx, managed.Name, domain); err != nil {
+		return err
+	}
+
+	if secret == nil {
+		return nil
+	}
+
+	err = c.client.CoreV1().Secrets(c.Namespace).Delete(ctx, secret.Name, deleteIfUnchanged(secret))
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("failed to delete secret %s: %v", secret.Name, err)
+	}
+
+	return nil
+}
+
+// copyLegacySecret copies the TLS secret stored under its legacy name to the new one and returns the legacy
+// secret, or nil when there is none.
+func (c *KubeClient) copyLegacySecret(ctx context.Context, legacyName string, job jobs.VanityDomain) (*v1.Secret, error) {
+	secrets := c.client.CoreV1().Secrets(c.Namespace)
+
+	secret, err := secrets.Get(ctx, legacyName, metaV1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.checkSecretOwnership(secret, job); err != nil {
+		return nil, err
+	}
+
+	annotations := map[string]string{}
+	for key, value := range secret.Annotations {
+		annotations[key] = value
+	}
+
+	// ingress-shim names the Certificate after the secret, point an issued secret at the one for the new name
+	if _, ok := annotations[certManagerCertificateAnnotation]; ok {
+		annotations[certManagerCertificateAnnotation] = tlsSecretName(job)
+	}
+
+	renamed := &v1.Secret{
+		ObjectMeta: metaV1.ObjectMeta{
+			Name:        tlsSecretName(job),
+			Namespace:   c.Namespace,
+			Labels:      secret.Labels,
+			Annotations: annotations,
+		},
+		Type: secret.Type,
+		Data: secret.Data,
+	}
+
+	if _, err := secrets.Create(ctx, renamed, metaV1.CreateOptions{FieldManager: FieldManager}); err != nil && !apierrors.IsAlreadyExists(err) {
+		return nil, fmt.Errorf("failed to copy secret %s: %v", legacyName, err)
+	}
+
+	return secret, nil
+}
+
+// legacyName is the name objects were given before names were hashed.
+func legacyName(domain string) string {
+	return strings.ReplaceAll(domain, ".", "-")
+}
+
+// claimUnlabeledIngresses stamps the ownership labels and domain spec on the Ingresses, and their TLS Secrets, that
+// releases before ownership labels wrote. Those are recognised by their shape: a single host rule to the cluster
+// service, named after the host by the legacy scheme, terminating TLS with the matching legacy Secret.
+func (c *KubeClient) claimUnlabeledIngresses(ctx context.Context, lookup func(domain string) (*jobs.DomainRecord, error)) error {
+	ingresses, err := c.client.NetworkingV1().Ingresses(c.Namespace).List(ctx, metaV1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to list ingresses: %v", err)
+	}
+
+	for i := range ingresses.Items {
+		ingress := &ingresses.Items[i]
+
+		host, ok := c.unlabeledLegacyIngress(ingress)
+		if !ok {
+			continue
+		}
+
+		domain := jobs.VanityDomain{VanityDomain: host}
+		referenceID := ""
+
+		record, err := lookup(host)
+		if err != nil {
+			return fmt.Errorf("failed to look up vanity domain %s: %w", host, err)
+		}
+		if record != nil {
+			domain = record.Domain
+			referenceID = record.Status.ReferenceID
+		}
+
+		log.Printf("Claiming Ingress %s/%s of vanity domain %s written before ownership labels", c.Namespace, ingress.Name, host)
+
+		if err := c.claimLegacySecret(ctx, ingress.Name+tlsSecretSuffix, referenceID, domain); err != nil {
+			return err
+		}
+
+		// The Ingress last, it is how an interrupted run finds the domain again
+		if err := c.stampOwnership(&ingress.ObjectMeta, referenceID, domain); err != nil {
+			return err
+		}
+
+		if _, err := c.client.NetworkingV1().Ingresses(c.Namespace).Update(ctx, ingress, metaV1.UpdateOptions{FieldManager: FieldManager}); err != nil {
+			return fmt.Errorf("failed to claim ingress %s: %v", ingress.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// unlabeledLegacyIngress returns the host of an Ingress an earlier release wrote without ownership labels.
+func (c *KubeClient) unlabeledLegacyIngress(ingress *networkingV1.Ingress) (string, bool) {
+	if _, ok := ingress.Labels[ManagedByLabel]; ok {
+		return "", false
+	}
+
+	if len(ingress.Spec.Rules) != 1 || len(ingress.Spec.TLS) != 1 {
+		return "", false
+	}
+
+	rule := ingress.Spec.Rules[0]
+	if rule.Host == "" || ingress.Name != legacyName(rule.Host) || ingress.Spec.TLS[0].SecretName != ingress.Name+tlsSecretSuffix {
+		return "", false
+	}
+
+	if rule.HTTP == nil || len(rule.HTTP.Paths) != 1 {
+		return "", false
+	}
+
+	service := rule.HTTP.Paths[0].Backend.Service
+	if service == nil || service.Name != c.ServiceName {
+		return "", false
+	}
+
+	return rule.Host, true
+}
+
+// checkLegacyRoute refuses a job for a domain whose Ingress an earlier release wrote without ownership labels, the
+// job would otherwise write a second routing object for the host next to it. Adopt doesn't help, the legacy objects
+// are only taken over by the migration.
+func (c *KubeClient) checkLegacyRoute(ctx context.Context, job jobs.VanityDomain) error {
+	if _, ok := c.routing.(*ingressProvider); !ok {
+		return nil
+	}
+
+	name := legacyName(job.VanityDomain)
+	ingress, err := c.client.NetworkingV1().Ingresses(c.Namespace).Get(ctx, name, metaV1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get ingress %s: %v", name, err)
+	}
+
+	if host, ok := c.unlabeledLegacyIngress(ingress); ok && host == job.VanityDomain {
+		return fmt.Errorf("%w: Ingress %s/%s was written by an earlier release, run the manager with -migrate-legacy-names to take it over", ErrUnmanagedObject, c.Namespace, name)
+	}
+
+	return nil
+}
+
+// claimLegacySecret stamps the ownership labels on the legacy TLS Secret of a claimed Ingress. Earlier releases
+// labelled provided certificates with their domain, cert-manager named issued ones after their Certificate.
+func (c *KubeClient) claimLegacySecret(ctx context.Context, name string, referenceID string, domain jobs.VanityDomain) error {
+	secrets := c.client.CoreV1().Secrets(c.Namespace)
+
+	secret, err := secrets.Get(ctx, name, metaV1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get secret %s: %v", name, err)
+	}
+
+	if _, ok := secret.Labels[ManagedByLabel]; ok {
+		return nil
+	}
+
+	provided := secret.Labels["Provided"] == "true" && secret.Labels[DomainLabel] == domain.VanityDomain
+	issued := secret.Annotations[certManagerCertificateAnnotation] == name
+	if !provided && !issued {
+		return nil
+	}
+
+	if err := c.stampOwnership(&secret.ObjectMeta, referenceID, domain); err != nil {
+		return err
+	}
+
+	if _, err := secrets.Update(ctx, secret, metaV1.UpdateOptions{FieldManager: FieldManager}); err != nil {
+		return fmt.Errorf("failed to claim secret %s: %v", name, err)
+	}
+
+	return nil
+}
+
+// stampOwnership adds the labels and annotations the manager writes to the metadata of a claimed object.
+func (c *KubeClient) stampOwnership(meta *metaV1.ObjectMeta, referenceID string, domain jobs.VanityDomain) error {
+	spec, err := domainSpec(domain)
+	if err != nil {
+		return err
+	}
+
+	labels, annotations, err := c.ownershipMetadata(referenceID, domain)
+	if err != nil {
+		return err
+	}
+	annotations[DomainSpecAnnotation] = spec
+
+	if meta.Labels == nil {
+		meta.Labels = map[string]string{}
+	}
+	for key, value := range labels {
+		meta.Labels[key] = value
+	}
+
+	if meta.Annotations == nil {
+		meta.Annotations = map[string]string{}
+	}
+	for key, value := range annotations {
+		meta.Annotations[key] = value
+	}
+
+	return nil
+}
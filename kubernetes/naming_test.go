@@ -0,0 +1,331 @@
+package kubernetes
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/geekgonecrazy/vanityDomainManager/config"
+	"github.com/geekgonecrazy/vanityDomainManager/jobs"
+	v1 "k8s.io/api/core/v1"
+	networkingV1 "k8s.io/api/networking/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestRouteNames(t *testing.T) {
+	name := func(domain string) string {
+		return routeName(jobs.VanityDomain{VanityDomain: domain})
+	}
+
+	domains := []string{
+		"example.org",
+		"a-b.com",
+		"a.b.com",
+		"Shop.Example.COM",
+		"bücher.example",
+		"*.example.org",
+		strings.Repeat("long-label.", 20) + "example.org",
+	}
+
+	seen := map[string]string{}
+	for _, domain := range domains {
+		n := name(domain)
+
+		if errs := validation.IsDNS1123Label(n); len(errs) != 0 {
+			t.Errorf("%s: %q is not a valid name: %v", domain, n, errs)
+		}
+
+		if errs := validation.IsDNS1123Label(n + tlsSecretSuffix); len(errs) != 0 {
+			t.Errorf("%s: secret name %q is not valid: %v", domain, n+tlsSecretSuffix, errs)
+		}
+
+		if other, ok := seen[n]; ok {
+			t.Errorf("%s and %s share the name %q", domain, other, n)
+		}
+		seen[n] = domain
+	}
+
+	if name("Shop.Example.COM") != name("shop.example.com") {
+		t.Errorf("Expected names to ignore case")
+	}
+
+	if n := name("bücher.example"); !strings.HasPrefix(n, "xn--bcher-kva-example-") {
+		t.Errorf("Expected a punycoded name, got %q", n)
+	}
+
+	if n := name("example.org"); n != name("example.org") || !strings.HasPrefix(n, "example-org-") {
+		t.Errorf("Expected a stable readable name, got %q", n)
+	}
+}
+
+func noRecord(domain string) (*jobs.DomainRecord, error) {
+	return nil, nil
+}
+
+func TestMigrateLegacyNames(t *testing.T) {
+	domain := jobs.VanityDomain{VanityDomain: "example.org", DesiredDNSTargetType: "CNAME", DesiredCNAMETarget: "lb.example.net"}
+	spec, _ := domainSpec(domain)
+	managed := map[string]string{ManagedByLabel: ManagedByValue}
+
+	legacyIngress := &networkingV1.Ingress{ObjectMeta: metaV1.ObjectMeta{
+		Name:        "example-org",
+		Namespace:   "vanity",
+		Labels:      managed,
+		Annotations: map[string]string{DomainSpecAnnotation: spec, ReferenceIDAnnotation: "ref-1"},
+	}}
+	legacySecret := &v1.Secret{
+		ObjectMeta: metaV1.ObjectMeta{
+			Name:      "example-org-tls-cert",
+			Namespace: "vanity",
+			Labels:    map[string]string{ManagedByLabel: ManagedByValue, "Provided": "true"},
+		},
+		Data: map[string][]byte{"tls.crt": []byte("CERT"), "tls.key": []byte("KEY")},
+	}
+
+	c := newDynamicTestClient(t)
+	c.client = fake.NewClientset(legacyIngress, legacySecret)
+	c.routing = &ingressProvider{kube: c}
+	ctx := context.Background()
+
+	if err := c.MigrateLegacyNames(ctx, noRecord); err != nil {
+		t.Fatalf("Failed to migrate: %v", err)
+	}
+
+	// A second run finds nothing left to rename
+	if err := c.MigrateLegacyNames(ctx, noRecord); err != nil {
+		t.Fatalf("Failed to migrate again: %v", err)
+	}
+
+	ingress, err := c.client.NetworkingV1().Ingresses("vanity").Get(ctx, routeName(domain), metaV1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Failed to get renamed ingress: %v", err)
+	}
+
+	if ingress.Annotations[ReferenceIDAnnotation] != "ref-1" || ingress.Spec.TLS[0].SecretName != tlsSecretName(domain) {
+		t.Errorf("Unexpected renamed ingress %+v", ingress.ObjectMeta)
+	}
+
+	if _, ok := ingress.Annotations["cert-manager.io/cluster-issuer"]; ok {
+		t.Errorf("Expected the provided certificate to be kept instead of requesting one")
+	}
+
+	secret, err := c.client.CoreV1().Secrets("vanity").Get(ctx, tlsSecretName(domain), metaV1.GetOptions{})
+	if err != nil || string(secret.Data["tls.key"]) != "KEY" {
+		t.Fatalf("Expected the secret to be copied, got %v", err)
+	}
+
+	if _, err := c.client.NetworkingV1().Ingresses("vanity").Get(ctx, "example-org", metaV1.GetOptions{}); err == nil {
+		t.Errorf("Expected the legacy ingress to be removed")
+	}
+
+	if _, err := c.client.CoreV1().Secrets("vanity").Get(ctx, "example-org-tls-cert", metaV1.GetOptions{}); err == nil {
+		t.Errorf("Expected the legacy secret to be removed")
+	}
+}
+
+func TestMigrateLegacyNamesCreatesCertificates(t *testing.T) {
+	domain := jobs.VanityDomain{VanityDomain: "example.org", DesiredDNSTargetType: "CNAME", DesiredCNAMETarget: "lb.example.net"}
+	spec, _ := domainSpec(domain)
+
+	legacyIngress := &networkingV1.Ingress{ObjectMeta: metaV1.ObjectMeta{
+		Name:        "example-org",
+		Namespace:   "vanity",
+		Labels:      map[string]string{ManagedByLabel: ManagedByValue},
+		Annotations: map[string]string{DomainSpecAnnotation: spec, ReferenceIDAnnotation: "ref-1"},
+	}}
+
+	c := newDynamicTestClient(t)
+	c.client = fake.NewClientset(legacyIngress)
+	c.routing = &ingressProvider{kube: c}
+	c.certificates = config.CertificatesConfig{
+		Mode:               "explicit",
+		CertificateProfile: config.CertificateProfile{IssuerRef: config.CertificateIssuerRef{Name: "letsencrypt", Kind: "ClusterIssuer"}},
+		Tenants:            map[string]config.CertificateProfile{"acme": {IssuerRef: config.CertificateIssuerRef{Name: "acme-ca", Kind: "Issuer"}}},
+	}
+	ctx := context.Background()
+
+	lookup := func(name string) (*jobs.DomainRecord, error) {
+		if name != domain.VanityDomain {
+			t.Errorf("Expected the owner of %s to be looked up, got %s", domain.VanityDomain, name)
+		}
+		return &jobs.DomainRecord{Domain: domain, Owner: "acme"}, nil
+	}
+
+	if err := c.MigrateLegacyNames(ctx, lookup); err != nil {
+		t.Fatalf("Failed to migrate: %v", err)
+	}
+
+	cert, err := c.dynamic.Resource(certificateResource).Namespace("vanity").Get(ctx, tlsSecretName(domain), metaV1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Expected the renamed domain to get a certificate, got %v", err)
+	}
+
+	if issuer, _, _ := unstructured.NestedString(cert.Object, "spec", "issuerRef", "name"); issuer != "acme-ca" {
+		t.Errorf("Expected the owner's issuer, got %s", issuer)
+	}
+}
+
+// baselineIngress is shaped like the Ingresses written before ownership labels existed.
+func baselineIngress(host string, annotations map[string]string) *networkingV1.Ingress {
+	pathType := networkingV1.PathTypeImplementationSpecific
+	name := legacyName(host)
+
+	return &networkingV1.Ingress{
+		ObjectMeta: metaV1.ObjectMeta{Name: name, Namespace: "vanity", Annotations: annotations},
+		Spec: networkingV1.IngressSpec{
+			Rules: []networkingV1.IngressRule{{
+				Host: host,
+				IngressRuleValue: networkingV1.IngressRuleValue{HTTP: &networkingV1.HTTPIngressRuleValue{
+					Paths: []networkingV1.HTTPIngressPath{{
+						PathType: &pathType,
+						Backend: networkingV1.IngressBackend{Service: &networkingV1.IngressServiceBackend{
+							Name: "web",
+							Port: networkingV1.ServiceBackendPort{Number: 8080},
+						}},
+					}},
+				}},
+			}},
+			TLS: []networkingV1.IngressTLS{{Hosts: []string{host}, SecretName: name + "-tls-cert"}},
+		},
+	}
+}
+
+func TestMigrateUnlabeledLegacyObjects(t *testing.T) {
+	provided := baselineIngress("example.org", map[string]string{})
+	providedSecret := &v1.Secret{
+		ObjectMeta: metaV1.ObjectMeta{
+			Name:      "example-org-tls-cert",
+			Namespace: "vanity",
+			Labels:    map[string]string{"Domain": "example.org", "Provided": "true"},
+		},
+		Data: map[string][]byte{"tls.crt": []byte("CERT"), "tls.key": []byte("KEY")},
+	}
+
+	issued := baselineIngress("example.net", map[string]string{"cert-manager.io/cluster-issuer": "letsencrypt"})
+	issuedSecret := &v1.Secret{
+		ObjectMeta: metaV1.ObjectMeta{
+			Name:        "example-net-tls-cert",
+			Namespace:   "vanity",
+			Annotations: map[string]string{certManagerCertificateAnnotation: "example-net-tls-cert"},
+		},
+		Data: map[string][]byte{"tls.crt": []byte("ISSUED"), "tls.key": []byte("ISSUED-KEY")},
+	}
+
+	// Someone else's Ingress to the same service, not named by the legacy scheme
+	other := baselineIngress("shop.example.com", nil)
+	other.Name = "shop"
+
+	c := newDynamicTestClient(t)
+	c.client = fake.NewClientset(provided, providedSecret, issued, issuedSecret, other)
+	c.routing = &ingressProvider{kube: c}
+	ctx := context.Background()
+
+	known := jobs.VanityDomain{VanityDomain: "example.org", DesiredDNSTargetType: "CNAME", DesiredCNAMETarget: "lb.example.net"}
+	lookup := func(domain string) (*jobs.DomainRecord, error) {
+		if domain != known.VanityDomain {
+			return nil, nil
+		}
+		return &jobs.DomainRecord{Domain: known, Status: jobs.DomainStatus{ReferenceID: "ref-1"}}, nil
+	}
+
+	if err := c.MigrateLegacyNames(ctx, lookup); err != nil {
+		t.Fatalf("Failed to migrate: %v", err)
+	}
+
+	ingress, err := c.client.NetworkingV1().Ingresses("vanity").Get(ctx, routeName(known), metaV1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Failed to get renamed ingress: %v", err)
+	}
+
+	if managed, ok := managedDomain("Ingress", ingress.Name, ingress.Annotations); !ok || managed.ReferenceID != "ref-1" || managed.Domain.DesiredCNAMETarget != "lb.example.net" {
+		t.Errorf("Expected the renamed ingress to carry the registry's spec, got %+v", ingress.ObjectMeta)
+	}
+
+	secret, err := c.client.CoreV1().Secrets("vanity").Get(ctx, tlsSecretName(known), metaV1.GetOptions{})
+	if err != nil || string(secret.Data["tls.key"]) != "KEY" || !c.ownsObject(secret.Labels) {
+		t.Fatalf("Expected the provided secret to be copied and owned, got %v", err)
+	}
+
+	unknown := jobs.VanityDomain{VanityDomain: "example.net"}
+	if _, err := c.client.NetworkingV1().Ingresses("vanity").Get(ctx, routeName(unknown), metaV1.GetOptions{}); err != nil {
+		t.Errorf("Expected the domain the registry doesn't know to be renamed too, got %v", err)
+	}
+
+	secret, err = c.client.CoreV1().Secrets("vanity").Get(ctx, tlsSecretName(unknown), metaV1.GetOptions{})
+	if err != nil || secret.Annotations[certManagerCertificateAnnotation] != tlsSecretName(unknown) {
+		t.Errorf("Expected the issued secret to be copied for the new Certificate, got %v", err)
+	}
+
+	for _, name := range []string{"example-org", "example-net"} {
+		if _, err := c.client.NetworkingV1().Ingresses("vanity").Get(ctx, name, metaV1.GetOptions{}); err == nil {
+			t.Errorf("Expected the legacy ingress %s to be removed", name)
+		}
+
+		if _, err := c.client.CoreV1().Secrets("vanity").Get(ctx, name+"-tls-cert", metaV1.GetOptions{}); err == nil {
+			t.Errorf("Expected the legacy secret %s-tls-cert to be removed", name)
+		}
+	}
+
+	shop, err := c.client.NetworkingV1().Ingresses("vanity").Get(ctx, "shop", metaV1.GetOptions{})
+	if err != nil || len(shop.Labels) != 0 {
+		t.Errorf("Expected an ingress not named by the legacy scheme to be left alone, got %v", err)
+	}
+}
+
+func TestJobsAfterUnlabeledLegacyMigration(t *testing.T) {
+	domain := jobs.VanityDomain{VanityDomain: "example.org", ProvidedCertificate: &jobs.DomainCustomCert{Cert: "CERT", Key: "KEY"}}
+	secret := &v1.Secret{
+		ObjectMeta: metaV1.ObjectMeta{
+			Name:      "example-org-tls-cert",
+			Namespace: "vanity",
+			Labels:    map[string]string{"Domain": "example.org", "Provided": "true"},
+		},
+		Data: map[string][]byte{"tls.crt": []byte("CERT"), "tls.key": []byte("KEY")},
+	}
+
+	c := newDynamicTestClient(t)
+	c.client = fake.NewClientset(baselineIngress("example.org", map[string]string{}), secret)
+	c.Environment = "production"
+	c.routing = &ingressProvider{kube: c}
+	ctx := context.Background()
+
+	// Before the migration a job would write a second Ingress for the host, adopt or not
+	domain.Adopt = true
+	err := c.SetVanityDomain(ctx, "ref-2", domain)
+	if !errors.Is(err, ErrUnmanagedObject) || !strings.Contains(err.Error(), "-migrate-legacy-names") {
+		t.Errorf("Expected the job to be refused until the migration ran, got %v", err)
+	}
+
+	if err := c.UnSetVanityDomain(ctx, domain); !errors.Is(err, ErrUnmanagedObject) {
+		t.Errorf("Expected the removal to be refused until the migration ran, got %v", err)
+	}
+
+	lookup := func(string) (*jobs.DomainRecord, error) {
+		return &jobs.DomainRecord{Domain: jobs.VanityDomain{VanityDomain: "example.org"}, Status: jobs.DomainStatus{ReferenceID: "ref-1"}}, nil
+	}
+	if err := c.MigrateLegacyNames(ctx, lookup); err != nil {
+		t.Fatalf("Failed to migrate: %v", err)
+	}
+
+	// The migrated objects carry the ownership labels, jobs no longer need adopt
+	domain.Adopt = false
+	if err := c.SetVanityDomain(ctx, "ref-2", domain); err != nil {
+		t.Errorf("Failed to update migrated domain: %v", err)
+	}
+
+	if err := c.SetTLS(ctx, "ref-2", domain); err != nil {
+		t.Errorf("Failed to update migrated secret: %v", err)
+	}
+
+	if err := c.UnSetTLS(ctx, domain); err != nil {
+		t.Errorf("Failed to remove migrated secret: %v", err)
+	}
+
+	if err := c.UnSetVanityDomain(ctx, domain); err != nil {
+		t.Errorf("Failed to remove migrated domain: %v", err)
+	}
+}
@@ -0,0 +1,108 @@
+package kubernetes
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/geekgonecrazy/vanityDomainManager/config"
+	"github.com/geekgonecrazy/vanityDomainManager/jobs"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+const (
+	openshiftIssuerNameAnnotation = "cert-manager.io/issuer-name"
+	openshiftIssuerKindAnnotation = "cert-manager.io/issuer-kind"
+)
+
+var routeResource = schema.GroupVersionResource{Group: "route.openshift.io", Version: "v1", Resource: "routes"}
+
+// openshiftProvider exposes vanity domains with OpenShift Routes. Routes can't reference a Secret, so a provided
+// certificate is inlined into the Route; otherwise cert-manager's openshift-routes add-on fills it in when an
+// issuer is configured.
+type openshiftProvider struct {
+	kube   *KubeClient
+	config config.OpenShiftConfig
+}
+
+// SetRoute creates or updates the Route for the vanity domain.
+func (p *openshiftProvider) SetRoute(ctx context.Context, referenceID string, job jobs.VanityDomain) error {
+	// A Route has a single path, more would need a Route per path sharing the host
+	routes := p.kube.domainRoutes(job)
+	if len(routes) > 1 {
+		return fmt.Errorf("vanity domain %s has %d routes, the openshift backend supports one route per domain", job.VanityDomain, len(routes))
+	}
+	target := routes[0]
+
+	metadata, err := p.kube.managedObjectMeta(routeName(job), referenceID, job)
+	if err != nil {
+		return err
+	}
+
+	tls := map[string]interface{}{
+		"termination":                   p.config.Termination,
+		"insecureEdgeTerminationPolicy": p.config.InsecureEdgeTerminationPolicy,
+	}
+
+	if job.ProvidedCertificate != nil {
+		tls["certificate"] = job.ProvidedCertificate.Cert
+		tls["key"] = job.ProvidedCertificate.Key
+	} else if p.kube.CertManagerIssuer != "" {
+		annotations := metadata["annotations"].(map[string]interface{})
+		annotations[openshiftIssuerNameAnnotation] = p.kube.CertManagerIssuer
+		annotations[openshiftIssuerKindAnnotation] = "ClusterIssuer"
+	}
+
+	route := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": routeResource.GroupVersion().String(),
+		"kind":       "Route",
+		"metadata":   metadata,
+		"spec": map[string]interface{}{
+			"host": job.VanityDomain,
+			"to": map[string]interface{}{
+				"kind":   "Service",
+				"name":   target.ServiceName,
+				"weight": int64(100),
+			},
+			"port": map[string]interface{}{
+				"targetPort": int64(target.ServicePort),
+			},
+			"tls": tls,
+		},
+	}}
+
+	if target.Path != "" {
+		if err := unstructured.SetNestedField(route.Object, target.Path, "spec", "path"); err != nil {
+			return err
+		}
+	}
+
+	if err := p.kube.applyUnstructured(ctx, routeResource, route, job); err != nil {
+		return fmt.Errorf("failed to set route for vanity domain %s: %w", job.VanityDomain, err)
+	}
+
+	return nil
+}
+
+// UnSetRoute deletes the Route for the vanity domain.
+func (p *openshiftProvider) UnSetRoute(ctx context.Context, name string, job jobs.VanityDomain) error {
+	if err := p.kube.deleteUnstructured(ctx, routeResource, name, job); err != nil {
+		return fmt.Errorf("failed to remove route for vanity domain %s: %w", job.VanityDomain, err)
+	}
+
+	return nil
+}
+
+// ListManagedDomains returns every vanity domain that has a Route written by the manager.
+func (p *openshiftProvider) ListManagedDomains(ctx context.Context) ([]ManagedDomain, error) {
+	return p.kube.listManagedUnstructured(ctx, routeResource, "Route")
+}
+
+// DisableRoute keeps the Route but marks it with the given state and drops the cert-manager issuer annotations.
+func (p *openshiftProvider) DisableRoute(ctx context.Context, job jobs.VanityDomain, state string) error {
+	if err := p.kube.markUnstructured(ctx, routeResource, routeName(job), state, openshiftIssuerNameAnnotation, openshiftIssuerKindAnnotation); err != nil {
+		return fmt.Errorf("failed to disable route for vanity domain %s: %w", job.VanityDomain, err)
+	}
+
+	return nil
+}
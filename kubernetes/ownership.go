@@ -0,0 +1,91 @@
+package kubernetes
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/geekgonecrazy/vanityDomainManager/jobs"
+	v1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	OwnerLabel         = "vanitydomainmanager.io/owner" // Environment of the manager that wrote the object
+	SpecHashAnnotation = "vanitydomainmanager.io/spec-hash"
+
+	certManagerCertificateAnnotation = "cert-manager.io/certificate-name"
+)
+
+// ErrUnmanagedObject is returned instead of modifying or deleting an object the manager didn't write.
+var ErrUnmanagedObject = errors.New("object is not managed by vanityDomainManager")
+
+// ownershipMetadata is the bookkeeping every object written by the manager carries, it is merged over any
+// configured labels and annotations.
+func (c *KubeClient) ownershipMetadata(referenceID string, job jobs.VanityDomain) (map[string]string, map[string]string, error) {
+	spec, err := domainSpec(job)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	labels := map[string]string{ManagedByLabel: ManagedByValue, DomainLabel: routeName(job)}
+	if c.Environment != "" {
+		labels[OwnerLabel] = c.Environment
+	}
+
+	annotations := map[string]string{
+		ReferenceIDAnnotation: referenceID,
+		SpecHashAnnotation:    specHash(spec),
+		DomainAnnotation:      job.VanityDomain,
+	}
+
+	return labels, annotations, nil
+}
+
+// checkOwnership refuses to touch an existing object unless this manager wrote it or the job asked to adopt it.
+// Objects written before owner labels existed only carry the managed-by label and are accepted.
+func (c *KubeClient) checkOwnership(kind string, name string, labels map[string]string, job jobs.VanityDomain) error {
+	if c.ownsObject(labels) {
+		return nil
+	}
+
+	if job.Adopt {
+		log.Printf("Adopting %s %s/%s for vanity domain %s", kind, c.Namespace, name, job.VanityDomain)
+		return nil
+	}
+
+	if labels[ManagedByLabel] == ManagedByValue {
+		return fmt.Errorf("%w: %s %s/%s belongs to the %s environment, set adopt to take it over", ErrUnmanagedObject, kind, c.Namespace, name, labels[OwnerLabel])
+	}
+
+	return fmt.Errorf("%w: %s %s/%s already exists and wasn't created by the manager, set adopt to take it over", ErrUnmanagedObject, kind, c.Namespace, name)
+}
+
+// ownsObject reports whether this manager wrote an object, going by its labels.
+func (c *KubeClient) ownsObject(labels map[string]string) bool {
+	owner, hasOwner := labels[OwnerLabel]
+	return labels[ManagedByLabel] == ManagedByValue && (!hasOwner || c.Environment == "" || owner == c.Environment)
+}
+
+// checkSecretOwnership also accepts the Secret cert-manager issued for the domain's own routing object.
+func (c *KubeClient) checkSecretOwnership(secret *v1.Secret, job jobs.VanityDomain) error {
+	if secret.Annotations[certManagerCertificateAnnotation] == secret.Name && secret.Labels[ManagedByLabel] == "" {
+		return nil
+	}
+
+	return c.checkOwnership("Secret", secret.Name, secret.Labels, job)
+}
+
+// deleteIfUnchanged only deletes the object that was checked, not one recreated under the same name since.
+func deleteIfUnchanged(obj metaV1.Object) metaV1.DeleteOptions {
+	uid := obj.GetUID()
+	return metaV1.DeleteOptions{Preconditions: &metaV1.Preconditions{UID: &uid}}
+}
+
+// specHash identifies the desired state an object was written from.
+func specHash(spec string) string {
+	sum := sha256.Sum256([]byte(spec))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,72 @@
+package kubernetes
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/geekgonecrazy/vanityDomainManager/jobs"
+	v1 "k8s.io/api/core/v1"
+	networkingV1 "k8s.io/api/networking/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestRefusesUnmanagedObjects(t *testing.T) {
+	domain := jobs.VanityDomain{VanityDomain: "example.org", ProvidedCertificate: &jobs.DomainCustomCert{Cert: "CERT", Key: "KEY"}}
+	handmade := &networkingV1.Ingress{ObjectMeta: metaV1.ObjectMeta{Name: routeName(domain), Namespace: "vanity"}}
+	handmadeSecret := &v1.Secret{ObjectMeta: metaV1.ObjectMeta{Name: tlsSecretName(domain), Namespace: "vanity"}}
+
+	c := newDynamicTestClient(t)
+	c.client = fake.NewClientset(handmade, handmadeSecret)
+	c.Environment = "production"
+	c.routing = &ingressProvider{kube: c}
+	ctx := context.Background()
+
+	if err := c.SetVanityDomain(ctx, "ref-1", domain); !errors.Is(err, ErrUnmanagedObject) {
+		t.Errorf("Expected ErrUnmanagedObject updating a handmade ingress, got %v", err)
+	}
+
+	if err := c.SetTLS(ctx, "ref-1", domain); !errors.Is(err, ErrUnmanagedObject) {
+		t.Errorf("Expected ErrUnmanagedObject updating a handmade secret, got %v", err)
+	}
+
+	if err := c.UnSetVanityDomain(ctx, domain); !errors.Is(err, ErrUnmanagedObject) {
+		t.Errorf("Expected ErrUnmanagedObject deleting a handmade ingress, got %v", err)
+	}
+
+	if _, err := c.client.NetworkingV1().Ingresses("vanity").Get(ctx, routeName(domain), metaV1.GetOptions{}); err != nil {
+		t.Fatalf("Expected the handmade ingress to survive, got %v", err)
+	}
+
+	domain.Adopt = true
+	if err := c.SetVanityDomain(ctx, "ref-2", domain); err != nil {
+		t.Fatalf("Failed to adopt ingress: %v", err)
+	}
+
+	ingress, _ := c.client.NetworkingV1().Ingresses("vanity").Get(ctx, routeName(domain), metaV1.GetOptions{})
+	if ingress.Labels[ManagedByLabel] != ManagedByValue || ingress.Labels[OwnerLabel] != "production" {
+		t.Errorf("Expected ownership labels after adoption, got %v", ingress.Labels)
+	}
+
+	if ingress.Annotations[ReferenceIDAnnotation] != "ref-2" || ingress.Annotations[SpecHashAnnotation] == "" {
+		t.Errorf("Expected reference and spec hash annotations, got %v", ingress.Annotations)
+	}
+
+	// Once adopted the object is managed and later jobs don't need the flag
+	domain.Adopt = false
+	if err := c.UnSetVanityDomain(ctx, domain); err != nil {
+		t.Errorf("Expected the adopted ingress to be deleted, got %v", err)
+	}
+
+	// Another environment's manager sharing the namespace is refused too
+	c.Environment = "staging"
+	if err := c.SetVanityDomain(ctx, "ref-3", domain); err != nil {
+		t.Fatalf("Failed to create ingress: %v", err)
+	}
+
+	c.Environment = "production"
+	if err := c.SetVanityDomain(ctx, "ref-4", domain); !errors.Is(err, ErrUnmanagedObject) {
+		t.Errorf("Expected ErrUnmanagedObject for another environment's ingress, got %v", err)
+	}
+}
@@ -0,0 +1,471 @@
+package kubernetes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/geekgonecrazy/vanityDomainManager/jobs"
+	v1 "k8s.io/api/core/v1"
+	networkingV1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/informers"
+	coreListers "k8s.io/client-go/listers/core/v1"
+	networkingListers "k8s.io/client-go/listers/networking/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// DesiredState is where the reconciler reads what the manager wants exposed, normally the domain registry.
+type DesiredState interface {
+	// DesiredDomains lists every domain that should currently be exposed.
+	DesiredDomains() ([]ManagedDomain, error)
+	// DesiredDomain returns the desired state of a domain. ok is false when it shouldn't be exposed or a job
+	// is still working on it, the reconciler leaves those alone.
+	DesiredDomain(domain string) (managed ManagedDomain, ok bool, err error)
+	// Drifted is told about every managed object found changed and what was done about it.
+	Drifted(managed ManagedDomain, message string)
+}
+
+// Reconciler watches the managed Ingresses, TLS Secrets and Certificates and puts back any that were edited or
+// deleted outside the manager. Domains are queued by name so a burst of events for one domain is handled once, and
+// a domain that keeps drifting is retried with an exponential backoff.
+type Reconciler struct {
+	kube    *KubeClient
+	desired DesiredState
+	resync  time.Duration
+
+	factory   informers.SharedInformerFactory
+	queue     workqueue.TypedRateLimitingInterface[string]
+	synced    []cache.InformerSynced
+	secrets   coreListers.SecretLister
+	ingress   *ingressProvider                // nil unless the ingress backend is used
+	ingresses networkingListers.IngressLister // nil unless the ingress backend is used
+
+	certificateFactory dynamicinformer.DynamicSharedInformerFactory // nil unless the manager creates Certificates
+	certificates       cache.GenericLister                          // nil unless the manager creates Certificates
+
+	mu       sync.Mutex
+	lastGood map[string]*v1.Secret // Last copy of each provided TLS secret that held the desired certificate
+	reported map[string]string     // Last drift reported per domain, so unrepairable drift is reported once
+}
+
+// NewReconciler watches the objects the manager writes in its namespace. Routing objects are only watched with
+// the ingress backend, Certificates in explicit certificate mode, TLS secrets always.
+func (c *KubeClient) NewReconciler(desired DesiredState, resync time.Duration) (*Reconciler, error) {
+	managedOnly := func(options *metaV1.ListOptions) {
+		options.LabelSelector = fmt.Sprintf("%s=%s", ManagedByLabel, ManagedByValue)
+	}
+
+	factory := informers.NewSharedInformerFactoryWithOptions(c.client, 0,
+		informers.WithNamespace(c.Namespace),
+		informers.WithTweakListOptions(managedOnly),
+	)
+
+	r := &Reconciler{
+		kube:     c,
+		desired:  desired,
+		resync:   resync,
+		factory:  factory,
+		queue:    workqueue.NewTypedRateLimitingQueue(workqueue.DefaultTypedControllerRateLimiter[string]()),
+		lastGood: map[string]*v1.Secret{},
+		reported: map[string]string{},
+	}
+
+	handler := cache.ResourceEventHandlerFuncs{
+		AddFunc:    r.enqueueObject,
+		UpdateFunc: func(_, obj interface{}) { r.enqueueObject(obj) },
+		DeleteFunc: r.enqueueObject,
+	}
+
+	secrets := factory.Core().V1().Secrets()
+	if _, err := secrets.Informer().AddEventHandler(handler); err != nil {
+		return nil, fmt.Errorf("failed to watch secrets: %v", err)
+	}
+	r.secrets = secrets.Lister()
+	r.synced = append(r.synced, secrets.Informer().HasSynced)
+
+	if provider, ok := c.routing.(*ingressProvider); ok {
+		ingresses := factory.Networking().V1().Ingresses()
+		if _, err := ingresses.Informer().AddEventHandler(handler); err != nil {
+			return nil, fmt.Errorf("failed to watch ingresses: %v", err)
+		}
+		r.ingress = provider
+		r.ingresses = ingresses.Lister()
+		r.synced = append(r.synced, ingresses.Informer().HasSynced)
+	}
+
+	if c.ManagesCertificates() {
+		r.certificateFactory = dynamicinformer.NewFilteredDynamicSharedInformerFactory(c.dynamic, 0, c.Namespace, managedOnly)
+		certificates := r.certificateFactory.ForResource(certificateResource)
+		if _, err := certificates.Informer().AddEventHandler(handler); err != nil {
+			return nil, fmt.Errorf("failed to watch certificates: %v", err)
+		}
+		r.certificates = certificates.Lister()
+		r.synced = append(r.synced, certificates.Informer().HasSynced)
+	}
+
+	return r, nil
+}
+
+// Start fills the informer caches and runs workers until ctx is done. Every desired domain is also queued every
+// resync interval, which catches objects deleted while the manager wasn't running.
+func (r *Reconciler) Start(ctx context.Context, workers int) error {
+	r.factory.Start(ctx.Done())
+	if r.certificateFactory != nil {
+		r.certificateFactory.Start(ctx.Done())
+	}
+
+	if !cache.WaitForCacheSync(ctx.Done(), r.synced...) {
+		return fmt.Errorf("failed to sync informer caches")
+	}
+
+	go func() {
+		<-ctx.Done()
+		r.queue.ShutDown()
+	}()
+
+	go wait.UntilWithContext(ctx, func(context.Context) { r.enqueueDesired() }, r.resync)
+
+	for i := 0; i < workers; i++ {
+		go wait.UntilWithContext(ctx, r.runWorker, time.Second)
+	}
+
+	return nil
+}
+
+// enqueueObject queues the domain an Ingress, Secret or Certificate belongs to. Events are rate limited per domain, the
+// limit resets once the domain is found in its desired state.
+func (r *Reconciler) enqueueObject(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+
+	switch o := obj.(type) {
+	case *networkingV1.Ingress:
+		if !r.kube.ownsObject(o.Labels) {
+			return
+		}
+
+		if managed, ok := managedDomain("Ingress", o.Name, o.Annotations); ok {
+			r.queue.AddRateLimited(managed.Domain.VanityDomain)
+		}
+	case *v1.Secret:
+		if domain := secretDomain(o); domain != "" && r.kube.ownsObject(o.Labels) {
+			r.queue.AddRateLimited(domain)
+		}
+	case *unstructured.Unstructured:
+		if domain := o.GetAnnotations()[DomainAnnotation]; domain != "" && r.kube.ownsObject(o.GetLabels()) {
+			r.queue.AddRateLimited(domain)
+		}
+	}
+}
+
+// secretDomain returns the domain a TLS secret belongs to. Secrets written before the domain annotation existed
+// hold it in the domain label.
+func secretDomain(secret *v1.Secret) string {
+	if domain := secret.Annotations[DomainAnnotation]; domain != "" {
+		return domain
+	}
+
+	return secret.Labels[DomainLabel]
+}
+
+func (r *Reconciler) enqueueDesired() {
+	domains, err := r.desired.DesiredDomains()
+	if err != nil {
+		log.Printf("Failed to list desired domains: %s", err)
+		return
+	}
+
+	for _, managed := range domains {
+		r.queue.Add(managed.Domain.VanityDomain)
+	}
+}
+
+func (r *Reconciler) runWorker(ctx context.Context) {
+	for r.processNextItem(ctx) {
+	}
+}
+
+func (r *Reconciler) processNextItem(ctx context.Context) bool {
+	domain, shutdown := r.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer r.queue.Done(domain)
+
+	drifted, err := r.reconcile(ctx, domain)
+	if err != nil {
+		log.Printf("Failed to reconcile vanity domain %s: %s", domain, err)
+		r.queue.AddRateLimited(domain)
+		return true
+	}
+
+	// Our own repair comes back as an event, the backoff is kept until that shows the domain is settled
+	if !drifted {
+		r.queue.Forget(domain)
+	}
+
+	return true
+}
+
+// reconcile compares the live objects of a domain with its desired state and repairs them. It reports whether
+// anything had drifted.
+func (r *Reconciler) reconcile(ctx context.Context, domain string) (bool, error) {
+	managed, ok, err := r.desired.DesiredDomain(domain)
+	if err != nil {
+		return false, err
+	}
+
+	if !ok {
+		r.forget(domain)
+		return false, nil
+	}
+
+	// Whoever changed the objects owns the changed fields now, repairs take them back
+	ctx = withForceApply(ctx)
+	drifted := false
+
+	if r.ingress != nil {
+		ingressDrifted, err := r.reconcileIngress(ctx, managed)
+		if err != nil {
+			return false, err
+		}
+		drifted = ingressDrifted
+	}
+
+	if managed.Domain.ProvidedCertificate != nil {
+		secretDrifted, err := r.reconcileSecret(ctx, managed)
+		if err != nil {
+			return false, err
+		}
+		drifted = drifted || secretDrifted
+	} else if r.certificates != nil {
+		certificateDrifted, err := r.reconcileCertificate(ctx, managed)
+		if err != nil {
+			return false, err
+		}
+		drifted = drifted || certificateDrifted
+	}
+
+	if !drifted {
+		r.mu.Lock()
+		delete(r.reported, domain)
+		r.mu.Unlock()
+	}
+
+	return drifted, nil
+}
+
+func (r *Reconciler) reconcileIngress(ctx context.Context, managed ManagedDomain) (bool, error) {
+	desired, err := r.ingress.desiredIngress(managed.ReferenceID, managed.Domain)
+	if err != nil {
+		return false, err
+	}
+
+	drift := ""
+	live, err := r.ingresses.Ingresses(r.kube.Namespace).Get(desired.Name)
+	switch {
+	case apierrors.IsNotFound(err):
+		drift = fmt.Sprintf("Ingress %s/%s was deleted", r.kube.Namespace, desired.Name)
+	case err != nil:
+		return false, err
+	default:
+		drift = ingressDrift(live, desired)
+	}
+
+	if drift == "" {
+		return false, nil
+	}
+
+	return true, r.repair(managed, drift, func() error {
+		return r.ingress.SetRoute(ctx, managed.ReferenceID, managed.Domain)
+	})
+}
+
+// reconcileSecret checks a provided certificate is still in place. The registry never holds the private key, so
+// the secret can only be put back from the last good copy the informer saw.
+func (r *Reconciler) reconcileSecret(ctx context.Context, managed ManagedDomain) (bool, error) {
+	domain := managed.Domain.VanityDomain
+	name := tlsSecretName(managed.Domain)
+
+	live, err := r.secrets.Secrets(r.kube.Namespace).Get(name)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return false, err
+	}
+
+	if err == nil && string(live.Data["tls.crt"]) == managed.Domain.ProvidedCertificate.Cert && len(live.Data["tls.key"]) > 0 {
+		r.mu.Lock()
+		r.lastGood[domain] = live
+		r.mu.Unlock()
+		return false, nil
+	}
+
+	drift := fmt.Sprintf("Secret %s/%s was deleted", r.kube.Namespace, name)
+	if err == nil {
+		drift = fmt.Sprintf("certificate in Secret %s/%s was changed", r.kube.Namespace, name)
+	}
+
+	r.mu.Lock()
+	good := r.lastGood[domain]
+	r.mu.Unlock()
+
+	if good == nil {
+		r.report(managed, drift+", not repaired: the provided private key isn't kept, resubmit the job")
+		return true, nil
+	}
+
+	restored := managed.Domain
+	restored.ProvidedCertificate = &jobs.DomainCustomCert{
+		Cert: string(good.Data["tls.crt"]),
+		Key:  string(good.Data["tls.key"]),
+	}
+
+	return true, r.repair(managed, drift, func() error {
+		return r.kube.SetTLS(ctx, managed.ReferenceID, restored)
+	})
+}
+
+// reconcileCertificate checks the Certificate the manager created for a domain is still in place with the spec
+// of its owner's certificate profile.
+func (r *Reconciler) reconcileCertificate(ctx context.Context, managed ManagedDomain) (bool, error) {
+	desired, err := r.kube.desiredCertificate(managed.ReferenceID, managed.Owner, managed.Domain)
+	if err != nil {
+		return false, err
+	}
+
+	drift := ""
+	live, err := r.certificates.ByNamespace(r.kube.Namespace).Get(desired.GetName())
+	switch {
+	case apierrors.IsNotFound(err):
+		drift = fmt.Sprintf("Certificate %s/%s was deleted", r.kube.Namespace, desired.GetName())
+	case err != nil:
+		return false, err
+	default:
+		certificate, ok := live.(*unstructured.Unstructured)
+		if !ok {
+			return false, fmt.Errorf("unexpected certificate type %T", live)
+		}
+		drift = certificateDrift(certificate, desired)
+	}
+
+	if drift == "" {
+		return false, nil
+	}
+
+	return true, r.repair(managed, drift, func() error {
+		return r.kube.SetCertificate(ctx, managed.ReferenceID, managed.Owner, managed.Domain)
+	})
+}
+
+// repair runs fix and reports the drift with its outcome. Other errors are returned so the domain is retried
+// before anything is reported.
+func (r *Reconciler) repair(managed ManagedDomain, drift string, fix func() error) error {
+	// A job may have been queued for the domain since it was read, the repair would force its old state back
+	current, ok, err := r.desired.DesiredDomain(managed.Domain.VanityDomain)
+	if err != nil {
+		return err
+	}
+
+	if !ok || current.ReferenceID != managed.ReferenceID {
+		log.Printf("Not repairing vanity domain %s, a job is working on it: %s", managed.Domain.VanityDomain, drift)
+		return nil
+	}
+
+	err = fix()
+	if errors.Is(err, ErrUnmanagedObject) {
+		r.report(managed, fmt.Sprintf("%s, not repaired: %s", drift, err))
+		return nil
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to repair %s: %w", drift, err)
+	}
+
+	r.report(managed, drift+", repaired")
+	return nil
+}
+
+func (r *Reconciler) report(managed ManagedDomain, message string) {
+	domain := managed.Domain.VanityDomain
+
+	r.mu.Lock()
+	if r.reported[domain] == message {
+		r.mu.Unlock()
+		return
+	}
+	r.reported[domain] = message
+	r.mu.Unlock()
+
+	log.Printf("Vanity domain %s drifted: %s", domain, message)
+	r.desired.Drifted(managed, message)
+}
+
+func (r *Reconciler) forget(domain string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.lastGood, domain)
+	delete(r.reported, domain)
+}
+
+// ingressDrift describes how a live Ingress differs from the desired one. Labels and annotations added by others
+// are left alone, only the ones the manager sets are compared.
+func ingressDrift(live *networkingV1.Ingress, desired *networkingV1.Ingress) string {
+	name := fmt.Sprintf("Ingress %s/%s", live.Namespace, live.Name)
+
+	if !equality.Semantic.DeepEqual(live.Spec, desired.Spec) {
+		return fmt.Sprintf("spec of %s was changed", name)
+	}
+
+	for key, value := range desired.Labels {
+		if live.Labels[key] != value {
+			return fmt.Sprintf("label %s of %s was changed", key, name)
+		}
+	}
+
+	for key, value := range desired.Annotations {
+		if live.Annotations[key] != value {
+			return fmt.Sprintf("annotation %s of %s was changed", key, name)
+		}
+	}
+
+	return ""
+}
+
+// certificateDrift describes how a live Certificate differs from the desired one. Only the spec fields, labels and
+// annotations the manager sets are compared.
+func certificateDrift(live *unstructured.Unstructured, desired *unstructured.Unstructured) string {
+	name := fmt.Sprintf("Certificate %s/%s", live.GetNamespace(), live.GetName())
+
+	liveSpec, _, _ := unstructured.NestedMap(live.Object, "spec")
+	desiredSpec, _, _ := unstructured.NestedMap(desired.Object, "spec")
+	for key, value := range desiredSpec {
+		if !equality.Semantic.DeepEqual(liveSpec[key], value) {
+			return fmt.Sprintf("spec.%s of %s was changed", key, name)
+		}
+	}
+
+	for key, value := range desired.GetLabels() {
+		if live.GetLabels()[key] != value {
+			return fmt.Sprintf("label %s of %s was changed", key, name)
+		}
+	}
+
+	for key, value := range desired.GetAnnotations() {
+		if live.GetAnnotations()[key] != value {
+			return fmt.Sprintf("annotation %s of %s was changed", key, name)
+		}
+	}
+
+	return ""
+}
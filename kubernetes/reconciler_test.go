@@ -0,0 +1,377 @@
+package kubernetes
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/geekgonecrazy/vanityDomainManager/config"
+	"github.com/geekgonecrazy/vanityDomainManager/jobs"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+)
+
+type testDesiredState struct {
+	domains map[string]ManagedDomain
+	drifts  []string
+}
+
+func (s *testDesiredState) DesiredDomains() ([]ManagedDomain, error) {
+	domains := []ManagedDomain{}
+	for _, managed := range s.domains {
+		domains = append(domains, managed)
+	}
+	return domains, nil
+}
+
+func (s *testDesiredState) DesiredDomain(domain string) (ManagedDomain, bool, error) {
+	managed, ok := s.domains[domain]
+	return managed, ok, nil
+}
+
+func (s *testDesiredState) Drifted(managed ManagedDomain, message string) {
+	s.drifts = append(s.drifts, message)
+}
+
+// newTestReconciler starts the informers of a reconciler without its workers, so tests drive reconcile directly.
+func newTestReconciler(t *testing.T, c *KubeClient, desired DesiredState) *Reconciler {
+	t.Helper()
+
+	r, err := c.NewReconciler(desired, 0)
+	if err != nil {
+		t.Fatalf("Failed to create reconciler: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	r.factory.Start(ctx.Done())
+	if r.certificateFactory != nil {
+		r.certificateFactory.Start(ctx.Done())
+	}
+	if !cache.WaitForCacheSync(ctx.Done(), r.synced...) {
+		t.Fatalf("Expected the informer caches to sync")
+	}
+
+	return r
+}
+
+// waitForCache waits until the informers have caught up with a change made through the client.
+func waitForCache(t *testing.T, r *Reconciler, ready func() bool) {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if !cache.WaitForCacheSync(ctx.Done(), ready) {
+		t.Fatalf("Expected the informer cache to catch up")
+	}
+}
+
+func TestReconcilerRepairsIngress(t *testing.T) {
+	c := newDynamicTestClient(t)
+	c.client = fake.NewClientset()
+	c.routing = &ingressProvider{kube: c}
+	ctx := context.Background()
+
+	domain := jobs.VanityDomain{VanityDomain: "example.org", DesiredDNSTargetType: "CNAME", DesiredCNAMETarget: "lb.example.net"}
+	if err := c.SetVanityDomain(ctx, "ref-1", domain); err != nil {
+		t.Fatalf("Failed to set vanity domain: %v", err)
+	}
+
+	desired := &testDesiredState{domains: map[string]ManagedDomain{"example.org": {Domain: domain, ReferenceID: "ref-1"}}}
+	r := newTestReconciler(t, c, desired)
+
+	if drifted, err := r.reconcile(ctx, "example.org"); err != nil || drifted {
+		t.Fatalf("Expected no drift on a fresh ingress, got %v (%v)", drifted, err)
+	}
+
+	// Someone points the ingress at another service
+	ingress, _ := c.client.NetworkingV1().Ingresses("vanity").Get(ctx, routeName(domain), metaV1.GetOptions{})
+	ingress.Spec.Rules[0].HTTP.Paths[0].Backend.Service.Name = "elsewhere"
+	if _, err := c.client.NetworkingV1().Ingresses("vanity").Update(ctx, ingress, metaV1.UpdateOptions{}); err != nil {
+		t.Fatalf("Failed to edit ingress: %v", err)
+	}
+
+	waitForCache(t, r, func() bool {
+		live, err := r.ingresses.Ingresses("vanity").Get(routeName(domain))
+		return err == nil && live.Spec.Rules[0].HTTP.Paths[0].Backend.Service.Name == "elsewhere"
+	})
+
+	if drifted, err := r.reconcile(ctx, "example.org"); err != nil || !drifted {
+		t.Fatalf("Expected the edit to be found, got %v (%v)", drifted, err)
+	}
+
+	ingress, _ = c.client.NetworkingV1().Ingresses("vanity").Get(ctx, routeName(domain), metaV1.GetOptions{})
+	if ingress.Spec.Rules[0].HTTP.Paths[0].Backend.Service.Name != "web" {
+		t.Errorf("Expected the backend to be repaired, got %s", ingress.Spec.Rules[0].HTTP.Paths[0].Backend.Service.Name)
+	}
+
+	// Deleted outright
+	if err := c.client.NetworkingV1().Ingresses("vanity").Delete(ctx, routeName(domain), metaV1.DeleteOptions{}); err != nil {
+		t.Fatalf("Failed to delete ingress: %v", err)
+	}
+
+	waitForCache(t, r, func() bool {
+		_, err := r.ingresses.Ingresses("vanity").Get(routeName(domain))
+		return err != nil
+	})
+
+	if _, err := r.reconcile(ctx, "example.org"); err != nil {
+		t.Fatalf("Failed to reconcile: %v", err)
+	}
+
+	if _, err := c.client.NetworkingV1().Ingresses("vanity").Get(ctx, routeName(domain), metaV1.GetOptions{}); err != nil {
+		t.Errorf("Expected the ingress to be recreated, got %v", err)
+	}
+
+	if len(desired.drifts) != 2 || !strings.Contains(desired.drifts[0], "spec") || !strings.Contains(desired.drifts[1], "deleted") {
+		t.Errorf("Unexpected drift reports %v", desired.drifts)
+	}
+}
+
+func TestReconcilerRepairsCertificate(t *testing.T) {
+	c := newDynamicTestClient(t)
+	c.client = fake.NewClientset()
+	c.routing = &ingressProvider{kube: c}
+	c.certificates = config.CertificatesConfig{
+		Mode:               "explicit",
+		CertificateProfile: config.CertificateProfile{IssuerRef: config.CertificateIssuerRef{Name: "letsencrypt", Kind: "ClusterIssuer"}},
+		Tenants:            map[string]config.CertificateProfile{"acme": {IssuerRef: config.CertificateIssuerRef{Name: "acme-ca", Kind: "Issuer"}}},
+	}
+	ctx := context.Background()
+	certificates := c.dynamic.Resource(certificateResource).Namespace("vanity")
+
+	domain := jobs.VanityDomain{VanityDomain: "example.org", DesiredDNSTargetType: "CNAME", DesiredCNAMETarget: "lb.example.net"}
+	if err := c.SetCertificate(ctx, "ref-1", "acme", domain); err != nil {
+		t.Fatalf("Failed to set certificate: %v", err)
+	}
+
+	if err := c.SetVanityDomain(ctx, "ref-1", domain); err != nil {
+		t.Fatalf("Failed to set vanity domain: %v", err)
+	}
+
+	desired := &testDesiredState{domains: map[string]ManagedDomain{"example.org": {Domain: domain, ReferenceID: "ref-1", Owner: "acme"}}}
+	r := newTestReconciler(t, c, desired)
+
+	if drifted, err := r.reconcile(ctx, "example.org"); err != nil || drifted {
+		t.Fatalf("Expected no drift on a fresh certificate, got %v (%v)", drifted, err)
+	}
+
+	// Someone switches the certificate to another issuer
+	cert, _ := certificates.Get(ctx, tlsSecretName(domain), metaV1.GetOptions{})
+	if err := unstructured.SetNestedField(cert.Object, "elsewhere", "spec", "issuerRef", "name"); err != nil {
+		t.Fatalf("Failed to edit certificate: %v", err)
+	}
+	if _, err := certificates.Update(ctx, cert, metaV1.UpdateOptions{}); err != nil {
+		t.Fatalf("Failed to edit certificate: %v", err)
+	}
+
+	waitForCache(t, r, func() bool {
+		live, err := r.certificates.ByNamespace("vanity").Get(tlsSecretName(domain))
+		if err != nil {
+			return false
+		}
+		issuer, _, _ := unstructured.NestedString(live.(*unstructured.Unstructured).Object, "spec", "issuerRef", "name")
+		return issuer == "elsewhere"
+	})
+
+	if drifted, err := r.reconcile(ctx, "example.org"); err != nil || !drifted {
+		t.Fatalf("Expected the edit to be found, got %v (%v)", drifted, err)
+	}
+
+	cert, _ = certificates.Get(ctx, tlsSecretName(domain), metaV1.GetOptions{})
+	if issuer, _, _ := unstructured.NestedString(cert.Object, "spec", "issuerRef", "name"); issuer != "acme-ca" {
+		t.Errorf("Expected the owner's issuer to be restored, got %s", issuer)
+	}
+
+	// Deleted outright
+	if err := certificates.Delete(ctx, tlsSecretName(domain), metaV1.DeleteOptions{}); err != nil {
+		t.Fatalf("Failed to delete certificate: %v", err)
+	}
+
+	waitForCache(t, r, func() bool {
+		_, err := r.certificates.ByNamespace("vanity").Get(tlsSecretName(domain))
+		return err != nil
+	})
+
+	if _, err := r.reconcile(ctx, "example.org"); err != nil {
+		t.Fatalf("Failed to reconcile: %v", err)
+	}
+
+	cert, err := certificates.Get(ctx, tlsSecretName(domain), metaV1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Expected the certificate to be recreated, got %v", err)
+	}
+
+	if issuer, _, _ := unstructured.NestedString(cert.Object, "spec", "issuerRef", "name"); issuer != "acme-ca" {
+		t.Errorf("Expected the recreated certificate to use the owner's issuer, got %s", issuer)
+	}
+
+	if len(desired.drifts) != 2 || !strings.Contains(desired.drifts[0], "spec.issuerRef") || !strings.Contains(desired.drifts[1], "deleted") {
+		t.Errorf("Unexpected drift reports %v", desired.drifts)
+	}
+}
+
+func TestReconcilerRestoresProvidedSecret(t *testing.T) {
+	c := newDynamicTestClient(t)
+	c.client = fake.NewClientset()
+	c.routing = &traefikProvider{kube: c}
+	ctx := context.Background()
+
+	domain := jobs.VanityDomain{VanityDomain: "example.org", ProvidedCertificate: &jobs.DomainCustomCert{Cert: "CERT", Key: "KEY"}}
+	if err := c.SetTLS(ctx, "ref-1", domain); err != nil {
+		t.Fatalf("Failed to set TLS: %v", err)
+	}
+
+	// The registry keeps the certificate but not the key
+	recorded := domain
+	recorded.ProvidedCertificate = &jobs.DomainCustomCert{Cert: "CERT"}
+	desired := &testDesiredState{domains: map[string]ManagedDomain{"example.org": {Domain: recorded, ReferenceID: "ref-1"}}}
+	r := newTestReconciler(t, c, desired)
+
+	if r.ingresses != nil {
+		t.Errorf("Expected ingresses not to be watched with the traefik backend")
+	}
+
+	if drifted, err := r.reconcile(ctx, "example.org"); err != nil || drifted {
+		t.Fatalf("Expected no drift, got %v (%v)", drifted, err)
+	}
+
+	if err := c.client.CoreV1().Secrets("vanity").Delete(ctx, tlsSecretName(domain), metaV1.DeleteOptions{}); err != nil {
+		t.Fatalf("Failed to delete secret: %v", err)
+	}
+
+	waitForCache(t, r, func() bool {
+		_, err := r.secrets.Secrets("vanity").Get(tlsSecretName(domain))
+		return err != nil
+	})
+
+	if drifted, err := r.reconcile(ctx, "example.org"); err != nil || !drifted {
+		t.Fatalf("Expected the deletion to be found, got %v (%v)", drifted, err)
+	}
+
+	secret, err := c.client.CoreV1().Secrets("vanity").Get(ctx, tlsSecretName(domain), metaV1.GetOptions{})
+	if err != nil || string(secret.Data["tls.key"]) != "KEY" {
+		t.Fatalf("Expected the secret to be restored with its key, got %v", err)
+	}
+
+	// Without a good copy there is nothing to restore from, which is reported once
+	r.forget("example.org")
+	if err := c.client.CoreV1().Secrets("vanity").Delete(ctx, tlsSecretName(domain), metaV1.DeleteOptions{}); err != nil {
+		t.Fatalf("Failed to delete secret: %v", err)
+	}
+
+	waitForCache(t, r, func() bool {
+		_, err := r.secrets.Secrets("vanity").Get(tlsSecretName(domain))
+		return err != nil
+	})
+
+	r.reconcile(ctx, "example.org")
+	r.reconcile(ctx, "example.org")
+
+	if len(desired.drifts) != 2 || !strings.Contains(desired.drifts[1], "not repaired") {
+		t.Errorf("Unexpected drift reports %v", desired.drifts)
+	}
+}
+
+// jobStartingState is a desired state where a job is queued for every domain right after the reconciler read it.
+type jobStartingState struct {
+	testDesiredState
+	reads int
+}
+
+func (s *jobStartingState) DesiredDomain(domain string) (ManagedDomain, bool, error) {
+	s.reads++
+	if s.reads > 1 {
+		return ManagedDomain{}, false, nil
+	}
+
+	return s.testDesiredState.DesiredDomain(domain)
+}
+
+func TestReconcilerLeavesDomainsToJobs(t *testing.T) {
+	c := newDynamicTestClient(t)
+	c.client = fake.NewClientset()
+	c.routing = &ingressProvider{kube: c}
+	ctx := context.Background()
+
+	domain := jobs.VanityDomain{VanityDomain: "example.org", DesiredDNSTargetType: "CNAME", DesiredCNAMETarget: "lb.example.net"}
+	if err := c.SetVanityDomain(ctx, "ref-1", domain); err != nil {
+		t.Fatalf("Failed to set vanity domain: %v", err)
+	}
+
+	desired := &jobStartingState{testDesiredState: testDesiredState{domains: map[string]ManagedDomain{"example.org": {Domain: domain, ReferenceID: "ref-1"}}}}
+	r := newTestReconciler(t, c, desired)
+
+	// The job repoints the ingress while the reconciler looks at it
+	ingress, _ := c.client.NetworkingV1().Ingresses("vanity").Get(ctx, routeName(domain), metaV1.GetOptions{})
+	ingress.Spec.Rules[0].HTTP.Paths[0].Backend.Service.Name = "web-v2"
+	if _, err := c.client.NetworkingV1().Ingresses("vanity").Update(ctx, ingress, metaV1.UpdateOptions{}); err != nil {
+		t.Fatalf("Failed to edit ingress: %v", err)
+	}
+
+	waitForCache(t, r, func() bool {
+		live, err := r.ingresses.Ingresses("vanity").Get(routeName(domain))
+		return err == nil && live.Spec.Rules[0].HTTP.Paths[0].Backend.Service.Name == "web-v2"
+	})
+
+	if _, err := r.reconcile(ctx, "example.org"); err != nil {
+		t.Fatalf("Failed to reconcile: %v", err)
+	}
+
+	ingress, _ = c.client.NetworkingV1().Ingresses("vanity").Get(ctx, routeName(domain), metaV1.GetOptions{})
+	if ingress.Spec.Rules[0].HTTP.Paths[0].Backend.Service.Name != "web-v2" || len(desired.drifts) != 0 {
+		t.Errorf("Expected the job's change to be left alone, got %s and drifts %v", ingress.Spec.Rules[0].HTTP.Paths[0].Backend.Service.Name, desired.drifts)
+	}
+}
+
+func TestRunLeaderElected(t *testing.T) {
+	client := fake.NewClientset()
+	leading := make(chan string, 2)
+
+	cancels := map[string]context.CancelFunc{}
+	for _, replica := range []string{"a", "b"} {
+		c := &KubeClient{client: client, Namespace: "vanity", Environment: "Test"}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancels[replica] = cancel
+		t.Cleanup(cancel)
+
+		if err := c.RunLeaderElected(ctx, "reconciler", func(context.Context) { leading <- replica }); err != nil {
+			t.Fatalf("Failed to run leader election: %v", err)
+		}
+	}
+
+	var leader string
+	select {
+	case leader = <-leading:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Expected a replica to lead")
+	}
+
+	select {
+	case other := <-leading:
+		t.Fatalf("Expected a single leader, got %s and %s", leader, other)
+	case <-time.After(3 * time.Second):
+	}
+
+	if _, err := client.CoordinationV1().Leases("vanity").Get(context.Background(), "vanitydomainmanager-test-reconciler", metaV1.GetOptions{}); err != nil {
+		t.Fatalf("Failed to get lease: %v", err)
+	}
+
+	// The leader going away hands over to the other replica
+	cancels[leader]()
+
+	select {
+	case next := <-leading:
+		if next == leader {
+			t.Errorf("Expected the other replica to take over, got %s again", next)
+		}
+	case <-time.After(10 * time.Second):
+		t.Error("Expected the other replica to take over")
+	}
+}
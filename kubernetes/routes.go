@@ -0,0 +1,74 @@
+package kubernetes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/geekgonecrazy/vanityDomainManager/jobs"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ErrInvalidRoute is returned for a domain or route that can't be written into a routing object as it is. Retrying
+// can't help, the job has to be resubmitted.
+var ErrInvalidRoute = errors.New("route can't be written into a routing object")
+
+// domainRoutes resolves the routes of a domain with defaults filled in. A domain without routes gets the single
+// catch-all path every vanity domain had before routes existed.
+func (c *KubeClient) domainRoutes(job jobs.VanityDomain) []jobs.Route {
+	if len(job.Routes) == 0 {
+		return []jobs.Route{{
+			PathType:    "ImplementationSpecific",
+			ServiceName: c.ServiceName,
+			ServicePort: c.ServicePort,
+		}}
+	}
+
+	routes := make([]jobs.Route, 0, len(job.Routes))
+	for _, route := range job.Routes {
+		if route.PathType == "" {
+			route.PathType = "Prefix"
+		}
+
+		if route.ServiceName == "" {
+			route.ServiceName = c.ServiceName
+			route.ServicePort = c.ServicePort
+		}
+
+		routes = append(routes, route)
+	}
+
+	return routes
+}
+
+// validateRoutes checks that every service a job routes to exists and exposes the port.
+func (c *KubeClient) validateRoutes(ctx context.Context, job jobs.VanityDomain) error {
+	for _, route := range job.Routes {
+		if route.ServiceName == "" {
+			continue
+		}
+
+		service, err := c.client.CoreV1().Services(c.Namespace).Get(ctx, route.ServiceName, metaV1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			return fmt.Errorf("route %s for vanity domain %s targets service %s, which doesn't exist", route.Path, job.VanityDomain, route.ServiceName)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to get service %s for vanity domain %s: %v", route.ServiceName, job.VanityDomain, err)
+		}
+
+		found := false
+		for _, port := range service.Spec.Ports {
+			if port.Port == route.ServicePort {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return fmt.Errorf("route %s for vanity domain %s targets port %d, which service %s doesn't expose", route.Path, job.VanityDomain, route.ServicePort, route.ServiceName)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,214 @@
+package kubernetes
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/geekgonecrazy/vanityDomainManager/config"
+	"github.com/geekgonecrazy/vanityDomainManager/jobs"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/retry"
+)
+
+// RoutingProvider exposes vanity domains through one kind of routing object. Every object it writes carries the
+// managed-by label and the domain spec annotations so ListManagedDomains can recover them.
+type RoutingProvider interface {
+	// SetRoute creates or updates the routing object for the domain.
+	SetRoute(ctx context.Context, referenceID string, job jobs.VanityDomain) error
+	// UnSetRoute removes the routing object called name, a missing object is not an error. name is routeName(job)
+	// except for objects written under the legacy naming scheme.
+	UnSetRoute(ctx context.Context, name string, job jobs.VanityDomain) error
+	// ListManagedDomains returns every vanity domain with a routing object written by the manager.
+	ListManagedDomains(ctx context.Context) ([]ManagedDomain, error)
+	// DisableRoute keeps the routing object but marks it with state and stops certificate issuance for it.
+	DisableRoute(ctx context.Context, job jobs.VanityDomain, state string) error
+}
+
+// newRoutingProvider returns the provider for the configured cluster.routingBackend.
+func newRoutingProvider(kube *KubeClient, clusterConfig config.ClusterConfig) (RoutingProvider, error) {
+	switch clusterConfig.RoutingBackend {
+	case "", "ingress":
+		return &ingressProvider{kube: kube}, nil
+	case "gateway":
+		return &gatewayProvider{kube: kube, config: clusterConfig.Gateway}, nil
+	case "traefik":
+		return &traefikProvider{kube: kube, config: clusterConfig.Traefik}, nil
+	case "openshift":
+		return &openshiftProvider{kube: kube, config: clusterConfig.OpenShift}, nil
+	default:
+		return nil, fmt.Errorf("unknown routing backend %q", clusterConfig.RoutingBackend)
+	}
+}
+
+// SetVanityDomain creates or updates the routing object for the provided vanity domain.
+func (c *KubeClient) SetVanityDomain(ctx context.Context, referenceID string, job jobs.VanityDomain) error {
+	if err := c.validateRoutes(ctx, job); err != nil {
+		return err
+	}
+
+	if err := c.checkLegacyRoute(ctx, job); err != nil {
+		return err
+	}
+
+	return c.routing.SetRoute(ctx, referenceID, job)
+}
+
+// UnSetVanityDomain deletes the routing object for the provided vanity domain.
+func (c *KubeClient) UnSetVanityDomain(ctx context.Context, job jobs.VanityDomain) error {
+	if err := c.checkLegacyRoute(ctx, job); err != nil {
+		return err
+	}
+
+	return c.routing.UnSetRoute(ctx, routeName(job), job)
+}
+
+// ListManagedDomains returns every vanity domain that has a routing object written by the manager.
+func (c *KubeClient) ListManagedDomains(ctx context.Context) ([]ManagedDomain, error) {
+	return c.routing.ListManagedDomains(ctx)
+}
+
+// DisableVanityDomain keeps the routing object in place but marks it with the given state and stops certificate
+// issuance for it.
+func (c *KubeClient) DisableVanityDomain(ctx context.Context, job jobs.VanityDomain, state string) error {
+	if err := c.routing.DisableRoute(ctx, job, state); err != nil {
+		return err
+	}
+
+	// The issued secret stays and keeps serving until it expires
+	if c.ManagesCertificates() {
+		return c.UnSetCertificate(ctx, job)
+	}
+
+	return nil
+}
+
+// managedObjectMeta is the unstructured metadata every routing object written by the manager carries.
+func (c *KubeClient) managedObjectMeta(name string, referenceID string, job jobs.VanityDomain) (map[string]interface{}, error) {
+	labels, annotations, err := c.objectMetadata(referenceID, job)
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{
+		"name":        name,
+		"namespace":   c.Namespace,
+		"labels":      toUnstructuredMap(labels),
+		"annotations": toUnstructuredMap(annotations),
+	}, nil
+}
+
+// applyUnstructured applies obj if the manager owns the existing object of the same name, or there is none. Fields
+// other controllers set on the object are kept.
+func (c *KubeClient) applyUnstructured(ctx context.Context, resource schema.GroupVersionResource, obj *unstructured.Unstructured, job jobs.VanityDomain) error {
+	client := c.dynamic.Resource(resource).Namespace(obj.GetNamespace())
+
+	existing, err := client.Get(ctx, obj.GetName(), metaV1.GetOptions{})
+	switch {
+	case apierrors.IsNotFound(err):
+	case err != nil:
+		return err
+	default:
+		if err := c.checkOwnership(existing.GetKind(), existing.GetName(), existing.GetLabels(), job); err != nil {
+			return err
+		}
+
+		err := upgradeManagedFields(existing, func(data []byte, opts metaV1.PatchOptions) error {
+			_, err := client.Patch(ctx, obj.GetName(), types.JSONPatchType, data, opts)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to upgrade field managers of %s %s: %v", obj.GetKind(), obj.GetName(), err)
+		}
+	}
+
+	if _, err := client.Apply(ctx, obj.GetName(), obj, applyOptions(ctx, job)); err != nil {
+		return applyError(obj.GetKind(), obj.GetNamespace(), obj.GetName(), err)
+	}
+
+	return nil
+}
+
+// deleteUnstructured deletes a namespaced object the manager owns, a missing object is not an error.
+func (c *KubeClient) deleteUnstructured(ctx context.Context, resource schema.GroupVersionResource, name string, job jobs.VanityDomain) error {
+	client := c.dynamic.Resource(resource).Namespace(c.Namespace)
+
+	existing, err := client.Get(ctx, name, metaV1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := c.checkOwnership(existing.GetKind(), name, existing.GetLabels(), job); err != nil {
+		return err
+	}
+
+	err = client.Delete(ctx, name, deleteIfUnchanged(existing))
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+
+	return nil
+}
+
+// listManagedUnstructured recovers the managed domains from every object of resource written by the manager.
+func (c *KubeClient) listManagedUnstructured(ctx context.Context, resource schema.GroupVersionResource, kind string) ([]ManagedDomain, error) {
+	objects, err := c.dynamic.Resource(resource).Namespace(c.Namespace).List(ctx, metaV1.ListOptions{
+		LabelSelector: fmt.Sprintf("%s=%s", ManagedByLabel, ManagedByValue),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list managed %s: %v", resource.Resource, err)
+	}
+
+	domains := []ManagedDomain{}
+	for _, obj := range objects.Items {
+		if managed, ok := managedDomain(kind, obj.GetName(), obj.GetAnnotations()); ok {
+			domains = append(domains, managed)
+		}
+	}
+
+	return domains, nil
+}
+
+// markUnstructured sets the state annotation on an object and removes the given annotations, usually the ones that
+// ask cert-manager for a certificate.
+func (c *KubeClient) markUnstructured(ctx context.Context, resource schema.GroupVersionResource, name string, state string, remove ...string) error {
+	return c.updateUnstructured(ctx, resource, name, func(obj *unstructured.Unstructured) error {
+		annotations := obj.GetAnnotations()
+		if annotations == nil {
+			annotations = map[string]string{}
+		}
+
+		for _, key := range remove {
+			delete(annotations, key)
+		}
+		annotations[StateAnnotation] = state
+		obj.SetAnnotations(annotations)
+
+		return nil
+	})
+}
+
+// updateUnstructured applies mutate to the live object, retrying when another writer changed it in between.
+func (c *KubeClient) updateUnstructured(ctx context.Context, resource schema.GroupVersionResource, name string, mutate func(*unstructured.Unstructured) error) error {
+	client := c.dynamic.Resource(resource).Namespace(c.Namespace)
+
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		obj, err := client.Get(ctx, name, metaV1.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		if err := mutate(obj); err != nil {
+			return err
+		}
+
+		_, err = client.Update(ctx, obj, metaV1.UpdateOptions{FieldManager: FieldManager})
+		return err
+	})
+}
@@ -0,0 +1,347 @@
+package kubernetes
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/geekgonecrazy/vanityDomainManager/config"
+	"github.com/geekgonecrazy/vanityDomainManager/jobs"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	clienttesting "k8s.io/client-go/testing"
+)
+
+// newDynamicTestClient returns a client backed by a fake dynamic client that knows every routing resource.
+func newDynamicTestClient(t *testing.T) *KubeClient {
+	t.Helper()
+
+	listKinds := map[schema.GroupVersionResource]string{
+		httpRouteResource:          "HTTPRouteList",
+		gatewayResource:            "GatewayList",
+		referenceGrantResource:     "ReferenceGrantList",
+		ingressRouteResource:       "IngressRouteList",
+		routeResource:              "RouteList",
+		certificateResource:        "CertificateList",
+		certificateRequestResource: "CertificateRequestList",
+		orderResource:              "OrderList",
+	}
+
+	dynamicClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), listKinds)
+	dynamicClient.PrependReactor("patch", "*", applyReactor(dynamicClient.Tracker()))
+
+	return &KubeClient{
+		dynamic:           dynamicClient,
+		Namespace:         "vanity",
+		CertManagerIssuer: "letsencrypt",
+		ServiceName:       "web",
+		ServicePort:       8080,
+	}
+}
+
+// applyReactor stands in for server-side apply, which the fake dynamic client only supports on existing objects.
+// The applied object replaces the stored one, field ownership isn't tracked.
+func applyReactor(tracker clienttesting.ObjectTracker) clienttesting.ReactionFunc {
+	return func(action clienttesting.Action) (bool, runtime.Object, error) {
+		patch, ok := action.(clienttesting.PatchActionImpl)
+		if !ok || patch.GetPatchType() != types.ApplyPatchType {
+			return false, nil, nil
+		}
+
+		obj := &unstructured.Unstructured{}
+		if err := obj.UnmarshalJSON(patch.GetPatch()); err != nil {
+			return true, nil, err
+		}
+
+		resource, namespace := patch.GetResource(), patch.GetNamespace()
+		if _, err := tracker.Get(resource, namespace, patch.GetName()); apierrors.IsNotFound(err) {
+			return true, obj, tracker.Create(resource, obj, namespace)
+		}
+
+		return true, obj, tracker.Update(resource, obj, namespace)
+	}
+}
+
+func newGatewayTestClient(t *testing.T, gatewayNamespace string) *KubeClient {
+	t.Helper()
+
+	c := newDynamicTestClient(t)
+	c.routing = &gatewayProvider{kube: c, config: config.GatewayConfig{
+		Name:         "public",
+		Namespace:    gatewayNamespace,
+		TLS:          "listener",
+		ListenerPort: 443,
+	}}
+
+	gateway := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": gatewayResource.GroupVersion().String(),
+		"kind":       "Gateway",
+		"metadata": map[string]interface{}{
+			"name":      "public",
+			"namespace": gatewayNamespace,
+		},
+		"spec": map[string]interface{}{
+			"gatewayClassName": "example",
+			"listeners": []interface{}{
+				map[string]interface{}{"name": "http", "port": int64(80), "protocol": "HTTP"},
+			},
+		},
+	}}
+
+	if _, err := c.dynamic.Resource(gatewayResource).Namespace(gatewayNamespace).Create(context.Background(), gateway, metaV1.CreateOptions{}); err != nil {
+		t.Fatalf("Failed to create gateway: %v", err)
+	}
+
+	return c
+}
+
+func gatewayListeners(t *testing.T, c *KubeClient) []interface{} {
+	t.Helper()
+
+	gateway, err := c.dynamic.Resource(gatewayResource).Namespace("gateways").Get(context.Background(), "public", metaV1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Failed to get gateway: %v", err)
+	}
+
+	listeners, _, _ := unstructured.NestedSlice(gateway.Object, "spec", "listeners")
+	return listeners
+}
+
+func TestGatewayRouteLifecycle(t *testing.T) {
+	c := newGatewayTestClient(t, "gateways")
+	ctx := context.Background()
+	domain := jobs.VanityDomain{VanityDomain: "shop.example.com", DesiredDNSTargetType: "CNAME", DesiredCNAMETarget: "lb.example.net"}
+
+	if err := c.SetVanityDomain(ctx, "ref-1", domain); err != nil {
+		t.Fatalf("Failed to set vanity domain: %v", err)
+	}
+
+	// Setting the same domain again must update in place rather than duplicate anything
+	if err := c.SetVanityDomain(ctx, "ref-2", domain); err != nil {
+		t.Fatalf("Failed to set vanity domain again: %v", err)
+	}
+
+	route, err := c.dynamic.Resource(httpRouteResource).Namespace("vanity").Get(ctx, routeName(domain), metaV1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Failed to get HTTPRoute: %v", err)
+	}
+
+	hostnames, _, _ := unstructured.NestedStringSlice(route.Object, "spec", "hostnames")
+	if len(hostnames) != 1 || hostnames[0] != "shop.example.com" {
+		t.Errorf("Unexpected hostnames %v", hostnames)
+	}
+
+	listeners := gatewayListeners(t, c)
+	if len(listeners) != 2 {
+		t.Fatalf("Expected the http listener and one https listener, got %d", len(listeners))
+	}
+
+	if _, err := c.dynamic.Resource(referenceGrantResource).Namespace("vanity").Get(ctx, tlsSecretName(domain), metaV1.GetOptions{}); err != nil {
+		t.Errorf("Expected a referencegrant for a gateway in another namespace, got %v", err)
+	}
+
+	managed, err := c.ListManagedDomains(ctx)
+	if err != nil {
+		t.Fatalf("Failed to list managed domains: %v", err)
+	}
+
+	if len(managed) != 1 || managed[0].ReferenceID != "ref-2" || managed[0].Domain.DesiredCNAMETarget != "lb.example.net" {
+		t.Errorf("Unexpected managed domains %+v", managed)
+	}
+
+	if err := c.UnSetVanityDomain(ctx, domain); err != nil {
+		t.Fatalf("Failed to unset vanity domain: %v", err)
+	}
+
+	if _, err := c.dynamic.Resource(httpRouteResource).Namespace("vanity").Get(ctx, routeName(domain), metaV1.GetOptions{}); err == nil {
+		t.Errorf("Expected httproute to be removed")
+	}
+
+	if listeners := gatewayListeners(t, c); len(listeners) != 1 {
+		t.Errorf("Expected only the http listener to remain, got %d", len(listeners))
+	}
+
+	if _, err := c.dynamic.Resource(referenceGrantResource).Namespace("vanity").Get(ctx, tlsSecretName(domain), metaV1.GetOptions{}); err == nil {
+		t.Errorf("Expected referencegrant to be removed")
+	}
+}
+
+func TestGatewaySameNamespaceSkipsReferenceGrant(t *testing.T) {
+	c := newGatewayTestClient(t, "vanity")
+	ctx := context.Background()
+
+	if err := c.SetVanityDomain(ctx, "ref-1", jobs.VanityDomain{VanityDomain: "example.org"}); err != nil {
+		t.Fatalf("Failed to set vanity domain: %v", err)
+	}
+
+	grants, err := c.dynamic.Resource(referenceGrantResource).Namespace("vanity").List(ctx, metaV1.ListOptions{})
+	if err != nil {
+		t.Fatalf("Failed to list ReferenceGrants: %v", err)
+	}
+
+	if len(grants.Items) != 0 {
+		t.Errorf("Expected no referencegrant when the gateway shares the namespace, got %d", len(grants.Items))
+	}
+}
+
+func TestTraefikRouteUsesResolverWithoutProvidedCertificate(t *testing.T) {
+	c := newDynamicTestClient(t)
+	c.routing = &traefikProvider{kube: c, config: config.TraefikConfig{EntryPoints: []string{"websecure"}, CertResolver: "le"}}
+	ctx := context.Background()
+	domain := jobs.VanityDomain{VanityDomain: "example.org"}
+
+	if err := c.SetVanityDomain(ctx, "ref-1", domain); err != nil {
+		t.Fatalf("Failed to set vanity domain: %v", err)
+	}
+
+	route, err := c.dynamic.Resource(ingressRouteResource).Namespace("vanity").Get(ctx, routeName(domain), metaV1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Failed to get IngressRoute: %v", err)
+	}
+
+	if resolver, _, _ := unstructured.NestedString(route.Object, "spec", "tls", "certResolver"); resolver != "le" {
+		t.Errorf("Expected certResolver le, got %q", resolver)
+	}
+
+	if err := c.DisableVanityDomain(ctx, domain, jobs.StateDNSDrifted); err != nil {
+		t.Fatalf("Failed to disable vanity domain: %v", err)
+	}
+
+	route, _ = c.dynamic.Resource(ingressRouteResource).Namespace("vanity").Get(ctx, routeName(domain), metaV1.GetOptions{})
+	if _, found, _ := unstructured.NestedString(route.Object, "spec", "tls", "certResolver"); found {
+		t.Errorf("Expected certResolver to be dropped from a disabled route")
+	}
+
+	if route.GetAnnotations()[StateAnnotation] != jobs.StateDNSDrifted {
+		t.Errorf("Expected state annotation %q, got %q", jobs.StateDNSDrifted, route.GetAnnotations()[StateAnnotation])
+	}
+}
+
+func TestOpenShiftRouteInlinesProvidedCertificate(t *testing.T) {
+	c := newDynamicTestClient(t)
+	c.routing = &openshiftProvider{kube: c, config: config.OpenShiftConfig{Termination: "edge", InsecureEdgeTerminationPolicy: "Redirect"}}
+	ctx := context.Background()
+
+	provided := jobs.VanityDomain{VanityDomain: "provided.example.org", ProvidedCertificate: &jobs.DomainCustomCert{Cert: "CERT", Key: "KEY"}}
+	if err := c.SetVanityDomain(ctx, "ref-1", provided); err != nil {
+		t.Fatalf("Failed to set vanity domain: %v", err)
+	}
+
+	route, err := c.dynamic.Resource(routeResource).Namespace("vanity").Get(ctx, routeName(provided), metaV1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Failed to get route: %v", err)
+	}
+
+	if key, _, _ := unstructured.NestedString(route.Object, "spec", "tls", "key"); key != "KEY" {
+		t.Errorf("Expected the provided key inline, got %q", key)
+	}
+
+	if _, ok := route.GetAnnotations()[openshiftIssuerNameAnnotation]; ok {
+		t.Errorf("Expected no cert-manager issuer for a provided certificate")
+	}
+
+	issued := jobs.VanityDomain{VanityDomain: "issued.example.org"}
+	if err := c.SetVanityDomain(ctx, "ref-2", issued); err != nil {
+		t.Fatalf("Failed to set vanity domain: %v", err)
+	}
+
+	route, _ = c.dynamic.Resource(routeResource).Namespace("vanity").Get(ctx, routeName(issued), metaV1.GetOptions{})
+	if route.GetAnnotations()[openshiftIssuerNameAnnotation] != "letsencrypt" {
+		t.Errorf("Expected cert-manager issuer annotation, got %v", route.GetAnnotations())
+	}
+
+	managed, err := c.ListManagedDomains(ctx)
+	if err != nil || len(managed) != 2 {
+		t.Fatalf("Expected 2 managed domains, got %d (%v)", len(managed), err)
+	}
+}
+
+func TestIngressRoutesValidatedAgainstServices(t *testing.T) {
+	api := &v1.Service{
+		ObjectMeta: metaV1.ObjectMeta{Name: "api", Namespace: "vanity"},
+		Spec:       v1.ServiceSpec{Ports: []v1.ServicePort{{Port: 9000}}},
+	}
+
+	c := newDynamicTestClient(t)
+	c.client = fake.NewClientset(api)
+	c.routing = &ingressProvider{kube: c}
+	ctx := context.Background()
+
+	domain := jobs.VanityDomain{
+		VanityDomain: "example.org",
+		Routes: []jobs.Route{
+			{Path: "/api", ServiceName: "api", ServicePort: 9000},
+			{Path: "/", PathType: "Prefix"},
+		},
+	}
+
+	if err := c.SetVanityDomain(ctx, "ref-1", domain); err != nil {
+		t.Fatalf("Failed to set vanity domain: %v", err)
+	}
+
+	ingress, err := c.client.NetworkingV1().Ingresses("vanity").Get(ctx, routeName(domain), metaV1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Failed to get ingress: %v", err)
+	}
+
+	paths := ingress.Spec.Rules[0].HTTP.Paths
+	if len(paths) != 2 {
+		t.Fatalf("Expected 2 paths, got %d", len(paths))
+	}
+
+	if paths[0].Path != "/api" || string(*paths[0].PathType) != "Prefix" || paths[0].Backend.Service.Name != "api" || paths[0].Backend.Service.Port.Number != 9000 {
+		t.Errorf("Unexpected first path %+v", paths[0])
+	}
+
+	if paths[1].Backend.Service.Name != "web" || paths[1].Backend.Service.Port.Number != 8080 {
+		t.Errorf("Expected the second path to default to the cluster service, got %+v", paths[1].Backend.Service)
+	}
+
+	domain.Routes[0].ServicePort = 9001
+	if err := c.SetVanityDomain(ctx, "ref-2", domain); err == nil {
+		t.Errorf("Expected a port the service doesn't expose to be rejected")
+	}
+
+	domain.Routes[0].ServiceName = "missing"
+	if err := c.SetVanityDomain(ctx, "ref-3", domain); err == nil {
+		t.Errorf("Expected a missing service to be rejected")
+	}
+}
+
+func TestTraefikRuleRefusesRuleBreaks(t *testing.T) {
+	c := newDynamicTestClient(t)
+	c.routing = &traefikProvider{kube: c, config: config.TraefikConfig{EntryPoints: []string{"websecure"}}}
+	ctx := context.Background()
+
+	// Queued before jobs were checked for backticks
+	domain := jobs.VanityDomain{VanityDomain: "example.org", Routes: []jobs.Route{{Path: "/`) || PathPrefix(`/"}}}
+	if err := c.SetVanityDomain(ctx, "ref-1", domain); !errors.Is(err, ErrInvalidRoute) {
+		t.Fatalf("Expected a path that breaks the rule to be refused for good, got %v", err)
+	}
+
+	if _, err := c.dynamic.Resource(ingressRouteResource).Namespace("vanity").Get(ctx, routeName(domain), metaV1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("Expected no IngressRoute to be written, got %v", err)
+	}
+
+	domain.Routes = []jobs.Route{{Path: "/api", PathType: "Exact"}}
+	if err := c.SetVanityDomain(ctx, "ref-1", domain); err != nil {
+		t.Fatalf("Failed to set vanity domain: %v", err)
+	}
+
+	route, err := c.dynamic.Resource(ingressRouteResource).Namespace("vanity").Get(ctx, routeName(domain), metaV1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Failed to get IngressRoute: %v", err)
+	}
+
+	routes, _, _ := unstructured.NestedSlice(route.Object, "spec", "routes")
+	if match := routes[0].(map[string]interface{})["match"]; match != "Host(`example.org`) && Path(`/api`)" {
+		t.Errorf("Expected the rule to quote the host and path, got %v", match)
+	}
+}
@@ -0,0 +1,136 @@
+package kubernetes
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/geekgonecrazy/vanityDomainManager/config"
+	"github.com/geekgonecrazy/vanityDomainManager/jobs"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+var ingressRouteResource = schema.GroupVersionResource{Group: "traefik.io", Version: "v1alpha1", Resource: "ingressroutes"}
+
+// traefikProvider exposes vanity domains with Traefik IngressRoutes. Certificates come from the domain's TLS secret
+// or, when configured and none was provided, from a Traefik certificate resolver.
+type traefikProvider struct {
+	kube   *KubeClient
+	config config.TraefikConfig
+}
+
+// SetRoute creates or updates the IngressRoute for the vanity domain.
+func (p *traefikProvider) SetRoute(ctx context.Context, referenceID string, job jobs.VanityDomain) error {
+	metadata, err := p.kube.managedObjectMeta(routeName(job), referenceID, job)
+	if err != nil {
+		return err
+	}
+
+	tls := map[string]interface{}{"secretName": tlsSecretName(job)}
+	if job.ProvidedCertificate == nil && p.config.CertResolver != "" && !p.kube.ManagesCertificates() {
+		tls = map[string]interface{}{"certResolver": p.config.CertResolver}
+	}
+
+	entryPoints := []interface{}{}
+	for _, entryPoint := range p.config.EntryPoints {
+		entryPoints = append(entryPoints, entryPoint)
+	}
+
+	if err := checkRuleValue(job.VanityDomain); err != nil {
+		return fmt.Errorf("failed to set ingressroute for vanity domain %s: %w", job.VanityDomain, err)
+	}
+
+	routes := []interface{}{}
+	for _, r := range p.kube.domainRoutes(job) {
+		if err := checkRuleValue(r.Path); err != nil {
+			return fmt.Errorf("failed to set ingressroute for vanity domain %s: %w", job.VanityDomain, err)
+		}
+
+		match := fmt.Sprintf("Host(`%s`)", job.VanityDomain)
+		switch {
+		case r.Path == "":
+		case r.PathType == "Exact":
+			match += fmt.Sprintf(" && Path(`%s`)", r.Path)
+		default:
+			match += fmt.Sprintf(" && PathPrefix(`%s`)", r.Path)
+		}
+
+		routes = append(routes, map[string]interface{}{
+			"match": match,
+			"kind":  "Rule",
+			"services": []interface{}{
+				map[string]interface{}{
+					"name": r.ServiceName,
+					"port": int64(r.ServicePort),
+				},
+			},
+		})
+	}
+
+	route := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": ingressRouteResource.GroupVersion().String(),
+		"kind":       "IngressRoute",
+		"metadata":   metadata,
+		"spec": map[string]interface{}{
+			"entryPoints": entryPoints,
+			"routes":      routes,
+			"tls":         tls,
+		},
+	}}
+
+	if err := p.kube.applyUnstructured(ctx, ingressRouteResource, route, job); err != nil {
+		return fmt.Errorf("failed to set ingressroute for vanity domain %s: %w", job.VanityDomain, err)
+	}
+
+	return nil
+}
+
+// checkRuleValue refuses a value that would end its backtick quote in a rule early. New jobs with such values are
+// rejected when they are queued, this keeps the rule intact for jobs queued by older versions.
+func checkRuleValue(value string) error {
+	if strings.ContainsFunc(value, func(r rune) bool { return r == '`' || unicode.IsControl(r) }) {
+		return fmt.Errorf("%w: %q can't be used in a traefik rule", ErrInvalidRoute, value)
+	}
+
+	return nil
+}
+
+// UnSetRoute deletes the IngressRoute for the vanity domain.
+func (p *traefikProvider) UnSetRoute(ctx context.Context, name string, job jobs.VanityDomain) error {
+	if err := p.kube.deleteUnstructured(ctx, ingressRouteResource, name, job); err != nil {
+		return fmt.Errorf("failed to remove ingressroute for vanity domain %s: %w", job.VanityDomain, err)
+	}
+
+	return nil
+}
+
+// ListManagedDomains returns every vanity domain that has an IngressRoute written by the manager.
+func (p *traefikProvider) ListManagedDomains(ctx context.Context) ([]ManagedDomain, error) {
+	return p.kube.listManagedUnstructured(ctx, ingressRouteResource, "IngressRoute")
+}
+
+// DisableRoute keeps the IngressRoute but marks it with the given state and stops the certificate resolver from
+// requesting certificates for it.
+func (p *traefikProvider) DisableRoute(ctx context.Context, job jobs.VanityDomain, state string) error {
+	err := p.kube.updateUnstructured(ctx, ingressRouteResource, routeName(job), func(route *unstructured.Unstructured) error {
+		annotations := route.GetAnnotations()
+		if annotations == nil {
+			annotations = map[string]string{}
+		}
+		annotations[StateAnnotation] = state
+		route.SetAnnotations(annotations)
+
+		if _, resolved, _ := unstructured.NestedString(route.Object, "spec", "tls", "certResolver"); resolved {
+			return unstructured.SetNestedField(route.Object, map[string]interface{}{"secretName": tlsSecretName(job)}, "spec", "tls")
+		}
+
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to disable ingressroute for vanity domain %s: %w", job.VanityDomain, err)
+	}
+
+	return nil
+}
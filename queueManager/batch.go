@@ -0,0 +1,252 @@
+package queueManager
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/geekgonecrazy/vanityDomainManager/config"
+	"github.com/geekgonecrazy/vanityDomainManager/jobs"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/nats-io/nuid"
+)
+
+const (
+	batchJobPending   = "pending"
+	batchJobSucceeded = "succeeded"
+	batchJobFailed    = "failed"
+)
+
+var ErrBatchNotFound = errors.New("batch not found")
+
+// BatchJobError describes why a job in a batch was rejected.
+type BatchJobError struct {
+	Index       int    `json:"index"`
+	ReferenceID string `json:"referenceId"`
+	Error       string `json:"error"`
+}
+
+// InvalidBatchError is returned when any job in a batch fails validation. No job of the batch is queued.
+type InvalidBatchError struct {
+	Errors []BatchJobError
+}
+
+func (e *InvalidBatchError) Error() string {
+	return fmt.Sprintf("%d jobs in the batch are invalid", len(e.Errors))
+}
+
+func (e *InvalidBatchError) Unwrap() error {
+	return ErrInvalidJob
+}
+
+func (q *queueManager) ensureBatches() error {
+	env := config.Config().System().Environment
+
+	kv, err := q.queue.KeyValue(context.Background(), jetstream.KeyValueConfig{
+		Bucket:      fmt.Sprintf("%s_%s", env, "vanityDomainManager_batches"),
+		Description: "Aggregate status of job batches submitted to Vanity Domain Manager",
+		TTL:         config.Config().Queue().JobStream.MaxAge,
+	})
+	if err != nil {
+		return fmt.Errorf("create batches bucket: %w", err)
+	}
+
+	q.batches = kv
+	return nil
+}
+
+// AddBatch validates every job up front and only then queues them all under a shared batch ID.
+func (q *queueManager) AddBatch(batch []jobs.VanityDomainJob) (string, error) {
+	if len(batch) == 0 {
+		return "", fmt.Errorf("%w: batch is empty", ErrInvalidJob)
+	}
+
+	invalid := &InvalidBatchError{}
+	seen := map[string]bool{}
+	for i, job := range batch {
+		err := job.Validate()
+		if err == nil {
+			err = validateSchedule(job)
+		}
+
+		if err == nil {
+			err = validateAnnotations(job)
+		}
+
+		if err == nil {
+			err = validateOwner(job)
+		}
+
+		if err == nil && seen[job.ReferenceID] {
+			err = fmt.Errorf("duplicate referenceId in batch")
+		}
+		seen[job.ReferenceID] = true
+
+		if err != nil {
+			invalid.Errors = append(invalid.Errors, BatchJobError{Index: i, ReferenceID: job.ReferenceID, Error: err.Error()})
+		}
+	}
+
+	if len(invalid.Errors) > 0 {
+		return "", invalid
+	}
+
+	batchID := nuid.Next()
+	now := time.Now().UTC()
+	status := jobs.BatchStatus{
+		BatchID:   batchID,
+		Total:     len(batch),
+		Pending:   len(batch),
+		Jobs:      map[string]string{},
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+
+	for _, job := range batch {
+		status.Jobs[job.ReferenceID] = batchJobPending
+	}
+
+	data, err := json.Marshal(status)
+	if err != nil {
+		return "", fmt.Errorf("json marshal batch status: %w", err)
+	}
+
+	if _, err := q.batches.Create(context.Background(), batchID, data); err != nil {
+		return "", fmt.Errorf("create batch %s: %w", batchID, err)
+	}
+
+	// Published before any job is queued, so it can't arrive after the update of a job that already finished
+	q.publishBatchStatus(status)
+
+	for _, job := range batch {
+		job.BatchID = batchID
+
+		if err := q.AddDomainJob(job); err != nil {
+			q.logger.Printf("Failed to queue job %s of batch %s: %s", job.ReferenceID, batchID, err)
+			q.recordBatchResult(job, false)
+		}
+	}
+
+	q.logger.Printf("Batch %s with %d jobs queued", batchID, len(batch))
+
+	return batchID, nil
+}
+
+// GetBatch returns the aggregate status of a batch.
+func (q *queueManager) GetBatch(batchID string) (*jobs.BatchStatus, error) {
+	entry, err := q.batches.Get(context.Background(), batchID)
+	if err != nil {
+		if errors.Is(err, jetstream.ErrKeyNotFound) || errors.Is(err, jetstream.ErrInvalidKey) {
+			return nil, ErrBatchNotFound
+		}
+		return nil, fmt.Errorf("get batch %s: %w", batchID, err)
+	}
+
+	var status jobs.BatchStatus
+	if err := json.Unmarshal(entry.Value(), &status); err != nil {
+		return nil, fmt.Errorf("json unmarshal batch %s: %w", batchID, err)
+	}
+
+	return &status, nil
+}
+
+// recordBatchResult counts the final result of a job towards its batch and publishes the new aggregate.
+func (q *queueManager) recordBatchResult(job jobs.VanityDomainJob, succeeded bool) {
+	if job.BatchID == "" {
+		return
+	}
+
+	var updated jobs.BatchStatus
+	changed := false
+	err := q.updateKey(q.batches, job.BatchID, func(current []byte) ([]byte, error) {
+		if current == nil {
+			return nil, ErrBatchNotFound
+		}
+
+		updated = jobs.BatchStatus{}
+		changed = false
+		if err := json.Unmarshal(current, &updated); err != nil {
+			return nil, fmt.Errorf("json unmarshal batch %s: %w", job.BatchID, err)
+		}
+
+		// Each job only counts once
+		if updated.Jobs[job.ReferenceID] != batchJobPending {
+			return nil, nil
+		}
+
+		updated.Pending--
+		if succeeded {
+			updated.Succeeded++
+			updated.Jobs[job.ReferenceID] = batchJobSucceeded
+		} else {
+			updated.Failed++
+			updated.Jobs[job.ReferenceID] = batchJobFailed
+		}
+		updated.UpdatedAt = time.Now().UTC()
+		changed = true
+
+		return json.Marshal(updated)
+	})
+	if err != nil {
+		q.logger.Printf("Failed to record result of job %s in batch %s: %s", job.ReferenceID, job.BatchID, err)
+		return
+	}
+
+	if changed {
+		q.publishBatchStatus(updated)
+	}
+}
+
+func (q *queueManager) publishBatchStatus(status jobs.BatchStatus) {
+	data, err := json.Marshal(status)
+	if err != nil {
+		q.logger.Printf("Failed to marshal status of batch %s: %s", status.BatchID, err)
+		return
+	}
+
+	data, headers, err := encodeEvent(EventTypeBatchStatus, status.BatchID, status.UpdatedAt, data)
+	if err != nil {
+		q.logger.Printf("Failed to encode status of batch %s: %s", status.BatchID, err)
+		return
+	}
+
+	subjectName := q.GetBatchStatusSubject(status.BatchID)
+	if err := q.queue.PublishStatus(context.Background(), subjectName, data, headers); err != nil {
+		q.logger.Printf("Failed to publish status of batch %s: %s", status.BatchID, err)
+	}
+}
+
+// startBatchListener accepts batches published to the batch job subject and replies with the batch ID or the
+// validation errors.
+func (q *queueManager) startBatchListener() error {
+	_, err := q.nc.QueueSubscribe(q.GetBatchJobSubject(), listenerQueueGroup, func(msg *nats.Msg) {
+		var batch []jobs.VanityDomainJob
+		var response any
+
+		if err := json.Unmarshal(msg.Data, &batch); err != nil {
+			response = map[string]string{"error": "Invalid request body"}
+		} else if batchID, err := q.AddBatch(batch); err != nil {
+			var invalid *InvalidBatchError
+			if errors.As(err, &invalid) {
+				response = map[string]any{"error": err.Error(), "jobs": invalid.Errors}
+			} else {
+				q.logger.Printf("Failed to add batch: %s", err)
+				response = map[string]string{"error": err.Error()}
+			}
+		} else {
+			response = map[string]string{"batchId": batchID}
+		}
+
+		if msg.Reply == "" {
+			return
+		}
+
+		data, _ := json.Marshal(response)
+		msg.Respond(data)
+	})
+
+	return err
+}
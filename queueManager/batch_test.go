@@ -0,0 +1,179 @@
+package queueManager
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/geekgonecrazy/vanityDomainManager/jobs"
+	"github.com/nats-io/nats.go"
+)
+
+func removeJob(referenceID string) jobs.VanityDomainJob {
+	return jobs.VanityDomainJob{ReferenceID: referenceID, Type: "remove", Domain: jobs.VanityDomain{VanityDomain: "localhost"}}
+}
+
+// subscribeBatchStatuses collects the aggregate statuses published for any batch from now on.
+func subscribeBatchStatuses(t *testing.T, q *queueManager) chan jobs.BatchStatus {
+	t.Helper()
+
+	statuses := make(chan jobs.BatchStatus, 100)
+	sub, err := q.nc.Subscribe(q.GetBatchStatusSubject("*"), func(msg *nats.Msg) {
+		var status jobs.BatchStatus
+		if err := json.Unmarshal(eventData(msg.Data), &status); err != nil {
+			t.Errorf("Failed to decode batch status: %v", err)
+		}
+		statuses <- status
+	})
+	if err != nil {
+		t.Fatalf("Failed to subscribe to batch statuses: %v", err)
+	}
+	t.Cleanup(func() { sub.Unsubscribe() })
+
+	return statuses
+}
+
+func nextBatchStatus(t *testing.T, statuses chan jobs.BatchStatus) jobs.BatchStatus {
+	t.Helper()
+
+	select {
+	case status := <-statuses:
+		return status
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for a batch status")
+	}
+
+	return jobs.BatchStatus{}
+}
+
+func TestAddBatchValidation(t *testing.T) {
+	q, _ := newTestManager(t)
+
+	if _, err := q.AddBatch(nil); !errors.Is(err, ErrInvalidJob) {
+		t.Errorf("Expected an empty batch to be rejected, got %v", err)
+	}
+
+	notBefore := time.Now().Add(time.Hour)
+	expiresAt := notBefore.Add(-time.Minute)
+	scheduled := removeJob("ref-4")
+	scheduled.NotBefore = &notBefore
+	scheduled.ExpiresAt = &expiresAt
+
+	_, err := q.AddBatch([]jobs.VanityDomainJob{removeJob("ref-1"), removeJob("ref-1"), removeJob("a.b"), scheduled, removeJob("ref-5")})
+
+	var invalid *InvalidBatchError
+	if !errors.As(err, &invalid) || !errors.Is(err, ErrInvalidJob) {
+		t.Fatalf("Expected the batch to be rejected, got %v", err)
+	}
+
+	indexes := []int{}
+	for _, jobError := range invalid.Errors {
+		indexes = append(indexes, jobError.Index)
+	}
+
+	if len(indexes) != 3 || indexes[0] != 1 || indexes[1] != 2 || indexes[2] != 3 {
+		t.Errorf("Expected the duplicate, the bad reference ID and the bad schedule to be reported, got %+v", invalid.Errors)
+	}
+
+	info, err := q.queue.(*jetstreamQueue).jobStream.Info(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to get job stream info: %v", err)
+	}
+
+	if info.State.Msgs != 0 {
+		t.Errorf("Expected no job of a rejected batch to be queued, got %d", info.State.Msgs)
+	}
+}
+
+func TestBatchAggregation(t *testing.T) {
+	q, _ := newTestManager(t)
+	statuses := subscribeBatchStatuses(t, q)
+
+	batch := []jobs.VanityDomainJob{removeJob("ref-1"), removeJob("ref-2"), removeJob("ref-3")}
+	batchID, err := q.AddBatch(batch)
+	if err != nil {
+		t.Fatalf("Failed to add batch: %v", err)
+	}
+
+	status := nextBatchStatus(t, statuses)
+	if status.BatchID != batchID || status.Total != 3 || status.Pending != 3 {
+		t.Errorf("Expected the queued batch to be published first, got %+v", status)
+	}
+
+	for i := range batch {
+		batch[i].BatchID = batchID
+	}
+
+	q.recordBatchResult(batch[0], true)
+	q.recordBatchResult(batch[1], false)
+
+	// A redelivered job doesn't count twice
+	q.recordBatchResult(batch[0], false)
+
+	q.recordBatchResult(batch[2], true)
+
+	for _, expected := range []int{2, 1, 0} {
+		if status := nextBatchStatus(t, statuses); status.Pending != expected {
+			t.Errorf("Expected %d jobs pending, got %+v", expected, status)
+		}
+	}
+
+	stored, err := q.GetBatch(batchID)
+	if err != nil {
+		t.Fatalf("Failed to get batch: %v", err)
+	}
+
+	if stored.Succeeded != 2 || stored.Failed != 1 || stored.Pending != 0 || stored.Jobs["ref-1"] != batchJobSucceeded || stored.Jobs["ref-2"] != batchJobFailed {
+		t.Errorf("Expected two succeeded and one failed job, got %+v", stored)
+	}
+
+	if _, err := q.GetBatch("unknown"); !errors.Is(err, ErrBatchNotFound) {
+		t.Errorf("Expected an unknown batch to be not found, got %v", err)
+	}
+}
+
+func TestBatchListener(t *testing.T) {
+	q, _ := newTestManager(t)
+
+	// Every replica listens, a batch is still queued once
+	for replica := 0; replica < 2; replica++ {
+		if err := q.startBatchListener(); err != nil {
+			t.Fatalf("Failed to start batch listener: %v", err)
+		}
+	}
+
+	replies, err := q.nc.SubscribeSync(nats.NewInbox())
+	if err != nil {
+		t.Fatalf("Failed to subscribe to replies: %v", err)
+	}
+
+	data, _ := json.Marshal([]jobs.VanityDomainJob{removeJob("ref-1")})
+	if err := q.nc.PublishRequest(q.GetBatchJobSubject(), replies.Subject, data); err != nil {
+		t.Fatalf("Failed to send batch: %v", err)
+	}
+
+	reply, err := replies.NextMsg(5 * time.Second)
+	if err != nil {
+		t.Fatalf("Failed to get a reply: %v", err)
+	}
+
+	var response map[string]string
+	if err := json.Unmarshal(reply.Data, &response); err != nil || response["batchId"] == "" {
+		t.Fatalf("Expected a batch ID, got %s", reply.Data)
+	}
+
+	if extra, err := replies.NextMsg(200 * time.Millisecond); err == nil {
+		t.Errorf("Expected a single reply, got another %s", extra.Data)
+	}
+
+	info, err := q.queue.(*jetstreamQueue).jobStream.Info(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to get job stream info: %v", err)
+	}
+
+	if info.State.Msgs != 1 {
+		t.Errorf("Expected the job to be queued once, got %d", info.State.Msgs)
+	}
+}
@@ -0,0 +1,90 @@
+package queueManager
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/geekgonecrazy/vanityDomainManager/config"
+	"github.com/geekgonecrazy/vanityDomainManager/jobs"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/nats-io/nuid"
+)
+
+func (q *queueManager) ensureCertificateStore() error {
+	storeConfig := config.Config().Queue().CertificateStore
+	if !storeConfig.Enabled {
+		return nil
+	}
+
+	// Certificates live as long as the jobs referencing them, so ones a job never cleaned up don't pile up
+	store, err := q.queue.ObjectStore(context.Background(), jetstream.ObjectStoreConfig{
+		Bucket:      storeConfig.Bucket,
+		Description: "Provided certificates for jobs queued in Vanity Domain Manager",
+		TTL:         config.Config().Queue().JobStream.MaxAge,
+	})
+	if err != nil {
+		return fmt.Errorf("create certificate store: %w", err)
+	}
+
+	q.certificates = store
+	return nil
+}
+
+// offloadCertificate moves the provided certificate of a job into the object store, leaving only a reference on
+// the job so large chains don't inflate the job message.
+func (q *queueManager) offloadCertificate(job *jobs.VanityDomainJob) error {
+	if q.certificates == nil || job.Domain.ProvidedCertificate == nil {
+		return nil
+	}
+
+	data, err := json.Marshal(job.Domain.ProvidedCertificate)
+	if err != nil {
+		return fmt.Errorf("json marshal certificate: %w", err)
+	}
+
+	name := fmt.Sprintf("%s-%s", job.ReferenceID, nuid.Next())
+	if _, err := q.certificates.PutBytes(context.Background(), name, data); err != nil {
+		return fmt.Errorf("store certificate %s: %w", name, err)
+	}
+
+	job.Domain.ProvidedCertificate = nil
+	job.Domain.CertificateRef = name
+	return nil
+}
+
+// fetchCertificate loads an offloaded certificate back onto the domain.
+func (q *queueManager) fetchCertificate(domain *jobs.VanityDomain) error {
+	if domain.CertificateRef == "" {
+		return nil
+	}
+
+	if q.certificates == nil {
+		return fmt.Errorf("job references certificate %s but the certificate store is not enabled", domain.CertificateRef)
+	}
+
+	data, err := q.certificates.GetBytes(context.Background(), domain.CertificateRef)
+	if err != nil {
+		return fmt.Errorf("fetch certificate %s: %w", domain.CertificateRef, err)
+	}
+
+	var cert jobs.DomainCustomCert
+	if err := json.Unmarshal(data, &cert); err != nil {
+		return fmt.Errorf("json unmarshal certificate %s: %w", domain.CertificateRef, err)
+	}
+
+	domain.ProvidedCertificate = &cert
+	return nil
+}
+
+// deleteCertificate removes an offloaded certificate once its job no longer needs it.
+func (q *queueManager) deleteCertificate(ref string) {
+	if q.certificates == nil || ref == "" {
+		return
+	}
+
+	if err := q.certificates.Delete(context.Background(), ref); err != nil && !errors.Is(err, jetstream.ErrObjectNotFound) {
+		q.logger.Printf("Failed to delete certificate %s: %s", ref, err)
+	}
+}
@@ -0,0 +1,107 @@
+package queueManager
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/geekgonecrazy/vanityDomainManager/jobs"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// failingQueue fails every job publish.
+type failingQueue struct {
+	Queue
+}
+
+func (f failingQueue) PublishJob(ctx context.Context, subject string, data []byte, msgID string) (uint64, error) {
+	return 0, errors.New("no responders")
+}
+
+func certificateJob(referenceID string) jobs.VanityDomainJob {
+	return jobs.VanityDomainJob{
+		ReferenceID: referenceID,
+		Type:        "add",
+		Domain: jobs.VanityDomain{
+			VanityDomain:          "example.org",
+			DesiredDNSTargetType:  "A",
+			DesiredARecordTargets: []string{"127.0.0.1"},
+			ProvidedCertificate:   &jobs.DomainCustomCert{Cert: "CERT", Key: "KEY"},
+		},
+	}
+}
+
+func storedCertificates(t *testing.T, q *queueManager) int {
+	t.Helper()
+
+	objects, err := q.certificates.List(context.Background())
+	if err != nil && !errors.Is(err, jetstream.ErrNoObjectsFound) {
+		t.Fatalf("Failed to list certificates: %v", err)
+	}
+
+	return len(objects)
+}
+
+func TestCertificateStoreRoundTrip(t *testing.T) {
+	q, _ := newTestManager(t, `
+queue:
+  backend: memory
+  jobStream:
+    maxAge: 48h
+  certificateStore:
+    enabled: true
+`)
+
+	status, err := q.certificates.Status(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to get certificate store status: %v", err)
+	}
+
+	if status.TTL().Hours() != 48 {
+		t.Errorf("Expected certificates to expire with the job stream, got %v", status.TTL())
+	}
+
+	job := certificateJob("ref-1")
+	if err := q.offloadCertificate(&job); err != nil {
+		t.Fatalf("Failed to offload certificate: %v", err)
+	}
+
+	if job.Domain.ProvidedCertificate != nil || job.Domain.CertificateRef == "" {
+		t.Fatalf("Expected only a reference on the job, got %+v", job.Domain)
+	}
+
+	if err := q.fetchCertificate(&job.Domain); err != nil {
+		t.Fatalf("Failed to fetch certificate: %v", err)
+	}
+
+	if job.Domain.ProvidedCertificate == nil || job.Domain.ProvidedCertificate.Cert != "CERT" || job.Domain.ProvidedCertificate.Key != "KEY" {
+		t.Errorf("Expected the stored certificate back, got %+v", job.Domain.ProvidedCertificate)
+	}
+
+	q.deleteCertificate(job.Domain.CertificateRef)
+	if count := storedCertificates(t, q); count != 0 {
+		t.Errorf("Expected the certificate to be deleted, %d left", count)
+	}
+
+	// Deleting twice is harmless
+	q.deleteCertificate(job.Domain.CertificateRef)
+}
+
+func TestCertificateDeletedWhenPublishFails(t *testing.T) {
+	q, _ := newTestManager(t, `
+queue:
+  backend: memory
+  certificateStore:
+    enabled: true
+`)
+
+	q.queue = failingQueue{q.queue}
+
+	if err := q.AddDomainJob(certificateJob("ref-1")); err == nil {
+		t.Fatal("Expected the job not to be queued")
+	}
+
+	if count := storedCertificates(t, q); count != 0 {
+		t.Errorf("Expected the certificate of the unqueued job to be deleted, %d left", count)
+	}
+}
@@ -0,0 +1,34 @@
+package queueManager
+
+import (
+	"context"
+	"crypto/x509"
+	"time"
+
+	"github.com/geekgonecrazy/vanityDomainManager/jobs"
+	"github.com/geekgonecrazy/vanityDomainManager/kubernetes"
+)
+
+// cluster is what the workers need from Kubernetes. It is the *kubernetes.KubeClient in production, tests swap in
+// a fake.
+type cluster interface {
+	SetVanityDomain(ctx context.Context, referenceID string, job jobs.VanityDomain) error
+	UnSetVanityDomain(ctx context.Context, job jobs.VanityDomain) error
+	DisableVanityDomain(ctx context.Context, job jobs.VanityDomain, state string) error
+	ListManagedDomains(ctx context.Context) ([]kubernetes.ManagedDomain, error)
+
+	SetTLS(ctx context.Context, referenceID string, job jobs.VanityDomain) error
+	UnSetTLS(ctx context.Context, job jobs.VanityDomain) error
+	GetCertificate(ctx context.Context, job jobs.VanityDomain) (*x509.Certificate, error)
+
+	ManagesCertificates() bool
+	IssuesCertificate(job jobs.VanityDomain) bool
+	SetCertificate(ctx context.Context, referenceID string, tenant string, job jobs.VanityDomain) error
+	UnSetCertificate(ctx context.Context, job jobs.VanityDomain) error
+	GetCertificateStatus(ctx context.Context, job jobs.VanityDomain) (kubernetes.CertificateStatus, error)
+
+	NewReconciler(desired kubernetes.DesiredState, resync time.Duration) (*kubernetes.Reconciler, error)
+	RunLeaderElected(ctx context.Context, name string, run func(ctx context.Context)) error
+}
+
+var _ cluster = (*kubernetes.KubeClient)(nil)
@@ -0,0 +1,107 @@
+package queueManager
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/geekgonecrazy/vanityDomainManager/jobs"
+	"github.com/geekgonecrazy/vanityDomainManager/kubernetes"
+)
+
+// fakeCluster records the calls the workers make and answers them from its fields.
+type fakeCluster struct {
+	mu                  sync.Mutex
+	calls               []string
+	managesCertificates bool
+	certificateStatus   kubernetes.CertificateStatus
+	managed             []kubernetes.ManagedDomain
+}
+
+func (c *fakeCluster) record(format string, args ...any) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.calls = append(c.calls, fmt.Sprintf(format, args...))
+}
+
+func (c *fakeCluster) recorded() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return append([]string{}, c.calls...)
+}
+
+func (c *fakeCluster) SetVanityDomain(ctx context.Context, referenceID string, job jobs.VanityDomain) error {
+	c.record("SetVanityDomain %s", job.VanityDomain)
+	return nil
+}
+
+func (c *fakeCluster) UnSetVanityDomain(ctx context.Context, job jobs.VanityDomain) error {
+	c.record("UnSetVanityDomain %s", job.VanityDomain)
+	return nil
+}
+
+func (c *fakeCluster) DisableVanityDomain(ctx context.Context, job jobs.VanityDomain, state string) error {
+	c.record("DisableVanityDomain %s %s", job.VanityDomain, state)
+	return nil
+}
+
+func (c *fakeCluster) ListManagedDomains(ctx context.Context) ([]kubernetes.ManagedDomain, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return append([]kubernetes.ManagedDomain{}, c.managed...), nil
+}
+
+func (c *fakeCluster) SetTLS(ctx context.Context, referenceID string, job jobs.VanityDomain) error {
+	c.record("SetTLS %s", job.VanityDomain)
+	return nil
+}
+
+func (c *fakeCluster) UnSetTLS(ctx context.Context, job jobs.VanityDomain) error {
+	c.record("UnSetTLS %s", job.VanityDomain)
+	return nil
+}
+
+func (c *fakeCluster) GetCertificate(ctx context.Context, job jobs.VanityDomain) (*x509.Certificate, error) {
+	return nil, nil
+}
+
+func (c *fakeCluster) ManagesCertificates() bool {
+	return c.managesCertificates
+}
+
+func (c *fakeCluster) IssuesCertificate(job jobs.VanityDomain) bool {
+	return c.managesCertificates && job.ProvidedCertificate == nil
+}
+
+func (c *fakeCluster) SetCertificate(ctx context.Context, referenceID string, tenant string, job jobs.VanityDomain) error {
+	c.record("SetCertificate %s", job.VanityDomain)
+	return nil
+}
+
+func (c *fakeCluster) UnSetCertificate(ctx context.Context, job jobs.VanityDomain) error {
+	c.record("UnSetCertificate %s", job.VanityDomain)
+	return nil
+}
+
+func (c *fakeCluster) GetCertificateStatus(ctx context.Context, job jobs.VanityDomain) (kubernetes.CertificateStatus, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.certificateStatus, nil
+}
+
+func (c *fakeCluster) NewReconciler(desired kubernetes.DesiredState, resync time.Duration) (*kubernetes.Reconciler, error) {
+	return nil, errors.New("the fake cluster has no reconciler")
+}
+
+// RunLeaderElected runs right away, the fake cluster only ever has one replica.
+func (c *fakeCluster) RunLeaderElected(ctx context.Context, name string, run func(ctx context.Context)) error {
+	go run(ctx)
+	return nil
+}
@@ -0,0 +1,75 @@
+// Package embedded runs a NATS server with JetStream inside the process for the memory queue backend. Only a manager
+// built with the memory tag links it, and the tests.
+package embedded
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+)
+
+// Start runs the server and connects to it in-process. It only listens on the network when listen is a connection
+// string. stop shuts the server down and removes its store, after the connection is closed.
+func Start(listen string) (*nats.Conn, func(), error) {
+	opts := &server.Options{
+		ServerName: "vanityDomainManager",
+		DontListen: true,
+		JetStream:  true,
+		NoLog:      true,
+		NoSigs:     true,
+	}
+
+	if listen != "" {
+		address, err := url.Parse(listen)
+		if err != nil {
+			return nil, nil, fmt.Errorf("parse nats connection string: %w", err)
+		}
+
+		port, err := strconv.Atoi(address.Port())
+		if err != nil {
+			return nil, nil, fmt.Errorf("nats connection string %s has no port", listen)
+		}
+
+		opts.DontListen = false
+		opts.Host = address.Hostname()
+		opts.Port = port
+	}
+
+	storeDir, err := os.MkdirTemp("", "vanityDomainManager-jetstream-")
+	if err != nil {
+		return nil, nil, fmt.Errorf("create embedded jetstream store: %w", err)
+	}
+	opts.StoreDir = storeDir
+
+	ns, err := server.NewServer(opts)
+	if err != nil {
+		os.RemoveAll(storeDir)
+		return nil, nil, fmt.Errorf("create embedded nats server: %w", err)
+	}
+
+	go ns.Start()
+
+	stop := func() {
+		ns.Shutdown()
+		ns.WaitForShutdown()
+		os.RemoveAll(storeDir)
+	}
+
+	if !ns.ReadyForConnections(10 * time.Second) {
+		stop()
+		return nil, nil, fmt.Errorf("embedded nats server did not start")
+	}
+
+	nc, err := nats.Connect("", nats.Name("Vanity Domain Manager"), nats.InProcessServer(ns))
+	if err != nil {
+		stop()
+		return nil, nil, fmt.Errorf("nats connect to embedded server: %w", err)
+	}
+
+	return nc, stop, nil
+}
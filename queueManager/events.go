@@ -0,0 +1,127 @@
+package queueManager
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/geekgonecrazy/vanityDomainManager/config"
+	"github.com/geekgonecrazy/vanityDomainManager/jobs"
+	"github.com/nats-io/nuid"
+)
+
+// CloudEvents types are part of the public contract, a breaking payload change needs a new version suffix.
+const (
+	EventTypeJobStatus           = "io.vanitydomainmanager.job.status.v1"
+	EventTypeBatchStatus         = "io.vanitydomainmanager.batch.status.v1"
+	EventTypeDomainActivated     = "io.vanitydomainmanager.domain.activated.v1"
+	EventTypeCertificateExpiring = "io.vanitydomainmanager.certificate.expiring.v1"
+	EventTypeDriftDetected       = "io.vanitydomainmanager.domain.drifted.v1"
+	EventTypeDomainRecovered     = "io.vanitydomainmanager.domain.recovered.v1"
+	EventTypeObjectDrifted       = "io.vanitydomainmanager.object.drifted.v1"
+)
+
+// Lifecycle event subjects, the last token of {environment}.vanityDomainManager.events.*
+var lifecycleEventSubjects = map[string]string{
+	EventTypeDomainActivated:     "activated",
+	EventTypeCertificateExpiring: "certificate_expiring",
+	EventTypeDriftDetected:       "drifted",
+	EventTypeDomainRecovered:     "recovered",
+	EventTypeObjectDrifted:       "object_drifted",
+}
+
+// cloudEvent is a CloudEvents 1.0 envelope in structured content mode.
+type cloudEvent struct {
+	SpecVersion     string          `json:"specversion"`
+	ID              string          `json:"id"`
+	Source          string          `json:"source"`
+	Type            string          `json:"type"`
+	Subject         string          `json:"subject,omitempty"`
+	Time            time.Time       `json:"time"`
+	DataContentType string          `json:"datacontenttype"`
+	Data            json.RawMessage `json:"data"`
+}
+
+// encodeEvent wraps data in the configured event format. subject is the CloudEvents subject, usually the domain.
+// In binary mode the attributes travel as ce- headers and data is left untouched.
+func encodeEvent(eventType string, subject string, at time.Time, data []byte) ([]byte, map[string]string, error) {
+	eventsConfig := config.Config().Events()
+	if eventsConfig.Format != "cloudevents" {
+		return data, nil, nil
+	}
+
+	event := cloudEvent{
+		SpecVersion:     "1.0",
+		ID:              nuid.Next(),
+		Source:          eventsConfig.Source,
+		Type:            eventType,
+		Subject:         subject,
+		Time:            at,
+		DataContentType: "application/json",
+		Data:            data,
+	}
+
+	if eventsConfig.Mode == "binary" {
+		headers := map[string]string{
+			"ce-specversion": event.SpecVersion,
+			"ce-id":          event.ID,
+			"ce-source":      event.Source,
+			"ce-type":        event.Type,
+			"ce-time":        event.Time.Format(time.RFC3339Nano),
+			"content-type":   event.DataContentType,
+		}
+
+		if subject != "" {
+			headers["ce-subject"] = subject
+		}
+
+		return data, headers, nil
+	}
+
+	envelope, err := json.Marshal(event)
+	if err != nil {
+		return nil, nil, fmt.Errorf("json marshal cloudevent: %w", err)
+	}
+
+	return envelope, map[string]string{"content-type": "application/cloudevents+json"}, nil
+}
+
+// eventData returns the payload of a message published by encodeEvent, whatever the configured format was.
+func eventData(data []byte) []byte {
+	var envelope struct {
+		SpecVersion string          `json:"specversion"`
+		Data        json.RawMessage `json:"data"`
+	}
+
+	if err := json.Unmarshal(data, &envelope); err != nil || envelope.SpecVersion == "" {
+		return data
+	}
+
+	return envelope.Data
+}
+
+// publishLifecycleEvent announces a change to a managed domain on {environment}.vanityDomainManager.events.*.
+func (q *queueManager) publishLifecycleEvent(eventType string, event jobs.DomainLifecycleEvent) {
+	event.Timestamp = time.Now().UTC()
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		q.logger.Printf("Failed to marshal %s event for %s: %s", eventType, event.Domain, err)
+		return
+	}
+
+	data, headers, err := encodeEvent(eventType, event.Domain, event.Timestamp, data)
+	if err != nil {
+		q.logger.Printf("Failed to encode %s event for %s: %s", eventType, event.Domain, err)
+		return
+	}
+
+	subjectName := q.GetEventSubject(lifecycleEventSubjects[eventType])
+	if err := q.queue.PublishStatus(context.Background(), subjectName, data, headers); err != nil {
+		q.logger.Printf("Failed to publish %s event for %s: %s", eventType, event.Domain, err)
+		return
+	}
+
+	q.logger.Printf("Lifecycle event %s published for %s", eventType, event.Domain)
+}
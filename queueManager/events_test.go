@@ -0,0 +1,157 @@
+package queueManager
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/geekgonecrazy/vanityDomainManager/config"
+	"github.com/geekgonecrazy/vanityDomainManager/jobs"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+func TestEncodeEvent(t *testing.T) {
+	at := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	payload := []byte(`{"domain":"example.org"}`)
+
+	tests := []struct {
+		name        string
+		events      string
+		contentType string
+		headers     map[string]string
+		envelope    bool
+	}{
+		{"json", "events:\n  format: json", "", nil, false},
+		{"structured", "events:\n  format: cloudevents\n  source: /test", "application/cloudevents+json", nil, true},
+		{"binary", "events:\n  format: cloudevents\n  mode: binary\n  source: /test", "application/json", map[string]string{
+			"ce-specversion": "1.0",
+			"ce-source":      "/test",
+			"ce-type":        EventTypeDomainActivated,
+			"ce-subject":     "example.org",
+			"ce-time":        at.Format(time.RFC3339Nano),
+		}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			loadTestConfig(t, test.events)
+
+			data, headers, err := encodeEvent(EventTypeDomainActivated, "example.org", at, payload)
+			if err != nil {
+				t.Fatalf("Failed to encode event: %v", err)
+			}
+
+			if headers["content-type"] != test.contentType {
+				t.Errorf("Expected content type %q, got %q", test.contentType, headers["content-type"])
+			}
+
+			for key, value := range test.headers {
+				if headers[key] != value {
+					t.Errorf("Expected header %s %q, got %q", key, value, headers[key])
+				}
+			}
+
+			if test.envelope {
+				var event cloudEvent
+				if err := json.Unmarshal(data, &event); err != nil {
+					t.Fatalf("Failed to decode envelope: %v", err)
+				}
+
+				if event.SpecVersion != "1.0" || event.ID == "" || event.Source != "/test" || event.Type != EventTypeDomainActivated || event.Subject != "example.org" || !event.Time.Equal(at) {
+					t.Errorf("Expected the CloudEvents attributes in the envelope, got %+v", event)
+				}
+			} else if string(data) != string(payload) {
+				t.Errorf("Expected the payload to be left untouched, got %s", data)
+			}
+
+			if decoded := eventData(data); string(decoded) != string(payload) {
+				t.Errorf("Expected eventData to return the payload, got %s", decoded)
+			}
+		})
+	}
+}
+
+func TestEventDataKeepsPlainPayloads(t *testing.T) {
+	for _, data := range []string{`{"data":"not an envelope"}`, `not json`, `[]`} {
+		if decoded := eventData([]byte(data)); string(decoded) != data {
+			t.Errorf("Expected %s to be returned as is, got %s", data, decoded)
+		}
+	}
+}
+
+func TestLifecycleEventsHaveTheirOwnStream(t *testing.T) {
+	q, _ := newTestManager(t)
+	ctx := context.Background()
+	streams := q.queue.(*jetstreamQueue)
+
+	q.publishLifecycleEvent(EventTypeDomainActivated, jobs.DomainLifecycleEvent{Domain: "example.org", ReferenceID: "ref-1"})
+
+	events, err := testJetStream(q).Stream(ctx, config.Config().Queue().EventStream.Name)
+	if err != nil {
+		t.Fatalf("Failed to get event stream: %v", err)
+	}
+
+	if info := events.CachedInfo(); info.State.Msgs != 1 || info.Config.Retention != jetstream.LimitsPolicy {
+		t.Errorf("Expected the event on a limits stream, got %d messages with %s retention", info.State.Msgs, info.Config.Retention)
+	}
+
+	info, err := streams.statusStream.Info(ctx)
+	if err != nil {
+		t.Fatalf("Failed to get status stream info: %v", err)
+	}
+
+	if info.State.Msgs != 0 {
+		t.Errorf("Expected the status stream to hold no events, got %d messages", info.State.Msgs)
+	}
+}
+
+func TestEventSubjectsMoveOffTheStatusStream(t *testing.T) {
+	q, _ := newTestManager(t)
+	ctx := context.Background()
+	queueConfig := config.Config().Queue()
+	jobSubjects := q.GetJobSubject(">")
+	statusSubjects := []string{q.GetStatusSubject(">"), q.GetBatchStatusSubject("*")}
+	eventSubjects := []string{q.GetEventSubject("*")}
+
+	// The layout of earlier versions, with events kept on the status stream
+	if err := testJetStream(q).DeleteStream(ctx, queueConfig.EventStream.Name); err != nil {
+		t.Fatalf("Failed to delete event stream: %v", err)
+	}
+
+	legacy := streamConfig(queueConfig.StatusStream, "Queue for Status Updates coming from Vanity Domain Manager", append(statusSubjects, eventSubjects...))
+	status, err := testJetStream(q).UpdateStream(ctx, legacy)
+	if err != nil {
+		t.Fatalf("Failed to add the event subjects to the status stream: %v", err)
+	}
+
+	// Without events left behind the subjects move over by themselves
+	if _, err := newJetStreamQueue(testJetStream(q), queueConfig, jobSubjects, statusSubjects, eventSubjects); err != nil {
+		t.Fatalf("Expected the empty event subjects to move, got %v", err)
+	}
+
+	if err := testJetStream(q).DeleteStream(ctx, queueConfig.EventStream.Name); err != nil {
+		t.Fatalf("Failed to delete event stream: %v", err)
+	}
+
+	if _, err := testJetStream(q).UpdateStream(ctx, legacy); err != nil {
+		t.Fatalf("Failed to add the event subjects to the status stream: %v", err)
+	}
+
+	q.publishLifecycleEvent(EventTypeDomainActivated, jobs.DomainLifecycleEvent{Domain: "example.org", ReferenceID: "ref-1"})
+
+	_, err = newJetStreamQueue(testJetStream(q), queueConfig, jobSubjects, statusSubjects, eventSubjects)
+	purge := "nats stream purge " + queueConfig.StatusStream.Name + " --subject " + q.GetEventSubject("*")
+	if err == nil || !strings.Contains(err.Error(), purge) {
+		t.Fatalf("Expected the retained events to block the move, got %v", err)
+	}
+
+	if err := status.Purge(ctx, jetstream.WithPurgeSubject(q.GetEventSubject("*"))); err != nil {
+		t.Fatalf("Failed to purge events: %v", err)
+	}
+
+	if _, err := newJetStreamQueue(testJetStream(q), queueConfig, jobSubjects, statusSubjects, eventSubjects); err != nil {
+		t.Errorf("Expected the move to succeed after the purge, got %v", err)
+	}
+}
@@ -0,0 +1,407 @@
+package queueManager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/geekgonecrazy/vanityDomainManager/config"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/nats-io/nuid"
+)
+
+// statusHistoryConsumer prefixes the short lived consumers StatusHistory reads with, which fetch up to
+// statusHistoryBatch statuses at a time.
+const (
+	statusHistoryConsumer = "vanityDomainManager-status-history-"
+	statusHistoryBatch    = 100
+)
+
+type jetstreamQueue struct {
+	js             jetstream.JetStream
+	jobStream      jetstream.Stream
+	statusStream   jetstream.Stream
+	consumerConfig jetstream.ConsumerConfig
+	bucketStorage  jetstream.StorageType // The memory backend keeps its buckets in memory like its streams
+}
+
+func newJetStreamQueue(js jetstream.JetStream, queueConfig config.QueueConfig, jobSubjects string, statusSubjects []string, eventSubjects []string) (*jetstreamQueue, error) {
+	q := &jetstreamQueue{
+		js:            js,
+		bucketStorage: jetstream.FileStorage,
+		consumerConfig: jetstream.ConsumerConfig{
+			Name:          queueConfig.Consumer.Name,
+			Durable:       queueConfig.Consumer.Name,
+			Description:   "The consumer for the vanityDomainManager",
+			AckPolicy:     jetstream.AckExplicitPolicy,
+			AckWait:       queueConfig.Consumer.AckWait,
+			MaxAckPending: queueConfig.Consumer.MaxAckPending,
+			FilterSubject: jobSubjects,
+			MaxDeliver:    queueConfig.Consumer.MaxDeliver,
+		},
+	}
+
+	if queueConfig.Backend == "memory" {
+		q.bucketStorage = jetstream.MemoryStorage
+	}
+
+	statusStream, err := ensureStream(js, streamConfig(queueConfig.StatusStream, "Queue for Status Updates coming from Vanity Domain Manager", statusSubjects))
+	if err != nil {
+		return nil, err
+	}
+
+	jobStream, err := ensureStream(js, streamConfig(queueConfig.JobStream, "Job Queue for Vanity Domain Manager", []string{jobSubjects}))
+	if err != nil {
+		return nil, err
+	}
+
+	// After the status stream, which listened on the event subjects in earlier versions and has to let go of them
+	if _, err := ensureStream(js, streamConfig(queueConfig.EventStream, "Lifecycle events of domains managed by Vanity Domain Manager", eventSubjects)); err != nil {
+		return nil, err
+	}
+
+	q.jobStream = jobStream
+	q.statusStream = statusStream
+	return q, nil
+}
+
+func streamConfig(streamConfig config.StreamConfig, description string, subjects []string) jetstream.StreamConfig {
+	storage := jetstream.FileStorage
+	if streamConfig.Storage == "memory" {
+		storage = jetstream.MemoryStorage
+	}
+
+	retention := jetstream.WorkQueuePolicy
+	switch streamConfig.Retention {
+	case "limits":
+		retention = jetstream.LimitsPolicy
+	case "interest":
+		retention = jetstream.InterestPolicy
+	}
+
+	return jetstream.StreamConfig{
+		Name:        streamConfig.Name,
+		Description: description,
+		Subjects:    subjects,
+		Retention:   retention,
+		Storage:     storage,
+		Replicas:    streamConfig.Replicas,
+		MaxAge:      streamConfig.MaxAge,
+		MaxMsgs:     streamConfig.MaxMsgs,
+		MaxBytes:    streamConfig.MaxBytes,
+
+		MaxMsgsPerSubject: streamConfig.MaxMsgsPerSubject,
+	}
+}
+
+// ensureStream creates or updates a stream, refusing with a migration plan when the existing stream differs in
+// ways JetStream can't change in place or that need an operator.
+func ensureStream(js jetstream.JetStream, desired jetstream.StreamConfig) (jetstream.Stream, error) {
+	existing, err := js.Stream(context.Background(), desired.Name)
+	if err != nil && !errors.Is(err, jetstream.ErrStreamNotFound) {
+		return nil, fmt.Errorf("get stream %s: %w", desired.Name, err)
+	}
+
+	if err == nil {
+		stranded, err := strandedSubjects(existing, desired.Subjects)
+		if err != nil {
+			return nil, err
+		}
+
+		if plan := streamMigrationPlan(existing.CachedInfo().Config, desired, stranded); plan != "" {
+			return nil, errors.New(plan)
+		}
+	}
+
+	stream, err := js.CreateOrUpdateStream(context.Background(), desired)
+	if err != nil {
+		return nil, fmt.Errorf("add stream %s: %w", desired.Name, err)
+	}
+
+	return stream, nil
+}
+
+// strandedSubjects returns the subjects the stream would stop listening on that still hold messages. Nothing
+// would read those messages after the update.
+func strandedSubjects(existing jetstream.Stream, subjects []string) ([]string, error) {
+	stranded := []string{}
+
+	for _, subject := range existing.CachedInfo().Config.Subjects {
+		if subjectCovered(subject, subjects) {
+			continue
+		}
+
+		info, err := existing.Info(context.Background(), jetstream.WithSubjectFilter(subject))
+		if err != nil {
+			return nil, fmt.Errorf("get stream %s subjects: %w", existing.CachedInfo().Config.Name, err)
+		}
+
+		if len(info.State.Subjects) > 0 {
+			stranded = append(stranded, subject)
+		}
+	}
+
+	return stranded, nil
+}
+
+// subjectCovered reports whether every subject matching subject also matches one of patterns.
+func subjectCovered(subject string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if subjectSubset(strings.Split(subject, "."), strings.Split(pattern, ".")) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func subjectSubset(subject []string, pattern []string) bool {
+	for i, token := range pattern {
+		if token == ">" {
+			return i < len(subject)
+		}
+
+		if i >= len(subject) || subject[i] == ">" || (token != "*" && token != subject[i]) {
+			return false
+		}
+	}
+
+	return len(subject) == len(pattern)
+}
+
+// streamMigrationPlan describes how to move from the existing stream config to the desired one when the update
+// can't be done in place, or shouldn't be done by whichever replica starts first. stranded lists the subjects the
+// stream would drop while they still hold messages. It returns an empty string when the update is safe.
+func streamMigrationPlan(existing jetstream.StreamConfig, desired jetstream.StreamConfig, stranded []string) string {
+	recreate := []string{}
+
+	if existing.Storage != desired.Storage {
+		recreate = append(recreate, fmt.Sprintf("storage %s -> %s", existing.Storage, desired.Storage))
+	}
+
+	if existing.Retention != desired.Retention && (existing.Retention == jetstream.WorkQueuePolicy || desired.Retention == jetstream.WorkQueuePolicy) {
+		recreate = append(recreate, fmt.Sprintf("retention %s -> %s", existing.Retention, desired.Retention))
+	}
+
+	changes := append([]string{}, recreate...)
+	steps := []string{"Stop every vanityDomainManager replica for this environment"}
+
+	if len(recreate) > 0 {
+		steps = append(steps,
+			fmt.Sprintf("Back up the stream if its messages matter: nats stream backup %s ./%s-backup", existing.Name, existing.Name),
+			fmt.Sprintf("Remove the stream: nats stream rm %s", existing.Name),
+			"Start vanityDomainManager again to recreate it with the new settings",
+		)
+	} else {
+		for _, subject := range stranded {
+			changes = append(changes, fmt.Sprintf("subject %s dropped with messages left", subject))
+			steps = append(steps, fmt.Sprintf("Purge the messages nothing would read anymore: nats stream purge %s --subject %s", existing.Name, subject))
+		}
+
+		// Moving the stream's raft group is left to an operator rather than to whichever replica starts first. 0
+		// replicas is the server default of 1
+		if max(existing.Replicas, 1) != max(desired.Replicas, 1) {
+			changes = append(changes, fmt.Sprintf("replicas %d -> %d", existing.Replicas, desired.Replicas))
+			steps = append(steps, fmt.Sprintf("Scale the stream and wait for it to be current: nats stream edit %s --replicas %d", existing.Name, desired.Replicas))
+		}
+
+		steps = append(steps, "Start vanityDomainManager again to apply the remaining settings")
+	}
+
+	if len(changes) == 0 {
+		return ""
+	}
+
+	plan := fmt.Sprintf("stream %s can't be updated in place (%s). Migration plan:", existing.Name, strings.Join(changes, ", "))
+	for i, step := range steps {
+		plan += fmt.Sprintf("\n  %d. %s", i+1, step)
+	}
+
+	return plan + "\n  Or keep the stream by reverting these settings in the queue config"
+}
+
+func (q *jetstreamQueue) PublishJob(ctx context.Context, subject string, data []byte, msgID string) (uint64, error) {
+	opts := []jetstream.PublishOpt{}
+	if msgID != "" {
+		opts = append(opts, jetstream.WithMsgID(msgID))
+	}
+
+	ack, err := q.js.Publish(ctx, subject, data, opts...)
+	if err != nil {
+		return 0, err
+	}
+
+	return ack.Sequence, nil
+}
+
+func (q *jetstreamQueue) PublishStatus(ctx context.Context, subject string, data []byte, headers map[string]string) error {
+	msg := nats.NewMsg(subject)
+	msg.Data = data
+	for key, value := range headers {
+		msg.Header.Set(key, value)
+	}
+
+	_, err := q.js.PublishMsg(ctx, msg)
+	return err
+}
+
+// StatusHistory reads the retained statuses on subject, at most config.MaxStatusHistory of them. Nothing is acked,
+// so reading leaves the statuses of a work queue stream in place.
+func (q *jetstreamQueue) StatusHistory(ctx context.Context, subject string) ([][]byte, error) {
+	// A short lived consumer per request so readers never interfere with each other
+	con, err := q.statusStream.CreateConsumer(ctx, jetstream.ConsumerConfig{
+		Name:              statusHistoryConsumer + nuid.Next(),
+		FilterSubject:     subject,
+		DeliverPolicy:     jetstream.DeliverAllPolicy,
+		AckPolicy:         jetstream.AckExplicitPolicy,
+		MaxAckPending:     config.MaxStatusHistory,
+		InactiveThreshold: time.Minute,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("create status history consumer: %w", err)
+	}
+	defer q.statusStream.DeleteConsumer(context.Background(), con.CachedInfo().Name)
+
+	history := [][]byte{}
+
+	pending := min(con.CachedInfo().NumPending, config.MaxStatusHistory)
+	for uint64(len(history)) < pending {
+		batch, err := con.Fetch(min(int(pending)-len(history), statusHistoryBatch), jetstream.FetchMaxWait(5*time.Second))
+		if err != nil {
+			return nil, fmt.Errorf("fetch status history: %w", err)
+		}
+
+		fetched := 0
+		for msg := range batch.Messages() {
+			history = append(history, msg.Data())
+			fetched++
+		}
+
+		if err := batch.Error(); err != nil {
+			return nil, fmt.Errorf("fetch status history: %w", err)
+		}
+
+		// Removed by the stream limits while reading
+		if fetched == 0 {
+			break
+		}
+	}
+
+	return history, nil
+}
+
+func (q *jetstreamQueue) ConsumeJobs(concurrency int, handler func(Delivery)) error {
+	owned := func(name string) bool { return name == q.consumerConfig.Name }
+	if err := checkConsumers(q.jobStream, owned, "keep it by setting queue.consumer.name to %s"); err != nil {
+		return err
+	}
+
+	con, err := q.jobStream.CreateOrUpdateConsumer(context.Background(), q.consumerConfig)
+	if err != nil {
+		return fmt.Errorf("create or update consumer: %w", err)
+	}
+
+	// Only pull what there is room for, the message waiting for a slot is kept alive until it gets one
+	slots := make(chan struct{}, concurrency)
+	if _, err := con.Consume(func(msg jetstream.Msg) {
+		delivery := &jetstreamDelivery{msg: msg}
+		acquire(delivery, slots, q.consumerConfig.AckWait/3)
+
+		go func() {
+			defer func() { <-slots }()
+			handler(delivery)
+		}()
+	}, jetstream.PullMaxMessages(concurrency)); err != nil {
+		return fmt.Errorf("consume: %w", err)
+	}
+
+	return nil
+}
+
+// checkConsumers catches consumers the manager doesn't know on a work queue stream. On the job stream a renamed
+// consumer would keep the new one from being created.
+func checkConsumers(stream jetstream.Stream, owned func(name string) bool, keep string) error {
+	if stream.CachedInfo().Config.Retention != jetstream.WorkQueuePolicy {
+		return nil
+	}
+
+	streamName := stream.CachedInfo().Config.Name
+	names := stream.ConsumerNames(context.Background())
+	for name := range names.Name() {
+		if owned(name) {
+			continue
+		}
+
+		return fmt.Errorf(`work queue stream %s has consumer %s, which the manager doesn't own. Migration plan:
+  1. Stop every vanityDomainManager replica for this environment
+  2. Wait for consumer %s to have no pending messages: nats consumer info %s %s
+  3. Remove it: nats consumer rm %s %s
+  4. Start vanityDomainManager again
+  Or %s`, streamName, name, name, streamName, name, streamName, name, fmt.Sprintf(keep, name))
+	}
+
+	if err := names.Err(); err != nil {
+		return fmt.Errorf("list consumers of %s: %w", streamName, err)
+	}
+
+	return nil
+}
+
+func (q *jetstreamQueue) MaxDeliver() int {
+	return q.consumerConfig.MaxDeliver
+}
+
+func (q *jetstreamQueue) KeyValue(ctx context.Context, bucketConfig jetstream.KeyValueConfig) (jetstream.KeyValue, error) {
+	bucketConfig.Storage = q.bucketStorage
+	return q.js.CreateOrUpdateKeyValue(ctx, bucketConfig)
+}
+
+func (q *jetstreamQueue) ObjectStore(ctx context.Context, storeConfig jetstream.ObjectStoreConfig) (jetstream.ObjectStore, error) {
+	storeConfig.Storage = q.bucketStorage
+	return q.js.CreateOrUpdateObjectStore(ctx, storeConfig)
+}
+
+type jetstreamDelivery struct {
+	msg jetstream.Msg
+}
+
+func (d *jetstreamDelivery) Subject() string {
+	return d.msg.Subject()
+}
+
+func (d *jetstreamDelivery) Data() []byte {
+	return d.msg.Data()
+}
+
+func (d *jetstreamDelivery) Sequence() uint64 {
+	metadata, err := d.msg.Metadata()
+	if err != nil {
+		return 0
+	}
+
+	return metadata.Sequence.Stream
+}
+
+func (d *jetstreamDelivery) NumDelivered() uint64 {
+	metadata, err := d.msg.Metadata()
+	if err != nil {
+		return 1
+	}
+
+	return metadata.NumDelivered
+}
+
+func (d *jetstreamDelivery) Ack() error {
+	return d.msg.Ack()
+}
+
+func (d *jetstreamDelivery) Nak(delay time.Duration) error {
+	return d.msg.NakWithDelay(delay)
+}
+
+func (d *jetstreamDelivery) InProgress() error {
+	return d.msg.InProgress()
+}
@@ -0,0 +1,308 @@
+package queueManager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/geekgonecrazy/vanityDomainManager/jobs"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+func TestStreamMigrationPlan(t *testing.T) {
+	existing := jetstream.StreamConfig{
+		Name:      "test_jobs",
+		Subjects:  []string{"test.jobs.>"},
+		Retention: jetstream.WorkQueuePolicy,
+		Storage:   jetstream.FileStorage,
+		Replicas:  1,
+	}
+
+	tests := []struct {
+		name     string
+		change   func(desired *jetstream.StreamConfig)
+		stranded []string
+		expected []string
+	}{
+		{"unchanged", func(desired *jetstream.StreamConfig) {}, nil, nil},
+		{"limits changed in place", func(desired *jetstream.StreamConfig) { desired.MaxMsgs = 10 }, nil, nil},
+		{"subject added", func(desired *jetstream.StreamConfig) { desired.Subjects = append(desired.Subjects, "test.more.>") }, nil, nil},
+		{"storage", func(desired *jetstream.StreamConfig) { desired.Storage = jetstream.MemoryStorage }, nil, []string{"storage File -> Memory", "nats stream rm test_jobs"}},
+		{"to limits retention", func(desired *jetstream.StreamConfig) { desired.Retention = jetstream.LimitsPolicy }, nil, []string{"retention WorkQueue -> Limits", "nats stream rm test_jobs"}},
+		{"replicas", func(desired *jetstream.StreamConfig) { desired.Replicas = 3 }, nil, []string{"replicas 1 -> 3", "nats stream edit test_jobs --replicas 3"}},
+		{"subject dropped with messages", func(desired *jetstream.StreamConfig) { desired.Subjects = []string{"test.work.>"} }, []string{"test.jobs.>"}, []string{"subject test.jobs.> dropped", "nats stream purge test_jobs --subject test.jobs.>"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			desired := existing
+			desired.Subjects = append([]string{}, existing.Subjects...)
+			test.change(&desired)
+
+			plan := streamMigrationPlan(existing, desired, test.stranded)
+			if len(test.expected) == 0 {
+				if plan != "" {
+					t.Errorf("Expected the update to be safe, got %s", plan)
+				}
+				return
+			}
+
+			for _, expected := range test.expected {
+				if !strings.Contains(plan, expected) {
+					t.Errorf("Expected the plan to contain %q, got %s", expected, plan)
+				}
+			}
+		})
+	}
+}
+
+func TestSubjectCovered(t *testing.T) {
+	tests := []struct {
+		subject  string
+		patterns []string
+		covered  bool
+	}{
+		{"test.status.>", []string{"test.status.>"}, true},
+		{"test.status.*", []string{"test.status.>"}, true},
+		{"test.events.*", []string{"test.status.>", "test.*.*"}, true},
+		{"test.status.>", []string{"test.status.*"}, false},
+		{"test.events.*", []string{"test.status.>"}, false},
+		{"test.status", []string{"test.status.>"}, false},
+	}
+
+	for _, test := range tests {
+		if covered := subjectCovered(test.subject, test.patterns); covered != test.covered {
+			t.Errorf("Expected %s covered by %v to be %v", test.subject, test.patterns, test.covered)
+		}
+	}
+}
+
+func TestEnsureStreamRefusesStrandedSubjects(t *testing.T) {
+	q, _ := newTestManager(t)
+	ctx := context.Background()
+
+	config := jetstream.StreamConfig{Name: "stranded", Subjects: []string{"stranded.a.>", "stranded.b.>"}, Storage: jetstream.MemoryStorage}
+	if _, err := ensureStream(testJetStream(q), config); err != nil {
+		t.Fatalf("Failed to create stream: %v", err)
+	}
+
+	if _, err := testJetStream(q).Publish(ctx, "stranded.a.1", []byte("job")); err != nil {
+		t.Fatalf("Failed to publish: %v", err)
+	}
+
+	// Nothing left on b, it can go
+	config.Subjects = []string{"stranded.a.>"}
+	if _, err := ensureStream(testJetStream(q), config); err != nil {
+		t.Fatalf("Expected dropping an empty subject to be applied, got %v", err)
+	}
+
+	config.Subjects = []string{"stranded.c.>"}
+	_, err := ensureStream(testJetStream(q), config)
+	if err == nil || !strings.Contains(err.Error(), "nats stream purge stranded --subject stranded.a.>") {
+		t.Errorf("Expected dropping a subject with messages to be refused, got %v", err)
+	}
+}
+
+func TestCheckConsumers(t *testing.T) {
+	q, _ := newTestManager(t)
+	ctx := context.Background()
+
+	stream, err := ensureStream(testJetStream(q), jetstream.StreamConfig{Name: "consumers", Subjects: []string{"consumers.>"}, Retention: jetstream.WorkQueuePolicy, Storage: jetstream.MemoryStorage})
+	if err != nil {
+		t.Fatalf("Failed to create stream: %v", err)
+	}
+
+	owned := func(name string) bool { return strings.HasPrefix(name, "ours") }
+
+	if _, err := stream.CreateOrUpdateConsumer(ctx, jetstream.ConsumerConfig{Durable: "ours-1", FilterSubject: "consumers.a"}); err != nil {
+		t.Fatalf("Failed to create consumer: %v", err)
+	}
+
+	if err := checkConsumers(stream, owned, "keep %s"); err != nil {
+		t.Errorf("Expected owned consumers to pass, got %v", err)
+	}
+
+	if _, err := stream.CreateOrUpdateConsumer(ctx, jetstream.ConsumerConfig{Durable: "theirs", FilterSubject: "consumers.b"}); err != nil {
+		t.Fatalf("Failed to create consumer: %v", err)
+	}
+
+	err = checkConsumers(stream, owned, "keep %s")
+	if err == nil || !strings.Contains(err.Error(), "nats consumer rm consumers theirs") || !strings.Contains(err.Error(), "keep theirs") {
+		t.Errorf("Expected the foreign consumer to be refused, got %v", err)
+	}
+
+	// Only work queue streams are checked
+	limits, err := ensureStream(testJetStream(q), jetstream.StreamConfig{Name: "consumers_limits", Subjects: []string{"limits.>"}, Storage: jetstream.MemoryStorage})
+	if err != nil {
+		t.Fatalf("Failed to create stream: %v", err)
+	}
+
+	if _, err := limits.CreateOrUpdateConsumer(ctx, jetstream.ConsumerConfig{Durable: "theirs"}); err != nil {
+		t.Fatalf("Failed to create consumer: %v", err)
+	}
+
+	if err := checkConsumers(limits, owned, "keep %s"); err != nil {
+		t.Errorf("Expected a limits stream to allow any consumer, got %v", err)
+	}
+}
+
+func TestStatusHistory(t *testing.T) {
+	q, _ := newTestManager(t, `
+queue:
+  backend: memory
+  statusStream:
+    maxMsgsPerSubject: 250
+`)
+
+	if retention := q.queue.(*jetstreamQueue).statusStream.CachedInfo().Config.Retention; retention != jetstream.LimitsPolicy {
+		t.Fatalf("Expected the status stream to use limits retention by default, got %s", retention)
+	}
+
+	for i := 0; i < 250; i++ {
+		if err := q.SendProgressUpdate("ref-1", "example.org", jobs.StateAwaitingDNS, fmt.Sprintf("check %d", i)); err != nil {
+			t.Fatalf("Failed to send status: %v", err)
+		}
+	}
+
+	if err := q.SendProgressUpdate("ref-2", "example.net", jobs.StateAwaitingDNS, "other job"); err != nil {
+		t.Fatalf("Failed to send status: %v", err)
+	}
+
+	// An independent consumer acking every status doesn't take them away from the history
+	statusStream := q.queue.(*jetstreamQueue).statusStream
+	outside, err := statusStream.CreateOrUpdateConsumer(context.Background(), jetstream.ConsumerConfig{Durable: "dashboard", AckPolicy: jetstream.AckExplicitPolicy})
+	if err != nil {
+		t.Fatalf("Failed to create consumer: %v", err)
+	}
+
+	batch, err := outside.Fetch(251)
+	if err != nil {
+		t.Fatalf("Failed to fetch: %v", err)
+	}
+
+	for msg := range batch.Messages() {
+		if err := msg.DoubleAck(context.Background()); err != nil {
+			t.Fatalf("Failed to ack: %v", err)
+		}
+	}
+
+	// Reading twice leaves what was read in place
+	for read := 0; read < 2; read++ {
+		history, err := q.GetJobHistory("ref-1")
+		if err != nil {
+			t.Fatalf("Failed to get history: %v", err)
+		}
+
+		if len(history) != 250 {
+			t.Fatalf("Expected all 250 statuses over several fetches, got %d", len(history))
+		}
+
+		for i, status := range history {
+			if status.ReferenceID != "ref-1" || status.Message != fmt.Sprintf("check %d", i) {
+				t.Fatalf("Expected status %d of ref-1 in order, got %+v", i, status)
+			}
+		}
+	}
+
+	history, err := q.GetJobHistory("ref-3")
+	if err != nil {
+		t.Fatalf("Failed to get history: %v", err)
+	}
+
+	if len(history) != 0 {
+		t.Errorf("Expected no history for an unknown job, got %v", history)
+	}
+}
+
+func TestAddDomainJobRejectsSubjectTokens(t *testing.T) {
+	q, _ := newTestManager(t)
+
+	for _, referenceID := range []string{"", "a.b", "a*", "a>", "a b", "a\tb"} {
+		job := jobs.VanityDomainJob{ReferenceID: referenceID, Type: "remove", Domain: jobs.VanityDomain{VanityDomain: "example.org"}}
+		if err := q.AddDomainJob(job); !errors.Is(err, ErrInvalidJob) {
+			t.Errorf("Expected reference ID %q to be rejected, got %v", referenceID, err)
+		}
+	}
+}
+
+func TestAddDomainJobRejectsUnknownOwners(t *testing.T) {
+	q, _ := newTestManager(t, `
+cluster:
+  certManagerIssuer: letsencrypt
+  certificates:
+    mode: explicit
+    tenants:
+      acme:
+        issuerRef:
+          name: acme-issuer
+`)
+
+	for owner, valid := range map[string]bool{"": true, "acme": true, "other": false} {
+		job := jobs.VanityDomainJob{ReferenceID: "ref-" + owner, Type: "remove", Owner: owner, Domain: jobs.VanityDomain{VanityDomain: "example.org"}}
+
+		err := q.AddDomainJob(job)
+		if valid && err != nil {
+			t.Errorf("Failed to add job owned by %q: %v", owner, err)
+		}
+
+		if !valid && !errors.Is(err, ErrInvalidJob) {
+			t.Errorf("Expected owner %q to be rejected, got %v", owner, err)
+		}
+	}
+}
+
+func TestAddDomainJobValidatesRoutes(t *testing.T) {
+	q, _ := newTestManager(t)
+
+	job := jobs.VanityDomainJob{
+		ReferenceID: "ref-1",
+		Type:        "add",
+		Domain: jobs.VanityDomain{
+			VanityDomain:          "example.org",
+			DesiredDNSTargetType:  "A",
+			DesiredARecordTargets: []string{"192.0.2.1"},
+			Routes:                []jobs.Route{{Path: "/api"}, {Path: "/api"}},
+		},
+	}
+
+	if err := q.AddDomainJob(job); !errors.Is(err, ErrInvalidJob) {
+		t.Errorf("Expected duplicate routes to be rejected before queueing, got %v", err)
+	}
+
+	job.Domain.Routes = []jobs.Route{{Path: "/api", ServiceName: "api"}}
+	if err := q.AddDomainJob(job); !errors.Is(err, ErrInvalidJob) {
+		t.Errorf("Expected a route service without a port to be rejected before queueing, got %v", err)
+	}
+
+	job.Domain.Routes = []jobs.Route{{Path: "/api"}}
+	if err := q.AddDomainJob(job); err != nil {
+		t.Errorf("Failed to add job: %v", err)
+	}
+}
+
+func TestAddDomainJobRejectsRuleBreaks(t *testing.T) {
+	q, _ := newTestManager(t)
+
+	job := jobs.VanityDomainJob{
+		ReferenceID: "ref-1",
+		Type:        "add",
+		Domain: jobs.VanityDomain{
+			VanityDomain:          "example.org",
+			DesiredDNSTargetType:  "A",
+			DesiredARecordTargets: []string{"192.0.2.1"},
+			Routes:                []jobs.Route{{Path: "/api`) || Host(`evil.example"}},
+		},
+	}
+
+	if err := q.AddDomainJob(job); !errors.Is(err, ErrInvalidJob) {
+		t.Errorf("Expected a path that breaks routing rules to be rejected, got %v", err)
+	}
+
+	job.Domain.Routes = nil
+	job.Domain.VanityDomain = "example.org`) || Host(`evil.example"
+	if err := q.AddDomainJob(job); !errors.Is(err, ErrInvalidJob) {
+		t.Errorf("Expected a domain that breaks routing rules to be rejected, got %v", err)
+	}
+}
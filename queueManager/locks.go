@@ -0,0 +1,76 @@
+package queueManager
+
+import (
+	"sync"
+	"time"
+)
+
+// acquire takes a slot, telling the queue that msg is still in progress every interval while it waits so it isn't
+// redelivered in the meantime.
+func acquire(msg Delivery, slots chan struct{}, interval time.Duration) {
+	select {
+	case slots <- struct{}{}:
+		return
+	default:
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case slots <- struct{}{}:
+			return
+		case <-ticker.C:
+			msg.InProgress()
+		}
+	}
+}
+
+// domainLocks lets jobs for different domains run in parallel while jobs for the same domain run one at a time.
+type domainLocks struct {
+	mu    sync.Mutex
+	locks map[string]*domainLock
+}
+
+type domainLock struct {
+	slot    chan struct{}
+	waiters int
+}
+
+// lock waits until no other job for domain is running, keeping msg alive meanwhile, and returns the function that
+// lets the next one run.
+func (l *domainLocks) lock(msg Delivery, domain string, interval time.Duration) func() {
+	if domain == "" {
+		return func() {}
+	}
+
+	key := registryKey(domain)
+
+	l.mu.Lock()
+	if l.locks == nil {
+		l.locks = map[string]*domainLock{}
+	}
+
+	lock, ok := l.locks[key]
+	if !ok {
+		lock = &domainLock{slot: make(chan struct{}, 1)}
+		l.locks[key] = lock
+	}
+	lock.waiters++
+	l.mu.Unlock()
+
+	acquire(msg, lock.slot, interval)
+
+	return func() {
+		<-lock.slot
+
+		l.mu.Lock()
+		defer l.mu.Unlock()
+
+		lock.waiters--
+		if lock.waiters == 0 {
+			delete(l.locks, key)
+		}
+	}
+}
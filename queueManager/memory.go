@@ -0,0 +1,9 @@
+//go:build memory
+
+package queueManager
+
+import "github.com/geekgonecrazy/vanityDomainManager/queueManager/embedded"
+
+func init() {
+	startEmbeddedServer = embedded.Start
+}
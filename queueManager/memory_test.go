@@ -0,0 +1,264 @@
+package queueManager
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/geekgonecrazy/vanityDomainManager/config"
+	"github.com/geekgonecrazy/vanityDomainManager/jobs"
+	"github.com/geekgonecrazy/vanityDomainManager/queueManager/embedded"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// loadTestConfig loads a config with the memory backend built from sections, top level YAML blocks added to the
+// system and cluster settings every config needs. A queue section replaces the default memory backend one.
+func loadTestConfig(t *testing.T, sections ...string) {
+	t.Helper()
+
+	content := `
+system:
+  environment: test
+cluster:
+  namespace: vanity
+  serviceName: web
+  servicePort: 3000
+`
+	hasQueue := false
+	for _, section := range sections {
+		hasQueue = hasQueue || strings.HasPrefix(strings.TrimSpace(section), "queue:")
+		content += strings.TrimSpace(section) + "\n"
+	}
+
+	if !hasQueue {
+		content += "queue:\n  backend: memory\n"
+	}
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+
+	if err := config.Load(path); err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+}
+
+// newTestManager starts a manager on the memory backend with a fake cluster. The config is built from sections
+// like loadTestConfig does.
+func newTestManager(t *testing.T, sections ...string) (*queueManager, *fakeCluster) {
+	t.Helper()
+
+	loadTestConfig(t, sections...)
+
+	cluster := &fakeCluster{}
+	q := newQueueManager(cluster)
+	q.logger = log.New(io.Discard, "", 0)
+	q.retryBaseDelay = time.Millisecond
+	q.schedulePoll = 10 * time.Millisecond
+
+	nc, stop, err := embedded.Start("")
+	if err != nil {
+		t.Fatalf("Failed to start embedded server: %v", err)
+	}
+	q.stopEmbedded = stop
+	t.Cleanup(q.Close)
+
+	if err := q.connectJetStream(nc); err != nil {
+		t.Fatalf("Failed to set up JetStream: %v", err)
+	}
+
+	return q, cluster
+}
+
+// testJetStream returns the JetStream context of a test manager, for tests that look at its streams directly.
+func testJetStream(q *queueManager) jetstream.JetStream {
+	return q.queue.(*jetstreamQueue).js
+}
+
+// subscribeStatuses collects the status updates published for a job from now on.
+func subscribeStatuses(t *testing.T, q *queueManager, referenceID string) chan jobs.JobStatus {
+	t.Helper()
+
+	statuses := make(chan jobs.JobStatus, 100)
+	sub, err := q.nc.Subscribe(q.GetStatusSubject(referenceID), func(msg *nats.Msg) {
+		var status jobs.JobStatus
+		if err := json.Unmarshal(eventData(msg.Data), &status); err != nil {
+			t.Errorf("Failed to decode status: %v", err)
+		}
+		statuses <- status
+	})
+	if err != nil {
+		t.Fatalf("Failed to subscribe to statuses: %v", err)
+	}
+	t.Cleanup(func() { sub.Unsubscribe() })
+
+	return statuses
+}
+
+// waitForFinalStatus returns the first final status among statuses.
+func waitForFinalStatus(t *testing.T, statuses chan jobs.JobStatus) jobs.JobStatus {
+	t.Helper()
+
+	for {
+		select {
+		case status := <-statuses:
+			if status.IsFinal() {
+				return status
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for a final status")
+		}
+	}
+}
+
+func TestMemoryBackendNeedsBuildTag(t *testing.T) {
+	if startEmbeddedServer != nil {
+		t.Skip("built with the memory tag")
+	}
+
+	loadTestConfig(t)
+
+	if _, err := Start(); err == nil || !strings.Contains(err.Error(), "-tags memory") {
+		t.Errorf("Expected the memory backend to ask for the build tag, got %v", err)
+	}
+}
+
+func TestMemoryQueueRedelivery(t *testing.T) {
+	q, _ := newTestManager(t)
+
+	deliveries := make(chan uint64, 10)
+	if err := q.queue.ConsumeJobs(1, func(msg Delivery) {
+		deliveries <- msg.NumDelivered()
+
+		if msg.NumDelivered() == 1 {
+			msg.Nak(10 * time.Millisecond)
+			return
+		}
+
+		msg.Ack()
+	}); err != nil {
+		t.Fatalf("Failed to consume jobs: %v", err)
+	}
+
+	if _, err := q.queue.PublishJob(context.Background(), q.GetJobSubject("ref"), []byte("{}"), ""); err != nil {
+		t.Fatalf("Failed to publish job: %v", err)
+	}
+
+	for _, expected := range []uint64{1, 2} {
+		select {
+		case delivered := <-deliveries:
+			if delivered != expected {
+				t.Errorf("Expected delivery %d, got %d", expected, delivered)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for delivery %d", expected)
+		}
+	}
+}
+
+func TestMemoryQueueDropsAfterMaxDeliver(t *testing.T) {
+	q, _ := newTestManager(t, `
+queue:
+  backend: memory
+  consumer:
+    maxDeliver: 3
+`)
+
+	statuses := subscribeStatuses(t, q, "ref")
+
+	if err := q.queue.ConsumeJobs(1, func(msg Delivery) {
+		q.ackornack(msg, "ref", "example.com", true, "boom")
+	}); err != nil {
+		t.Fatalf("Failed to consume jobs: %v", err)
+	}
+
+	if _, err := q.queue.PublishJob(context.Background(), q.GetJobSubject("ref"), []byte("{}"), ""); err != nil {
+		t.Fatalf("Failed to publish job: %v", err)
+	}
+
+	for i := 1; i <= 3; i++ {
+		select {
+		case status := <-statuses:
+			if status.Dropped != (i == 3) {
+				t.Errorf("Delivery %d: expected dropped=%v, got %v", i, i == 3, status.Dropped)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for status %d", i)
+		}
+	}
+}
+
+func TestMemoryBackendRunsPipeline(t *testing.T) {
+	q, cluster := newTestManager(t)
+
+	if err := q.StartWorkers(); err != nil {
+		t.Fatalf("Failed to start workers: %v", err)
+	}
+
+	if err := q.StartRPC(); err != nil {
+		t.Fatalf("Failed to start rpc: %v", err)
+	}
+
+	statuses := subscribeStatuses(t, q, "ref-1")
+
+	job := jobs.VanityDomainJob{
+		ReferenceID: "ref-1",
+		Type:        "add",
+		Domain:      jobs.VanityDomain{VanityDomain: "localhost", DesiredDNSTargetType: "A", DesiredARecordTargets: []string{"127.0.0.1"}},
+	}
+	if err := q.AddDomainJob(job); err != nil {
+		t.Fatalf("Failed to add job: %v", err)
+	}
+
+	select {
+	case status := <-statuses:
+		if !status.Success {
+			t.Fatalf("Expected the job to succeed, got %+v", status)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the job status")
+	}
+
+	record, err := q.GetDomain("localhost")
+	if err != nil {
+		t.Fatalf("Failed to get domain: %v", err)
+	}
+
+	if record.Status.State != jobs.StateActive {
+		t.Errorf("Expected the registry to record the domain as active, got %s", record.Status.State)
+	}
+
+	if calls := cluster.recorded(); len(calls) != 1 || calls[0] != "SetVanityDomain localhost" {
+		t.Errorf("Expected the route to be set, got %v", calls)
+	}
+
+	if err := q.CancelJob("ref-2"); err != nil {
+		t.Errorf("Failed to cancel job: %v", err)
+	}
+
+	batchID, err := q.AddBatch([]jobs.VanityDomainJob{{ReferenceID: "ref-3", Type: "remove", Domain: jobs.VanityDomain{VanityDomain: "localhost"}}})
+	if err != nil {
+		t.Fatalf("Failed to add batch: %v", err)
+	}
+
+	if _, err := q.GetBatch(batchID); err != nil {
+		t.Errorf("Failed to get batch: %v", err)
+	}
+
+	reply, err := q.nc.Request(q.GetRPCSubject("ref-4"), []byte("not json"), 5*time.Second)
+	if err != nil {
+		t.Fatalf("Failed to call rpc endpoint: %v", err)
+	}
+
+	if reply.Header.Get("Nats-Service-Error-Code") != "400" {
+		t.Errorf("Expected the rpc endpoint to reject the request, got %q", reply.Data)
+	}
+}
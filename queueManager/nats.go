@@ -9,23 +9,79 @@ import (
 	"time"
 
 	"github.com/geekgonecrazy/vanityDomainManager/config"
+	"github.com/geekgonecrazy/vanityDomainManager/encryption"
 	"github.com/geekgonecrazy/vanityDomainManager/jobs"
+	"github.com/geekgonecrazy/vanityDomainManager/kubernetes"
 	"github.com/nats-io/nats.go"
 	"github.com/nats-io/nats.go/jetstream"
 )
 
 type SubjectType string
 
+// startEmbeddedServer starts the in-process NATS server of the memory backend and returns the connection to it and
+// a func stopping it. It is nil unless the manager is built with the memory tag, which keeps the server out of
+// production binaries.
+var startEmbeddedServer func(listen string) (*nats.Conn, func(), error)
+
 type queueManager struct {
-	js           jetstream.JetStream
-	jobStream    jetstream.Stream
-	statusStream jetstream.Stream
+	queue        Queue
+	nc           *nats.Conn
+	cluster      cluster
 	logger       *log.Logger
+	stopEmbedded func() // Stops the in-process NATS server of the memory backend, nil with jetstream
+
+	domains        jetstream.KeyValue    // Domain registry
+	certificates   jetstream.ObjectStore // Offloaded provided certificates, nil unless enabled
+	cancellations  jetstream.KeyValue    // Reference IDs of cancelled jobs
+	batches        jetstream.KeyValue    // Aggregate batch status
+	scheduled      jetstream.KeyValue    // Jobs held until their notBefore time, by reference ID
+	domainLocks    domainLocks           // Keeps jobs for the same domain from running at the same time
+	retryBaseDelay time.Duration         // First backoff delay, doubled with every failed delivery
+	schedulePoll   time.Duration         // How often the schedule is checked for jobs that are due
+	expiryWarned   map[string]time.Time  // Certificate expiry already announced per vanity domain
 }
 
-var _queueManager *queueManager
-
+// Start connects to the configured queue backend and returns the manager the workers and the router share.
 func Start() (*queueManager, error) {
+	q := newQueueManager(kubernetes.GetClient())
+
+	var nc *nats.Conn
+	var err error
+
+	switch config.Config().Queue().Backend {
+	case "memory":
+		if startEmbeddedServer == nil {
+			return nil, fmt.Errorf("the memory queue backend isn't built into this binary, build it with -tags memory")
+		}
+
+		q.logger.Println("Using the in-memory queue, jobs will not survive a restart")
+		nc, q.stopEmbedded, err = startEmbeddedServer(config.Config().Nats().ConnectionString)
+	default:
+		nc, err = connectNats()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := q.connectJetStream(nc); err != nil {
+		q.Close()
+		return nil, err
+	}
+
+	return q, nil
+}
+
+func newQueueManager(cluster cluster) *queueManager {
+	return &queueManager{
+		cluster:        cluster,
+		logger:         log.New(os.Stdout, "[QueueManager] ", log.LstdFlags),
+		retryBaseDelay: 30 * time.Second,
+		schedulePoll:   time.Second,
+		expiryWarned:   map[string]time.Time{},
+	}
+}
+
+func connectNats() (*nats.Conn, error) {
 	log.Println("Invoking a new NATS Publisher")
 
 	natsConfig := config.Config().Nats()
@@ -34,11 +90,9 @@ func Start() (*queueManager, error) {
 		return nil, fmt.Errorf("nats connection string is empty")
 	}
 
-	natsOpts := []nats.Option{}
-
-	if !config.Config().IsDevelopment() {
-		log.Println("using nats JWT authentication")
-		natsOpts = append(natsOpts, nats.UserJWTAndSeed(natsConfig.JWT, natsConfig.Seed))
+	natsOpts, err := natsSecurityOptions(natsConfig)
+	if err != nil {
+		return nil, err
 	}
 
 	natsOpts = append(natsOpts,
@@ -65,66 +119,87 @@ func Start() (*queueManager, error) {
 		return nil, fmt.Errorf("nats connect %w", err)
 	}
 
+	return nc, nil
+}
+
+// connectJetStream sets up the streams, consumer and buckets the manager works with on nc.
+func (q *queueManager) connectJetStream(nc *nats.Conn) error {
+	q.nc = nc
+
 	js, err := jetstream.New(nc)
 	if err != nil {
-		return nil, fmt.Errorf("jetstream: %w", err)
+		return fmt.Errorf("jetstream: %w", err)
 	}
 
-	_queueManager = &queueManager{
-		js:     js,
-		logger: log.New(os.Stdout, "[QueueManager] ", log.LstdFlags),
+	queue, err := newJetStreamQueue(js, config.Config().Queue(), q.GetJobSubject(">"), []string{q.GetStatusSubject(">"), q.GetBatchStatusSubject("*")}, []string{q.GetEventSubject("*")})
+	if err != nil {
+		return err
 	}
 
-	if err := _queueManager.ensureStreams(); err != nil {
-		return nil, err
+	q.queue = queue
+
+	if err := q.ensureCertificateStore(); err != nil {
+		return err
 	}
 
-	return _queueManager, nil
+	if err := q.ensureCancellations(); err != nil {
+		return err
+	}
+
+	if err := q.ensureBatches(); err != nil {
+		return err
+	}
+
+	if err := q.ensureSchedule(); err != nil {
+		return err
+	}
+
+	return q.ensureRegistry()
 }
 
-func Mgr() *queueManager {
-	if _queueManager == nil {
-		panic("queue manager is not initialized")
+// Close disconnects from NATS and stops the embedded server of the memory backend.
+func (q *queueManager) Close() {
+	if q.nc != nil {
+		q.nc.Close()
+	}
+
+	if q.stopEmbedded != nil {
+		q.stopEmbedded()
 	}
-	return _queueManager
 }
 
-func (q *queueManager) ensureStreams() error {
-	env := config.Config().System().Environment
+// natsSecurityOptions builds the authentication and TLS options for the auth method selected in the config.
+func natsSecurityOptions(natsConfig config.NatsConfig) ([]nats.Option, error) {
+	natsOpts := []nats.Option{}
 
-	statusStream, err := q.js.CreateOrUpdateStream(context.Background(), jetstream.StreamConfig{
-		Name:        fmt.Sprintf("%s_%s", env, "vanityDomainManager_status"),
-		Description: "Queue for Status Updates coming from Vanity Domain Manager",
-		Subjects: []string{
-			q.GetStatusSubject(">"),
-		},
-		Retention: jetstream.WorkQueuePolicy,
-		MaxAge:    7 * time.Hour * 24,
-		MaxMsgs:   1_000_000_000,
-		MaxBytes:  4 << 20, // 4 MB
-	})
-	if err != nil {
-		return fmt.Errorf("add stream: %w", err)
-	}
-
-	jobStream, err := q.js.CreateOrUpdateStream(context.Background(), jetstream.StreamConfig{
-		Name:        fmt.Sprintf("%s_%s", env, "vanityDomainManager_jobs"),
-		Description: "Job Queue for Vanity Domain Manager",
-		Subjects: []string{
-			q.GetJobSubject(">"),
-		},
-		Retention: jetstream.WorkQueuePolicy,
-		MaxAge:    7 * time.Hour * 24,
-		MaxMsgs:   1_000_000_000,
-		MaxBytes:  4 << 20, // 4 MB
-	})
-	if err != nil {
-		return fmt.Errorf("add stream: %w", err)
+	log.Printf("using nats %s authentication", natsConfig.Auth)
+
+	switch natsConfig.Auth {
+	case "jwt":
+		natsOpts = append(natsOpts, nats.UserJWTAndSeed(natsConfig.JWT, natsConfig.Seed))
+	case "creds":
+		natsOpts = append(natsOpts, nats.UserCredentials(natsConfig.CredsFile))
+	case "nkey":
+		opt, err := nats.NkeyOptionFromSeed(natsConfig.NKeySeedFile)
+		if err != nil {
+			return nil, fmt.Errorf("nats nkey seed: %w", err)
+		}
+		natsOpts = append(natsOpts, opt)
+	case "userpass":
+		natsOpts = append(natsOpts, nats.UserInfo(natsConfig.User, natsConfig.Password))
+	case "token":
+		natsOpts = append(natsOpts, nats.Token(natsConfig.Token))
 	}
 
-	q.jobStream = jobStream
-	q.statusStream = statusStream
-	return nil
+	if natsConfig.TLS.CAFile != "" {
+		natsOpts = append(natsOpts, nats.RootCAs(natsConfig.TLS.CAFile))
+	}
+
+	if natsConfig.TLS.CertFile != "" {
+		natsOpts = append(natsOpts, nats.ClientCert(natsConfig.TLS.CertFile, natsConfig.TLS.KeyFile))
+	}
+
+	return natsOpts, nil
 }
 
 func (q *queueManager) StartWorkers() error {
@@ -134,40 +209,162 @@ func (q *queueManager) StartWorkers() error {
 		return fmt.Errorf("start domain job worker: %w", err)
 	}
 
+	if err := q.startCancelListener(); err != nil {
+		return fmt.Errorf("start cancel listener: %w", err)
+	}
+
+	if err := q.startBatchListener(); err != nil {
+		return fmt.Errorf("start batch listener: %w", err)
+	}
+
+	q.startScheduleReleaser()
+
+	if config.Config().Worker().Reverify.Enabled || config.Config().Events().CertificateExpiryWarning > 0 {
+		q.startReverifyScheduler()
+	}
+
+	if config.Config().Worker().Reconcile.Enabled {
+		if err := q.startReconciler(); err != nil {
+			return fmt.Errorf("start reconciler: %w", err)
+		}
+	}
+
 	return nil
 }
 
 func (q *queueManager) AddDomainJob(job jobs.VanityDomainJob) error {
+	if err := job.Validate(); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidJob, err)
+	}
+
+	if err := validateSchedule(job); err != nil {
+		return err
+	}
+
+	if err := validateAnnotations(job); err != nil {
+		return err
+	}
+
+	if err := validateOwner(job); err != nil {
+		return err
+	}
+
+	// Always publish the current schema so workers never have to guess
+	job.SchemaVersion = jobs.CurrentSchemaVersion
+
+	// Keep private keys out of the stream in plain text when a manager key is configured
+	if job.Domain.ProvidedCertificate != nil && encryption.GetKeyring().CanEncrypt() {
+		cert := *job.Domain.ProvidedCertificate
+		if err := encryption.GetKeyring().SealCertificate(&cert); err != nil {
+			return fmt.Errorf("encrypt certificate key: %w", err)
+		}
+		job.Domain.ProvidedCertificate = &cert
+	}
+
+	if err := q.offloadCertificate(&job); err != nil {
+		return err
+	}
+
 	data, err := json.Marshal(job)
 	if err != nil {
+		q.deleteCertificate(job.Domain.CertificateRef)
 		return fmt.Errorf("json marshal: %w", err)
 	}
 
+	// Jobs for later wait in the schedule, so they don't sit on the job consumer until they are due
+	if job.NotBefore != nil && time.Now().Before(*job.NotBefore) {
+		if err := q.holdJob(job, data); err != nil {
+			q.deleteCertificate(job.Domain.CertificateRef)
+			return err
+		}
+
+		return nil
+	}
+
+	if err := q.publishJob(job, data, ""); err != nil {
+		// No job will ever fetch or delete the stored certificate
+		q.deleteCertificate(job.Domain.CertificateRef)
+		return err
+	}
+
+	return nil
+}
+
+// publishJob queues the marshalled job and supersedes older pending jobs for its domain right away.
+func (q *queueManager) publishJob(job jobs.VanityDomainJob, data []byte, msgID string) error {
 	subjectName := q.GetJobSubject(job.ReferenceID)
-	if _, err := q.js.Publish(context.Background(), subjectName, data); err != nil {
+	sequence, err := q.queue.PublishJob(context.Background(), subjectName, data, msgID)
+	if err != nil {
 		return fmt.Errorf("publish job to %s: %w", subjectName, err)
 	}
 
 	q.logger.Printf("Job published to subject %s", subjectName)
 
+	if job.Domain.VanityDomain != "" {
+		if _, err := q.claimLatestJob(job, sequence); err != nil {
+			q.logger.Printf("Failed to record %s as the latest job for %s: %s", job.ReferenceID, job.Domain.VanityDomain, err)
+		}
+	}
+
 	return nil
 }
 
-func (q *queueManager) SendStatusUpdate(referenceID string, success bool, errorMessage string, dropped bool) error {
-	msg := jobs.JobStatus{
+func (q *queueManager) SendStatusUpdate(referenceID string, domain string, success bool, errorMessage string, dropped bool) error {
+	return q.publishStatus(jobs.JobStatus{
 		Success:      success,
 		ReferenceID:  referenceID,
+		Domain:       domain,
 		ErrorMessage: errorMessage,
 		Dropped:      dropped,
+	})
+}
+
+// SendProgressUpdate publishes a non-final status so callers can follow a job that is still being worked on.
+func (q *queueManager) SendProgressUpdate(referenceID string, domain string, state string, message string) error {
+	return q.publishStatus(jobs.JobStatus{
+		ReferenceID: referenceID,
+		Domain:      domain,
+		State:       state,
+		Message:     message,
+	})
+}
+
+// GetJobHistory returns every retained status update for a job, oldest first.
+func (q *queueManager) GetJobHistory(referenceID string) ([]jobs.JobStatus, error) {
+	history, err := q.queue.StatusHistory(context.Background(), q.GetStatusSubject(referenceID))
+	if err != nil {
+		return nil, err
 	}
 
+	statuses := make([]jobs.JobStatus, 0, len(history))
+	for _, data := range history {
+		var status jobs.JobStatus
+		if err := json.Unmarshal(eventData(data), &status); err != nil {
+			q.logger.Printf("Skipping undecodable status for %s: %s", referenceID, err)
+			continue
+		}
+
+		statuses = append(statuses, status)
+	}
+
+	return statuses, nil
+}
+
+func (q *queueManager) publishStatus(msg jobs.JobStatus) error {
+	msg.Timestamp = time.Now().UTC()
+
 	data, err := json.Marshal(msg)
 	if err != nil {
 		return fmt.Errorf("json marshal status update: %w", err)
 	}
 
-	subjectName := q.GetStatusSubject(referenceID)
-	if _, err := q.js.Publish(context.Background(), subjectName, data); err != nil {
+	data, headers, err := encodeEvent(EventTypeJobStatus, msg.Domain, msg.Timestamp, data)
+	if err != nil {
+		return err
+	}
+
+	subjectName := q.GetStatusSubject(msg.ReferenceID)
+	if err := q.queue.PublishStatus(context.Background(), subjectName, data, headers); err != nil {
 		return fmt.Errorf("publish status update to %s: %w", subjectName, err)
 	}
 
@@ -184,36 +381,58 @@ func (q *queueManager) GetStatusSubject(sub string) string {
 	return fmt.Sprintf("%s.vanityDomainManager.status.%s", config.Config().System().Environment, sub)
 }
 
-func (q *queueManager) ackornack(config jetstream.ConsumerConfig, msg jetstream.Msg, referenceID string, hasError bool, errorMessage string) {
+func (q *queueManager) GetEventSubject(sub string) string {
+	return fmt.Sprintf("%s.vanityDomainManager.events.%s", config.Config().System().Environment, sub)
+}
+
+func (q *queueManager) GetBatchJobSubject() string {
+	return fmt.Sprintf("%s.vanityDomainManager.batchjob", config.Config().System().Environment)
+}
+
+func (q *queueManager) GetBatchStatusSubject(sub string) string {
+	return fmt.Sprintf("%s.vanityDomainManager.batchstatus.%s", config.Config().System().Environment, sub)
+}
+
+func (q *queueManager) GetCancelSubject(sub string) string {
+	return fmt.Sprintf("%s.vanityDomainManager.cancel.%s", config.Config().System().Environment, sub)
+}
+
+func (q *queueManager) GetRPCSubject(sub string) string {
+	return fmt.Sprintf("%s.vanityDomainManager.rpc.%s", config.Config().System().Environment, sub)
+}
+
+// ackornack acks or naks the message depending on the outcome and reports whether it was dropped.
+func (q *queueManager) ackornack(msg Delivery, referenceID string, domain string, hasError bool, errorMessage string) bool {
 	if hasError {
 		// Get message info for retry logic
-		msgInfo, _ := msg.Metadata()
-		deliveryCount := msgInfo.NumDelivered
+		deliveryCount := msg.NumDelivered()
+		maxDeliver := q.queue.MaxDeliver()
 
 		q.logger.Printf("Error: %s", errorMessage)
 
-		if deliveryCount >= uint64(config.MaxDeliver) {
-			q.logger.Printf("Message %s has reached max retries (%d). Remove from the queue.", msg.Subject(), config.MaxDeliver)
+		if deliveryCount >= uint64(maxDeliver) {
+			q.logger.Printf("Message %s has reached max retries (%d). Remove from the queue.", msg.Subject(), maxDeliver)
 
-			if err := q.SendStatusUpdate(referenceID, false, errorMessage, true); err != nil {
+			if err := q.SendStatusUpdate(referenceID, domain, false, errorMessage, true); err != nil {
 				q.logger.Printf("Failed to send status update for job %s: %s", msg.Subject(), err)
 			}
 
 			msg.Ack()
-			return
+			return true
 		}
 
-		if err := q.SendStatusUpdate(referenceID, false, errorMessage, false); err != nil {
+		if err := q.SendStatusUpdate(referenceID, domain, false, errorMessage, false); err != nil {
 			q.logger.Printf("Failed to send status update for job %s: %s", msg.Subject(), err)
 		}
 
 		// Calculate and apply exponential backoff
-		baseDelay := 30 * time.Second
-		nakDelay := baseDelay * time.Duration(1<<(deliveryCount-1))
+		nakDelay := q.retryBaseDelay * time.Duration(1<<(deliveryCount-1))
 		q.logger.Printf("Message %s will be retried after backoff delay of %v.", msg.Subject(), nakDelay)
-		msg.NakWithDelay(nakDelay)
+		msg.Nak(nakDelay)
 	} else {
 		// If processing was successful, acknowledge the message
 		msg.Ack()
 	}
+
+	return false
 }
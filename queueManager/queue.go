@@ -0,0 +1,44 @@
+package queueManager
+
+import (
+	"context"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// Queue is the transport jobs and status updates travel over, JetStream on a NATS server or on the embedded server
+// of the memory backend.
+type Queue interface {
+	// PublishJob durably enqueues a job message on subject and returns its sequence in the queue. Publishes with
+	// the same non-empty msgID shortly after each other enqueue the message once.
+	PublishJob(ctx context.Context, subject string, data []byte, msgID string) (uint64, error)
+	// PublishStatus publishes a status update or event on subject, with optional message headers.
+	PublishStatus(ctx context.Context, subject string, data []byte, headers map[string]string) error
+	// StatusHistory returns every retained status update on subject, oldest first.
+	StatusHistory(ctx context.Context, subject string) ([][]byte, error)
+	// ConsumeJobs starts delivering job messages to handler, each in its own goroutine and at most concurrency at
+	// a time.
+	ConsumeJobs(concurrency int, handler func(Delivery)) error
+	// MaxDeliver is the number of deliveries after which a failing job is dropped.
+	MaxDeliver() int
+	// KeyValue creates or updates the key value bucket described by bucketConfig, stored like the queue's streams.
+	KeyValue(ctx context.Context, bucketConfig jetstream.KeyValueConfig) (jetstream.KeyValue, error)
+	// ObjectStore creates or updates the object store described by storeConfig, stored like the queue's streams.
+	ObjectStore(ctx context.Context, storeConfig jetstream.ObjectStoreConfig) (jetstream.ObjectStore, error)
+}
+
+// Delivery is a single delivery of a job message. Every delivery must end with Ack or Nak.
+type Delivery interface {
+	Subject() string
+	Data() []byte
+	// Sequence is the position of the message in the queue, later messages have higher sequences.
+	Sequence() uint64
+	// NumDelivered is 1 on the first delivery and grows with every redelivery.
+	NumDelivered() uint64
+	Ack() error
+	// Nak asks for the message to be redelivered after delay.
+	Nak(delay time.Duration) error
+	// InProgress tells the queue the message is still being worked on so it isn't redelivered.
+	InProgress() error
+}
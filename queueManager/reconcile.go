@@ -0,0 +1,95 @@
+package queueManager
+
+import (
+	"context"
+	"errors"
+
+	"github.com/geekgonecrazy/vanityDomainManager/config"
+	"github.com/geekgonecrazy/vanityDomainManager/jobs"
+	"github.com/geekgonecrazy/vanityDomainManager/kubernetes"
+)
+
+// startReconciler repairs managed objects that drift from the registry. Only the replica holding the reconciler
+// Lease runs it, so replicas don't repair the same objects at once. A reconciler can't be started again once it
+// stopped, every term as leader gets a new one.
+func (q *queueManager) startReconciler() error {
+	reconcileConfig := config.Config().Worker().Reconcile
+
+	return q.cluster.RunLeaderElected(context.Background(), "reconciler", func(ctx context.Context) {
+		q.logger.Printf("Starting reconciler, resyncing every %v", reconcileConfig.Resync)
+
+		reconciler, err := q.cluster.NewReconciler(registryState{q: q}, reconcileConfig.Resync)
+		if err != nil {
+			q.logger.Printf("Failed to create reconciler: %s", err)
+			return
+		}
+
+		if err := reconciler.Start(ctx, reconcileConfig.Workers); err != nil {
+			q.logger.Printf("Failed to start reconciler: %s", err)
+		}
+	})
+}
+
+// registryState serves the registry to the reconciler. Only active domains are desired, a domain with a job
+// queued or in flight, a failed job or one disabled for DNS drift is left to the jobs.
+type registryState struct {
+	q *queueManager
+}
+
+func (s registryState) DesiredDomains() ([]kubernetes.ManagedDomain, error) {
+	records, err := s.q.ListDomains()
+	if err != nil {
+		return nil, err
+	}
+
+	domains := []kubernetes.ManagedDomain{}
+	for _, record := range records {
+		if isSettled(record) {
+			domains = append(domains, desiredDomain(record))
+		}
+	}
+
+	return domains, nil
+}
+
+func (s registryState) DesiredDomain(domain string) (kubernetes.ManagedDomain, bool, error) {
+	record, err := s.q.GetDomain(domain)
+	if errors.Is(err, ErrDomainNotFound) {
+		return kubernetes.ManagedDomain{}, false, nil
+	}
+	if err != nil {
+		return kubernetes.ManagedDomain{}, false, err
+	}
+
+	if !isSettled(*record) {
+		return kubernetes.ManagedDomain{}, false, nil
+	}
+
+	return desiredDomain(*record), true, nil
+}
+
+func (s registryState) Drifted(managed kubernetes.ManagedDomain, message string) {
+	s.q.publishLifecycleEvent(EventTypeObjectDrifted, jobs.DomainLifecycleEvent{
+		Domain:      managed.Domain.VanityDomain,
+		ReferenceID: managed.ReferenceID,
+		Message:     message,
+	})
+}
+
+// isSettled reports whether a domain is active with no newer job queued for it. A queued job records itself as
+// the latest job before it is delivered, the domain only turns pending once a worker picks it up.
+func isSettled(record jobs.DomainRecord) bool {
+	if record.Status.State != jobs.StateActive {
+		return false
+	}
+
+	return record.LatestJob == nil || record.LatestJob.ReferenceID == record.Status.ReferenceID
+}
+
+func desiredDomain(record jobs.DomainRecord) kubernetes.ManagedDomain {
+	return kubernetes.ManagedDomain{
+		Domain:      record.Domain,
+		ReferenceID: record.Status.ReferenceID,
+		Owner:       record.Owner,
+	}
+}
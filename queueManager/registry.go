@@ -0,0 +1,291 @@
+package queueManager
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/geekgonecrazy/vanityDomainManager/config"
+	"github.com/geekgonecrazy/vanityDomainManager/jobs"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+const (
+	maxDomainHistory = 50 // Oldest events are dropped once a record has this many
+	maxUpdateRetries = 10 // Attempts at an optimistic update before giving up
+)
+
+var ErrDomainNotFound = errors.New("domain not found")
+
+func (q *queueManager) ensureRegistry() error {
+	env := config.Config().System().Environment
+
+	kv, err := q.queue.KeyValue(context.Background(), jetstream.KeyValueConfig{
+		Bucket:      fmt.Sprintf("%s_%s", env, "vanityDomainManager_domains"),
+		Description: "Registry of vanity domains managed by Vanity Domain Manager",
+		History:     1,
+	})
+	if err != nil {
+		return fmt.Errorf("create domain registry: %w", err)
+	}
+
+	q.domains = kv
+	return nil
+}
+
+// GetDomain returns the registry record for a vanity domain.
+func (q *queueManager) GetDomain(domain string) (*jobs.DomainRecord, error) {
+	entry, err := q.domains.Get(context.Background(), registryKey(domain))
+	if err != nil {
+		if errors.Is(err, jetstream.ErrKeyNotFound) {
+			return nil, ErrDomainNotFound
+		}
+		return nil, fmt.Errorf("get domain %s: %w", domain, err)
+	}
+
+	return decodeDomainRecord(entry)
+}
+
+// FindDomain returns the registry record for a vanity domain, or nil when the registry doesn't know the domain.
+func (q *queueManager) FindDomain(domain string) (*jobs.DomainRecord, error) {
+	record, err := q.GetDomain(domain)
+	if errors.Is(err, ErrDomainNotFound) {
+		return nil, nil
+	}
+
+	return record, err
+}
+
+// ListDomains returns every record in the registry.
+func (q *queueManager) ListDomains() ([]jobs.DomainRecord, error) {
+	lister, err := q.domains.ListKeys(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("list domain keys: %w", err)
+	}
+	defer lister.Stop()
+
+	records := []jobs.DomainRecord{}
+	for key := range lister.Keys() {
+		entry, err := q.domains.Get(context.Background(), key)
+		if err != nil {
+			if errors.Is(err, jetstream.ErrKeyNotFound) {
+				continue
+			}
+			return nil, fmt.Errorf("get domain %s: %w", key, err)
+		}
+
+		record, err := decodeDomainRecord(entry)
+		if err != nil {
+			return nil, err
+		}
+
+		records = append(records, *record)
+	}
+
+	return records, nil
+}
+
+// updateDomain applies mutate to the current record for a domain and writes it back only if nobody else has
+// written it since it was read, retrying from a fresh read when they have. Nothing is written when mutate
+// returns false.
+func (q *queueManager) updateDomain(domain string, mutate func(record *jobs.DomainRecord) bool) error {
+	return q.updateKey(q.domains, registryKey(domain), func(current []byte) ([]byte, error) {
+		record := &jobs.DomainRecord{History: []jobs.DomainEvent{}}
+		if current != nil {
+			if err := json.Unmarshal(current, record); err != nil {
+				return nil, fmt.Errorf("json unmarshal domain record %s: %w", domain, err)
+			}
+		}
+
+		if !mutate(record) {
+			return nil, nil
+		}
+
+		if len(record.History) > maxDomainHistory {
+			record.History = record.History[len(record.History)-maxDomainHistory:]
+		}
+
+		record.Revision = 0
+		return json.Marshal(record)
+	})
+}
+
+// updateKey reads a key, lets mutate build the new value from the current one (nil when the key doesn't exist)
+// and writes it only if the key hasn't changed since it was read, retrying from a fresh read when it has.
+// Nothing is written when mutate returns a nil value.
+func (q *queueManager) updateKey(kv jetstream.KeyValue, key string, mutate func(current []byte) ([]byte, error)) error {
+	for attempt := 0; attempt < maxUpdateRetries; attempt++ {
+		var current []byte
+		var revision uint64
+
+		entry, err := kv.Get(context.Background(), key)
+		if err != nil && !errors.Is(err, jetstream.ErrKeyNotFound) {
+			return fmt.Errorf("get %s: %w", key, err)
+		}
+
+		if err == nil {
+			current = entry.Value()
+			revision = entry.Revision()
+		}
+
+		data, err := mutate(current)
+		if err != nil {
+			return err
+		}
+
+		if data == nil {
+			return nil
+		}
+
+		if revision == 0 {
+			_, err = kv.Create(context.Background(), key, data)
+		} else {
+			_, err = kv.Update(context.Background(), key, data, revision)
+		}
+
+		if err == nil {
+			return nil
+		}
+
+		if !isRevisionConflict(err) {
+			return fmt.Errorf("write %s: %w", key, err)
+		}
+
+		q.logger.Printf("%s was updated concurrently, retrying", key)
+	}
+
+	return fmt.Errorf("write %s: gave up after %d conflicting updates", key, maxUpdateRetries)
+}
+
+// recordDomainJob stores the desired spec of a job and marks the domain as pending. Only the first delivery of a
+// job records it, redeliveries find the job still pending and don't add to the history.
+func (q *queueManager) recordDomainJob(job jobs.VanityDomainJob) {
+	if err := q.updateDomain(job.Domain.VanityDomain, func(record *jobs.DomainRecord) bool {
+		if record.Status.ReferenceID == job.ReferenceID && record.Status.State == jobs.StatePending {
+			return false
+		}
+
+		if job.Type != "remove" {
+			record.Domain = job.Domain
+			record.Domain.CertificateRef = ""
+			if record.Domain.ProvidedCertificate != nil {
+				// Keep the public certificate for reference but never the key
+				record.Domain.ProvidedCertificate = &jobs.DomainCustomCert{Cert: job.Domain.ProvidedCertificate.Cert}
+			}
+		}
+
+		if job.Owner != "" {
+			record.Owner = job.Owner
+		}
+
+		if record.Domain.VanityDomain == "" {
+			record.Domain.VanityDomain = job.Domain.VanityDomain
+		}
+
+		setDomainState(record, job.ReferenceID, job.Type, jobs.StatePending, "")
+		return true
+	}); err != nil {
+		q.logger.Printf("Failed to record job %s for %s: %s", job.ReferenceID, job.Domain.VanityDomain, err)
+	}
+}
+
+// recordProvidedCertificate keeps the public certificate of a job whose certificate was offloaded to the object
+// store, it is only known once fetched. The reconciler relies on it to tell provided certificates from issued ones.
+func (q *queueManager) recordProvidedCertificate(domain string, cert string) {
+	if err := q.updateDomain(domain, func(record *jobs.DomainRecord) bool {
+		record.Domain.ProvidedCertificate = &jobs.DomainCustomCert{Cert: cert}
+		return true
+	}); err != nil {
+		q.logger.Printf("Failed to record provided certificate for %s: %s", domain, err)
+	}
+}
+
+// recordDomainState moves a domain to a new state and appends it to the history.
+func (q *queueManager) recordDomainState(domain string, referenceID string, jobType string, state string, message string) {
+	if err := q.updateDomain(domain, func(record *jobs.DomainRecord) bool {
+		if record.Domain.VanityDomain == "" {
+			record.Domain.VanityDomain = domain
+		}
+
+		setDomainState(record, referenceID, jobType, state, message)
+		return true
+	}); err != nil {
+		q.logger.Printf("Failed to record state %s for %s: %s", state, domain, err)
+	}
+}
+
+// claimLatestJob records a job as the newest for its domain unless a job that was queued after it already is.
+// It returns the reference ID of that newer job when there is one.
+func (q *queueManager) claimLatestJob(job jobs.VanityDomainJob, sequence uint64) (string, error) {
+	newer := ""
+
+	err := q.updateDomain(job.Domain.VanityDomain, func(record *jobs.DomainRecord) bool {
+		latest := record.LatestJob
+		if latest != nil && latest.ReferenceID != job.ReferenceID && latest.Sequence > sequence {
+			newer = latest.ReferenceID
+			return false
+		}
+
+		if latest != nil && latest.ReferenceID == job.ReferenceID && latest.Sequence == sequence {
+			return false
+		}
+
+		if record.Domain.VanityDomain == "" {
+			record.Domain.VanityDomain = job.Domain.VanityDomain
+		}
+
+		record.LatestJob = &jobs.LatestJob{ReferenceID: job.ReferenceID, Sequence: sequence}
+		return true
+	})
+
+	return newer, err
+}
+
+func setDomainState(record *jobs.DomainRecord, referenceID string, jobType string, state string, message string) {
+	now := time.Now().UTC()
+
+	record.Status = jobs.DomainStatus{
+		State:       state,
+		ReferenceID: referenceID,
+		UpdatedAt:   now,
+	}
+
+	if state == jobs.StatePending || state == jobs.StateFailed || state == jobs.StateDNSDrifted {
+		record.Status.ErrorMessage = message
+	}
+
+	// A new job or a removal starts re-verification over
+	if state != jobs.StateActive && state != jobs.StateDNSDrifted {
+		record.Reverify = nil
+	}
+
+	record.History = append(record.History, jobs.DomainEvent{
+		ReferenceID: referenceID,
+		Type:        jobType,
+		State:       state,
+		Message:     message,
+		At:          now,
+	})
+}
+
+func decodeDomainRecord(entry jetstream.KeyValueEntry) (*jobs.DomainRecord, error) {
+	var record jobs.DomainRecord
+	if err := json.Unmarshal(entry.Value(), &record); err != nil {
+		return nil, fmt.Errorf("json unmarshal domain record %s: %w", entry.Key(), err)
+	}
+
+	record.Revision = entry.Revision()
+	return &record, nil
+}
+
+func isRevisionConflict(err error) bool {
+	var apiErr *jetstream.APIError
+	return errors.Is(err, jetstream.ErrKeyExists) || (errors.As(err, &apiErr) && apiErr.ErrorCode == jetstream.JSErrCodeStreamWrongLastSequence)
+}
+
+func registryKey(domain string) string {
+	return strings.ToLower(strings.TrimSuffix(domain, "."))
+}
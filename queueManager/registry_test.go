@@ -0,0 +1,267 @@
+package queueManager
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/geekgonecrazy/vanityDomainManager/config"
+	"github.com/geekgonecrazy/vanityDomainManager/jobs"
+)
+
+func TestUpdateDomainKeepsConcurrentUpdates(t *testing.T) {
+	q, _ := newTestManager(t)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			q.recordDomainState("example.org", fmt.Sprintf("ref-%d", i), "add", jobs.StateActive, "")
+		}()
+	}
+	wg.Wait()
+
+	record, err := q.GetDomain("example.org")
+	if err != nil {
+		t.Fatalf("Failed to get domain: %v", err)
+	}
+
+	if len(record.History) != 20 {
+		t.Errorf("Expected every concurrent update to be kept, got %d history entries", len(record.History))
+	}
+}
+
+func TestUpdateKeyRetriesOnConflict(t *testing.T) {
+	q, _ := newTestManager(t)
+	ctx := context.Background()
+
+	tests := []struct {
+		name     string
+		existing string
+	}{
+		{"create", ""},
+		{"update", "0"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			key := "counter-" + test.name
+			if test.existing != "" {
+				if _, err := q.domains.PutString(ctx, key, test.existing); err != nil {
+					t.Fatalf("Failed to put key: %v", err)
+				}
+			}
+
+			calls := 0
+			err := q.updateKey(q.domains, key, func(current []byte) ([]byte, error) {
+				calls++
+				if calls == 1 {
+					// Another replica writes the key between our read and our write
+					if _, err := q.domains.PutString(ctx, key, "41"); err != nil {
+						t.Fatalf("Failed to put key: %v", err)
+					}
+				}
+
+				var counter int
+				json.Unmarshal(current, &counter)
+				return json.Marshal(counter + 1)
+			})
+			if err != nil {
+				t.Fatalf("Failed to update key: %v", err)
+			}
+
+			if calls != 2 {
+				t.Errorf("Expected the update to be retried once, got %d calls", calls)
+			}
+
+			entry, err := q.domains.Get(ctx, key)
+			if err != nil {
+				t.Fatalf("Failed to get key: %v", err)
+			}
+
+			if string(entry.Value()) != "42" {
+				t.Errorf("Expected the retry to build on the concurrent write, got %s", entry.Value())
+			}
+		})
+	}
+}
+
+func TestUpdateKeyGivesUp(t *testing.T) {
+	q, _ := newTestManager(t)
+	ctx := context.Background()
+
+	calls := 0
+	err := q.updateKey(q.domains, "contended", func(current []byte) ([]byte, error) {
+		calls++
+		if _, err := q.domains.PutString(ctx, "contended", fmt.Sprint(calls)); err != nil {
+			t.Fatalf("Failed to put key: %v", err)
+		}
+
+		return []byte("mine"), nil
+	})
+
+	if err == nil || !strings.Contains(err.Error(), "gave up") {
+		t.Errorf("Expected the update to give up, got: %v", err)
+	}
+
+	if calls != maxUpdateRetries {
+		t.Errorf("Expected %d attempts, got %d", maxUpdateRetries, calls)
+	}
+}
+
+func TestClaimLatestJob(t *testing.T) {
+	q, _ := newTestManager(t)
+
+	claim := func(referenceID string, sequence uint64) string {
+		t.Helper()
+
+		newer, err := q.claimLatestJob(jobs.VanityDomainJob{ReferenceID: referenceID, Domain: jobs.VanityDomain{VanityDomain: "example.org"}}, sequence)
+		if err != nil {
+			t.Fatalf("Failed to claim %s: %v", referenceID, err)
+		}
+
+		return newer
+	}
+
+	if newer := claim("ref-2", 5); newer != "" {
+		t.Errorf("Expected the first job to claim the domain, got newer job %s", newer)
+	}
+
+	if newer := claim("ref-1", 3); newer != "ref-2" {
+		t.Errorf("Expected the job queued earlier to find ref-2, got %q", newer)
+	}
+
+	if newer := claim("ref-2", 5); newer != "" {
+		t.Errorf("Expected a redelivery of the latest job to keep its claim, got newer job %s", newer)
+	}
+
+	if newer := claim("ref-3", 7); newer != "" {
+		t.Errorf("Expected a job queued later to claim the domain, got newer job %s", newer)
+	}
+
+	record, err := q.GetDomain("example.org")
+	if err != nil {
+		t.Fatalf("Failed to get domain: %v", err)
+	}
+
+	if record.LatestJob == nil || record.LatestJob.ReferenceID != "ref-3" || record.LatestJob.Sequence != 7 {
+		t.Errorf("Expected ref-3 to be the latest job, got %+v", record.LatestJob)
+	}
+}
+
+func TestRecordDomainJobOncePerJob(t *testing.T) {
+	q, _ := newTestManager(t)
+
+	job := jobs.VanityDomainJob{ReferenceID: "ref-1", Type: "add", Domain: jobs.VanityDomain{VanityDomain: "example.org", DesiredDNSTargetType: "CNAME", DesiredCNAMETarget: "lb.example.net"}}
+
+	// First delivery, a failure and the redelivery after it
+	q.recordDomainJob(job)
+	q.recordDomainState("example.org", "ref-1", "add", jobs.StatePending, "DNS not ready")
+	q.recordDomainJob(job)
+
+	record, err := q.GetDomain("example.org")
+	if err != nil {
+		t.Fatalf("Failed to get domain: %v", err)
+	}
+
+	if len(record.History) != 2 {
+		t.Fatalf("Expected the job and its failure in the history, got %+v", record.History)
+	}
+
+	// The same reference ID submitted again once the domain is active is a new job
+	q.recordDomainState("example.org", "ref-1", "add", jobs.StateActive, "")
+	job.Domain.DesiredCNAMETarget = "lb2.example.net"
+	q.recordDomainJob(job)
+
+	record, err = q.GetDomain("example.org")
+	if err != nil {
+		t.Fatalf("Failed to get domain: %v", err)
+	}
+
+	if len(record.History) != 4 || record.Domain.DesiredCNAMETarget != "lb2.example.net" {
+		t.Errorf("Expected the resubmitted job to be recorded, got %+v", record)
+	}
+}
+
+func TestReverifyChecksRegistryDomains(t *testing.T) {
+	q, cluster := newTestManager(t)
+
+	// Not drifted
+	q.recordDomainJob(jobs.VanityDomainJob{ReferenceID: "ref-1", Type: "add", Domain: jobs.VanityDomain{VanityDomain: "localhost", DesiredDNSTargetType: "A", DesiredARecordTargets: []string{"192.0.2.1"}}})
+	q.recordDomainState("localhost", "ref-1", "add", jobs.StateActive, "")
+
+	// Removed domains are not checked
+	q.recordDomainJob(jobs.VanityDomainJob{ReferenceID: "ref-2", Type: "add", Domain: jobs.VanityDomain{VanityDomain: "localhost.localdomain", DesiredDNSTargetType: "A", DesiredARecordTargets: []string{"192.0.2.1"}}})
+	q.recordDomainState("localhost.localdomain", "ref-2", "remove", jobs.StateRemoved, "")
+
+	reverifyConfig := config.Config().Worker().Reverify
+	reverifyConfig.FailureThreshold = 1
+	if err := q.reverifyDomains(reverifyConfig); err != nil {
+		t.Fatalf("Failed to re-verify domains: %v", err)
+	}
+
+	record, err := q.GetDomain("localhost")
+	if err != nil {
+		t.Fatalf("Failed to get domain: %v", err)
+	}
+
+	if record.Status.State != jobs.StateDNSDrifted {
+		t.Errorf("Expected the registry domain to drift although the cluster lists no objects, got %s", record.Status.State)
+	}
+
+	record, err = q.GetDomain("localhost.localdomain")
+	if err != nil {
+		t.Fatalf("Failed to get domain: %v", err)
+	}
+
+	if record.Status.State != jobs.StateRemoved {
+		t.Errorf("Expected the removed domain to be left alone, got %s", record.Status.State)
+	}
+
+	if len(cluster.recorded()) != 0 {
+		t.Errorf("Expected the none policy not to touch the cluster, got %v", cluster.recorded())
+	}
+}
+
+func TestRegistryStateLeavesQueuedJobs(t *testing.T) {
+	q, _ := newTestManager(t)
+	state := registryState{q: q}
+
+	domain := jobs.VanityDomain{VanityDomain: "localhost", DesiredDNSTargetType: "A", DesiredARecordTargets: []string{"127.0.0.1"}}
+	job := jobs.VanityDomainJob{ReferenceID: "ref-1", Type: "add", Domain: domain}
+	if _, err := q.claimLatestJob(job, 1); err != nil {
+		t.Fatalf("Failed to claim job: %v", err)
+	}
+
+	q.recordDomainJob(job)
+	if _, ok, _ := state.DesiredDomain("localhost"); ok {
+		t.Error("Expected a domain with a job in flight to be left alone")
+	}
+
+	q.recordDomainState("localhost", "ref-1", "add", jobs.StateActive, "")
+	if managed, ok, err := state.DesiredDomain("localhost"); err != nil || !ok || managed.ReferenceID != "ref-1" {
+		t.Fatalf("Expected the active domain to be reconciled, got %v %v", ok, err)
+	}
+
+	// Queued, but no worker picked it up yet
+	if _, err := q.claimLatestJob(jobs.VanityDomainJob{ReferenceID: "ref-2", Type: "remove", Domain: domain}, 2); err != nil {
+		t.Fatalf("Failed to claim job: %v", err)
+	}
+
+	if _, ok, _ := state.DesiredDomain("localhost"); ok {
+		t.Error("Expected a domain with a queued job to be left alone")
+	}
+
+	domains, err := state.DesiredDomains()
+	if err != nil {
+		t.Fatalf("Failed to list desired domains: %v", err)
+	}
+
+	if len(domains) != 0 {
+		t.Errorf("Expected no desired domains while a job is queued, got %+v", domains)
+	}
+}
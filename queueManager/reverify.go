@@ -0,0 +1,242 @@
+package queueManager
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/geekgonecrazy/vanityDomainManager/config"
+	"github.com/geekgonecrazy/vanityDomainManager/jobs"
+	"github.com/geekgonecrazy/vanityDomainManager/verifiers"
+)
+
+// startReverifyScheduler periodically re-verifies DNS and checks certificate expiry, whichever is enabled.
+func (q *queueManager) startReverifyScheduler() {
+	reverifyConfig := config.Config().Worker().Reverify
+	expiryWarning := config.Config().Events().CertificateExpiryWarning
+
+	q.logger.Printf("Starting re-verification scheduler, every %v", reverifyConfig.Interval)
+
+	go func() {
+		ticker := time.NewTicker(reverifyConfig.Interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			if reverifyConfig.Enabled {
+				if err := q.reverifyDomains(reverifyConfig); err != nil {
+					q.logger.Printf("Re-verification run failed: %s", err)
+				}
+			}
+
+			if expiryWarning > 0 {
+				if err := q.checkCertificateExpiry(expiryWarning); err != nil {
+					q.logger.Printf("Certificate expiry check failed: %s", err)
+				}
+			}
+		}
+	}()
+}
+
+// reverifyDomains re-runs DNS verification for every active domain in the registry and applies the drift policy
+// to domains that have failed FailureThreshold times in a row. Drifted domains whose DNS matches again recover.
+func (q *queueManager) reverifyDomains(reverifyConfig config.ReverifyConfig) error {
+	records, err := q.ListDomains()
+	if err != nil {
+		return err
+	}
+
+	for _, record := range records {
+		if record.Status.State != jobs.StateActive && record.Status.State != jobs.StateDNSDrifted {
+			continue
+		}
+
+		q.reverifyDomain(reverifyConfig, record.Domain.VanityDomain, verifiers.VerifyDomain(record.Domain))
+	}
+
+	return nil
+}
+
+// reverifyDomain counts a check in the domain's registry record and acts on it. Replicas check on their own
+// tickers, a check within half an interval of the last one is left out so each replica doesn't add its own.
+func (q *queueManager) reverifyDomain(reverifyConfig config.ReverifyConfig, domain string, verifyErr error) {
+	var checked *jobs.DomainRecord
+
+	err := q.updateDomain(domain, func(record *jobs.DomainRecord) bool {
+		checked = nil
+
+		// Removed or reconfigured since the list was read
+		if record.Status.State != jobs.StateActive && record.Status.State != jobs.StateDNSDrifted {
+			return false
+		}
+
+		now := time.Now().UTC()
+		if record.Reverify == nil {
+			record.Reverify = &jobs.Reverify{}
+		} else if now.Sub(record.Reverify.CheckedAt) < reverifyConfig.Interval/2 {
+			return false
+		}
+
+		if verifyErr != nil {
+			record.Reverify.Failures++
+		} else {
+			record.Reverify.Failures = 0
+		}
+		record.Reverify.CheckedAt = now
+
+		copied := *record
+		checked = &copied
+		return true
+	})
+	if err != nil {
+		q.logger.Printf("Failed to record re-verification of %s: %s", domain, err)
+		return
+	}
+
+	if checked == nil {
+		return
+	}
+
+	if verifyErr == nil {
+		if checked.Status.State == jobs.StateDNSDrifted {
+			q.handleRecovery(*checked)
+		}
+		return
+	}
+
+	failures := checked.Reverify.Failures
+	q.logger.Printf("Re-verification of %s failed (%d/%d): %s", domain, failures, reverifyConfig.FailureThreshold, verifyErr)
+
+	if failures >= reverifyConfig.FailureThreshold && checked.Status.State == jobs.StateActive {
+		q.handleDrift(reverifyConfig, *checked, verifyErr)
+	}
+}
+
+func (q *queueManager) handleDrift(reverifyConfig config.ReverifyConfig, record jobs.DomainRecord, verifyErr error) {
+	domain := record.Domain
+	referenceID := record.Status.ReferenceID
+
+	q.logger.Printf("Vanity Domain %s has drifted, applying policy %s", domain.VanityDomain, reverifyConfig.Policy)
+
+	message := fmt.Sprintf("DNS for %s no longer matches after %d checks: %s", domain.VanityDomain, reverifyConfig.FailureThreshold, verifyErr)
+	state := jobs.StateDNSDrifted
+
+	switch reverifyConfig.Policy {
+	case "disable":
+		if err := q.cluster.DisableVanityDomain(context.Background(), domain, jobs.StateDNSDrifted); err != nil {
+			q.logger.Printf("Failed to disable drifted domain %s: %s", domain.VanityDomain, err)
+		} else {
+			message += ", domain disabled"
+		}
+	case "remove":
+		if q.cluster.ManagesCertificates() {
+			if err := q.cluster.UnSetCertificate(context.Background(), domain); err != nil {
+				q.logger.Printf("Failed to remove certificate for drifted domain %s: %s", domain.VanityDomain, err)
+			}
+		}
+
+		if err := q.cluster.UnSetTLS(context.Background(), domain); err != nil {
+			q.logger.Printf("Failed to remove TLS for drifted domain %s: %s", domain.VanityDomain, err)
+		}
+
+		if err := q.cluster.UnSetVanityDomain(context.Background(), domain); err != nil {
+			q.logger.Printf("Failed to remove drifted domain %s: %s", domain.VanityDomain, err)
+		} else {
+			message += ", domain removed"
+			state = jobs.StateRemoved
+		}
+	}
+
+	q.recordDomainState(domain.VanityDomain, referenceID, "", state, message)
+
+	q.publishLifecycleEvent(EventTypeDriftDetected, jobs.DomainLifecycleEvent{
+		Domain:      domain.VanityDomain,
+		ReferenceID: referenceID,
+		Message:     message,
+	})
+
+	if err := q.SendProgressUpdate(referenceID, domain.VanityDomain, state, message); err != nil {
+		q.logger.Printf("Failed to send drift update for %s: %s", domain.VanityDomain, err)
+	}
+}
+
+// handleRecovery makes a drifted domain active again once its DNS matches. The route and certificate are applied
+// again, which re-enables a domain the disable policy turned off and changes nothing otherwise. When that fails the
+// domain stays drifted and the next check tries again.
+func (q *queueManager) handleRecovery(record jobs.DomainRecord) {
+	domain := record.Domain
+	referenceID := record.Status.ReferenceID
+
+	q.logger.Printf("Vanity Domain %s has recovered", domain.VanityDomain)
+
+	if err := q.cluster.SetVanityDomain(context.Background(), referenceID, domain); err != nil {
+		q.logger.Printf("Failed to enable recovered domain %s: %s", domain.VanityDomain, err)
+		return
+	}
+
+	if domain.ProvidedCertificate == nil && q.cluster.ManagesCertificates() {
+		if err := q.cluster.SetCertificate(context.Background(), referenceID, record.Owner, domain); err != nil {
+			q.logger.Printf("Failed to restore certificate for recovered domain %s: %s", domain.VanityDomain, err)
+			return
+		}
+	}
+
+	message := fmt.Sprintf("DNS for %s matches again", domain.VanityDomain)
+	q.recordDomainState(domain.VanityDomain, referenceID, "", jobs.StateActive, message)
+
+	q.publishLifecycleEvent(EventTypeDomainRecovered, jobs.DomainLifecycleEvent{
+		Domain:      domain.VanityDomain,
+		ReferenceID: referenceID,
+		Message:     message,
+	})
+
+	if err := q.SendProgressUpdate(referenceID, domain.VanityDomain, jobs.StateActive, message); err != nil {
+		q.logger.Printf("Failed to send recovery update for %s: %s", domain.VanityDomain, err)
+	}
+}
+
+// checkCertificateExpiry announces certificates of active domains that expire within warning, once per certificate.
+func (q *queueManager) checkCertificateExpiry(warning time.Duration) error {
+	records, err := q.ListDomains()
+	if err != nil {
+		return err
+	}
+
+	seen := map[string]bool{}
+	for _, record := range records {
+		if record.Status.State != jobs.StateActive {
+			continue
+		}
+
+		domain := record.Domain
+		seen[domain.VanityDomain] = true
+
+		cert, err := q.cluster.GetCertificate(context.Background(), domain)
+		if err != nil {
+			q.logger.Printf("Failed to read certificate of %s: %s", domain.VanityDomain, err)
+			continue
+		}
+
+		// Not issued yet, or renewed since we last warned
+		if cert == nil || time.Until(cert.NotAfter) > warning || q.expiryWarned[domain.VanityDomain].Equal(cert.NotAfter) {
+			continue
+		}
+
+		notAfter := cert.NotAfter.UTC()
+		q.publishLifecycleEvent(EventTypeCertificateExpiring, jobs.DomainLifecycleEvent{
+			Domain:      domain.VanityDomain,
+			ReferenceID: record.Status.ReferenceID,
+			Message:     fmt.Sprintf("certificate for %s expires at %s", domain.VanityDomain, notAfter.Format(time.RFC3339)),
+			NotAfter:    &notAfter,
+		})
+
+		q.expiryWarned[domain.VanityDomain] = cert.NotAfter
+	}
+
+	for domain := range q.expiryWarned {
+		if !seen[domain] {
+			delete(q.expiryWarned, domain)
+		}
+	}
+
+	return nil
+}
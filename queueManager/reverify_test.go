@@ -0,0 +1,230 @@
+package queueManager
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/geekgonecrazy/vanityDomainManager/config"
+	"github.com/geekgonecrazy/vanityDomainManager/jobs"
+	"github.com/nats-io/nats.go"
+)
+
+// addActiveDomain records localhost as an active domain expecting an A record for target. localhost resolves to
+// 127.0.0.1, so any other target fails verification.
+func addActiveDomain(t *testing.T, q *queueManager, target string) {
+	t.Helper()
+
+	q.recordDomainJob(jobs.VanityDomainJob{ReferenceID: "ref-1", Type: "add", Domain: jobs.VanityDomain{VanityDomain: "localhost", DesiredDNSTargetType: "A", DesiredARecordTargets: []string{target}}})
+	q.recordDomainState("localhost", "ref-1", "add", jobs.StateActive, "")
+}
+
+// setTarget changes the A record localhost is expected to have, as if its DNS was repointed.
+func setTarget(t *testing.T, q *queueManager, target string) {
+	t.Helper()
+
+	if err := q.updateDomain("localhost", func(record *jobs.DomainRecord) bool {
+		record.Domain.DesiredARecordTargets = []string{target}
+		return true
+	}); err != nil {
+		t.Fatalf("Failed to set target: %v", err)
+	}
+}
+
+// subscribeLifecycleEvents collects the lifecycle event types published from now on.
+func subscribeLifecycleEvents(t *testing.T, q *queueManager) chan string {
+	t.Helper()
+
+	events := make(chan string, 100)
+	sub, err := q.nc.Subscribe(q.GetEventSubject("*"), func(msg *nats.Msg) {
+		for eventType, subject := range lifecycleEventSubjects {
+			if msg.Subject == q.GetEventSubject(subject) {
+				events <- eventType
+			}
+		}
+	})
+	if err != nil {
+		t.Fatalf("Failed to subscribe to events: %v", err)
+	}
+	t.Cleanup(func() { sub.Unsubscribe() })
+
+	return events
+}
+
+func reverifyAndGet(t *testing.T, q *queueManager, reverifyConfig config.ReverifyConfig) *jobs.DomainRecord {
+	t.Helper()
+
+	if err := q.reverifyDomains(reverifyConfig); err != nil {
+		t.Fatalf("Failed to re-verify domains: %v", err)
+	}
+
+	record, err := q.GetDomain("localhost")
+	if err != nil {
+		t.Fatalf("Failed to get domain: %v", err)
+	}
+
+	return record
+}
+
+func expectEvent(t *testing.T, events chan string, eventType string) {
+	t.Helper()
+
+	select {
+	case got := <-events:
+		if got != eventType {
+			t.Errorf("Expected event %s, got %s", eventType, got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("Expected event %s, got none", eventType)
+	}
+}
+
+func TestReverifyPolicies(t *testing.T) {
+	tests := []struct {
+		policy       string
+		driftState   string
+		driftCalls   []string
+		recovers     bool
+		recoverCalls []string
+	}{
+		{"none", jobs.StateDNSDrifted, []string{}, true, []string{"SetVanityDomain localhost"}},
+		{"disable", jobs.StateDNSDrifted, []string{"DisableVanityDomain localhost dns_drifted"}, true, []string{"SetVanityDomain localhost"}},
+		{"remove", jobs.StateRemoved, []string{"UnSetTLS localhost", "UnSetVanityDomain localhost"}, false, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.policy, func(t *testing.T) {
+			q, cluster := newTestManager(t)
+			events := subscribeLifecycleEvents(t, q)
+			addActiveDomain(t, q, "192.0.2.1")
+
+			// Every run counts as its own check
+			reverifyConfig := config.Config().Worker().Reverify
+			reverifyConfig.Interval = 0
+			reverifyConfig.FailureThreshold = 2
+			reverifyConfig.Policy = test.policy
+
+			record := reverifyAndGet(t, q, reverifyConfig)
+			if record.Status.State != jobs.StateActive || record.Reverify == nil || record.Reverify.Failures != 1 {
+				t.Fatalf("Expected one failure below the threshold to be counted, got %s %+v", record.Status.State, record.Reverify)
+			}
+
+			record = reverifyAndGet(t, q, reverifyConfig)
+			if record.Status.State != test.driftState {
+				t.Fatalf("Expected the domain to be %s after reaching the threshold, got %s", test.driftState, record.Status.State)
+			}
+
+			if calls := cluster.recorded(); !reflect.DeepEqual(calls, test.driftCalls) {
+				t.Errorf("Expected drift to call %v, got %v", test.driftCalls, calls)
+			}
+			expectEvent(t, events, EventTypeDriftDetected)
+
+			// Failing on is not another drift
+			reverifyAndGet(t, q, reverifyConfig)
+			if calls := cluster.recorded(); !reflect.DeepEqual(calls, test.driftCalls) {
+				t.Errorf("Expected the policy to be applied once, got %v", calls)
+			}
+
+			setTarget(t, q, "127.0.0.1")
+			record = reverifyAndGet(t, q, reverifyConfig)
+
+			if !test.recovers {
+				if record.Status.State != test.driftState || len(cluster.recorded()) != len(test.driftCalls) {
+					t.Errorf("Expected the removed domain to stay removed, got %s %v", record.Status.State, cluster.recorded())
+				}
+				return
+			}
+
+			if record.Status.State != jobs.StateActive || record.Reverify.Failures != 0 {
+				t.Errorf("Expected the domain to recover, got %s %+v", record.Status.State, record.Reverify)
+			}
+
+			if calls := cluster.recorded()[len(test.driftCalls):]; !reflect.DeepEqual(calls, test.recoverCalls) {
+				t.Errorf("Expected recovery to call %v, got %v", test.recoverCalls, calls)
+			}
+			expectEvent(t, events, EventTypeDomainRecovered)
+		})
+	}
+}
+
+func TestReverifyRestoresIssuedCertificate(t *testing.T) {
+	q, cluster := newTestManager(t)
+	cluster.managesCertificates = true
+	addActiveDomain(t, q, "192.0.2.1")
+
+	reverifyConfig := config.Config().Worker().Reverify
+	reverifyConfig.Interval = 0
+	reverifyConfig.FailureThreshold = 1
+	reverifyConfig.Policy = "disable"
+
+	reverifyAndGet(t, q, reverifyConfig)
+	setTarget(t, q, "127.0.0.1")
+	record := reverifyAndGet(t, q, reverifyConfig)
+
+	expected := []string{"DisableVanityDomain localhost dns_drifted", "SetVanityDomain localhost", "SetCertificate localhost"}
+	if record.Status.State != jobs.StateActive || !reflect.DeepEqual(cluster.recorded(), expected) {
+		t.Errorf("Expected the disabled domain and its certificate to be restored, got %s %v", record.Status.State, cluster.recorded())
+	}
+}
+
+func TestReverifyCountIsShared(t *testing.T) {
+	q, _ := newTestManager(t)
+	addActiveDomain(t, q, "192.0.2.1")
+
+	reverifyConfig := config.Config().Worker().Reverify
+	reverifyConfig.FailureThreshold = 2
+
+	reverifyAndGet(t, q, reverifyConfig)
+
+	// A replica, or the manager after a restart, sees the count through the registry and doesn't check again within
+	// the interval
+	replica := newQueueManager(q.cluster)
+	replica.logger = q.logger
+	replica.queue = q.queue
+	replica.domains = q.domains
+
+	if err := replica.reverifyDomains(reverifyConfig); err != nil {
+		t.Fatalf("Failed to re-verify domains: %v", err)
+	}
+
+	record, err := q.GetDomain("localhost")
+	if err != nil {
+		t.Fatalf("Failed to get domain: %v", err)
+	}
+
+	if record.Status.State != jobs.StateActive || record.Reverify.Failures != 1 {
+		t.Errorf("Expected the replica to skip the domain checked within the interval, got %s %+v", record.Status.State, record.Reverify)
+	}
+
+	// Once the interval has passed the replica continues the count
+	if err := q.updateDomain("localhost", func(record *jobs.DomainRecord) bool {
+		record.Reverify.CheckedAt = record.Reverify.CheckedAt.Add(-reverifyConfig.Interval)
+		return true
+	}); err != nil {
+		t.Fatalf("Failed to age the check: %v", err)
+	}
+
+	if err := replica.reverifyDomains(reverifyConfig); err != nil {
+		t.Fatalf("Failed to re-verify domains: %v", err)
+	}
+
+	record, err = q.GetDomain("localhost")
+	if err != nil {
+		t.Fatalf("Failed to get domain: %v", err)
+	}
+
+	if record.Status.State != jobs.StateDNSDrifted || record.Reverify.Failures != 2 {
+		t.Errorf("Expected the replica to reach the threshold with the stored count, got %s %+v", record.Status.State, record.Reverify)
+	}
+
+	// A new job starts over
+	q.recordDomainState("localhost", "ref-2", "add", jobs.StatePending, "")
+	record, err = q.GetDomain("localhost")
+	if err != nil {
+		t.Fatalf("Failed to get domain: %v", err)
+	}
+
+	if record.Reverify != nil {
+		t.Errorf("Expected a new job to reset the count, got %+v", record.Reverify)
+	}
+}
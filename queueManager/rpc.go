@@ -0,0 +1,107 @@
+package queueManager
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/geekgonecrazy/vanityDomainManager/config"
+	"github.com/geekgonecrazy/vanityDomainManager/jobs"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/micro"
+)
+
+// StartRPC registers a NATS micro service that accepts a job and replies with its final status. The job still
+// goes through the durable job stream and worker, so retries behave exactly as they do for async submissions.
+func (q *queueManager) StartRPC() error {
+	q.logger.Println("Starting RPC service")
+
+	svc, err := micro.AddService(q.nc, micro.Config{
+		Name:        "vanityDomainManager",
+		Version:     "1.0.0",
+		Description: "Synchronous job submission for the Vanity Domain Manager",
+	})
+	if err != nil {
+		return fmt.Errorf("add micro service: %w", err)
+	}
+
+	if err := svc.AddEndpoint("domainjob", micro.HandlerFunc(func(req micro.Request) {
+		// Requests can wait minutes for a result, don't hold up the endpoint's subscription
+		go q.handleRPCRequest(req)
+	}), micro.WithEndpointSubject(q.GetRPCSubject("*"))); err != nil {
+		return fmt.Errorf("add rpc endpoint: %w", err)
+	}
+
+	return nil
+}
+
+func (q *queueManager) handleRPCRequest(req micro.Request) {
+	var job jobs.VanityDomainJob
+	if err := json.Unmarshal(req.Data(), &job); err != nil {
+		req.Error("400", fmt.Sprintf("invalid job: %s", err), nil)
+		return
+	}
+
+	// The last token of the subject is the reference ID when the body doesn't carry one
+	if job.ReferenceID == "" {
+		job.ReferenceID = req.Subject()[strings.LastIndex(req.Subject(), ".")+1:]
+	}
+
+	// Subscribe before publishing so the final status can't slip past us
+	statuses := make(chan *nats.Msg, 64)
+	sub, err := q.nc.ChanSubscribe(q.GetStatusSubject(job.ReferenceID), statuses)
+	if err != nil {
+		req.Error("500", fmt.Sprintf("subscribe to status: %s", err), nil)
+		return
+	}
+	defer sub.Unsubscribe()
+
+	if err := q.AddDomainJob(job); err != nil {
+		if errors.Is(err, ErrInvalidJob) {
+			req.Error("400", err.Error(), nil)
+			return
+		}
+
+		req.Error("500", fmt.Sprintf("failed to add job to queue: %s", err), nil)
+		return
+	}
+
+	timeout := time.After(config.Config().RPC().Timeout)
+	lastState := "pending"
+
+	for {
+		select {
+		case msg := <-statuses:
+			var status jobs.JobStatus
+			if err := json.Unmarshal(eventData(msg.Data), &status); err != nil {
+				q.logger.Printf("Failed to decode status for %s: %s", job.ReferenceID, err)
+				continue
+			}
+
+			if status.IsFinal() {
+				if err := req.RespondJSON(status); err != nil {
+					q.logger.Printf("Failed to respond to rpc request %s: %s", job.ReferenceID, err)
+				}
+				return
+			}
+
+			if status.State != "" {
+				lastState = status.State
+			} else if status.ErrorMessage != "" {
+				lastState = fmt.Sprintf("retrying after: %s", status.ErrorMessage)
+			}
+		case <-timeout:
+			if err := req.RespondJSON(jobs.JobStatus{
+				ReferenceID:  job.ReferenceID,
+				State:        jobs.StateTimedOut,
+				ErrorMessage: fmt.Sprintf("no final status within %v, job is still queued", config.Config().RPC().Timeout),
+				Message:      lastState,
+			}); err != nil {
+				q.logger.Printf("Failed to respond to rpc request %s: %s", job.ReferenceID, err)
+			}
+			return
+		}
+	}
+}
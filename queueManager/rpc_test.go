@@ -0,0 +1,99 @@
+package queueManager
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/geekgonecrazy/vanityDomainManager/jobs"
+)
+
+func TestRPCRepliesWithFinalStatus(t *testing.T) {
+	q, _ := newTestManager(t)
+
+	if err := q.StartWorkers(); err != nil {
+		t.Fatalf("Failed to start workers: %v", err)
+	}
+
+	if err := q.StartRPC(); err != nil {
+		t.Fatalf("Failed to start rpc: %v", err)
+	}
+
+	// The reference ID comes from the subject when the body has none
+	data, _ := json.Marshal(jobs.VanityDomainJob{Type: "remove", Domain: jobs.VanityDomain{VanityDomain: "example.org"}})
+	reply, err := q.nc.Request(q.GetRPCSubject("ref-1"), data, 5*time.Second)
+	if err != nil {
+		t.Fatalf("Failed to call rpc endpoint: %v", err)
+	}
+
+	var status jobs.JobStatus
+	if err := json.Unmarshal(reply.Data, &status); err != nil {
+		t.Fatalf("Failed to decode reply %q: %v", reply.Data, err)
+	}
+
+	if !status.Success || status.ReferenceID != "ref-1" || status.Domain != "example.org" {
+		t.Errorf("Expected the successful final status of ref-1, got %+v", status)
+	}
+}
+
+func TestRPCRepliesTimedOut(t *testing.T) {
+	q, _ := newTestManager(t, `
+rpc:
+  enabled: true
+  timeout: 200ms
+`)
+
+	// No worker is running, so the job stays queued
+	if err := q.StartRPC(); err != nil {
+		t.Fatalf("Failed to start rpc: %v", err)
+	}
+
+	data, _ := json.Marshal(jobs.VanityDomainJob{ReferenceID: "ref-1", Type: "remove", Domain: jobs.VanityDomain{VanityDomain: "example.org"}})
+	reply, err := q.nc.Request(q.GetRPCSubject("ref-1"), data, 5*time.Second)
+	if err != nil {
+		t.Fatalf("Failed to call rpc endpoint: %v", err)
+	}
+
+	var status jobs.JobStatus
+	if err := json.Unmarshal(reply.Data, &status); err != nil {
+		t.Fatalf("Failed to decode reply %q: %v", reply.Data, err)
+	}
+
+	if status.State != jobs.StateTimedOut || status.ReferenceID != "ref-1" || status.Message != "pending" {
+		t.Errorf("Expected a timed out reply for the pending job, got %+v", status)
+	}
+
+	if status.IsFinal() {
+		t.Error("Expected a timed out reply not to be final")
+	}
+}
+
+func TestRPCRejectsInvalidJobs(t *testing.T) {
+	q, _ := newTestManager(t)
+
+	if err := q.StartRPC(); err != nil {
+		t.Fatalf("Failed to start rpc: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		body string
+		code string
+	}{
+		{"not json", `not json`, "400"},
+		{"unsupported schema version", `{"schemaVersion": 99, "type": "add"}`, "400"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reply, err := q.nc.Request(q.GetRPCSubject("ref-1"), []byte(test.body), 5*time.Second)
+			if err != nil {
+				t.Fatalf("Failed to call rpc endpoint: %v", err)
+			}
+
+			if code := reply.Header.Get("Nats-Service-Error-Code"); code != test.code {
+				t.Errorf("Expected error code %s, got %q: %s", test.code, code, reply.Header.Get("Nats-Service-Error"))
+			}
+		})
+	}
+}
@@ -0,0 +1,344 @@
+package queueManager
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/geekgonecrazy/vanityDomainManager/config"
+	"github.com/geekgonecrazy/vanityDomainManager/jobs"
+	"github.com/geekgonecrazy/vanityDomainManager/kubernetes"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+var ErrInvalidJob = errors.New("invalid job")
+
+// listenerQueueGroup has every replica's listeners share requests, so each request is handled by one of them.
+const listenerQueueGroup = "vanityDomainManager"
+
+// stoppedError ends processing of a job that was cancelled or superseded while it was being worked on.
+type stoppedError struct {
+	state   string
+	message string
+}
+
+func (e *stoppedError) Error() string {
+	return e.message
+}
+
+func (q *queueManager) ensureCancellations() error {
+	env := config.Config().System().Environment
+
+	kv, err := q.queue.KeyValue(context.Background(), jetstream.KeyValueConfig{
+		Bucket:      fmt.Sprintf("%s_%s", env, "vanityDomainManager_cancellations"),
+		Description: "Jobs cancelled through Vanity Domain Manager",
+		// A cancellation only has to outlive the job it cancels
+		TTL: config.Config().Queue().JobStream.MaxAge,
+	})
+	if err != nil {
+		return fmt.Errorf("create cancellations bucket: %w", err)
+	}
+
+	q.cancellations = kv
+	return nil
+}
+
+// CancelJob marks a job as cancelled. A job still held in the schedule is dropped right away, a queued one is
+// acked as cancelled the next time it is delivered.
+func (q *queueManager) CancelJob(referenceID string) error {
+	if _, err := q.cancellations.PutString(context.Background(), referenceID, time.Now().UTC().Format(time.RFC3339)); err != nil {
+		return fmt.Errorf("cancel job %s: %w", referenceID, err)
+	}
+
+	q.logger.Printf("Job %s cancelled", referenceID)
+
+	if err := q.dropScheduledJob(referenceID); err != nil {
+		q.logger.Printf("Failed to drop scheduled job %s, it is dropped when due: %s", referenceID, err)
+	}
+
+	return nil
+}
+
+func (q *queueManager) ensureSchedule() error {
+	env := config.Config().System().Environment
+
+	// No TTL, a held job leaves the bucket when it is due or cancelled
+	kv, err := q.queue.KeyValue(context.Background(), jetstream.KeyValueConfig{
+		Bucket:      fmt.Sprintf("%s_%s", env, "vanityDomainManager_scheduled"),
+		Description: "Jobs held by Vanity Domain Manager until their notBefore time",
+		History:     1,
+	})
+	if err != nil {
+		return fmt.Errorf("create schedule bucket: %w", err)
+	}
+
+	q.scheduled = kv
+	return nil
+}
+
+// holdJob keeps the marshalled job in the schedule until its notBefore time, when a replica queues it.
+func (q *queueManager) holdJob(job jobs.VanityDomainJob, data []byte) error {
+	if _, err := q.scheduled.Put(context.Background(), job.ReferenceID, data); err != nil {
+		return fmt.Errorf("schedule job %s: %w", job.ReferenceID, err)
+	}
+
+	message := fmt.Sprintf("scheduled for %s", job.NotBefore.UTC().Format(time.RFC3339))
+	q.logger.Printf("Job %s is %s", job.ReferenceID, message)
+
+	// Only the job is scheduled, the domain keeps the state of the last job that ran
+	if err := q.SendProgressUpdate(job.ReferenceID, job.Domain.VanityDomain, jobs.StateScheduled, message); err != nil {
+		q.logger.Printf("Failed to send status update for job %s: %s", job.ReferenceID, err)
+	}
+
+	return nil
+}
+
+// startScheduleReleaser queues held jobs once they are due. Every replica runs it, a job two replicas release at
+// the same time is still queued once.
+func (q *queueManager) startScheduleReleaser() {
+	go func() {
+		ticker := time.NewTicker(q.schedulePoll)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			if err := q.releaseDueJobs(); err != nil {
+				q.logger.Printf("Failed to release scheduled jobs: %s", err)
+			}
+		}
+	}()
+}
+
+// releaseDueJobs moves the held jobs whose notBefore time has passed to the job stream.
+func (q *queueManager) releaseDueJobs() error {
+	ctx := context.Background()
+
+	keys, err := q.scheduled.ListKeys(ctx)
+	if err != nil {
+		return fmt.Errorf("list scheduled jobs: %w", err)
+	}
+	defer keys.Stop()
+
+	for referenceID := range keys.Keys() {
+		entry, err := q.scheduled.Get(ctx, referenceID)
+		if errors.Is(err, jetstream.ErrKeyNotFound) {
+			continue
+		}
+		if err != nil {
+			q.logger.Printf("Failed to get scheduled job %s: %s", referenceID, err)
+			continue
+		}
+
+		var job jobs.VanityDomainJob
+		if err := json.Unmarshal(entry.Value(), &job); err != nil {
+			q.logger.Printf("Failed to parse scheduled job %s, dropping it: %s", referenceID, err)
+			q.scheduled.Delete(ctx, referenceID, jetstream.LastRevision(entry.Revision()))
+			continue
+		}
+
+		if job.NotBefore != nil && time.Now().Before(*job.NotBefore) {
+			continue
+		}
+
+		// The message ID makes the job stream drop the copy another replica releasing the same job publishes
+		if err := q.publishJob(job, entry.Value(), fmt.Sprintf("scheduled-%s-%d", referenceID, entry.Revision())); err != nil {
+			q.logger.Printf("Failed to release scheduled job %s: %s", referenceID, err)
+			continue
+		}
+
+		if err := q.scheduled.Delete(ctx, referenceID, jetstream.LastRevision(entry.Revision())); err != nil && !errors.Is(err, jetstream.ErrKeyNotFound) {
+			q.logger.Printf("Failed to remove released job %s from the schedule: %s", referenceID, err)
+		}
+	}
+
+	return nil
+}
+
+// dropScheduledJob drops a cancelled job that is still held in the schedule. A job that is due may already be
+// queued, it is left to be dropped when it is delivered so it isn't reported twice.
+func (q *queueManager) dropScheduledJob(referenceID string) error {
+	ctx := context.Background()
+
+	entry, err := q.scheduled.Get(ctx, referenceID)
+	if errors.Is(err, jetstream.ErrKeyNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var job jobs.VanityDomainJob
+	if err := json.Unmarshal(entry.Value(), &job); err != nil {
+		return err
+	}
+
+	if job.NotBefore == nil || !time.Now().Before(*job.NotBefore) {
+		return nil
+	}
+
+	if err := q.scheduled.Delete(ctx, referenceID, jetstream.LastRevision(entry.Revision())); err != nil {
+		return err
+	}
+
+	q.dropJob(job, jobs.StateCancelled, fmt.Sprintf("job %s was cancelled", job.ReferenceID))
+	return nil
+}
+
+// startCancelListener lets NATS clients cancel a job by sending any message to its cancel subject.
+func (q *queueManager) startCancelListener() error {
+	_, err := q.nc.QueueSubscribe(q.GetCancelSubject("*"), listenerQueueGroup, func(msg *nats.Msg) {
+		referenceID := msg.Subject[strings.LastIndex(msg.Subject, ".")+1:]
+
+		response := `{"status":"cancelled"}`
+		if err := q.CancelJob(referenceID); err != nil {
+			q.logger.Printf("Failed to cancel job %s: %s", referenceID, err)
+			response = `{"error":"failed to cancel job"}`
+		}
+
+		if msg.Reply != "" {
+			msg.Respond([]byte(response))
+		}
+	})
+
+	return err
+}
+
+func (q *queueManager) isCancelled(referenceID string) bool {
+	_, err := q.cancellations.Get(context.Background(), referenceID)
+	if err != nil && !errors.Is(err, jetstream.ErrKeyNotFound) {
+		q.logger.Printf("Failed to check cancellation of %s: %s", referenceID, err)
+	}
+
+	return err == nil
+}
+
+// validateSchedule rejects schedules the job stream can't honour.
+func validateSchedule(job jobs.VanityDomainJob) error {
+	if job.NotBefore != nil && job.ExpiresAt != nil && !job.ExpiresAt.After(*job.NotBefore) {
+		return fmt.Errorf("%w: expiresAt must be after notBefore", ErrInvalidJob)
+	}
+
+	maxAge := config.Config().Queue().JobStream.MaxAge
+	if job.NotBefore != nil && time.Until(*job.NotBefore) > maxAge {
+		return fmt.Errorf("%w: notBefore can be at most %v in the future", ErrInvalidJob, maxAge)
+	}
+
+	return nil
+}
+
+// validateAnnotations rejects per job annotations the cluster config doesn't allow jobs to override.
+func validateAnnotations(job jobs.VanityDomainJob) error {
+	if err := kubernetes.CheckAnnotationOverrides(job.Domain.Annotations, config.Config().Cluster().AllowedAnnotationOverrides); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidJob, err)
+	}
+
+	return nil
+}
+
+// validateOwner rejects owners that don't name a configured certificate tenant. The owner picks the tenant's
+// certificate profile, so an unknown one would silently be issued with the defaults.
+func validateOwner(job jobs.VanityDomainJob) error {
+	certificates := config.Config().Cluster().Certificates
+	if job.Owner == "" || certificates.Mode != "explicit" || len(certificates.Tenants) == 0 {
+		return nil
+	}
+
+	if _, ok := certificates.Tenants[job.Owner]; !ok {
+		return fmt.Errorf("%w: owner %s is not a configured certificate tenant", ErrInvalidJob, job.Owner)
+	}
+
+	return nil
+}
+
+// holdOrDiscard settles deliveries of jobs that are cancelled, expired or not due yet. It reports whether the
+// delivery was settled and must not be processed.
+func (q *queueManager) holdOrDiscard(msg Delivery, job jobs.VanityDomainJob) bool {
+	if q.isCancelled(job.ReferenceID) {
+		q.logger.Printf("Job %s was cancelled, removing from the queue", job.ReferenceID)
+		q.discardJob(msg, job, jobs.StateCancelled, fmt.Sprintf("job %s was cancelled", job.ReferenceID))
+		return true
+	}
+
+	now := time.Now()
+
+	if job.ExpiresAt != nil && now.After(*job.ExpiresAt) {
+		q.logger.Printf("Job %s expired at %s, removing from the queue", job.ReferenceID, job.ExpiresAt)
+		q.discardJob(msg, job, jobs.StateExpired, fmt.Sprintf("job expired at %s", job.ExpiresAt.UTC().Format(time.RFC3339)))
+		return true
+	}
+
+	// Queued before the schedule existed, or released early by a replica whose clock runs ahead
+	if job.NotBefore != nil && now.Before(*job.NotBefore) {
+		if err := q.holdJob(job, msg.Data()); err != nil {
+			q.logger.Printf("Failed to hold job %s: %s", job.ReferenceID, err)
+			msg.Nak(q.retryBaseDelay)
+			return true
+		}
+
+		msg.Ack()
+		return true
+	}
+
+	if job.Domain.VanityDomain != "" {
+		newer, err := q.claimLatestJob(job, msg.Sequence())
+		if err != nil {
+			q.logger.Printf("Failed to check whether job %s was superseded: %s", job.ReferenceID, err)
+		}
+
+		if newer != "" {
+			q.logger.Printf("Job %s was superseded by %s, removing from the queue", job.ReferenceID, newer)
+			q.discardJob(msg, job, jobs.StateSuperseded, fmt.Sprintf("superseded by job %s", newer))
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkStillWanted is used by long running steps to stop early when the job was cancelled or a newer job for
+// the domain was queued while it was being worked on.
+func (q *queueManager) checkStillWanted(msg Delivery, job jobs.VanityDomainJob) error {
+	if q.isCancelled(job.ReferenceID) {
+		return &stoppedError{state: jobs.StateCancelled, message: fmt.Sprintf("job %s was cancelled", job.ReferenceID)}
+	}
+
+	record, err := q.GetDomain(job.Domain.VanityDomain)
+	if err != nil {
+		return nil
+	}
+
+	if latest := record.LatestJob; latest != nil && latest.ReferenceID != job.ReferenceID && latest.Sequence > msg.Sequence() {
+		return &stoppedError{state: jobs.StateSuperseded, message: fmt.Sprintf("superseded by job %s", latest.ReferenceID)}
+	}
+
+	return nil
+}
+
+// discardJob acks a job without processing it and reports it as dropped with the reason in state.
+func (q *queueManager) discardJob(msg Delivery, job jobs.VanityDomainJob, state string, message string) {
+	q.dropJob(job, state, message)
+	msg.Ack()
+}
+
+// dropJob reports a job that won't be processed as dropped with the reason in state.
+func (q *queueManager) dropJob(job jobs.VanityDomainJob, state string, message string) {
+	if job.Domain.VanityDomain != "" {
+		q.recordDomainState(job.Domain.VanityDomain, job.ReferenceID, job.Type, state, message)
+	}
+
+	if err := q.publishStatus(jobs.JobStatus{
+		ReferenceID:  job.ReferenceID,
+		Domain:       job.Domain.VanityDomain,
+		ErrorMessage: message,
+		Dropped:      true,
+		State:        state,
+	}); err != nil {
+		q.logger.Printf("Failed to send status update for job %s: %s", job.ReferenceID, err)
+	}
+
+	q.deleteCertificate(job.Domain.CertificateRef)
+	q.recordBatchResult(job, false)
+}
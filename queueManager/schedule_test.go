@@ -0,0 +1,276 @@
+package queueManager
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/geekgonecrazy/vanityDomainManager/jobs"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+func TestHoldLeavesRegistryAlone(t *testing.T) {
+	q, _ := newTestManager(t)
+	statuses := subscribeStatuses(t, q, "ref-2")
+
+	domain := jobs.VanityDomain{VanityDomain: "localhost", DesiredDNSTargetType: "A", DesiredARecordTargets: []string{"127.0.0.1"}}
+	q.recordDomainJob(jobs.VanityDomainJob{ReferenceID: "ref-1", Type: "add", Domain: domain})
+	q.recordDomainState("localhost", "ref-1", "add", jobs.StateActive, "")
+
+	// Queued by a release without the schedule, it moves there instead of waiting on the consumer
+	notBefore := time.Now().Add(time.Hour)
+	job := jobs.VanityDomainJob{ReferenceID: "ref-2", Type: "change", Domain: domain, NotBefore: &notBefore}
+	data, err := json.Marshal(job)
+	if err != nil {
+		t.Fatalf("Failed to marshal job: %v", err)
+	}
+
+	msg := &testDelivery{data: data}
+	if !q.holdOrDiscard(msg, job) {
+		t.Fatal("Expected the job to be held")
+	}
+
+	if !msg.acked || msg.nakDelay != 0 {
+		t.Errorf("Expected the delivery to be acked, got acked %v nak delay %v", msg.acked, msg.nakDelay)
+	}
+
+	if _, err := q.scheduled.Get(context.Background(), "ref-2"); err != nil {
+		t.Errorf("Expected the job to be held in the schedule, got %v", err)
+	}
+
+	select {
+	case status := <-statuses:
+		if status.State != jobs.StateScheduled || status.Dropped {
+			t.Errorf("Expected a scheduled status for the job, got %+v", status)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the scheduled status")
+	}
+
+	record, err := q.GetDomain("localhost")
+	if err != nil {
+		t.Fatalf("Failed to get domain: %v", err)
+	}
+
+	if record.Status.State != jobs.StateActive || record.Status.ReferenceID != "ref-1" || len(record.History) != 2 {
+		t.Errorf("Expected the domain to keep the state of the job that ran, got %+v", record.Status)
+	}
+}
+
+func TestHeldJobRunsWhenDue(t *testing.T) {
+	q, cluster := newTestManager(t, `
+queue:
+  backend: memory
+  consumer:
+    maxDeliver: 2
+`)
+
+	if err := q.StartWorkers(); err != nil {
+		t.Fatalf("Failed to start workers: %v", err)
+	}
+
+	statuses := subscribeStatuses(t, q, "ref-1")
+
+	notBefore := time.Now().Add(300 * time.Millisecond)
+	if err := q.AddDomainJob(jobs.VanityDomainJob{
+		ReferenceID: "ref-1",
+		Type:        "add",
+		NotBefore:   &notBefore,
+		Domain:      jobs.VanityDomain{VanityDomain: "localhost", DesiredDNSTargetType: "A", DesiredARecordTargets: []string{"127.0.0.1"}},
+	}); err != nil {
+		t.Fatalf("Failed to add job: %v", err)
+	}
+
+	states := []string{}
+	for {
+		select {
+		case status := <-statuses:
+			states = append(states, status.State)
+
+			if status.IsFinal() {
+				if !status.Success {
+					t.Fatalf("Expected the held job to succeed on its second delivery, got %v", states)
+				}
+
+				if states[0] != jobs.StateScheduled || len(cluster.recorded()) == 0 {
+					t.Errorf("Expected a scheduled status before the job ran, got %v and calls %v", states, cluster.recorded())
+				}
+				return
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("Timed out waiting for the held job, got %v", states)
+		}
+	}
+}
+
+func TestScheduledJobsStayOffTheConsumer(t *testing.T) {
+	q, cluster := newTestManager(t, `
+queue:
+  backend: memory
+  consumer:
+    maxAckPending: 1
+worker:
+  concurrency: 1
+`)
+
+	if err := q.StartWorkers(); err != nil {
+		t.Fatalf("Failed to start workers: %v", err)
+	}
+
+	scheduled := subscribeStatuses(t, q, "ref-1")
+	statuses := subscribeStatuses(t, q, "ref-2")
+
+	notBefore := time.Now().Add(time.Hour)
+	if err := q.AddDomainJob(jobs.VanityDomainJob{
+		ReferenceID: "ref-1",
+		Type:        "add",
+		NotBefore:   &notBefore,
+		Domain:      jobs.VanityDomain{VanityDomain: "example.org", DesiredDNSTargetType: "A", DesiredARecordTargets: []string{"127.0.0.1"}},
+	}); err != nil {
+		t.Fatalf("Failed to add scheduled job: %v", err)
+	}
+
+	// With a single job pending at a time, a held job would keep this one from ever being delivered
+	if err := q.AddDomainJob(jobs.VanityDomainJob{
+		ReferenceID: "ref-2",
+		Type:        "add",
+		Domain:      jobs.VanityDomain{VanityDomain: "localhost", DesiredDNSTargetType: "A", DesiredARecordTargets: []string{"127.0.0.1"}},
+	}); err != nil {
+		t.Fatalf("Failed to add job: %v", err)
+	}
+
+	if status := waitForFinalStatus(t, statuses); !status.Success || len(cluster.recorded()) == 0 {
+		t.Errorf("Expected the job to run while the other one is scheduled, got %+v", status)
+	}
+
+	if err := q.CancelJob("ref-1"); err != nil {
+		t.Fatalf("Failed to cancel job: %v", err)
+	}
+
+	if status := waitForFinalStatus(t, scheduled); status.State != jobs.StateCancelled || !status.Dropped {
+		t.Errorf("Expected the scheduled job to be dropped as cancelled right away, got %+v", status)
+	}
+
+	if _, err := q.scheduled.Get(context.Background(), "ref-1"); !errors.Is(err, jetstream.ErrKeyNotFound) {
+		t.Errorf("Expected the cancelled job to leave the schedule, got %v", err)
+	}
+}
+
+func TestSupersededAtDelivery(t *testing.T) {
+	q, cluster := newTestManager(t)
+
+	domain := jobs.VanityDomain{VanityDomain: "localhost", DesiredDNSTargetType: "A", DesiredARecordTargets: []string{"127.0.0.1"}}
+	older := jobs.VanityDomainJob{ReferenceID: "ref-1", Type: "add", Domain: domain}
+	newer := jobs.VanityDomainJob{ReferenceID: "ref-2", Type: "change", Domain: domain}
+
+	if _, err := q.claimLatestJob(newer, 2); err != nil {
+		t.Fatalf("Failed to claim the newer job: %v", err)
+	}
+
+	msg := &testDelivery{sequence: 1}
+	if !q.holdOrDiscard(msg, older) || !msg.acked {
+		t.Fatal("Expected the older job to be dropped when delivered")
+	}
+
+	record, err := q.GetDomain("localhost")
+	if err != nil {
+		t.Fatalf("Failed to get domain: %v", err)
+	}
+
+	if record.Status.State != jobs.StateSuperseded || record.Status.ReferenceID != "ref-1" || len(cluster.recorded()) != 0 {
+		t.Errorf("Expected the older job to be superseded without touching the cluster, got %+v %v", record.Status, cluster.recorded())
+	}
+
+	// The newer job itself still runs, also when it is redelivered
+	for delivery := 0; delivery < 2; delivery++ {
+		if q.holdOrDiscard(&testDelivery{sequence: 2}, newer) {
+			t.Fatalf("Expected delivery %d of the newer job to be processed", delivery+1)
+		}
+	}
+}
+
+func TestSupersededWhileRunning(t *testing.T) {
+	q, _ := newTestManager(t)
+
+	domain := jobs.VanityDomain{VanityDomain: "localhost", DesiredDNSTargetType: "A", DesiredARecordTargets: []string{"127.0.0.1"}}
+	running := jobs.VanityDomainJob{ReferenceID: "ref-1", Type: "add", Domain: domain}
+	msg := &testDelivery{sequence: 1}
+
+	if q.holdOrDiscard(msg, running) {
+		t.Fatal("Expected the job to be processed")
+	}
+
+	if err := q.checkStillWanted(msg, running); err != nil {
+		t.Fatalf("Expected the latest job to be wanted, got %v", err)
+	}
+
+	if _, err := q.claimLatestJob(jobs.VanityDomainJob{ReferenceID: "ref-2", Type: "remove", Domain: domain}, 2); err != nil {
+		t.Fatalf("Failed to claim the newer job: %v", err)
+	}
+
+	var stopped *stoppedError
+	if err := q.checkStillWanted(msg, running); !errors.As(err, &stopped) || stopped.state != jobs.StateSuperseded {
+		t.Fatalf("Expected the running job to be superseded, got %v", err)
+	}
+
+	if !q.settleIfStopped(msg, running, stopped) || !msg.acked {
+		t.Error("Expected the superseded job to be acked")
+	}
+}
+
+func TestSupersededBeforeApplying(t *testing.T) {
+	q, cluster := newTestManager(t)
+
+	domain := jobs.VanityDomain{VanityDomain: "localhost", DesiredDNSTargetType: "A", DesiredARecordTargets: []string{"127.0.0.1"}}
+	running := jobs.VanityDomainJob{ReferenceID: "ref-1", Type: "add", Domain: domain}
+
+	// The newer job was queued after this one was delivered, while its DNS was checked
+	if _, err := q.claimLatestJob(jobs.VanityDomainJob{ReferenceID: "ref-2", Type: "remove", Domain: domain}, 2); err != nil {
+		t.Fatalf("Failed to claim the newer job: %v", err)
+	}
+
+	var stopped *stoppedError
+	if err := q.configureVanityDomain(&testDelivery{sequence: 1}, running); !errors.As(err, &stopped) {
+		t.Fatalf("Expected the job to stop, got %v", err)
+	}
+
+	if calls := cluster.recorded(); len(calls) != 0 {
+		t.Errorf("Expected the superseded job to leave the cluster alone, got %v", calls)
+	}
+}
+
+func TestCancelSubject(t *testing.T) {
+	q, _ := newTestManager(t)
+
+	// Every replica listens, a request is still handled once
+	for replica := 0; replica < 2; replica++ {
+		if err := q.startCancelListener(); err != nil {
+			t.Fatalf("Failed to start cancel listener: %v", err)
+		}
+	}
+
+	replies, err := q.nc.SubscribeSync(nats.NewInbox())
+	if err != nil {
+		t.Fatalf("Failed to subscribe to replies: %v", err)
+	}
+
+	if err := q.nc.PublishRequest(q.GetCancelSubject("ref-1"), replies.Subject, nil); err != nil {
+		t.Fatalf("Failed to request cancellation: %v", err)
+	}
+
+	reply, err := replies.NextMsg(5 * time.Second)
+	if err != nil {
+		t.Fatalf("Failed to get a reply: %v", err)
+	}
+
+	if string(reply.Data) != `{"status":"cancelled"}` || !q.isCancelled("ref-1") {
+		t.Errorf("Expected the job to be cancelled, got %s", reply.Data)
+	}
+
+	if extra, err := replies.NextMsg(200 * time.Millisecond); err == nil {
+		t.Errorf("Expected a single reply, got another %s", extra.Data)
+	}
+}
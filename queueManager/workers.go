@@ -2,41 +2,39 @@ package queueManager
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
+	"time"
 
+	"github.com/geekgonecrazy/vanityDomainManager/config"
+	"github.com/geekgonecrazy/vanityDomainManager/encryption"
 	"github.com/geekgonecrazy/vanityDomainManager/jobs"
 	"github.com/geekgonecrazy/vanityDomainManager/kubernetes"
 	"github.com/geekgonecrazy/vanityDomainManager/verifiers"
-
-	"github.com/nats-io/nats.go/jetstream"
 )
 
+// startDomainJobWorker works on up to worker.concurrency jobs at once, so a job waiting for DNS or a certificate
+// doesn't hold up jobs for other domains.
 func (q *queueManager) startDomainJobWorker() error {
-	q.logger.Println("Starting Domain job Worker")
+	concurrency := config.Config().Worker().Concurrency
+	heartbeat := config.Config().Queue().Consumer.AckWait / 3
 
-	config := jetstream.ConsumerConfig{
-		Name:          "vanityDomainManager-domainjob-worker",
-		Durable:       "vanityDomainManager-domainjob-worker",
-		Description:   "The consumer for the vanityDomainManager",
-		AckPolicy:     jetstream.AckExplicitPolicy,
-		FilterSubject: q.GetJobSubject(">"),
-		MaxDeliver:    10,
-	}
-	con, err := q.jobStream.CreateOrUpdateConsumer(context.Background(), config)
-	if err != nil {
-		return fmt.Errorf("create or update consumer: %w", err)
-	}
+	q.logger.Printf("Starting Domain job Worker, %d jobs at a time", concurrency)
 
-	_, err = con.Consume(q.domainJobHandler(config))
-	if err != nil {
-		return fmt.Errorf("consume: %w", err)
-	}
+	handler := q.domainJobHandler()
+	return q.queue.ConsumeJobs(concurrency, func(msg Delivery) {
+		// Jobs for the same domain would race each other, run them one after another
+		job, _ := jobs.DecodeJob(msg.Data())
+		defer q.domainLocks.lock(msg, job.Domain.VanityDomain, heartbeat)()
 
-	return nil
+		handler(msg)
+	})
 }
 
-func (q *queueManager) configureVanityDomain(referenceID string, domain jobs.VanityDomain) error {
+func (q *queueManager) configureVanityDomain(msg Delivery, job jobs.VanityDomainJob) error {
+	referenceID := job.ReferenceID
+	domain := job.Domain
+
 	q.logger.Printf("Configuring Vanity Domain %s ...", domain.VanityDomain)
 
 	// should do a dns check here to see if the VanityDomain is pointing to DesiredDNSTarget with DesiredDNSTargetType
@@ -46,12 +44,21 @@ func (q *queueManager) configureVanityDomain(referenceID string, domain jobs.Van
 
 	q.logger.Printf("Verifying Vanity Domain %s", domain.VanityDomain)
 
-	if err := verifiers.VerifyDomain(domain); err != nil {
+	if job.AwaitDNS || config.Config().Worker().AwaitDNS.Enabled {
+		if err := q.awaitDNS(msg, job); err != nil {
+			return err
+		}
+	} else if err := verifiers.VerifyDomain(domain); err != nil {
 		return fmt.Errorf("Domain verification failed for %s: %s", domain.VanityDomain, err)
 	}
 
 	q.logger.Printf("Vanity Domain %s verified successfully", domain.VanityDomain)
 
+	// A newer job may have been queued while DNS was checked, don't let this one overwrite it
+	if err := q.checkStillWanted(msg, job); err != nil {
+		return err
+	}
+
 	if domain.ProvidedCertificate != nil {
 		q.logger.Printf("Validating TLS Certificate provided for %s", domain.VanityDomain)
 		if err := verifiers.ValidateTLSCert(domain); err != nil {
@@ -60,89 +67,306 @@ func (q *queueManager) configureVanityDomain(referenceID string, domain jobs.Van
 
 		q.logger.Println("TLS Certificate Validated!")
 
+		if q.cluster.ManagesCertificates() {
+			// A Certificate left from an earlier job would have cert-manager overwrite the provided secret
+			if err := q.cluster.UnSetCertificate(context.Background(), domain); err != nil {
+				return fmt.Errorf("Failed to remove certificate for %s: %w", domain.VanityDomain, err)
+			}
+		}
+
 		q.logger.Println("Inserting TLS Certificate into environment")
 
-		if err := kubernetes.GetClient().SetTLS(context.Background(), domain); err != nil {
-			return fmt.Errorf("Failed to set TLS for %s: %s", domain.VanityDomain, err)
+		if err := q.cluster.SetTLS(context.Background(), referenceID, domain); err != nil {
+			return fmt.Errorf("Failed to set TLS for %s: %w", domain.VanityDomain, err)
 		}
 
 		q.logger.Println("TLS Certificate Ready for use!")
+	} else if q.cluster.ManagesCertificates() {
+		q.logger.Printf("Requesting certificate for %s from cert-manager", domain.VanityDomain)
+
+		if err := q.cluster.SetCertificate(context.Background(), referenceID, job.Owner, domain); err != nil {
+			return fmt.Errorf("Failed to set certificate for %s: %w", domain.VanityDomain, err)
+		}
 	}
 
 	q.logger.Println("Setting Vanity Domain in Environment")
 
-	if err := kubernetes.GetClient().SetVanityDomain(context.Background(), domain); err != nil {
-		return fmt.Errorf("Failed to set custom domain for %s: %s", domain.VanityDomain, err)
+	if err := q.cluster.SetVanityDomain(context.Background(), referenceID, domain); err != nil {
+		return fmt.Errorf("Failed to set custom domain for %s: %w", domain.VanityDomain, err)
 	}
 
 	q.logger.Println("Vanity Domain Set in Environment Successfully!")
 
-	if err := q.SendStatusUpdate(referenceID, true, "", false); err != nil {
+	if q.cluster.IssuesCertificate(domain) && !config.Config().Worker().AwaitCertificate.Disabled {
+		if err := q.awaitCertificate(msg, job); err != nil {
+			return err
+		}
+
+		q.logger.Printf("Certificate for %s issued", domain.VanityDomain)
+	}
+
+	q.recordDomainState(domain.VanityDomain, referenceID, job.Type, jobs.StateActive, "")
+
+	q.publishLifecycleEvent(EventTypeDomainActivated, jobs.DomainLifecycleEvent{
+		Domain:      domain.VanityDomain,
+		ReferenceID: referenceID,
+	})
+
+	if err := q.SendStatusUpdate(referenceID, domain.VanityDomain, true, "", false); err != nil {
 		return fmt.Errorf("failed to send status update for %s: %s", domain.VanityDomain, err)
 	}
 
 	return nil
 }
 
+// awaitDNS polls verification for up to the configured window, keeping the message alive with InProgress
+// heartbeats so slow DNS propagation doesn't use up delivery attempts.
+func (q *queueManager) awaitDNS(msg Delivery, job jobs.VanityDomainJob) error {
+	referenceID := job.ReferenceID
+	domain := job.Domain
+	awaitConfig := config.Config().Worker().AwaitDNS
+	deadline := time.Now().Add(awaitConfig.Window)
+
+	var lastStatus time.Time
+	for {
+		err := verifiers.VerifyDomain(domain)
+		if err == nil {
+			return nil
+		}
+
+		if err := q.checkStillWanted(msg, job); err != nil {
+			return err
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("Domain verification failed for %s after waiting %v: %s", domain.VanityDomain, awaitConfig.Window, err)
+		}
+
+		if time.Since(lastStatus) >= awaitConfig.StatusInterval {
+			observed := verifiers.DescribeDNS(domain)
+			q.logger.Printf("Still waiting for DNS on %s, observed %s", domain.VanityDomain, observed)
+
+			if err := q.SendProgressUpdate(referenceID, domain.VanityDomain, jobs.StateAwaitingDNS, fmt.Sprintf("still waiting, observed %s", observed)); err != nil {
+				q.logger.Printf("Failed to send progress update for %s: %s", domain.VanityDomain, err)
+			}
+
+			lastStatus = time.Now()
+		}
+
+		if err := msg.InProgress(); err != nil {
+			q.logger.Printf("Failed to extend ack deadline for %s: %s", msg.Subject(), err)
+		}
+
+		time.Sleep(awaitConfig.PollInterval)
+	}
+}
+
+// awaitCertificate waits for cert-manager to issue the domain's certificate, keeping the message alive with
+// InProgress heartbeats like awaitDNS. It fails with cert-manager's reason when issuance fails.
+func (q *queueManager) awaitCertificate(msg Delivery, job jobs.VanityDomainJob) error {
+	referenceID := job.ReferenceID
+	domain := job.Domain
+	awaitConfig := config.Config().Worker().AwaitCertificate
+	deadline := time.Now().Add(awaitConfig.Window)
+
+	var lastStatus time.Time
+	lastMessage := ""
+	for {
+		status, err := q.cluster.GetCertificateStatus(context.Background(), domain)
+		if err != nil {
+			q.logger.Printf("Failed to read certificate status of %s: %s", domain.VanityDomain, err)
+			status.Message = err.Error()
+		} else if status.Ready {
+			return nil
+		} else if status.Failed {
+			return fmt.Errorf("Certificate issuance failed for %s: %s", domain.VanityDomain, status.Message)
+		}
+
+		if err := q.checkStillWanted(msg, job); err != nil {
+			return err
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("Certificate for %s not ready after waiting %v: %s", domain.VanityDomain, awaitConfig.Window, status.Message)
+		}
+
+		if status.Message != lastMessage || time.Since(lastStatus) >= awaitConfig.StatusInterval {
+			q.logger.Printf("Still waiting for the certificate of %s: %s", domain.VanityDomain, status.Message)
+
+			if err := q.SendProgressUpdate(referenceID, domain.VanityDomain, jobs.StateAwaitingCertificate, status.Message); err != nil {
+				q.logger.Printf("Failed to send progress update for %s: %s", domain.VanityDomain, err)
+			}
+
+			lastStatus = time.Now()
+			lastMessage = status.Message
+		}
+
+		if err := msg.InProgress(); err != nil {
+			q.logger.Printf("Failed to extend ack deadline for %s: %s", msg.Subject(), err)
+		}
+
+		time.Sleep(awaitConfig.PollInterval)
+	}
+}
+
 func (q *queueManager) domainRemove(referenceID string, domain jobs.VanityDomain) error {
 	q.logger.Printf("Removing Vanity Domain %s", domain.VanityDomain)
 
+	if q.cluster.ManagesCertificates() {
+		if err := q.cluster.UnSetCertificate(context.Background(), domain); err != nil {
+			return fmt.Errorf("Failed to remove certificate for %s: %w", domain.VanityDomain, err)
+		}
+	}
+
 	q.logger.Printf("Removing TLS Certificate provided for %s", domain.VanityDomain)
-	if err := kubernetes.GetClient().UnSetTLS(context.Background(), domain); err != nil {
-		return fmt.Errorf("Failed to remove TLS for %s: %s", domain.VanityDomain, err)
+	if err := q.cluster.UnSetTLS(context.Background(), domain); err != nil {
+		return fmt.Errorf("Failed to remove TLS for %s: %w", domain.VanityDomain, err)
 	}
 
 	q.logger.Printf("TLS Certificiate removed for %s", domain.VanityDomain)
 
 	q.logger.Printf("Removing Vanity Domain from Environment %s", domain.VanityDomain)
 
-	if err := kubernetes.GetClient().UnSetVanityDomain(context.Background(), domain); err != nil {
-		return fmt.Errorf("Failed to remove Vanity Domain for %s: %s", domain.VanityDomain, err)
+	if err := q.cluster.UnSetVanityDomain(context.Background(), domain); err != nil {
+		return fmt.Errorf("Failed to remove Vanity Domain for %s: %w", domain.VanityDomain, err)
 	}
 
 	q.logger.Printf("Vanity Domain %s removed from Environment Successfully!", domain.VanityDomain)
 
-	if err := q.SendStatusUpdate(referenceID, true, "", false); err != nil {
+	q.recordDomainState(domain.VanityDomain, referenceID, "remove", jobs.StateRemoved, "")
+
+	if err := q.SendStatusUpdate(referenceID, domain.VanityDomain, true, "", false); err != nil {
 		return fmt.Errorf("failed to send status update for %s: %s", domain.VanityDomain, err)
 	}
 
 	return nil
 }
 
-func (q *queueManager) domainJobHandler(config jetstream.ConsumerConfig) func(msg jetstream.Msg) {
-	return func(msg jetstream.Msg) {
+// settleIfStopped discards a job whose processing ended because it was cancelled or superseded, because it would
+// have to touch Kubernetes objects or fields the manager doesn't own, or because its routes can't be written.
+func (q *queueManager) settleIfStopped(msg Delivery, job jobs.VanityDomainJob, err error) bool {
+	if errors.Is(err, kubernetes.ErrInvalidRoute) {
+		q.logger.Printf("Job %s refused: %s", job.ReferenceID, err)
+		q.discardJob(msg, job, jobs.StateFailed, err.Error())
+		return true
+	}
+
+	if errors.Is(err, kubernetes.ErrUnmanagedObject) || errors.Is(err, kubernetes.ErrFieldConflict) {
+		// Retrying can't help until the object is removed or the job is resubmitted with adopt
+		q.logger.Printf("Job %s refused: %s", job.ReferenceID, err)
+		q.discardJob(msg, job, jobs.StateUnmanaged, err.Error())
+		return true
+	}
+
+	var stopped *stoppedError
+	if !errors.As(err, &stopped) {
+		return false
+	}
+
+	q.logger.Printf("Job %s stopped: %s", job.ReferenceID, stopped.message)
+	q.discardJob(msg, job, stopped.state, stopped.message)
+	return true
+}
+
+func (q *queueManager) domainJobHandler() func(msg Delivery) {
+	return func(msg Delivery) {
 		q.logger.Printf("Received message on subject %s", msg.Subject())
 
 		hasError := true // Assume failure by default
 		errorMsg := ""
 		referenceID := "unknown"
+		settled := false // Set when the delivery was already acked or naked
+		var job jobs.VanityDomainJob
 		defer func() {
-			q.ackornack(config, msg, referenceID, hasError, errorMsg)
+			if settled {
+				return
+			}
+
+			errorMsg = job.Domain.ProvidedCertificate.RedactKey(errorMsg)
+			dropped := q.ackornack(msg, referenceID, job.Domain.VanityDomain, hasError, errorMsg)
+
+			if !hasError || dropped {
+				q.deleteCertificate(job.Domain.CertificateRef)
+				q.recordBatchResult(job, !hasError)
+			}
+
+			if hasError && job.Domain.VanityDomain != "" {
+				state := jobs.StatePending
+				if dropped {
+					state = jobs.StateFailed
+				}
+
+				q.recordDomainState(job.Domain.VanityDomain, job.ReferenceID, job.Type, state, errorMsg)
+			}
 		}()
 
-		var job jobs.VanityDomainJob
-		if err := json.Unmarshal(msg.Data(), &job); err != nil {
+		decoded, err := jobs.DecodeJob(msg.Data())
+		if errors.Is(err, jobs.ErrUnsupportedSchemaVersion) {
+			// Retrying can't help until a newer manager is deployed, so report it instead of burning deliveries
+			q.logger.Printf("Job %s: %s", decoded.ReferenceID, err)
+			q.discardJob(msg, decoded, jobs.StateUnsupported, err.Error())
+			settled = true
+			return
+		}
+
+		if err != nil {
 			q.logger.Printf("failed to unmarshal job err: %s", err)
 			return
 		}
 
+		job = decoded
 		referenceID = job.ReferenceID
 
+		if q.holdOrDiscard(msg, job) {
+			settled = true
+			return
+		}
+
+		if job.Domain.VanityDomain != "" {
+			q.recordDomainJob(job)
+		}
+
+		if err := q.fetchCertificate(&job.Domain); err != nil {
+			errorMsg = err.Error()
+			return
+		}
+
+		if job.Domain.CertificateRef != "" && job.Type != "remove" {
+			q.recordProvidedCertificate(job.Domain.VanityDomain, job.Domain.ProvidedCertificate.Cert)
+		}
+
+		// The key is only ever decrypted here, right before it is validated and handed to SetTLS
+		if job.Domain.ProvidedCertificate != nil {
+			cert, err := encryption.GetKeyring().OpenCertificate(job.Domain.ProvidedCertificate)
+			if err != nil {
+				// The keyring doesn't change between deliveries, so neither would the result
+				message := fmt.Sprintf("Failed to decrypt certificate key for %s: %s", job.Domain.VanityDomain, err)
+				q.logger.Printf("Job %s: %s", job.ReferenceID, message)
+				q.discardJob(msg, job, jobs.StateFailed, message)
+				settled = true
+				return
+			}
+			job.Domain.ProvidedCertificate = cert
+		}
+
 		switch job.Type {
 		case "add":
 			q.logger.Printf("Processing Vanity Domain Add for %s", job.Domain.VanityDomain)
-			if err := q.configureVanityDomain(job.ReferenceID, job.Domain); err != nil {
+			if err := q.configureVanityDomain(msg, job); err != nil {
+				settled = q.settleIfStopped(msg, job, err)
 				errorMsg = err.Error()
 				return
 			}
 		case "change":
 			q.logger.Printf("Processing Vanity Domain Change for %s", job.Domain.VanityDomain)
-			if err := q.configureVanityDomain(job.ReferenceID, job.Domain); err != nil {
+			if err := q.configureVanityDomain(msg, job); err != nil {
+				settled = q.settleIfStopped(msg, job, err)
 				errorMsg = err.Error()
 				return
 			}
 		case "remove":
 			if err := q.domainRemove(job.ReferenceID, job.Domain); err != nil {
+				settled = q.settleIfStopped(msg, job, err)
 				errorMsg = err.Error()
 				return
 			}
@@ -0,0 +1,330 @@
+package queueManager
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/geekgonecrazy/vanityDomainManager/jobs"
+	"github.com/geekgonecrazy/vanityDomainManager/kubernetes"
+)
+
+// testDelivery is a delivery handed straight to a worker function, it records how it was settled.
+type testDelivery struct {
+	mu         sync.Mutex
+	data       []byte
+	sequence   uint64
+	delivered  uint64
+	acked      bool
+	nakDelay   time.Duration
+	inProgress int
+}
+
+func (d *testDelivery) Subject() string {
+	return "test.vanityDomainManager.domainjob.ref"
+}
+
+func (d *testDelivery) Data() []byte {
+	return d.data
+}
+
+func (d *testDelivery) Sequence() uint64 {
+	return d.sequence
+}
+
+func (d *testDelivery) NumDelivered() uint64 {
+	if d.delivered == 0 {
+		return 1
+	}
+
+	return d.delivered
+}
+
+func (d *testDelivery) Ack() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.acked = true
+	return nil
+}
+
+func (d *testDelivery) Nak(delay time.Duration) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.nakDelay = delay
+	return nil
+}
+
+func (d *testDelivery) InProgress() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.inProgress++
+	return nil
+}
+
+func (d *testDelivery) heartbeats() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.inProgress
+}
+
+func TestAwaitDNSKeepsDeliveryAlive(t *testing.T) {
+	q, _ := newTestManager(t, `
+worker:
+  awaitDns:
+    window: 300ms
+    pollInterval: 20ms
+    statusInterval: 100ms
+`)
+
+	job := jobs.VanityDomainJob{
+		ReferenceID: "ref-1",
+		Type:        "add",
+		Domain:      jobs.VanityDomain{VanityDomain: "localhost", DesiredDNSTargetType: "A", DesiredARecordTargets: []string{"192.0.2.1"}},
+	}
+
+	msg := &testDelivery{}
+	err := q.awaitDNS(msg, job)
+	if err == nil || !strings.Contains(err.Error(), "after waiting 300ms") {
+		t.Fatalf("Expected DNS verification to give up after the window, got: %v", err)
+	}
+
+	if msg.heartbeats() < 5 {
+		t.Errorf("Expected the delivery to be kept alive on every poll, got %d heartbeats", msg.heartbeats())
+	}
+
+	history, err := q.GetJobHistory("ref-1")
+	if err != nil {
+		t.Fatalf("Failed to get job history: %v", err)
+	}
+
+	if len(history) < 2 || len(history) > 4 {
+		t.Fatalf("Expected a progress update every status interval, got %d", len(history))
+	}
+
+	for _, status := range history {
+		if status.State != jobs.StateAwaitingDNS || !strings.HasPrefix(status.Message, "still waiting, observed A 127.0.0.1") {
+			t.Errorf("Expected an awaiting_dns update with the observed records, got %+v", status)
+		}
+	}
+}
+
+func TestAwaitDNSDoesNotHoldUpOtherJobs(t *testing.T) {
+	q, cluster := newTestManager(t, `
+worker:
+  awaitDns:
+    window: 5s
+    pollInterval: 20ms
+`)
+
+	if err := q.StartWorkers(); err != nil {
+		t.Fatalf("Failed to start workers: %v", err)
+	}
+
+	waiting := subscribeStatuses(t, q, "ref-1")
+	other := subscribeStatuses(t, q, "ref-2")
+
+	if err := q.AddDomainJob(jobs.VanityDomainJob{
+		ReferenceID: "ref-1",
+		Type:        "add",
+		AwaitDNS:    true,
+		Domain:      jobs.VanityDomain{VanityDomain: "localhost", DesiredDNSTargetType: "A", DesiredARecordTargets: []string{"192.0.2.1"}},
+	}); err != nil {
+		t.Fatalf("Failed to add job: %v", err)
+	}
+
+	// Make sure the first job is waiting before the second one is queued
+	select {
+	case status := <-waiting:
+		if status.State != jobs.StateAwaitingDNS {
+			t.Fatalf("Expected the first job to await DNS, got %+v", status)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the first job")
+	}
+
+	if err := q.AddDomainJob(jobs.VanityDomainJob{ReferenceID: "ref-2", Type: "remove", Domain: jobs.VanityDomain{VanityDomain: "example.org"}}); err != nil {
+		t.Fatalf("Failed to add job: %v", err)
+	}
+
+	select {
+	case status := <-other:
+		if !status.Success {
+			t.Fatalf("Expected the second job to succeed, got %+v", status)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Expected the second job to finish while the first one awaits DNS, calls so far: %v", cluster.recorded())
+	}
+}
+
+func TestAwaitCertificateDoesNotHoldUpOtherJobs(t *testing.T) {
+	q, cluster := newTestManager(t, `
+worker:
+  awaitCertificate:
+    window: 5s
+    pollInterval: 20ms
+`)
+	cluster.managesCertificates = true
+	cluster.certificateStatus = kubernetes.CertificateStatus{Message: "order pending"}
+
+	if err := q.StartWorkers(); err != nil {
+		t.Fatalf("Failed to start workers: %v", err)
+	}
+
+	waiting := subscribeStatuses(t, q, "ref-1")
+	other := subscribeStatuses(t, q, "ref-2")
+
+	if err := q.AddDomainJob(jobs.VanityDomainJob{
+		ReferenceID: "ref-1",
+		Type:        "add",
+		Domain:      jobs.VanityDomain{VanityDomain: "localhost", DesiredDNSTargetType: "A", DesiredARecordTargets: []string{"127.0.0.1"}},
+	}); err != nil {
+		t.Fatalf("Failed to add job: %v", err)
+	}
+
+	// Make sure the first job is waiting before the second one is queued
+	select {
+	case status := <-waiting:
+		if status.State != jobs.StateAwaitingCertificate {
+			t.Fatalf("Expected the first job to await its certificate, got %+v", status)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the first job")
+	}
+
+	if err := q.AddDomainJob(jobs.VanityDomainJob{ReferenceID: "ref-2", Type: "remove", Domain: jobs.VanityDomain{VanityDomain: "example.org"}}); err != nil {
+		t.Fatalf("Failed to add job: %v", err)
+	}
+
+	select {
+	case status := <-other:
+		if !status.Success {
+			t.Fatalf("Expected the second job to succeed, got %+v", status)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Expected the second job to finish while the first one awaits its certificate, calls so far: %v", cluster.recorded())
+	}
+}
+
+func TestInvalidRouteDropsJob(t *testing.T) {
+	q, _ := newTestManager(t)
+	statuses := subscribeStatuses(t, q, "ref-1")
+
+	job := jobs.VanityDomainJob{ReferenceID: "ref-1", Type: "add", Domain: jobs.VanityDomain{VanityDomain: "example.org"}}
+	msg := &testDelivery{sequence: 1}
+
+	err := fmt.Errorf("Failed to set custom domain for example.org: %w", kubernetes.ErrInvalidRoute)
+	if !q.settleIfStopped(msg, job, err) || !msg.acked {
+		t.Fatal("Expected a job with an invalid route to be acked instead of retried")
+	}
+
+	select {
+	case status := <-statuses:
+		if !status.Dropped || status.State != jobs.StateFailed {
+			t.Errorf("Expected the job to be dropped as failed, got %+v", status)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("Timed out waiting for the drop status")
+	}
+}
+
+func TestDomainLocksSerializeJobsPerDomain(t *testing.T) {
+	locks := domainLocks{}
+	first := &testDelivery{}
+	second := &testDelivery{}
+	other := &testDelivery{}
+
+	unlock := locks.lock(first, "Example.org", 10*time.Millisecond)
+
+	// Another domain doesn't wait
+	locks.lock(other, "example.net", 10*time.Millisecond)()
+
+	acquired := make(chan struct{})
+	go func() {
+		locks.lock(second, "example.org.", 10*time.Millisecond)()
+		close(acquired)
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatal("Expected the second job for the domain to wait for the first")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	unlock()
+
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the second job to run once the first one finished")
+	}
+
+	if second.heartbeats() == 0 {
+		t.Error("Expected the waiting delivery to be kept alive")
+	}
+
+	if other.heartbeats() != 0 {
+		t.Errorf("Expected the job for another domain not to wait, got %d heartbeats", other.heartbeats())
+	}
+
+	if len(locks.locks) != 0 {
+		t.Errorf("Expected released locks to be forgotten, got %v", locks.locks)
+	}
+}
+
+func TestUndecryptableKeyDropsJob(t *testing.T) {
+	q, cluster := newTestManager(t)
+	statuses := subscribeStatuses(t, q, "ref-1")
+
+	// Encrypted with a key this manager doesn't have
+	job := jobs.VanityDomainJob{
+		ReferenceID: "ref-1",
+		Type:        "add",
+		Domain: jobs.VanityDomain{
+			VanityDomain:          "localhost",
+			DesiredDNSTargetType:  "A",
+			DesiredARecordTargets: []string{"127.0.0.1"},
+			ProvidedCertificate:   &jobs.DomainCustomCert{Cert: "CERT", EncryptedKey: &jobs.EncryptedKey{KeyID: "retired"}},
+		},
+	}
+
+	data, err := json.Marshal(job)
+	if err != nil {
+		t.Fatalf("Failed to marshal job: %v", err)
+	}
+
+	msg := &testDelivery{data: data}
+	q.domainJobHandler()(msg)
+
+	if !msg.acked || msg.nakDelay != 0 {
+		t.Errorf("Expected the job to be dropped on its first delivery, got acked %v nak delay %v", msg.acked, msg.nakDelay)
+	}
+
+	select {
+	case status := <-statuses:
+		if !status.Dropped || status.State != jobs.StateFailed || !strings.Contains(status.ErrorMessage, "Failed to decrypt certificate key") {
+			t.Errorf("Expected a dropped failed status, got %+v", status)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the status")
+	}
+
+	record, err := q.GetDomain("localhost")
+	if err != nil {
+		t.Fatalf("Failed to get domain: %v", err)
+	}
+
+	if record.Status.State != jobs.StateFailed {
+		t.Errorf("Expected the domain to be failed, got %s", record.Status.State)
+	}
+
+	if len(cluster.recorded()) != 0 {
+		t.Errorf("Expected the cluster not to be touched, got %v", cluster.recorded())
+	}
+}
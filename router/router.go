@@ -1,12 +1,32 @@
 package router
 
 import (
+	"errors"
+	"strconv"
+	"strings"
+
 	"github.com/geekgonecrazy/vanityDomainManager/jobs"
 	"github.com/geekgonecrazy/vanityDomainManager/queueManager"
 	"github.com/gin-gonic/gin"
 )
 
-func Start() {
+// Manager is the part of the queue manager the API serves.
+type Manager interface {
+	AddDomainJob(job jobs.VanityDomainJob) error
+	AddBatch(batch []jobs.VanityDomainJob) (string, error)
+	GetBatch(batchID string) (*jobs.BatchStatus, error)
+	CancelJob(referenceID string) error
+	GetJobHistory(referenceID string) ([]jobs.JobStatus, error)
+	ListDomains() ([]jobs.DomainRecord, error)
+	GetDomain(domain string) (*jobs.DomainRecord, error)
+}
+
+func Start(mgr Manager) {
+	New(mgr).Run(":9595")
+}
+
+// New builds the API routes on top of mgr.
+func New(mgr Manager) *gin.Engine {
 	router := gin.Default()
 
 	router.GET("/health", func(c *gin.Context) {
@@ -20,11 +40,143 @@ func Start() {
 			return
 		}
 
-		if err := queueManager.Mgr().AddDomainJob(job); err != nil {
+		if err := mgr.AddDomainJob(job); err != nil {
+			if errors.Is(err, queueManager.ErrInvalidJob) {
+				c.JSON(400, gin.H{"error": err.Error()})
+				return
+			}
+
 			c.JSON(500, gin.H{"error": "Failed to add job to queue"})
 			return
 		}
 	})
 
-	router.Run(":9595")
+	// gin can't route a literal colon, so custom methods like /v1/jobs:batch share one wildcard route
+	router.POST("/v1/jobs:method", func(c *gin.Context) {
+		if c.Param("method") != ":batch" {
+			c.JSON(404, gin.H{"error": "Not found"})
+			return
+		}
+
+		var batch []jobs.VanityDomainJob
+		if err := c.BindJSON(&batch); err != nil {
+			c.JSON(400, gin.H{"error": "Invalid request body"})
+			return
+		}
+
+		batchID, err := mgr.AddBatch(batch)
+		if err != nil {
+			var invalid *queueManager.InvalidBatchError
+			if errors.As(err, &invalid) {
+				c.JSON(400, gin.H{"error": err.Error(), "jobs": invalid.Errors})
+				return
+			}
+
+			if errors.Is(err, queueManager.ErrInvalidJob) {
+				c.JSON(400, gin.H{"error": err.Error()})
+				return
+			}
+
+			c.JSON(500, gin.H{"error": "Failed to add batch to queue"})
+			return
+		}
+
+		c.JSON(202, gin.H{"batchId": batchID})
+	})
+
+	router.GET("/v1/batches/:batchId", func(c *gin.Context) {
+		status, err := mgr.GetBatch(c.Param("batchId"))
+		if err != nil {
+			if errors.Is(err, queueManager.ErrBatchNotFound) {
+				c.JSON(404, gin.H{"error": "Batch not found"})
+				return
+			}
+
+			c.JSON(500, gin.H{"error": "Failed to get batch"})
+			return
+		}
+
+		c.JSON(200, status)
+	})
+
+	router.DELETE("/v1/jobs/:referenceId", func(c *gin.Context) {
+		if err := jobs.ValidateReferenceID(c.Param("referenceId")); err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+
+		if err := mgr.CancelJob(c.Param("referenceId")); err != nil {
+			c.JSON(500, gin.H{"error": "Failed to cancel job"})
+			return
+		}
+
+		c.JSON(202, gin.H{"status": "cancelled"})
+	})
+
+	router.GET("/v1/jobs/:referenceId/status", func(c *gin.Context) {
+		if err := jobs.ValidateReferenceID(c.Param("referenceId")); err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+
+		history, err := mgr.GetJobHistory(c.Param("referenceId"))
+		if err != nil {
+			c.JSON(500, gin.H{"error": "Failed to get job status history"})
+			return
+		}
+
+		if len(history) == 0 {
+			c.JSON(404, gin.H{"error": "No status found for job"})
+			return
+		}
+
+		c.JSON(200, history)
+	})
+
+	router.GET("/v1/schemas/jobs", func(c *gin.Context) {
+		c.JSON(200, gin.H{"current": jobs.CurrentSchemaVersion, "supported": jobs.SupportedSchemaVersions()})
+	})
+
+	router.GET("/v1/schemas/jobs/:version", func(c *gin.Context) {
+		version, err := strconv.Atoi(strings.TrimPrefix(c.Param("version"), "v"))
+		if err != nil {
+			c.JSON(400, gin.H{"error": "Invalid schema version"})
+			return
+		}
+
+		schema, err := jobs.JSONSchema(version)
+		if err != nil {
+			c.JSON(404, gin.H{"error": "Schema version not found"})
+			return
+		}
+
+		c.Data(200, "application/schema+json", schema)
+	})
+
+	router.GET("/v1/domains", func(c *gin.Context) {
+		records, err := mgr.ListDomains()
+		if err != nil {
+			c.JSON(500, gin.H{"error": "Failed to list domains"})
+			return
+		}
+
+		c.JSON(200, records)
+	})
+
+	router.GET("/v1/domains/:domain", func(c *gin.Context) {
+		record, err := mgr.GetDomain(c.Param("domain"))
+		if err != nil {
+			if errors.Is(err, queueManager.ErrDomainNotFound) {
+				c.JSON(404, gin.H{"error": "Domain not found"})
+				return
+			}
+
+			c.JSON(500, gin.H{"error": "Failed to get domain"})
+			return
+		}
+
+		c.JSON(200, record)
+	})
+
+	return router
 }
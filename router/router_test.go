@@ -0,0 +1,105 @@
+package router
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/geekgonecrazy/vanityDomainManager/jobs"
+	"github.com/gin-gonic/gin"
+)
+
+// fakeManager answers the job status history from its fields and fails every other call.
+type fakeManager struct {
+	history    map[string][]jobs.JobStatus
+	historyErr error
+	requested  []string
+}
+
+func (m *fakeManager) AddDomainJob(job jobs.VanityDomainJob) error {
+	return errors.New("not implemented")
+}
+
+func (m *fakeManager) AddBatch(batch []jobs.VanityDomainJob) (string, error) {
+	return "", errors.New("not implemented")
+}
+
+func (m *fakeManager) GetBatch(batchID string) (*jobs.BatchStatus, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (m *fakeManager) CancelJob(referenceID string) error {
+	return errors.New("not implemented")
+}
+
+func (m *fakeManager) ListDomains() ([]jobs.DomainRecord, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (m *fakeManager) GetDomain(domain string) (*jobs.DomainRecord, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (m *fakeManager) GetJobHistory(referenceID string) ([]jobs.JobStatus, error) {
+	m.requested = append(m.requested, referenceID)
+	return m.history[referenceID], m.historyErr
+}
+
+func TestJobStatusRoute(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	mgr := &fakeManager{history: map[string][]jobs.JobStatus{
+		"ref-1": {{ReferenceID: "ref-1", State: jobs.StateAwaitingDNS}, {ReferenceID: "ref-1", Success: true}},
+	}}
+	router := New(mgr)
+
+	tests := []struct {
+		name   string
+		path   string
+		status int
+	}{
+		{"history", "/v1/jobs/ref-1/status", 200},
+		{"unknown job", "/v1/jobs/ref-2/status", 404},
+		{"dot", "/v1/jobs/ref.1/status", 400},
+		{"wildcard", "/v1/jobs/ref*/status", 400},
+		{"full wildcard", "/v1/jobs/%3E/status", 400},
+		{"whitespace", "/v1/jobs/ref%201/status", 400},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, test.path, nil))
+
+			if recorder.Code != test.status {
+				t.Errorf("Expected status %d, got %d: %s", test.status, recorder.Code, recorder.Body)
+			}
+		})
+	}
+
+	if len(mgr.requested) != 2 {
+		t.Errorf("Expected only valid reference IDs to reach the manager, got %v", mgr.requested)
+	}
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/v1/jobs/ref-1/status", nil))
+
+	var history []jobs.JobStatus
+	if err := json.Unmarshal(recorder.Body.Bytes(), &history); err != nil {
+		t.Fatalf("Failed to decode history: %v", err)
+	}
+
+	if len(history) != 2 || history[0].State != jobs.StateAwaitingDNS || !history[1].Success {
+		t.Errorf("Expected the history in order, got %+v", history)
+	}
+
+	mgr.historyErr = errors.New("stream unavailable")
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/v1/jobs/ref-1/status", nil))
+
+	if recorder.Code != 500 {
+		t.Errorf("Expected a failed read to be a 500, got %d", recorder.Code)
+	}
+}
@@ -1,18 +1,28 @@
 package verifiers
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"slices"
+	"strings"
 
 	"github.com/geekgonecrazy/vanityDomainManager/jobs"
 )
 
+// dnsResolver is the part of *net.Resolver the verifiers use, so tests can answer lookups themselves.
+type dnsResolver interface {
+	LookupCNAME(ctx context.Context, host string) (string, error)
+	LookupIP(ctx context.Context, network string, host string) ([]net.IP, error)
+}
+
+var resolver dnsResolver = net.DefaultResolver
+
 // VerifyDomain checks the DNS records of a vanity domain against the desired targets.
 func VerifyDomain(domain jobs.VanityDomain) error {
 	switch domain.DesiredDNSTargetType {
 	case "CNAME":
-		cname, err := net.LookupCNAME(domain.VanityDomain)
+		cname, err := resolver.LookupCNAME(context.Background(), domain.VanityDomain)
 		if err != nil || cname == "" {
 			return fmt.Errorf("Error or empty cname: %v", err)
 		}
@@ -21,7 +31,7 @@ func VerifyDomain(domain jobs.VanityDomain) error {
 			return fmt.Errorf("Incorrect CNAME value: %s, expected: %s", cname, domain.DesiredCNAMETarget)
 		}
 	case "A":
-		ips, err := net.LookupIP(domain.VanityDomain)
+		ips, err := resolver.LookupIP(context.Background(), "ip", domain.VanityDomain)
 		if err != nil || len(ips) == 0 {
 			return fmt.Errorf("Error or empty A record: %v", err)
 		}
@@ -39,3 +49,30 @@ func VerifyDomain(domain jobs.VanityDomain) error {
 
 	return nil
 }
+
+// DescribeDNS reports what the resolver currently returns for a vanity domain so progress updates can show it.
+func DescribeDNS(domain jobs.VanityDomain) string {
+	switch domain.DesiredDNSTargetType {
+	case "CNAME":
+		cname, err := resolver.LookupCNAME(context.Background(), domain.VanityDomain)
+		if err != nil {
+			return fmt.Sprintf("CNAME lookup error: %v", err)
+		}
+
+		return fmt.Sprintf("CNAME %s", cname)
+	case "A":
+		ips, err := resolver.LookupIP(context.Background(), "ip", domain.VanityDomain)
+		if err != nil {
+			return fmt.Sprintf("A lookup error: %v", err)
+		}
+
+		observed := make([]string, 0, len(ips))
+		for _, ip := range ips {
+			observed = append(observed, ip.String())
+		}
+
+		return fmt.Sprintf("A %s", strings.Join(observed, ", "))
+	default:
+		return fmt.Sprintf("unsupported DNS target type %s", domain.DesiredDNSTargetType)
+	}
+}
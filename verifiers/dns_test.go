@@ -0,0 +1,108 @@
+package verifiers
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/geekgonecrazy/vanityDomainManager/jobs"
+)
+
+// fakeResolver answers lookups from fixed records, hosts without records don't exist.
+type fakeResolver struct {
+	cnames map[string]string
+	ips    map[string][]string
+}
+
+var errNoSuchHost = errors.New("no such host")
+
+func (r fakeResolver) LookupCNAME(ctx context.Context, host string) (string, error) {
+	cname, ok := r.cnames[host]
+	if !ok {
+		return "", errNoSuchHost
+	}
+
+	return cname, nil
+}
+
+func (r fakeResolver) LookupIP(ctx context.Context, network string, host string) ([]net.IP, error) {
+	addresses, ok := r.ips[host]
+	if !ok {
+		return nil, errNoSuchHost
+	}
+
+	ips := []net.IP{}
+	for _, address := range addresses {
+		ips = append(ips, net.ParseIP(address))
+	}
+
+	return ips, nil
+}
+
+func useResolver(t *testing.T, r dnsResolver) {
+	original := resolver
+	resolver = r
+	t.Cleanup(func() { resolver = original })
+}
+
+func TestVerifyDomain(t *testing.T) {
+	useResolver(t, fakeResolver{
+		cnames: map[string]string{"www.example.org": "lb.example.net.", "old.example.org": "legacy.example.net."},
+		ips:    map[string][]string{"example.org": {"192.0.2.10", "192.0.2.11"}, "partial.example.org": {"192.0.2.10", "198.51.100.1"}},
+	})
+
+	tests := []struct {
+		name   string
+		domain jobs.VanityDomain
+		valid  bool
+	}{
+		{"matching cname", jobs.VanityDomain{VanityDomain: "www.example.org", DesiredDNSTargetType: "CNAME", DesiredCNAMETarget: "lb.example.net"}, true},
+		{"other cname", jobs.VanityDomain{VanityDomain: "old.example.org", DesiredDNSTargetType: "CNAME", DesiredCNAMETarget: "lb.example.net"}, false},
+		{"missing cname", jobs.VanityDomain{VanityDomain: "new.example.org", DesiredDNSTargetType: "CNAME", DesiredCNAMETarget: "lb.example.net"}, false},
+		{"matching a records", jobs.VanityDomain{VanityDomain: "example.org", DesiredDNSTargetType: "A", DesiredARecordTargets: []string{"192.0.2.10", "192.0.2.11"}}, true},
+		{"one foreign a record", jobs.VanityDomain{VanityDomain: "partial.example.org", DesiredDNSTargetType: "A", DesiredARecordTargets: []string{"192.0.2.10"}}, false},
+		{"missing a records", jobs.VanityDomain{VanityDomain: "new.example.org", DesiredDNSTargetType: "A", DesiredARecordTargets: []string{"192.0.2.10"}}, false},
+		{"unsupported type", jobs.VanityDomain{VanityDomain: "example.org", DesiredDNSTargetType: "MX"}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := VerifyDomain(test.domain)
+			if test.valid && err != nil {
+				t.Errorf("Expected %s to verify, got: %v", test.domain.VanityDomain, err)
+			}
+
+			if !test.valid && err == nil {
+				t.Errorf("Expected verification of %s to fail, but it passed", test.domain.VanityDomain)
+			}
+		})
+	}
+}
+
+func TestDescribeDNS(t *testing.T) {
+	useResolver(t, fakeResolver{
+		cnames: map[string]string{"www.example.org": "lb.example.net."},
+		ips:    map[string][]string{"example.org": {"192.0.2.10", "2001:db8::1"}},
+	})
+
+	tests := []struct {
+		name     string
+		domain   jobs.VanityDomain
+		expected string
+	}{
+		{"cname", jobs.VanityDomain{VanityDomain: "www.example.org", DesiredDNSTargetType: "CNAME"}, "CNAME lb.example.net."},
+		{"cname lookup error", jobs.VanityDomain{VanityDomain: "new.example.org", DesiredDNSTargetType: "CNAME"}, "CNAME lookup error: no such host"},
+		{"a records", jobs.VanityDomain{VanityDomain: "example.org", DesiredDNSTargetType: "A"}, "A 192.0.2.10, 2001:db8::1"},
+		{"a lookup error", jobs.VanityDomain{VanityDomain: "new.example.org", DesiredDNSTargetType: "A"}, "A lookup error: no such host"},
+		{"unsupported type", jobs.VanityDomain{VanityDomain: "example.org", DesiredDNSTargetType: "MX"}, "unsupported DNS target type MX"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if observed := DescribeDNS(test.domain); observed != test.expected {
+				t.Errorf("Expected %q, got %q", test.expected, observed)
+			}
+		})
+	}
+}